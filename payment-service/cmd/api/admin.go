@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"payment-service/data"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// archivedWebhookResponse is an archived webhook with its raw body.
+type archivedWebhookResponse struct {
+	data.ArchivedWebhook
+	Body string `json:"body"` // Raw body of the webhook.
+}
+
+// listWebhooks returns the archived webhooks selected by the status, from and to query parameters,
+// oldest first. status is a comma-separated list and defaults to the failed and dead-lettered webhooks.
+func (app *Config) listWebhooks(c echo.Context) error {
+	statuses := c.QueryParam("status")
+	if statuses == "" {
+		statuses = data.WebhookFailed + "," + data.WebhookDeadLettered
+	}
+	filter, err := newArchiveFilter(statuses, c.QueryParam("from"), c.QueryParam("to"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	filter.Limit = maxReplayBatch
+	if limit, err := strconv.Atoi(c.QueryParam("limit")); err == nil && limit > 0 && limit < filter.Limit {
+		filter.Limit = limit
+	}
+	webhooks, err := app.Models.Archive.List(c.Request().Context(), filter)
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to list archived webhooks"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to list archived webhooks")
+	}
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+// getWebhook returns an archived webhook with its raw body.
+func (app *Config) getWebhook(c echo.Context) error {
+	w, status, err := app.archivedWebhook(c)
+	if err != nil {
+		return c.JSON(status, err.Error())
+	}
+	body, err := app.Models.Events.Payload(c.Request().Context(), w.PayloadDigest)
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to read archived webhook body"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to read archived webhook body")
+	}
+	return c.JSON(http.StatusOK, archivedWebhookResponse{ArchivedWebhook: *w, Body: string(body)})
+}
+
+// replayArchivedWebhook runs the archived webhook with the ID in the path through the pipeline again.
+func (app *Config) replayArchivedWebhook(c echo.Context) error {
+	w, status, err := app.archivedWebhook(c)
+	if err != nil {
+		return c.JSON(status, err.Error())
+	}
+	return c.JSON(http.StatusOK, app.replayWebhook(c.Request().Context(), *w))
+}
+
+// replayArchivedWebhooks replays the archived webhooks received between the from and to query
+// parameters, which are required, and with one of the statuses of status, failed and dead-lettered by default.
+func (app *Config) replayArchivedWebhooks(c echo.Context) error {
+	statuses := c.QueryParam("status")
+	if statuses == "" {
+		statuses = data.WebhookFailed + "," + data.WebhookDeadLettered
+	}
+	if c.QueryParam("from") == "" || c.QueryParam("to") == "" {
+		return c.JSON(http.StatusBadRequest, "from and to are required")
+	}
+	filter, err := newArchiveFilter(statuses, c.QueryParam("from"), c.QueryParam("to"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	results, err := app.replayWebhooks(c.Request().Context(), filter)
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to replay archived webhooks"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to replay archived webhooks")
+	}
+	return c.JSON(http.StatusOK, results)
+}
+
+// archivedWebhook fetches the archived webhook with the ID in the path. If it can't, it returns
+// the error to answer with and its HTTP status.
+func (app *Config) archivedWebhook(c echo.Context) (*data.ArchivedWebhook, int, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("invalid webhook id")
+	}
+	w, err := app.Models.Archive.Get(c.Request().Context(), id)
+	if errors.Is(err, data.ErrNotFound) {
+		return nil, http.StatusNotFound, errors.New("no archived webhook with this id")
+	}
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to read archived webhook"+err.Error())
+		return nil, http.StatusInternalServerError, errors.New("failed to read archived webhook")
+	}
+	return w, http.StatusOK, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"payment-service/data"
+	"payment-service/payment"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// billingSubscription is the caller's subscription as returned by the /billing/subscription routes.
+type billingSubscription struct {
+	SubscriptionID         string     `json:"subscription_id"`
+	Status                 string     `json:"status"`
+	ProductName            string     `json:"product_name"`
+	VariantName            string     `json:"variant_name"`
+	VariantID              int        `json:"variant_id"`
+	Cancelled              bool       `json:"cancelled"`
+	TrialEndsAt            *time.Time `json:"trial_ends_at"`
+	RenewsAt               time.Time  `json:"renews_at"`
+	EndsAt                 *time.Time `json:"ends_at"`
+	UpdatePaymentMethodURL string     `json:"update_payment_method_url"` // Expires after 24 hours.
+	CustomerPortalURL      string     `json:"customer_portal_url"`       // Expires after 24 hours.
+}
+
+func newBillingSubscription(s *payment.Subscription) billingSubscription {
+	return billingSubscription{
+		SubscriptionID:         s.ID,
+		Status:                 s.Status,
+		ProductName:            s.ProductName,
+		VariantName:            s.VariantName,
+		VariantID:              s.VariantID,
+		Cancelled:              s.Cancelled,
+		TrialEndsAt:            s.TrialEndsAt,
+		RenewsAt:               s.RenewsAt,
+		EndsAt:                 s.EndsAt,
+		UpdatePaymentMethodURL: s.URLs.UpdatePaymentMethod,
+		CustomerPortalURL:      s.URLs.CustomerPortal,
+	}
+}
+
+// pauseModes are the ways Lemon Squeezy can pause a subscription: "void" stops charging and offering
+// the service, "free" keeps offering it without charging.
+var pauseModes = map[string]bool{"void": true, "free": true}
+
+// getBillingSubscription returns the caller's subscription as Lemon Squeezy has it now.
+func (app *Config) getBillingSubscription(c echo.Context) error {
+	subscriptionID, err := app.callerSubscriptionID(c)
+	if err != nil {
+		return err
+	}
+	subscription, err := app.Billing.GetSubscription(c.Request().Context(), subscriptionID)
+	if err != nil {
+		return billingError(c, "get", err)
+	}
+	return c.JSON(http.StatusOK, newBillingSubscription(subscription))
+}
+
+// cancelBillingSubscription cancels the caller's subscription at the end of the billing period.
+// It can be resumed until then.
+func (app *Config) cancelBillingSubscription(c echo.Context) error {
+	subscriptionID, err := app.callerSubscriptionID(c)
+	if err != nil {
+		return err
+	}
+	if err := app.Billing.CancelSubscription(c.Request().Context(), subscriptionID); err != nil {
+		return billingError(c, "cancel", err)
+	}
+	// Cancelling doesn't return the subscription, so fetch it for the response.
+	subscription, err := app.Billing.GetSubscription(c.Request().Context(), subscriptionID)
+	if err != nil {
+		return billingError(c, "get", err)
+	}
+	return c.JSON(http.StatusOK, newBillingSubscription(subscription))
+}
+
+// pauseBillingSubscription pauses the caller's subscription with the mode in the request body, "void"
+// if none, until resumes_at if given or until it is resumed.
+func (app *Config) pauseBillingSubscription(c echo.Context) error {
+	var request struct {
+		Mode      string     `json:"mode"`
+		ResumesAt *time.Time `json:"resumes_at"`
+	}
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request body")
+	}
+	if request.Mode == "" {
+		request.Mode = "void"
+	}
+	if !pauseModes[request.Mode] {
+		return c.JSON(http.StatusBadRequest, "mode must be void or free")
+	}
+	pause := map[string]interface{}{"mode": request.Mode}
+	if request.ResumesAt != nil {
+		if !request.ResumesAt.After(time.Now()) {
+			return c.JSON(http.StatusBadRequest, "resumes_at must be in the future")
+		}
+		pause["resumes_at"] = request.ResumesAt.UTC().Format(time.RFC3339)
+	}
+
+	subscriptionID, err := app.callerSubscriptionID(c)
+	if err != nil {
+		return err
+	}
+	return app.updateBillingSubscription(c, "pause", subscriptionID, map[string]interface{}{"pause": pause})
+}
+
+// resumeBillingSubscription unpauses the caller's paused subscription, or resumes their cancelled
+// subscription if its billing period has not ended yet.
+func (app *Config) resumeBillingSubscription(c echo.Context) error {
+	subscriptionID, err := app.callerSubscriptionID(c)
+	if err != nil {
+		return err
+	}
+	subscription, err := app.Billing.GetSubscription(c.Request().Context(), subscriptionID)
+	if err != nil {
+		return billingError(c, "get", err)
+	}
+
+	var updates map[string]interface{}
+	switch subscription.Status {
+	case "paused":
+		updates = map[string]interface{}{"pause": nil}
+	case "cancelled":
+		updates = map[string]interface{}{"cancelled": false}
+	default:
+		return c.JSON(http.StatusConflict, "subscription is not paused or cancelled")
+	}
+	return app.updateBillingSubscription(c, "resume", subscriptionID, updates)
+}
+
+// changeBillingPlan moves the caller's subscription to the variant_id in the request body.
+// Lemon Squeezy prorates the change unless disable_prorations is set, and charges the difference on
+// the next invoice unless invoice_immediately is set.
+func (app *Config) changeBillingPlan(c echo.Context) error {
+	var request struct {
+		VariantID          int64 `json:"variant_id"`
+		InvoiceImmediately bool  `json:"invoice_immediately"`
+		DisableProrations  bool  `json:"disable_prorations"`
+	}
+	if err := c.Bind(&request); err != nil || request.VariantID <= 0 {
+		return c.JSON(http.StatusBadRequest, "variant_id is required")
+	}
+	updates := map[string]interface{}{"variant_id": request.VariantID}
+	if request.InvoiceImmediately {
+		updates["invoice_immediately"] = true
+	}
+	if request.DisableProrations {
+		updates["disable_prorations"] = true
+	}
+
+	subscriptionID, err := app.callerSubscriptionID(c)
+	if err != nil {
+		return err
+	}
+	return app.updateBillingSubscription(c, "change the plan of", subscriptionID, updates)
+}
+
+// callerSubscriptionID returns the ID of the latest subscription of the user authenticated by
+// JWTAuthMiddleware. Subscriptions are only linked to the users who checked them out, so a caller
+// can only ever act on their own subscription. The error is an HTTP error to return as it is.
+func (app *Config) callerSubscriptionID(c echo.Context) (string, error) {
+	if app.Billing == nil {
+		return "", echo.NewHTTPError(http.StatusServiceUnavailable, "Billing API is disabled")
+	}
+	userID := c.Get("userID").(int64)
+	p, err := app.Models.Payments.GetLatestPaymentByUserID(c.Request().Context(), userID)
+	if errors.Is(err, data.ErrNotFound) {
+		return "", echo.NewHTTPError(http.StatusNotFound, "no subscription for this account")
+	}
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to get the subscription of a user"+err.Error())
+		return "", echo.NewHTTPError(http.StatusInternalServerError, "failed to get subscription")
+	}
+	return p.SubscriptionID, nil
+}
+
+// updateBillingSubscription applies updates to the subscription and responds with the result.
+// The payments row is left to the subscription_updated webhook that follows, like any other change.
+func (app *Config) updateBillingSubscription(c echo.Context, action, subscriptionID string, updates map[string]interface{}) error {
+	subscription, err := app.Billing.UpdateSubscription(c.Request().Context(), subscriptionID, updates)
+	if err != nil {
+		return billingError(c, action, err)
+	}
+	return c.JSON(http.StatusOK, newBillingSubscription(subscription))
+}
+
+// billingError responds to a failed Lemon Squeezy request. Requests Lemon Squeezy rejected are passed
+// on with its reason; failures on its side are logged and answered with 502 or 503.
+func billingError(c echo.Context, action string, err error) error {
+	switch {
+	case errors.Is(err, payment.ErrNotFound):
+		return c.JSON(http.StatusNotFound, "subscription does not exist")
+	case errors.Is(err, payment.ErrInvalid):
+		return c.JSON(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, payment.ErrRateLimited), errors.Is(err, payment.ErrUnavailable):
+		app.Producer.publishMessage("key", "Payment Service", "Lemon Squeezy is unavailable, failed to "+action+" subscription: "+err.Error())
+		return c.JSON(http.StatusServiceUnavailable, "payment provider is unavailable, try again later")
+	default:
+		app.Producer.publishMessage("key", "Payment Service", "Failed to "+action+" subscription: "+err.Error())
+		return c.JSON(http.StatusBadGateway, "failed to "+action+" subscription")
+	}
+}
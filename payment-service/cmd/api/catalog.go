@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"payment-service/data"
+	"payment-service/payment"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultCatalogSyncInterval = time.Hour       // How often the catalog is synced when CATALOG_SYNC_INTERVAL is not set.
+	plansCacheTTL              = 5 * time.Minute // How long /plans is served from memory, and cached by clients.
+)
+
+// errBillingDisabled is returned by syncCatalog when there is no Lemon Squeezy API key.
+var errBillingDisabled = errors.New("LEMON_SQUEEZY_API_KEY is not set")
+
+// catalogSyncResult is what a catalog sync stored.
+type catalogSyncResult struct {
+	Products int       `json:"products"`
+	Variants int       `json:"variants"`
+	Skipped  []string  `json:"skipped,omitempty"` // Variants that couldn't be stored, with the reason.
+	SyncedAt time.Time `json:"synced_at"`
+}
+
+// plansCache holds the response of /plans between syncs.
+type plansCache struct {
+	mu      sync.Mutex
+	plans   []data.Plan
+	expires time.Time
+}
+
+var planCache plansCache
+
+// get returns the cached plans, loading them with load if they expired.
+func (c *plansCache) get(ctx context.Context, load func(ctx context.Context) ([]data.Plan, error)) ([]data.Plan, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.plans != nil && time.Now().Before(c.expires) {
+		return c.plans, nil
+	}
+	loaded, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.plans, c.expires = loaded, time.Now().Add(plansCacheTTL)
+	return loaded, nil
+}
+
+// invalidate makes the next get load the plans again.
+func (c *plansCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.plans = nil
+}
+
+// listPlans returns the plans on sale, with their prices, billing intervals and trials.
+// The response is public and cached, so it can be served to signed out visitors.
+func (app *Config) listPlans(c echo.Context) error {
+	list, err := planCache.get(c.Request().Context(), app.Models.Catalog.ListPlans)
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to list plans"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to list plans")
+	}
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(plansCacheTTL.Seconds())))
+	return c.JSON(http.StatusOK, list)
+}
+
+// syncCatalogNow syncs the catalog on demand and responds with what was stored.
+func (app *Config) syncCatalogNow(c echo.Context) error {
+	result, err := app.syncCatalog(c.Request().Context())
+	if errors.Is(err, errBillingDisabled) {
+		return c.JSON(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadGateway, "failed to sync catalog: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// runCatalogSync syncs the catalog on startup and then every CATALOG_SYNC_INTERVAL until ctx is cancelled.
+func (app *Config) runCatalogSync(ctx context.Context) {
+	interval := defaultCatalogSyncInterval
+	if value := os.Getenv("CATALOG_SYNC_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("catalog sync: invalid CATALOG_SYNC_INTERVAL %q, using %s", value, interval)
+		} else {
+			interval = parsed
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := app.syncCatalog(ctx); err != nil && !errors.Is(err, errBillingDisabled) {
+			app.Producer.publishMessage("key", "Payment Service", "Failed to sync the catalog: "+err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncCatalog fetches the stores, products and variants from Lemon Squeezy and stores the products and
+// variants in one transaction, so /plans never shows half a sync.
+func (app *Config) syncCatalog(ctx context.Context) (*catalogSyncResult, error) {
+	if app.Billing == nil {
+		return nil, errBillingDisabled
+	}
+	stores, err := app.Billing.ListStores(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing stores: %w", err)
+	}
+	products, err := app.Billing.ListProducts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing products: %w", err)
+	}
+	variants, err := app.Billing.ListVariants(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing variants: %w", err)
+	}
+
+	result := &catalogSyncResult{SyncedAt: time.Now()}
+	storedProducts, storedVariants, skipped, err := catalogFromProvider(stores, products, variants)
+	if err != nil {
+		return nil, err
+	}
+	err = app.Models.RunInTx(ctx, func(tx data.Models) error {
+		return tx.Catalog.Sync(ctx, storedProducts, storedVariants, result.SyncedAt)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storing catalog: %w", err)
+	}
+	planCache.invalidate()
+
+	result.Products, result.Variants, result.Skipped = len(storedProducts), len(storedVariants), skipped
+	for _, reason := range skipped {
+		log.Printf("catalog sync: skipped %s", reason)
+	}
+	return result, nil
+}
+
+// catalogFromProvider converts the Lemon Squeezy catalog into products and variants to store. Prices
+// are in the currency of their product's store. Variants of products that weren't listed are skipped,
+// and returned with the reason.
+func catalogFromProvider(stores []*payment.Store, products []*payment.Product, variants []*payment.Variant) ([]data.Product, []data.Variant, []string, error) {
+	currencies := map[int64]string{}
+	for _, s := range stores {
+		id, err := strconv.ParseInt(s.ID, 10, 64)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid store ID %q", s.ID)
+		}
+		currencies[id] = s.Currency
+	}
+
+	storedProducts := make([]data.Product, 0, len(products))
+	productCurrencies := map[int64]string{}
+	for _, p := range products {
+		id, err := strconv.ParseInt(p.ID, 10, 64)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid product ID %q", p.ID)
+		}
+		productCurrencies[id] = currencies[p.StoreID]
+		storedProducts = append(storedProducts, data.Product{
+			ID:          id,
+			StoreID:     p.StoreID,
+			Name:        p.Name,
+			Slug:        p.Slug,
+			Description: p.Description,
+			Status:      p.Status,
+			BuyNowURL:   p.BuyNowURL,
+			UpdatedAt:   p.UpdatedAt,
+		})
+	}
+
+	var skipped []string
+	storedVariants := make([]data.Variant, 0, len(variants))
+	for _, v := range variants {
+		id, err := strconv.ParseInt(v.ID, 10, 64)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid variant ID %q", v.ID)
+		}
+		currency, ok := productCurrencies[v.ProductID]
+		if !ok {
+			skipped = append(skipped, fmt.Sprintf("variant %d: product %d was not listed", id, v.ProductID))
+			continue
+		}
+		if currency == "" {
+			skipped = append(skipped, fmt.Sprintf("variant %d: the store of product %d was not listed", id, v.ProductID))
+			continue
+		}
+		storedVariants = append(storedVariants, data.Variant{
+			ID:                 id,
+			ProductID:          v.ProductID,
+			Name:               v.Name,
+			Slug:               v.Slug,
+			Description:        v.Description,
+			Status:             v.Status,
+			Price:              data.Money{Amount: v.Price, Currency: currency},
+			IsSubscription:     v.IsSubscription,
+			Interval:           v.Interval,
+			IntervalCount:      v.IntervalCount,
+			HasFreeTrial:       v.HasFreeTrial,
+			TrialInterval:      v.TrialInterval,
+			TrialIntervalCount: v.TrialIntervalCount,
+			Sort:               v.Sort,
+			UpdatedAt:          v.UpdatedAt,
+		})
+	}
+	return storedProducts, storedVariants, skipped, nil
+}
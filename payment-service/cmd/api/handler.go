@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"payment-service/data"
@@ -18,393 +18,165 @@ func (app *Config) pingHandler(c echo.Context) error {
 	return c.String(http.StatusOK, "system is working")
 }
 
-func (app *Config) SubscriptionCreated(c echo.Context) error {
-
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment, err := data.GetPayment(body)
+// subscriptionEvents returns the history of the webhooks received for a subscription, oldest first.
+func (app *Config) subscriptionEvents(c echo.Context) error {
+	events, err := app.Models.Events.ListBySubscriptionID(c.Request().Context(), c.Param("id"))
 	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+		app.Producer.publishMessage("key", "Payment Service", "Failed to list subscription events"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to list subscription events")
 	}
-	id, err := app.Models.CreatePayment(app.connection, *payment)
-	if err != nil {
-		go processSubscription("failed create", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-
+	if len(events) == 0 {
+		return c.JSON(http.StatusNotFound, "no events for this subscription")
 	}
-	app.Producer.publishMessage("key", "Payment Service", "Subscription created successfully")
-	go processSubscription(strconv.Itoa(id), payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	return nil
+	return c.JSON(http.StatusOK, events)
 }
 
-func (app *Config) SubscriptionUpdated(c echo.Context) error {
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-		go processSubscription("failed update", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-		go processSubscription("failed update", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	go processSubscription("success update", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-	return nil
-}
+// errStaleEvent is returned by updatePayment for a webhook older than the stored state of its subscription.
+var errStaleEvent = errors.New("webhook is older than the stored subscription")
 
-func (app *Config) SubscriptionCancelled(c echo.Context) error {
-
-	body, err := ioutil.ReadAll(c.Request().Body)
+// createPayment stores the payment of a subscription_created webhook, appends the webhook to the
+// subscription's event history and records a notification for the subscription service.
+// It runs in the transaction of tx, so the subscription service is notified if and only if the payment is committed.
+func createPayment(ctx context.Context, tx data.Models, eventName string, body []byte, payment *data.Payment) error {
+	id, err := tx.Payments.CreatePayment(ctx, *payment)
 	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+		return err
 	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	event := data.SubscriptionEvent{SubscriptionID: payment.SubscriptionID, EventName: eventName, StatusAfter: payment.Status}
+	if _, err := tx.Events.Append(ctx, event, body); err != nil {
+		return err
 	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-		go processSubscription("failed cancel", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	if err := trackTrial(ctx, tx, payment); err != nil {
+		return err
 	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-		go processSubscription("failed cancel", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	go processSubscription("success cancel", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
+	return notifySubscription(ctx, tx, strconv.FormatInt(id, 10), payment.Status, payment)
 }
 
-func (app *Config) SubscriptionResumed(c echo.Context) error {
-
-	body, err := ioutil.ReadAll(c.Request().Body)
+// updatePayment appends the webhook eventName with the raw body to the subscription's event history,
+// projects it onto the stored payment for payment.SubscriptionID, and records a notification of the
+// given mail type and status for the subscription service.
+// It runs in the transaction of tx, so concurrent webhooks for the same subscription can't interleave
+// between the lookup and the update, and the notification exists if and only if the update was committed.
+// Lemon Squeezy doesn't deliver webhooks in order, so a webhook whose updated_at is before the stored
+// one is only appended to the history, and errStaleEvent is returned.
+func updatePayment(ctx context.Context, tx data.Models, eventName string, body []byte, payment *data.Payment, mailType, status string) error {
+	existingpayment, err := tx.Payments.GetPaymentBySubscriptionID(ctx, payment.SubscriptionID)
 	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+		return err
 	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	event := data.SubscriptionEvent{SubscriptionID: payment.SubscriptionID, EventName: eventName, StatusBefore: existingpayment.Status, StatusAfter: payment.Status}
+	if _, err := tx.Events.Append(ctx, event, body); err != nil {
+		return err
 	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-		go processSubscription("failed resume", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	if payment.UpdatedAt.Before(existingpayment.UpdatedAt) {
+		return errStaleEvent
 	}
 	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-		go processSubscription("failed resume", payment.UserEmail, "failed", payment.ProductName, payment.VariantName)
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	payment.Version = existingpayment.Version // Fail rather than overwrite a change made since the lookup.
+	if payment.Total.Currency == "" {
+		// Subscription events carry no amounts; keep the ones from the last payment event.
+		payment.Subtotal, payment.Discount, payment.Tax, payment.Total = existingpayment.Subtotal, existingpayment.Discount, existingpayment.Tax, existingpayment.Total
 	}
-	// run the temporal workflow
-	go processSubscription("success resume", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
-}
-
-func (app *Config) SubscriptionExpired(c echo.Context) error {
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	if payment.UserID == 0 {
+		// Keep a user ID set by the backfill for subscriptions checked out without one.
+		payment.UserID = existingpayment.UserID
 	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	if payment.SubscriptionItemID == 0 {
+		// Keep a subscription item looked up for usage reporting, for webhooks that don't carry it.
+		payment.SubscriptionItemID = existingpayment.SubscriptionItemID
 	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	if err := tx.Payments.UpdatePayment(ctx, *payment); err != nil {
+		return err
 	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	if err := trackTrial(ctx, tx, payment); err != nil {
+		return err
 	}
-	go processSubscription("expired", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
+	return notifySubscription(ctx, tx, mailType, status, payment)
 }
 
-func (app *Config) SubscriptionPaused(c echo.Context) error {
-	body, err := ioutil.ReadAll(c.Request().Body)
+// applyInvoice appends a subscription_payment_* webhook to the history of the invoice's subscription,
+// stores the invoice's amounts and card on its payment, and records a notification of the given mail
+// type for the subscription service, in the transaction of tx.
+// Invoices don't carry the subscription's state, so the payment's status and updated_at are kept, and the
+// notification carries the stored subscription status: the subscription service stores it as the user's,
+// which the invoice's own status, such as paid or refunded, is not.
+func applyInvoice(ctx context.Context, tx data.Models, body []byte, webhook *data.Webhook, mailType string) error {
+	invoice := webhook.SubscriptionInvoice
+	existingpayment, err := tx.Payments.GetPaymentBySubscriptionID(ctx, strconv.FormatInt(invoice.SubscriptionID, 10))
 	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+		return err
 	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	event := data.SubscriptionEvent{SubscriptionID: existingpayment.SubscriptionID, EventName: webhook.EventName, StatusBefore: existingpayment.Status, StatusAfter: existingpayment.Status}
+	if _, err := tx.Events.Append(ctx, event, body); err != nil {
+		return err
 	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	payment := *existingpayment // The version makes the update fail rather than overwrite a change made since the lookup.
+	payment.Subtotal, payment.Discount, payment.Tax, payment.Total = invoice.Amounts()
+	if invoice.CardLastFour != "" {
+		payment.CardBrand, payment.CardLastFour = invoice.CardBrand, invoice.CardLastFour
 	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	if payment.UserID == 0 {
+		payment.UserID = webhook.UserID
 	}
-	go processSubscription("paused", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
-}
-
-func (app *Config) SubscriptionUnpaused(c echo.Context) error {
-
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+	if err := tx.Payments.UpdatePayment(ctx, payment); err != nil {
+		return err
 	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	go processSubscription("unpaused", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
+	return notifySubscription(ctx, tx, mailType, payment.Status, &payment)
 }
 
-func (app *Config) SubscriptionFailedPayment(c echo.Context) error {
-
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
+// notifySubscription records a notification of the given mail type and status about the subscription of payment
+// in the outbox of models. Called with the Models of a transaction, the notification is only delivered if the
+// transaction commits. The subscription service finds the user by the payment's user ID, or by its email if the
+// ID is 0, records the plan by variant ID, and keys the dunning of failed renewals by subscription ID.
+func notifySubscription(ctx context.Context, models data.Models, mailType, status string, payment *data.Payment) error {
+	var trialEndsAt int64
+	if payment.TrialEndsAt != nil {
+		trialEndsAt = payment.TrialEndsAt.Unix()
 	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	go processSubscription("payment", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
-}
-
-func (app *Config) SubscriptionSucessPayment(c echo.Context) error {
-
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	go processSubscription("payment success", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
-}
-
-func (app *Config) SubscriptionRecovered(c echo.Context) error {
-
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	go processSubscription("recovered", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
-}
-
-func (app *Config) SubscriptionRefunded(c echo.Context) error {
-
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	go processSubscription("refunded", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
-}
-
-func (app *Config) SubscriptionChanged(c echo.Context) error {
-	body, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment, err := data.GetPayment(body)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	subscription_id := payment.SubscriptionID
-	existingpayment, err := app.Models.GetPaymentBySubscriptionID(app.connection, subscription_id)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	payment.ID = existingpayment.ID
-	err = app.Models.UpdatePayment(app.connection, *payment)
-	if err != nil {
-
-		app.Producer.publishMessage("key", "Payment Service", "Failed to create subscription"+err.Error())
-		return nil
-	}
-	go processSubscription("changed", payment.UserEmail, payment.Status, payment.ProductName, payment.VariantName)
-	app.Producer.publishMessage("key", "Payment Service", "Subscription updated successfully")
-	return nil
-}
-
-func processSubscription(mailType, mailId, status, productName, variantName string) {
-	req := &subscription.SubscriptionRequest{
+	_, err := models.Outbox.Enqueue(ctx, data.EventSubscriptionNotification, data.SubscriptionNotification{
 		MailType:           mailType,
-		EmailId:            mailId,
+		UserID:             payment.UserID,
+		EmailID:            payment.UserEmail,
 		SubscriptionStatus: status,
-		ProductName:        productName,
-		VariantName:        variantName,
-	}
+		ProductName:        payment.ProductName,
+		VariantName:        payment.VariantName,
+		VariantID:          payment.VariantID,
+		SubscriptionID:     payment.SubscriptionID,
+		TrialEndsAt:        trialEndsAt,
+	})
+	return err
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// processSubscription sends a notification to the subscription service.
+// The event ID is sent along so the subscription service can drop redelivered notifications.
+// Returns an error if the request fails or the subscription service could not process it.
+func processSubscription(ctx context.Context, eventID string, n data.SubscriptionNotification) error {
+	req := &subscription.SubscriptionRequest{
+		MailType:           n.MailType,
+		EmailId:            n.EmailID,
+		SubscriptionStatus: n.SubscriptionStatus,
+		ProductName:        n.ProductName,
+		VariantName:        n.VariantName,
+		EventId:            eventID,
+		UserId:             n.UserID,
+		VariantId:          n.VariantID,
+		SubscriptionId:     n.SubscriptionID,
+		TrialEndsAt:        n.TrialEndsAt,
+		RenewsAt:           n.RenewsAt,
+		RenewalAmount:      n.RenewalAmount,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	r, err := app.SubscriptionServiceClient.ProcessSubscription(ctx, req)
-
 	if err != nil {
-		fmt.Println(err)
-		app.Producer.publishMessage("key", "Payment Service", "Failed to connect to the subscription service"+err.Error())
+		return fmt.Errorf("failed to connect to the subscription service: %w", err)
+	}
+	if !r.Success {
+		return fmt.Errorf("subscription service failed to process the subscription: %s", r.Message)
 	}
 
 	log.Printf("Response: %s", r)
+	return nil
 }
@@ -4,12 +4,14 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"payment-service/data"
 	"payment-service/grpc/subscription"
+	"payment-service/payment"
 	"sync"
 	"time"
 
-	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/labstack/echo/v4"
 	"google.golang.org/grpc"
 )
@@ -18,7 +20,7 @@ type Config struct {
 	Models                    data.Models // Data models for the application.
 	Producer                  *Publisher  // Kafka producer for logging.
 	SubscriptionServiceClient subscription.SubscriptionServiceClient
-	connection                *pgx.Conn
+	Billing                   payment.Payment // Lemon Squeezy API client for the /billing routes, nil if it isn't configured.
 }
 
 var app *Config
@@ -31,20 +33,34 @@ func init() {
 	}
 }
 
+// defaultKeyDir is where the key ring is read from when PII_KEY_DIR is not set.
+const defaultKeyDir = "/keys"
+
 func main() {
+	// Handle the migrate subcommand before connecting to any other services.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay-webhooks" {
+		os.Exit(runReplayWebhooks(os.Args[2:]))
+	}
+
 	var wg sync.WaitGroup
-	conn, err := connect() // Connect to the database.
+	pool, err := connect() // Connect to the database.
 	if err != nil {
 		log.Fatalf("Failed to connect to the database: %v", err) // Log and exit if the connection fails.
 		app.Producer.publishMessage("key", "Payment Service", "Failed to connect to the database")
 	}
 
-	defer conn.Close(context.Background())
+	defer pool.Close() // Ensure the database connections are closed on exit.
 
 	e := echo.New()
 	defer e.Close()
-	app.connection = conn
-	app.Models = data.NewModels(conn)
+	keys, err := loadKeyRing() // Load the keys that encrypt card details.
+	if err != nil {
+		log.Fatalf("Failed to load the key ring: %v", err)
+	}
+	app.Models = data.NewModels(pool, keys)
 	grpcConn, err := NewGrpcClient("subscription-service:50051")
 	if err != nil {
 		app.Producer.publishMessage("key", "Payment Service", "Failed to connect to the subscription service"+err.Error())
@@ -52,8 +68,49 @@ func main() {
 	defer grpcConn.Close()
 	subscriptionClient := subscription.NewSubscriptionServiceClient(grpcConn)
 	app.SubscriptionServiceClient = subscriptionClient
+	billing, err := payment.NewPayment()
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Billing API is disabled: "+err.Error())
+	} else {
+		app.Billing = billing
+	}
 	app.routes(e)
 	wg.Add(1)
+	go func() {
+		// Deliver the notifications recorded in the outbox to the subscription service.
+		app.relayOutbox(context.Background())
+	}()
+	wg.Add(1)
+	go func() {
+		// Move encrypted columns to the active key after a rotation.
+		app.runReencryption(context.Background(), data.NewCockroachPaymentRepository(pool, keys), data.NewCockroachSubscriptionEventRepository(pool, keys))
+	}()
+	wg.Add(1)
+	go func() {
+		// Keep the products and variants behind /plans in sync with Lemon Squeezy.
+		app.runCatalogSync(context.Background())
+	}()
+	wg.Add(1)
+	go func() {
+		// Correct the payments and users that drifted from Lemon Squeezy, and report the rest.
+		app.runReconciliation(context.Background())
+	}()
+	wg.Add(1)
+	go func() {
+		// Report the usage of metered subscriptions to Lemon Squeezy.
+		app.runUsageReporter(context.Background())
+	}()
+	wg.Add(1)
+	go func() {
+		// Tell customers about their subscriptions' upcoming renewals.
+		app.runRenewalNotices(context.Background())
+	}()
+	wg.Add(1)
+	go func() {
+		// Serve UsageService to the services that meter usage.
+		serveUsageGrpc()
+	}()
+	wg.Add(1)
 	go func() {
 		initialWaitTime := 1 * time.Second // Initial wait time for retrying server start.
 		maxRetries := 5                    // Maximum number of retries for starting the server.
@@ -78,16 +135,28 @@ func main() {
 	wg.Wait()
 }
 
-// connect establishes a connection to the CockroachDB database.
-// Returns a pointer to the database connection and an error, if any.
-func connect() (*pgx.Conn, error) {
+// loadKeyRing loads the key ring from PII_KEY_DIR, or from defaultKeyDir if it is not set.
+// Payments aren't looked up by encrypted values, so it has no blind index key.
+func loadKeyRing() (*data.KeyRing, error) {
+	keyDir := os.Getenv("PII_KEY_DIR")
+	if keyDir == "" {
+		keyDir = defaultKeyDir
+	}
+	return data.LoadKeyRing(keyDir, false)
+}
+
+// connect establishes a connection pool to the CockroachDB database.
+// A pool is used because the webhook handlers and the outbox relay query the database
+// concurrently, and each transaction needs a connection of its own.
+// Returns a pointer to the connection pool and an error, if any.
+func connect() (*pgxpool.Pool, error) {
 	url := "postgres://root@cockroach:26257/defaultdb?sslmode=disable" // Database connection URL.
-	conn, err := pgx.Connect(context.Background(), url)                // Attempt to connect to the database.
+	pool, err := pgxpool.Connect(context.Background(), url)            // Attempt to connect to the database.
 	if err != nil {
 		return nil, err // Return the error if the connection fails.
 	}
 	fmt.Println("Connected to the database") // Confirm successful connection.
-	return conn, nil                         // Return the database connection.
+	return pool, nil                         // Return the connection pool.
 }
 
 func NewGrpcClient(serverAddress string) (*grpc.ClientConn, error) {
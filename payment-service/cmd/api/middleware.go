@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
 )
 
@@ -57,3 +61,78 @@ func VerifySignatureMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		return next(c)
 	}
 }
+
+// RequireAdminToken only lets through requests with an "Authorization: Bearer <ADMIN_TOKEN>" header.
+// The admin API is disabled while ADMIN_TOKEN is not set.
+func RequireAdminToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "Admin API is disabled")
+		}
+		got := c.Request().Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+			app.Producer.publishMessage("key", "Payment Service", "Unauthorized admin request from IP: "+c.RealIP())
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid admin token")
+		}
+		return next(c)
+	}
+}
+
+// RequireUsageToken only lets through requests with an "Authorization: Bearer <USAGE_API_TOKEN>" header.
+// Usage ingestion is disabled while USAGE_API_TOKEN is not set.
+func RequireUsageToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := os.Getenv("USAGE_API_TOKEN")
+		if token == "" {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "Usage API is disabled")
+		}
+		got := c.Request().Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+			app.Producer.publishMessage("key", "Payment Service", "Unauthorized usage request from IP: "+c.RealIP())
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid usage token")
+		}
+		return next(c)
+	}
+}
+
+// JWTAuthMiddleware only lets through requests with a JWT issued by subscription-service at login, and
+// sets "userID" in the context to the token's user_id claim. Tokens are verified with JWT_SECRET, the key
+// subscription-service signs them with; the routes using it are disabled while it is not set.
+func JWTAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "Billing API is disabled")
+		}
+		authHeader := c.Request().Header.Get("Authorization")
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			return echo.NewHTTPError(http.StatusUnauthorized, "missing Authorization header")
+		}
+
+		token, err := jwt.Parse(strings.TrimPrefix(authHeader, "Bearer "), func(token *jwt.Token) (interface{}, error) {
+			// Only accept the HMAC tokens subscription-service issues, so a token can't pick another algorithm.
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+			}
+			return []byte(secret), nil
+		})
+		if err != nil || !token.Valid {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired token")
+		}
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+		}
+		userIDStr, ok := claims["user_id"].(string)
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnauthorized, "user_id claim must be a string")
+		}
+		userID, err := strconv.ParseInt(userIDStr, 10, 64)
+		if err != nil || userID <= 0 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "user_id format is invalid")
+		}
+		c.Set("userID", userID)
+		return next(c)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"payment-service/data"
+	"time"
+)
+
+const (
+	outboxPollInterval = 2 * time.Second // How often the relay looks for new events.
+	outboxBatchSize    = 50              // Maximum number of events claimed per poll.
+	outboxLease        = time.Minute     // How long a claimed event is reserved before another relay may retry it.
+	outboxMaxAttempts  = 30              // Deliveries of an event tried, a lease apart, before it is marked dead.
+)
+
+// relayOutbox polls the outbox and delivers events until ctx is cancelled.
+//
+// Delivery is at least once: an event is only marked as published after the subscription service
+// accepted it, so a relay that dies mid-event leaves it to be claimed again once its lease expires.
+// The event ID is sent with every request so the subscription service can drop duplicates.
+func (app *Config) relayOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep draining while full batches come back, so a backlog doesn't wait a poll interval per batch.
+		for {
+			claimed, err := app.relayBatch(ctx)
+			if err != nil {
+				log.Printf("outbox relay: %v", err)
+			}
+			if err != nil || claimed < outboxBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayBatch claims a batch of events and delivers them. An event that still fails after outboxMaxAttempts
+// deliveries is marked dead, so a poison event isn't retried forever; it is kept with its last error.
+// Returns the number of events claimed, and an error if the batch could not be claimed.
+func (app *Config) relayBatch(ctx context.Context) (int, error) {
+	events, err := app.Models.Outbox.Claim(ctx, outboxBatchSize, outboxLease)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim events: %w", err)
+	}
+	for _, event := range events {
+		if event.Attempts > outboxMaxAttempts {
+			// Relays died delivering it, before they could record a failure.
+			app.markDead(ctx, event, fmt.Errorf("claimed %d times without an outcome", event.Attempts))
+			continue
+		}
+		if err := deliverEvent(ctx, event); err != nil {
+			if event.Attempts >= outboxMaxAttempts {
+				app.markDead(ctx, event, err)
+				continue
+			}
+			app.Producer.publishMessage("key", "Payment Service", fmt.Sprintf("Failed to deliver %s event %s: %v", event.Type, event.ID, err))
+			if err := app.Models.Outbox.MarkFailed(ctx, event.ID, err); err != nil {
+				log.Printf("outbox relay: failed to record failure of event %s: %v", event.ID, err)
+			}
+			continue
+		}
+		if err := app.Models.Outbox.MarkPublished(ctx, event.ID); err != nil {
+			// The event will be delivered again once its lease expires; the receiver deduplicates it.
+			log.Printf("outbox relay: failed to mark event %s as published: %v", event.ID, err)
+		}
+	}
+	return len(events), nil
+}
+
+// markDead gives up on delivering event, which failed because of reason.
+func (app *Config) markDead(ctx context.Context, event data.OutboxEvent, reason error) {
+	app.Producer.publishMessage("key", "Payment Service", fmt.Sprintf("Gave up on %s event %s after %d attempts: %v", event.Type, event.ID, event.Attempts, reason))
+	if err := app.Models.Outbox.MarkDead(ctx, event.ID, reason); err != nil {
+		log.Printf("outbox relay: failed to mark event %s as dead: %v", event.ID, err)
+	}
+}
+
+// deliverEvent sends an event to its receiver.
+func deliverEvent(ctx context.Context, event data.OutboxEvent) error {
+	switch event.Type {
+	case data.EventSubscriptionNotification:
+		var notification data.SubscriptionNotification
+		if err := json.Unmarshal(event.Payload, &notification); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		return processSubscription(ctx, event.ID, notification)
+	default:
+		return fmt.Errorf("unknown event type %q", event.Type)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"strings"
+	"testing"
+)
+
+func TestRelayMarksPoisonEventDead(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	relay := &Config{Models: models, Producer: app.Producer}
+	// No receiver accepts an event of an unknown type, so every delivery fails.
+	id, err := models.Outbox.Enqueue(ctx, "unknown.type", map[string]string{})
+	if err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	// The earlier attempts failed and their leases expired.
+	for attempt := 1; attempt < outboxMaxAttempts; attempt++ {
+		if _, err := models.Outbox.Claim(ctx, 10, 0); err != nil {
+			t.Fatalf("Claim() error = %v", err)
+		}
+		if err := models.Outbox.MarkFailed(ctx, id, errors.New("failed")); err != nil {
+			t.Fatalf("MarkFailed() error = %v", err)
+		}
+	}
+	if claimed, err := relay.relayBatch(ctx); err != nil || claimed != 1 {
+		t.Fatalf("relayBatch() = %d, %v, want the event claimed", claimed, err)
+	}
+
+	if events, err := models.Outbox.Claim(ctx, 10, 0); err != nil || len(events) != 0 {
+		t.Errorf("Claim() after the last attempt = %+v, error %v, want none", events, err)
+	}
+	dead, err := models.Outbox.ListDead(ctx, 10)
+	if err != nil || len(dead) != 1 || dead[0].ID != id || dead[0].Attempts != outboxMaxAttempts || !strings.Contains(dead[0].LastError, "unknown event type") {
+		t.Errorf("ListDead() = %+v, error %v, want event %s with its last error", dead, err, id)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"payment-service/data"
+	"payment-service/grpc/subscription"
+	"payment-service/payment"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultReconcileInterval = 6 * time.Hour    // How often reconciliation runs when RECONCILE_INTERVAL is not set.
+	reconcileGracePeriod     = 15 * time.Minute // Subscriptions changed more recently are skipped, as their webhooks may still be on the way.
+	reconciledEvent          = "reconciliation" // Event name of the history entries of corrected payments.
+	reconciledMail           = "reconciled"     // Mail type of the notifications sent for corrections.
+)
+
+// getReconciliation returns the report of the reconciliation run with the ID in the path, or of the
+// latest run if there is none. With flagged=true, only the issues that weren't corrected are listed.
+func (app *Config) getReconciliation(c echo.Context) error {
+	ctx := c.Request().Context()
+	var run *data.ReconciliationRun
+	var err error
+	if c.Param("id") == "" {
+		run, err = app.Models.Reports.LatestRun(ctx)
+	} else {
+		id, parseErr := strconv.ParseInt(c.Param("id"), 10, 64)
+		if parseErr != nil {
+			return c.JSON(http.StatusBadRequest, "invalid reconciliation run id")
+		}
+		run, err = app.Models.Reports.GetRun(ctx, id)
+	}
+	if errors.Is(err, data.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, "reconciliation run does not exist")
+	}
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to get reconciliation run"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to get reconciliation run")
+	}
+	if c.QueryParam("flagged") == "true" {
+		flagged := []data.ReconciliationIssue{}
+		for _, issue := range run.Issues {
+			if !issue.Corrected {
+				flagged = append(flagged, issue)
+			}
+		}
+		run.Issues = flagged
+	}
+	return c.JSON(http.StatusOK, run)
+}
+
+// reconcileNow runs a reconciliation on demand and responds with its report.
+func (app *Config) reconcileNow(c echo.Context) error {
+	run, err := app.reconcile(c.Request().Context())
+	if errors.Is(err, errBillingDisabled) {
+		return c.JSON(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil && run == nil {
+		return c.JSON(http.StatusInternalServerError, "failed to reconcile: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, run)
+}
+
+// runReconciliation reconciles on startup and then every RECONCILE_INTERVAL until ctx is cancelled.
+func (app *Config) runReconciliation(ctx context.Context) {
+	interval := defaultReconcileInterval
+	if value := os.Getenv("RECONCILE_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("reconciliation: invalid RECONCILE_INTERVAL %q, using %s", value, interval)
+		} else {
+			interval = parsed
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := app.reconcile(ctx); err != nil && !errors.Is(err, errBillingDisabled) {
+			app.Producer.publishMessage("key", "Payment Service", "Failed to reconcile: "+err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile compares every Lemon Squeezy subscription with its payment and its user's subscription status,
+// corrects the differences that are safe to correct, stores the report and publishes its summary.
+// Subscriptions that fail to compare are skipped, and the run's Error says how many did. The stored run is
+// returned even if it failed.
+func (app *Config) reconcile(ctx context.Context) (*data.ReconciliationRun, error) {
+	if app.Billing == nil {
+		return nil, errBillingDisabled
+	}
+	run := data.ReconciliationRun{StartedAt: time.Now(), Issues: []data.ReconciliationIssue{}}
+	subscriptions, err := app.Billing.GetAllSubscriptions(ctx)
+	if err != nil {
+		run.Error = "listing subscriptions: " + err.Error()
+	}
+	var failed int
+	var firstErr error
+	for _, s := range subscriptions {
+		issues, err := app.reconcileSubscription(ctx, s, run.StartedAt)
+		if err != nil {
+			if failed++; firstErr == nil {
+				firstErr = fmt.Errorf("subscription %s: %w", s.ID, err)
+			}
+			continue
+		}
+		run.Subscriptions++
+		for _, issue := range issues {
+			if issue.Corrected {
+				run.Corrected++
+			} else {
+				run.Flagged++
+			}
+		}
+		run.Issues = append(run.Issues, issues...)
+	}
+	if failed > 0 {
+		run.Error = fmt.Sprintf("%d subscriptions could not be compared, the first: %v", failed, firstErr)
+	}
+	run.FinishedAt = time.Now()
+
+	err = app.Models.RunInTx(ctx, func(tx data.Models) error {
+		id, err := tx.Reports.SaveRun(ctx, run)
+		run.ID = id
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storing reconciliation run: %w", err)
+	}
+	app.publishReconciliationSummary(run)
+	if run.Error != "" {
+		return &run, errors.New(run.Error)
+	}
+	return &run, nil
+}
+
+// reconcileSubscription compares a subscription with its payment and user. A payment older than the
+// subscription is corrected from it; a user whose status or plan differs from their latest subscription is
+// sent a notification with it. Anything else that differs is returned as an issue that isn't corrected.
+func (app *Config) reconcileSubscription(ctx context.Context, s *payment.Subscription, now time.Time) ([]data.ReconciliationIssue, error) {
+	if s.UpdatedAt.After(now.Add(-reconcileGracePeriod)) {
+		return nil, nil
+	}
+	p, err := app.Models.Payments.GetPaymentBySubscriptionID(ctx, s.ID)
+	if errors.Is(err, data.ErrNotFound) {
+		detail := fmt.Sprintf("status %s, variant %d, customer %s", s.Status, s.VariantID, s.UserEmail)
+		return []data.ReconciliationIssue{{SubscriptionID: s.ID, Kind: data.IssueMissingPayment, Detail: detail}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	issue := data.ReconciliationIssue{SubscriptionID: s.ID, UserID: p.UserID}
+
+	if diff := paymentDiff(p, s); diff != "" {
+		issue.Detail = diff
+		if !s.UpdatedAt.After(p.UpdatedAt) {
+			issue.Kind = data.IssuePaymentAhead
+			return []data.ReconciliationIssue{issue}, nil
+		}
+		err := app.correctPayment(ctx, p, s)
+		if errors.Is(err, data.ErrConflict) {
+			return nil, nil // A webhook updated the payment meanwhile; the next run compares it again.
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The notification of the correction updates the user as well.
+		issue.Kind, issue.Corrected = data.IssuePaymentStale, true
+		return []data.ReconciliationIssue{issue}, nil
+	}
+
+	if app.SubscriptionServiceClient == nil {
+		return nil, nil
+	}
+	if p.UserID == 0 {
+		issue.Kind, issue.Detail = data.IssueUnlinkedUser, "customer "+p.UserEmail
+		return []data.ReconciliationIssue{issue}, nil
+	}
+	// A user's subscription status is the one of their latest subscription.
+	latest, err := app.Models.Payments.GetLatestPaymentByUserID(ctx, p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if latest.SubscriptionID != s.ID {
+		return nil, nil
+	}
+	rpcCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	user, err := app.SubscriptionServiceClient.ListEntitlements(rpcCtx, &subscription.ListEntitlementsRequest{UserId: p.UserID})
+	if status.Code(err) == codes.NotFound {
+		issue.Kind, issue.Detail = data.IssueUnknownUser, fmt.Sprintf("user %d", p.UserID)
+		return []data.ReconciliationIssue{issue}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting the subscription of user %d: %w", p.UserID, err)
+	}
+	if user.SubscriptionStatus == s.Status && user.VariantId == int64(s.VariantID) {
+		return nil, nil
+	}
+	if err := notifySubscription(ctx, app.Models, reconciledMail, s.Status, p); err != nil {
+		return nil, err
+	}
+	issue.Kind, issue.Corrected = data.IssueUserStatus, true
+	issue.Detail = fmt.Sprintf("status: user %q, Lemon Squeezy %q; variant: user %d, Lemon Squeezy %d", user.SubscriptionStatus, s.Status, user.VariantId, s.VariantID)
+	return []data.ReconciliationIssue{issue}, nil
+}
+
+// paymentDiff describes the fields of p that differ from the subscription, or returns "" if none do.
+func paymentDiff(p *data.Payment, s *payment.Subscription) string {
+	var diffs []string
+	if p.Status != s.Status {
+		diffs = append(diffs, fmt.Sprintf("status: payment %q, Lemon Squeezy %q", p.Status, s.Status))
+	}
+	if p.VariantID != int64(s.VariantID) {
+		diffs = append(diffs, fmt.Sprintf("variant: payment %d, Lemon Squeezy %d", p.VariantID, s.VariantID))
+	}
+	if p.ProductID != int64(s.ProductID) {
+		diffs = append(diffs, fmt.Sprintf("product: payment %d, Lemon Squeezy %d", p.ProductID, s.ProductID))
+	}
+	if !p.RenewsAt.Equal(s.RenewsAt) {
+		diffs = append(diffs, fmt.Sprintf("renews_at: payment %s, Lemon Squeezy %s", p.RenewsAt.Format(time.RFC3339), s.RenewsAt.Format(time.RFC3339)))
+	}
+	return strings.Join(diffs, "; ")
+}
+
+// correctPayment overwrites the subscription state of p with the subscription's, appends the correction to
+// the subscription's history and notifies the subscription service, in one transaction like a webhook.
+// It returns data.ErrConflict if p was updated since it was read.
+func (app *Config) correctPayment(ctx context.Context, p *data.Payment, s *payment.Subscription) error {
+	stored := *s
+	stored.URLs = payment.SubscriptionURLs{} // The links sign the customer in, so they aren't kept.
+	body, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	corrected := *p
+	corrected.Status, corrected.VariantID, corrected.VariantName = s.Status, int64(s.VariantID), s.VariantName
+	corrected.ProductID, corrected.ProductName = int64(s.ProductID), s.ProductName
+	corrected.RenewsAt, corrected.UpdatedAt, corrected.TrialEndsAt = s.RenewsAt, s.UpdatedAt, s.TrialEndsAt
+	return app.Models.RunInTx(ctx, func(tx data.Models) error {
+		event := data.SubscriptionEvent{SubscriptionID: s.ID, EventName: reconciledEvent, StatusBefore: p.Status, StatusAfter: s.Status}
+		if _, err := tx.Events.Append(ctx, event, body); err != nil {
+			return err
+		}
+		if err := tx.Payments.UpdatePayment(ctx, corrected); err != nil {
+			return err
+		}
+		if err := trackTrial(ctx, tx, &corrected); err != nil {
+			return err
+		}
+		return notifySubscription(ctx, tx, reconciledMail, corrected.Status, &corrected)
+	})
+}
+
+// reconciliationSummary is the event published on Kafka after every reconciliation run.
+type reconciliationSummary struct {
+	Event         string    `json:"event"` // Always "reconciliation.completed".
+	RunID         int64     `json:"run_id"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	Subscriptions int       `json:"subscriptions"`
+	Corrected     int       `json:"corrected"`
+	Flagged       int       `json:"flagged"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// publishReconciliationSummary publishes the counts of a run under the "reconciliation" key.
+func (app *Config) publishReconciliationSummary(run data.ReconciliationRun) {
+	summary, err := json.Marshal(reconciliationSummary{
+		Event:         "reconciliation.completed",
+		RunID:         run.ID,
+		StartedAt:     run.StartedAt,
+		FinishedAt:    run.FinishedAt,
+		Subscriptions: run.Subscriptions,
+		Corrected:     run.Corrected,
+		Flagged:       run.Flagged,
+		Error:         run.Error,
+	})
+	if err != nil {
+		log.Printf("reconciliation: failed to encode the summary of run %d: %v", run.ID, err)
+		return
+	}
+	if err := app.Producer.publishMessage("reconciliation", "Payment Service", string(summary)); err != nil {
+		log.Printf("reconciliation: failed to publish the summary of run %d: %v", run.ID, err)
+	}
+}
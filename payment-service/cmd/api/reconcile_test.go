@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"payment-service/data"
+	"payment-service/grpc/subscription"
+	"payment-service/payment"
+	"payment-service/payment/lemonsqueezytest"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSubscriptionService stores the status and variant of every notification as its user's, like the subscription service.
+type fakeSubscriptionService struct {
+	subscription.SubscriptionServiceClient
+	users map[int64]*subscription.ListEntitlementsResponse
+}
+
+// deliver applies notifications in order.
+func (f *fakeSubscriptionService) deliver(notifications []data.SubscriptionNotification) {
+	for _, n := range notifications {
+		f.users[n.UserID] = &subscription.ListEntitlementsResponse{SubscriptionStatus: n.SubscriptionStatus, VariantId: n.VariantID}
+	}
+}
+
+func (f *fakeSubscriptionService) ListEntitlements(ctx context.Context, in *subscription.ListEntitlementsRequest, opts ...grpc.CallOption) (*subscription.ListEntitlementsResponse, error) {
+	user, ok := f.users[in.UserId]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return user, nil
+}
+
+func TestReconcileAfterRenewal(t *testing.T) {
+	created := readFixture(t, "subscription_created")
+	server := lemonsqueezytest.NewServer("test-api-key")
+	t.Cleanup(server.Close)
+	server.AddSubscription("9007199254740993", map[string]interface{}{
+		"store_id": 1, "customer_id": 9007199254740995, "order_id": 9007199254740997, "product_id": 201, "variant_id": 101,
+		"product_name": "Product A", "variant_name": "Premium", "user_email": "jane.doe@example.com", "status": "active",
+		"renews_at": "2024-02-01T00:00:00.000000Z", "created_at": "2024-01-01T00:00:00.000000Z", "updated_at": "2024-01-01T00:00:00.000000Z",
+	})
+
+	models := data.NewMemoryModels()
+	users := &fakeSubscriptionService{users: map[int64]*subscription.ListEntitlementsResponse{}}
+	handleWebhooks(t, models, created, readFixture(t, "subscription_payment_success"))
+	users.deliver(claimNotifications(t, models))
+
+	reconciler := &Config{Models: models, Producer: app.Producer, SubscriptionServiceClient: users, Billing: payment.NewPaymentService(payment.Config{APIKey: "test-api-key", BaseURL: server.URL})}
+	run, err := reconciler.reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	// A renewal leaves the subscription as it was, so there is nothing to correct and no one to notify.
+	if run.Subscriptions != 1 || run.Corrected != 0 || run.Flagged != 0 {
+		t.Errorf("reconcile() = %+v, want one subscription compared and no issues", run)
+	}
+	for _, n := range claimNotifications(t, models) {
+		if n.MailType == reconciledMail {
+			t.Errorf("reconcile() sent %+v after a renewal", n)
+		}
+	}
+	if user := users.users[42]; user == nil || user.SubscriptionStatus != "active" {
+		t.Errorf("user 42 = %+v, want status active", user)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	reencryptInterval  = 10 * time.Minute // How often the re-encryption job looks for values under old keys.
+	reencryptBatchSize = 100              // Maximum number of rows rewritten per batch.
+)
+
+// reencrypter rewrites rows whose encrypted columns are not encrypted with the active key.
+type reencrypter interface {
+	Reencrypt(ctx context.Context, batchSize int) (int, error)
+}
+
+// runReencryption moves the encrypted columns of every repository to the active key until ctx is cancelled.
+// It also encrypts the card_last_four values of payments written before encryption was introduced.
+func (app *Config) runReencryption(ctx context.Context, repositories ...reencrypter) {
+	ticker := time.NewTicker(reencryptInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, r := range repositories {
+			for {
+				rewritten, err := r.Reencrypt(ctx, reencryptBatchSize)
+				if err != nil {
+					log.Printf("re-encryption: %v", err)
+					app.Producer.publishMessage("key", "Payment Service", "Failed to re-encrypt rows: "+err.Error())
+				} else if rewritten > 0 {
+					log.Printf("re-encryption: rewrote %d rows", rewritten)
+				}
+				if err != nil || rewritten < reencryptBatchSize {
+					break
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
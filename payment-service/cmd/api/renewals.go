@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"payment-service/data"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRenewalNoticeInterval   = time.Hour        // How often renewal notices are sent when RENEWAL_NOTICE_INTERVAL is not set.
+	defaultRenewalNoticeDays       = "7,1"            // Default of RENEWAL_NOTICE_DAYS: notices a week and a day before every renewal.
+	defaultAnnualRenewalNoticeDays = "30"             // Default of RENEWAL_NOTICE_ANNUAL_DAYS: an extra notice a month before yearly renewals.
+	renewalNoticeMail              = "renewal notice" // Mail type of the notifications of upcoming renewals.
+)
+
+// parseNoticeDays parses a comma-separated list of days before a renewal to send notices, such as "7,1".
+func parseNoticeDays(days string) ([]int, error) {
+	var parsed []int
+	for _, field := range strings.Split(days, ",") {
+		day, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || day < 1 {
+			return nil, fmt.Errorf("invalid renewal notice day %q", field)
+		}
+		parsed = append(parsed, day)
+	}
+	return parsed, nil
+}
+
+// noticeDaysFromEnv returns the days listed in the environment variable key, or those of fallback if it is not set or invalid.
+func noticeDaysFromEnv(key, fallback string) []int {
+	if value := os.Getenv(key); value != "" {
+		days, err := parseNoticeDays(value)
+		if err == nil {
+			return days
+		}
+		log.Printf("renewal notices: invalid %s %q, using %s", key, value, fallback)
+	}
+	days, _ := parseNoticeDays(fallback)
+	return days
+}
+
+// noticeWindow returns the narrowest of windows, in days before the renewal, that renewsAt is within at now,
+// or 0 if it is in none. Only the narrowest is announced, so a renewal found late, after downtime or a plan
+// change, gets one notice rather than one per window it has already entered.
+func noticeWindow(windows []int, now, renewsAt time.Time) int {
+	window := 0
+	for _, days := range windows {
+		if !renewsAt.After(now.AddDate(0, 0, days)) && (window == 0 || days < window) {
+			window = days
+		}
+	}
+	return window
+}
+
+// renewalAmount returns the amount a renewal is expected to charge: the total of the last charge, or the price
+// of the variant if nothing was charged yet, such as at the end of a trial. It returns "" if neither is known.
+func renewalAmount(payment data.Payment, variant *data.Variant) string {
+	if payment.Total.Amount > 0 && payment.Total.Currency != "" {
+		return payment.Total.String()
+	}
+	if variant != nil && variant.Price.Currency != "" {
+		return variant.Price.String()
+	}
+	return ""
+}
+
+// runRenewalNotices sends renewal notices on startup and then every RENEWAL_NOTICE_INTERVAL until ctx is cancelled.
+// Every renewal is announced RENEWAL_NOTICE_DAYS before it, and yearly ones RENEWAL_NOTICE_ANNUAL_DAYS before too.
+func (app *Config) runRenewalNotices(ctx context.Context) {
+	interval := defaultRenewalNoticeInterval
+	if value := os.Getenv("RENEWAL_NOTICE_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("renewal notices: invalid RENEWAL_NOTICE_INTERVAL %q, using %s", value, interval)
+		} else {
+			interval = parsed
+		}
+	}
+	days := noticeDaysFromEnv("RENEWAL_NOTICE_DAYS", defaultRenewalNoticeDays)
+	annualDays := noticeDaysFromEnv("RENEWAL_NOTICE_ANNUAL_DAYS", defaultAnnualRenewalNoticeDays)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := app.sendRenewalNotices(ctx, time.Now(), days, annualDays); err != nil {
+			app.Producer.publishMessage("key", "Payment Service", "Failed to send renewal notices: "+err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendRenewalNotices enqueues a notice for every active subscription that renews within one of the windows,
+// days before the renewal, that wasn't announced in that window yet, and returns how many it enqueued.
+// Subscriptions of yearly variants get annualDays too. Each notice is recorded in the transaction that
+// enqueues it, so a renewal is announced once per window even when runs overlap or the relay redelivers.
+func (app *Config) sendRenewalNotices(ctx context.Context, now time.Time, days, annualDays []int) (int, error) {
+	windows := append(append([]int{}, days...), annualDays...)
+	sort.Sort(sort.Reverse(sort.IntSlice(windows)))
+	if len(windows) == 0 {
+		return 0, nil
+	}
+	payments, err := app.Models.Payments.ListRenewing(ctx, now, now.AddDate(0, 0, windows[0]))
+	if err != nil {
+		return 0, fmt.Errorf("listing renewals: %w", err)
+	}
+
+	variants := map[int64]*data.Variant{}
+	sent, failed := 0, 0
+	var firstErr error
+	for _, payment := range payments {
+		variant, ok := variants[payment.VariantID]
+		if !ok {
+			variant, err = app.Models.Catalog.GetVariant(ctx, payment.VariantID)
+			if err != nil && !errors.Is(err, data.ErrNotFound) {
+				log.Printf("renewal notices: failed to get variant %d: %v", payment.VariantID, err)
+			}
+			variants[payment.VariantID] = variant
+		}
+		applicable := days
+		if variant != nil && variant.Interval == "year" {
+			applicable = windows
+		}
+		window := noticeWindow(applicable, now, payment.RenewsAt)
+		if window == 0 {
+			continue
+		}
+
+		payment := payment
+		var isNew bool
+		err := app.Models.RunInTx(ctx, func(tx data.Models) error {
+			var err error
+			isNew, err = tx.Renewals.Record(ctx, data.RenewalNotice{SubscriptionID: payment.SubscriptionID, RenewsAt: payment.RenewsAt, DaysBefore: window, SentAt: now})
+			if err != nil || !isNew {
+				return err
+			}
+			return notifyRenewal(ctx, tx, &payment, renewalAmount(payment, variant))
+		})
+		if err != nil {
+			if failed++; firstErr == nil {
+				firstErr = fmt.Errorf("subscription %s: %w", payment.SubscriptionID, err)
+			}
+			continue
+		}
+		if isNew {
+			sent++
+		}
+	}
+	if failed > 0 {
+		return sent, fmt.Errorf("%d renewal notices could not be sent, the first: %w", failed, firstErr)
+	}
+	return sent, nil
+}
+
+// notifyRenewal enqueues the notification of the upcoming renewal of payment's subscription, charging amount,
+// in the transaction of tx. It doesn't change the subscription, so its status is sent as stored.
+func notifyRenewal(ctx context.Context, tx data.Models, payment *data.Payment, amount string) error {
+	_, err := tx.Outbox.Enqueue(ctx, data.EventSubscriptionNotification, data.SubscriptionNotification{
+		MailType:           renewalNoticeMail,
+		UserID:             payment.UserID,
+		EmailID:            payment.UserEmail,
+		SubscriptionStatus: payment.Status,
+		ProductName:        payment.ProductName,
+		VariantName:        payment.VariantName,
+		VariantID:          payment.VariantID,
+		SubscriptionID:     payment.SubscriptionID,
+		RenewsAt:           payment.RenewsAt.Unix(),
+		RenewalAmount:      amount,
+	})
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"payment-service/data"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// maxReplayBatch bounds the number of webhooks replayed by one request or command.
+const maxReplayBatch = 500
+
+// replayResult is the outcome of replaying one archived webhook.
+type replayResult struct {
+	ID        int64  `json:"id"`              // ID of the archived webhook.
+	EventName string `json:"eventName"`       // Event the webhook was dispatched on.
+	Status    string `json:"status"`          // Archive status after the replay, or "" if it could not be replayed.
+	Error     string `json:"error,omitempty"` // Why the replay failed, if it did.
+}
+
+// failed reports whether the webhook still isn't processed after the replay.
+func (r replayResult) failed() bool {
+	return r.Status == "" || r.Status == data.WebhookFailed || r.Status == data.WebhookDeadLettered
+}
+
+// replayWebhook runs an archived webhook through the pipeline again and records the outcome in the archive.
+// Only requests whose signature was verified are archived, so the signature isn't checked again.
+// The webhook is dispatched on the event it was dispatched on before, or on its meta.event_name if it had none.
+func (app *Config) replayWebhook(ctx context.Context, w data.ArchivedWebhook) replayResult {
+	result := replayResult{ID: w.ID, EventName: w.EventName}
+	body, err := app.Models.Events.Payload(ctx, w.PayloadDigest)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	outcome := app.processWebhook(ctx, w.ID, w.EventName, w.Headers["X-Event-Name"], body, true)
+	result.EventName, result.Status = outcome.eventName, outcome.status
+	if outcome.err != nil {
+		result.Error = outcome.err.Error()
+	}
+	return result
+}
+
+// replayWebhooks replays the archived webhooks matching f, oldest first, up to maxReplayBatch of them.
+func (app *Config) replayWebhooks(ctx context.Context, f data.ArchiveFilter) ([]replayResult, error) {
+	if f.Limit <= 0 || f.Limit > maxReplayBatch {
+		f.Limit = maxReplayBatch
+	}
+	webhooks, err := app.Models.Archive.List(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]replayResult, 0, len(webhooks))
+	for _, w := range webhooks {
+		results = append(results, app.replayWebhook(ctx, w))
+	}
+	return results, nil
+}
+
+// newArchiveFilter builds an archive filter from a comma-separated list of statuses and RFC 3339 bounds
+// on the time of receipt. Empty arguments don't restrict the selection.
+func newArchiveFilter(statuses, from, to string) (data.ArchiveFilter, error) {
+	var f data.ArchiveFilter
+	for _, status := range strings.Split(statuses, ",") {
+		if status = strings.TrimSpace(status); status != "" {
+			f.Statuses = append(f.Statuses, status)
+		}
+	}
+	var err error
+	if from != "" {
+		if f.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return f, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if to != "" {
+		if f.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return f, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// runReplayWebhooks implements the "replay-webhooks" subcommand, which replays one archived webhook
+// or the webhooks received in a time range. Notifications are only recorded in the outbox, so it
+// connects only to the database, and returns the process exit code: 1 if a webhook still failed.
+func runReplayWebhooks(args []string) int {
+	flags := flag.NewFlagSet("replay-webhooks", flag.ContinueOnError)
+	id := flags.Int64("id", 0, "ID of the archived webhook to replay")
+	from := flags.String("from", "", "replay webhooks received at or after this RFC 3339 time")
+	to := flags.String("to", "", "replay webhooks received before this RFC 3339 time")
+	statuses := flags.String("status", data.WebhookFailed+","+data.WebhookDeadLettered, "comma-separated statuses of the webhooks to replay in the range")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	filter, err := newArchiveFilter(*statuses, *from, *to)
+	if err != nil || (*id == 0) == (*from == "" || *to == "") {
+		fmt.Fprintln(os.Stderr, "usage: paymentApp replay-webhooks -id ID | -from TIME -to TIME [-status STATUSES]")
+		return 2
+	}
+
+	pool, err := connect() // Connect to the database.
+	if err != nil {
+		log.Printf("Failed to connect to the database: %v", err)
+		return 1
+	}
+	defer pool.Close()
+	keys, err := loadKeyRing()
+	if err != nil {
+		log.Printf("Failed to load the key ring: %v", err)
+		return 1
+	}
+	app.Models = data.NewModels(pool, keys)
+
+	ctx := context.Background()
+	var results []replayResult
+	if *id != 0 {
+		w, err := app.Models.Archive.Get(ctx, *id)
+		if err != nil {
+			log.Printf("replay-webhooks failed: %v", err)
+			return 1
+		}
+		results = []replayResult{app.replayWebhook(ctx, *w)}
+	} else if results, err = app.replayWebhooks(ctx, filter); err != nil {
+		log.Printf("replay-webhooks failed: %v", err)
+		return 1
+	}
+
+	code := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEVENT\tSTATUS\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", r.ID, r.EventName, r.Status, r.Error)
+		if r.failed() {
+			code = 1
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 1
+	}
+	return code
+}
@@ -3,19 +3,46 @@ package main
 import "github.com/labstack/echo/v4"
 
 func (app *Config) routes(e *echo.Echo) {
-	s := e.Group("/subscription")                     // Create a new group for subscription-related route
-	s.Use(VerifySignatureMiddleware)                  // Add the VerifySignatureMiddleware to the group
-	e.GET("/ping", app.pingHandler)                   // Add a ping route to check if the server is running
-	s.POST("/created", app.SubscriptionCreated)       // Add a route for handling subscription creation events
-	s.POST("/updated", app.SubscriptionUpdated)       // Add a route for handling subscription update events
-	s.POST("/cancelled", app.SubscriptionCancelled)   // Add a route for handling subscription cancellation events
-	s.POST("/resumed", app.SubscriptionResumed)       // Add a route for handling subscription resumption events
-	s.POST("/expired", app.SubscriptionExpired)       // Add a route for handling subscription expiration events
-	s.POST("/paused", app.SubscriptionPaused)         // Add a route for handling subscription pause events
-	s.POST("/unpaused", app.SubscriptionUnpaused)     // Add a route for handling subscription unpause events
-	s.POST("/failed", app.SubscriptionFailedPayment)  // Add a route for handling failed payment events
-	s.POST("/success", app.SubscriptionSucessPayment) // Add a route for handling successful payment events
-	s.POST("/recovered", app.SubscriptionRecovered)   // Add a route for handling recovered payment events
-	s.POST("/refunded", app.SubscriptionRefunded)     // Add a route for handling refunded payment events
-	s.POST("/changed", app.SubscriptionChanged)       // Add a route for handling subscription change events
+	e.GET("/ping", app.pingHandler)                                                      // Add a ping route to check if the server is running
+	e.GET("/plans", app.listPlans)                                                       // List the plans on sale and their prices
+	e.POST("/webhooks/lemonsqueezy", app.lemonSqueezyWebhook, VerifySignatureMiddleware) // Receive every Lemon Squeezy webhook
+	e.POST("/usage", app.recordUsageEvent, RequireUsageToken)                            // Record a usage event of a metered subscription
+	e.GET("/billing/usage", app.getBillingUsage, JWTAuthMiddleware)                      // Show the caller's usage in the current billing period
+
+	a := e.Group("/admin")                                     // Create a new group for operator routes
+	a.Use(RequireAdminToken)                                   // Require the admin token for the group
+	a.GET("/webhooks", app.listWebhooks)                       // List archived webhooks, the failed ones by default
+	a.GET("/webhooks/:id", app.getWebhook)                     // Show an archived webhook and its body
+	a.POST("/webhooks/:id/replay", app.replayArchivedWebhook)  // Replay an archived webhook
+	a.POST("/webhooks/replay", app.replayArchivedWebhooks)     // Replay the archived webhooks of a time range
+	a.POST("/catalog/sync", app.syncCatalogNow)                // Sync the products and variants from Lemon Squeezy now
+	a.GET("/reconciliation", app.getReconciliation)            // Show the report of the latest reconciliation
+	a.GET("/reconciliation/:id", app.getReconciliation)        // Show the report of a reconciliation
+	a.POST("/reconciliation/run", app.reconcileNow)            // Reconcile with Lemon Squeezy now
+	a.GET("/trials", app.getTrialReport)                       // Show the conversion of the trials started in a time range
+	a.GET("/subscriptions/:id/events", app.subscriptionEvents) // List the webhooks received for a subscription
+
+	b := e.Group("/billing/subscription")            // Create a new group for the caller's subscription
+	b.Use(JWTAuthMiddleware)                         // Require a subscription-service login for the group
+	b.GET("", app.getBillingSubscription)            // Show the subscription and its payment method and portal links
+	b.POST("/cancel", app.cancelBillingSubscription) // Cancel at the end of the billing period
+	b.POST("/pause", app.pauseBillingSubscription)   // Pause billing
+	b.POST("/resume", app.resumeBillingSubscription) // Unpause, or undo a cancellation
+	b.POST("/change-plan", app.changeBillingPlan)    // Move to another variant
+
+	// Deprecated per-event routes, kept while webhooks are moved to /webhooks/lemonsqueezy.
+	s := e.Group("/subscription")                                             // Create a new group for subscription-related route
+	s.Use(VerifySignatureMiddleware)                                          // Add the VerifySignatureMiddleware to the group
+	s.POST("/created", app.legacyWebhook("subscription_created"))             // Subscription creation events
+	s.POST("/updated", app.legacyWebhook("subscription_updated"))             // Subscription update events
+	s.POST("/cancelled", app.legacyWebhook("subscription_cancelled"))         // Subscription cancellation events
+	s.POST("/resumed", app.legacyWebhook("subscription_resumed"))             // Subscription resumption events
+	s.POST("/expired", app.legacyWebhook("subscription_expired"))             // Subscription expiration events
+	s.POST("/paused", app.legacyWebhook("subscription_paused"))               // Subscription pause events
+	s.POST("/unpaused", app.legacyWebhook("subscription_unpaused"))           // Subscription unpause events
+	s.POST("/failed", app.legacyWebhook("subscription_payment_failed"))       // Failed payment events
+	s.POST("/success", app.legacyWebhook("subscription_payment_success"))     // Successful payment events
+	s.POST("/recovered", app.legacyWebhook("subscription_payment_recovered")) // Recovered payment events
+	s.POST("/refunded", app.legacyWebhook("subscription_payment_refunded"))   // Refunded payment events
+	s.POST("/changed", app.legacyWebhook("subscription_plan_changed"))        // Subscription change events
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"payment-service/data"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSubscriptionEventsRequireAdminToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := echo.New()
+	(&Config{Models: data.NewMemoryModels(), Producer: app.Producer}).routes(e)
+
+	for _, test := range []struct {
+		path, authorization string
+		want                int
+	}{
+		{"/subscriptions/1/events", "", http.StatusNotFound}, // The route moved under /admin.
+		{"/admin/subscriptions/1/events", "", http.StatusUnauthorized},
+		{"/admin/subscriptions/1/events", "Bearer wrong", http.StatusUnauthorized},
+		{"/admin/subscriptions/1/events", "Bearer secret", http.StatusNotFound}, // No events for subscription 1.
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("GET %s with %q = %d, want %d", test.path, test.authorization, rec.Code, test.want)
+		}
+		if test.authorization == "Bearer secret" && !strings.Contains(rec.Body.String(), "no events") {
+			t.Errorf("GET %s with the admin token = %s, want the handler's response", test.path, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"payment-service/data"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultTrialReportRange is how far back the trial report goes when from is not set.
+const defaultTrialReportRange = 90 * 24 * time.Hour
+
+// trackTrial records the free trial of a payment's subscription in the transaction of tx: its start and end
+// while the subscription is on trial, conversion once it becomes active, and expiry once it expires or goes
+// unpaid. Other statuses, such as cancelled or past_due, leave the outcome open until one of those follows.
+func trackTrial(ctx context.Context, tx data.Models, payment *data.Payment) error {
+	var outcome string
+	switch payment.Status {
+	case "on_trial":
+		if payment.TrialEndsAt == nil {
+			return nil
+		}
+		return tx.Trials.Track(ctx, data.Trial{
+			SubscriptionID: payment.SubscriptionID,
+			UserID:         payment.UserID,
+			VariantID:      payment.VariantID,
+			VariantName:    payment.VariantName,
+			StartedAt:      payment.CreatedAt,
+			EndsAt:         *payment.TrialEndsAt,
+		})
+	case "active":
+		outcome = data.TrialConverted
+	case "expired", "unpaid":
+		outcome = data.TrialExpired
+	default:
+		return nil
+	}
+	at := payment.UpdatedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	err := tx.Trials.End(ctx, payment.SubscriptionID, outcome, at)
+	if errors.Is(err, data.ErrNotFound) {
+		return nil // The subscription had no trial, or its outcome was already recorded.
+	}
+	return err
+}
+
+// trialVariantReport is the trial report of a variant.
+type trialVariantReport struct {
+	data.TrialStats
+	Running        int     `json:"running"`        // Number of trials without an outcome yet.
+	ConversionRate float64 `json:"conversionRate"` // Share of the trials with an outcome that converted, or 0 if none has one.
+}
+
+// trialReport is the response of getTrialReport.
+type trialReport struct {
+	From     time.Time            `json:"from"`
+	To       time.Time            `json:"to"`
+	Total    trialVariantReport   `json:"total"`    // Counts of every variant. Its variant ID is 0.
+	Variants []trialVariantReport `json:"variants"` // Counts per variant, sorted by variant ID.
+}
+
+// newTrialVariantReport adds the running trials and the conversion rate to the counts of s.
+func newTrialVariantReport(s data.TrialStats) trialVariantReport {
+	report := trialVariantReport{TrialStats: s, Running: s.Started - s.Converted - s.Expired}
+	if decided := s.Converted + s.Expired; decided > 0 {
+		report.ConversionRate = float64(s.Converted) / float64(decided)
+	}
+	return report
+}
+
+// getTrialReport returns how many trials started between the from and to query parameters (RFC 3339,
+// default the last 90 days) converted or expired, and their conversion rate, in total and per variant.
+func (app *Config) getTrialReport(c echo.Context) error {
+	filter, err := newArchiveFilter("", c.QueryParam("from"), c.QueryParam("to"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if filter.To.IsZero() {
+		filter.To = time.Now()
+	}
+	if filter.From.IsZero() {
+		filter.From = filter.To.Add(-defaultTrialReportRange)
+	}
+	if !filter.From.Before(filter.To) {
+		return c.JSON(http.StatusBadRequest, "from must be before to")
+	}
+
+	stats, err := app.Models.Trials.Stats(c.Request().Context(), filter.From, filter.To)
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to get trial stats"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to get trial stats")
+	}
+	report := trialReport{From: filter.From, To: filter.To, Variants: []trialVariantReport{}}
+	var total data.TrialStats
+	for _, s := range stats {
+		total.Started, total.Converted, total.Expired = total.Started+s.Started, total.Converted+s.Converted, total.Expired+s.Expired
+		report.Variants = append(report.Variants, newTrialVariantReport(s))
+	}
+	report.Total = newTrialVariantReport(total)
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"payment-service/data"
+	"payment-service/payment"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultUsageReportInterval = 5 * time.Minute // How often usage is reported when USAGE_REPORT_INTERVAL is not set.
+	usageReportBatchSize       = 100             // Number of periods reported per query.
+	maxUsageClockSkew          = 5 * time.Minute // How far in the future occurred_at may be, for senders with a fast clock.
+	maxIdempotencyKeyLength    = 255
+)
+
+var (
+	errUsageInvalid        = errors.New("invalid usage event")
+	errUsageNoSubscription = errors.New("no subscription for this account")
+	errUsageNotMetered     = errors.New("subscription is not usage-based")
+	errUsageOutsidePeriod  = errors.New("usage is outside the current billing period")
+	errUsageKeyReused      = errors.New("idempotency key was already used for a different usage event")
+)
+
+// usageEvent is a usage event as sent to POST /usage or UsageService.RecordUsage. Either UserID or
+// SubscriptionID identifies the subscription.
+type usageEvent struct {
+	UserID         int64     `json:"user_id"`         // Bills the latest subscription of the subscription-service user.
+	SubscriptionID string    `json:"subscription_id"` // Bills the Lemon Squeezy subscription.
+	Quantity       int64     `json:"quantity"`
+	IdempotencyKey string    `json:"idempotency_key"` // Unique per subscription; retries must reuse it.
+	OccurredAt     time.Time `json:"occurred_at"`     // Now if it is not set.
+}
+
+// billingUsage is the usage of a subscription in its current billing period, as returned by
+// GET /billing/usage and UsageService.GetCurrentUsage.
+type billingUsage struct {
+	SubscriptionID   string     `json:"subscription_id"`
+	PeriodStart      time.Time  `json:"period_start"`
+	PeriodEnd        time.Time  `json:"period_end"`
+	Quantity         int64      `json:"quantity"`          // Usage recorded in the period.
+	ReportedQuantity int64      `json:"reported_quantity"` // Usage reported to Lemon Squeezy so far.
+	ReportedAt       *time.Time `json:"reported_at"`
+}
+
+func newBillingUsage(p *data.UsagePeriod) billingUsage {
+	return billingUsage{
+		SubscriptionID:   p.SubscriptionID,
+		PeriodStart:      p.PeriodStart,
+		PeriodEnd:        p.PeriodEnd,
+		Quantity:         p.Quantity,
+		ReportedQuantity: p.ReportedQuantity,
+		ReportedAt:       p.ReportedAt,
+	}
+}
+
+// recordUsageEvent ingests a usage event sent with RequireUsageToken. New events are answered with
+// 201 Created, and retries of an event already recorded with 200 OK and the stored event.
+func (app *Config) recordUsageEvent(c echo.Context) error {
+	var request usageEvent
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request body")
+	}
+	event, duplicate, err := app.recordUsage(c.Request().Context(), request)
+	if err != nil {
+		return usageError(c, err)
+	}
+	if duplicate {
+		return c.JSON(http.StatusOK, event)
+	}
+	return c.JSON(http.StatusCreated, event)
+}
+
+// getBillingUsage returns the usage of the caller's latest subscription in its current billing period.
+func (app *Config) getBillingUsage(c echo.Context) error {
+	period, err := app.currentUsage(c.Request().Context(), usageEvent{UserID: c.Get("userID").(int64)})
+	if err != nil {
+		return usageError(c, err)
+	}
+	return c.JSON(http.StatusOK, newBillingUsage(period))
+}
+
+// usageError responds to a failed usage request, like billingError does for the errors of Lemon Squeezy.
+func usageError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errUsageInvalid):
+		return c.JSON(http.StatusBadRequest, err.Error())
+	case errors.Is(err, errUsageNoSubscription):
+		return c.JSON(http.StatusNotFound, err.Error())
+	case errors.Is(err, errUsageKeyReused):
+		return c.JSON(http.StatusConflict, err.Error())
+	case errors.Is(err, errUsageNotMetered), errors.Is(err, errUsageOutsidePeriod):
+		return c.JSON(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, errBillingDisabled):
+		return c.JSON(http.StatusServiceUnavailable, "Billing API is disabled")
+	case errors.Is(err, payment.ErrRateLimited), errors.Is(err, payment.ErrUnavailable):
+		app.Producer.publishMessage("key", "Payment Service", "Lemon Squeezy is unavailable, failed to record usage: "+err.Error())
+		return c.JSON(http.StatusServiceUnavailable, "payment provider is unavailable, try again later")
+	default:
+		app.Producer.publishMessage("key", "Payment Service", "Failed to record usage: "+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to record usage")
+	}
+}
+
+// recordUsage stores a usage event and adds it to the usage of its subscription item in the billing
+// period it occurred in. It reports whether the event was recorded by an earlier request with the same
+// idempotency key, in which case the stored event is returned. Reusing a key for a different quantity
+// returns errUsageKeyReused.
+func (app *Config) recordUsage(ctx context.Context, e usageEvent) (*data.UsageEvent, bool, error) {
+	now := time.Now()
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = now
+	}
+	switch {
+	case e.Quantity <= 0:
+		return nil, false, fmt.Errorf("%w: quantity must be more than 0", errUsageInvalid)
+	case e.IdempotencyKey == "" || len(e.IdempotencyKey) > maxIdempotencyKeyLength:
+		return nil, false, fmt.Errorf("%w: idempotency_key must have 1 to %d characters", errUsageInvalid, maxIdempotencyKeyLength)
+	case e.OccurredAt.After(now.Add(maxUsageClockSkew)):
+		return nil, false, fmt.Errorf("%w: occurred_at is in the future", errUsageInvalid)
+	}
+
+	p, err := app.usagePayment(ctx, e)
+	if err != nil {
+		return nil, false, err
+	}
+	period, err := app.usagePeriod(ctx, p, e.OccurredAt)
+	if err != nil {
+		return nil, false, err
+	}
+	// Usage reported after its period ended would be billed in the next one, so it isn't accepted.
+	// Retries of events recorded before the end are still answered as duplicates.
+	ended := !period.PeriodEnd.After(now)
+
+	var recorded *data.UsageEvent
+	duplicate := false
+	err = app.Models.RunInTx(ctx, func(tx data.Models) error {
+		stored, err := tx.Usage.Record(ctx, data.UsageEvent{
+			SubscriptionItemID: p.SubscriptionItemID,
+			SubscriptionID:     p.SubscriptionID,
+			IdempotencyKey:     e.IdempotencyKey,
+			Quantity:           e.Quantity,
+			PeriodStart:        period.PeriodStart,
+			OccurredAt:         e.OccurredAt,
+		})
+		if errors.Is(err, data.ErrDuplicate) {
+			recorded, duplicate = stored, true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ended {
+			return errUsageOutsidePeriod // Rolls the event back.
+		}
+		recorded = stored
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if duplicate && recorded.Quantity != e.Quantity {
+		return nil, false, errUsageKeyReused
+	}
+	return recorded, duplicate, nil
+}
+
+// currentUsage returns the usage of a subscription in the billing period that includes now.
+func (app *Config) currentUsage(ctx context.Context, e usageEvent) (*data.UsagePeriod, error) {
+	p, err := app.usagePayment(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	return app.usagePeriod(ctx, p, time.Now())
+}
+
+// usagePayment returns the payment of the subscription a usage event is billed to, with its subscription
+// item. The item is looked up in Lemon Squeezy and stored if the webhooks didn't carry it.
+func (app *Config) usagePayment(ctx context.Context, e usageEvent) (*data.Payment, error) {
+	var p *data.Payment
+	var err error
+	switch {
+	case e.SubscriptionID != "" && e.UserID != 0:
+		return nil, fmt.Errorf("%w: set either user_id or subscription_id", errUsageInvalid)
+	case e.SubscriptionID != "":
+		p, err = app.Models.Payments.GetPaymentBySubscriptionID(ctx, e.SubscriptionID)
+	case e.UserID != 0:
+		p, err = app.Models.Payments.GetLatestPaymentByUserID(ctx, e.UserID)
+	default:
+		return nil, fmt.Errorf("%w: user_id or subscription_id is required", errUsageInvalid)
+	}
+	if errors.Is(err, data.ErrNotFound) {
+		return nil, errUsageNoSubscription
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Status == "expired" {
+		return nil, errUsageNoSubscription
+	}
+	if p.SubscriptionItemID != 0 {
+		return p, nil
+	}
+
+	if app.Billing == nil {
+		return nil, errBillingDisabled
+	}
+	subscription, err := app.Billing.GetSubscription(ctx, p.SubscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("getting subscription %s: %w", p.SubscriptionID, err)
+	}
+	item := subscription.FirstSubscriptionItem
+	if item == nil || !item.IsUsageBased {
+		return nil, errUsageNotMetered
+	}
+	p.SubscriptionItemID = item.ID
+	// A webhook that updated the payment meanwhile carried the item as well, so a conflict is fine.
+	if err := app.Models.Payments.UpdatePayment(ctx, *p); err != nil && !errors.Is(err, data.ErrConflict) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// usagePeriod returns the billing period of the payment's subscription item that includes at. Periods
+// are stored the first time usage is recorded or queried in them, from the current period Lemon Squeezy
+// reports, so at must be in the current period if it isn't in a stored one.
+func (app *Config) usagePeriod(ctx context.Context, p *data.Payment, at time.Time) (*data.UsagePeriod, error) {
+	period, err := app.Models.Usage.FindPeriod(ctx, p.SubscriptionItemID, at)
+	if !errors.Is(err, data.ErrNotFound) {
+		return period, err
+	}
+
+	if app.Billing == nil {
+		return nil, errBillingDisabled
+	}
+	usage, err := app.Billing.GetCurrentUsage(ctx, p.SubscriptionItemID)
+	if errors.Is(err, payment.ErrNotFound) || errors.Is(err, payment.ErrInvalid) {
+		return nil, errUsageNotMetered
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting usage of subscription item %d: %w", p.SubscriptionItemID, err)
+	}
+	if at.Before(usage.PeriodStart) || !at.Before(usage.PeriodEnd) {
+		return nil, errUsageOutsidePeriod
+	}
+	stored := data.UsagePeriod{SubscriptionItemID: p.SubscriptionItemID, SubscriptionID: p.SubscriptionID, PeriodStart: usage.PeriodStart, PeriodEnd: usage.PeriodEnd}
+	if err := app.Models.Usage.AddPeriod(ctx, stored); err != nil {
+		return nil, err
+	}
+	return app.Models.Usage.FindPeriod(ctx, p.SubscriptionItemID, at)
+}
+
+// runUsageReporter reports recorded usage to Lemon Squeezy on startup and then every USAGE_REPORT_INTERVAL
+// until ctx is cancelled.
+func (app *Config) runUsageReporter(ctx context.Context) {
+	interval := defaultUsageReportInterval
+	if value := os.Getenv("USAGE_REPORT_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("usage reporter: invalid USAGE_REPORT_INTERVAL %q, using %s", value, interval)
+		} else {
+			interval = parsed
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := app.reportUsage(ctx); err != nil && !errors.Is(err, errBillingDisabled) {
+			app.Producer.publishMessage("key", "Payment Service", "Failed to report usage: "+err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportUsage sets the usage of every billing period that has usage recorded since it was last reported,
+// and returns the number of periods reported. Each report replaces the usage of the period with its total,
+// so reporting the same total twice, or from two replicas, bills it once. Lemon Squeezy only takes usage
+// for an item's current period, so usage left unreported when its period ended, because it was recorded
+// after the last run before the end or the reporter was down, is carried over into the current period and
+// billed with it. Periods that fail to report are retried on the next run.
+func (app *Config) reportUsage(ctx context.Context) (int, error) {
+	if app.Billing == nil {
+		return 0, errBillingDisabled
+	}
+	reported := 0
+	for {
+		periods, err := app.Models.Usage.ListUnreported(ctx, usageReportBatchSize)
+		if err != nil {
+			return reported, err
+		}
+		progress := false
+		done := map[string]bool{} // Periods reported in this batch, which may be listed again with older totals.
+		for _, p := range periods {
+			now := time.Now()
+			if !p.PeriodEnd.After(now) {
+				current, err := app.carryOverUsage(ctx, p, now)
+				if err != nil {
+					app.Producer.publishMessage("key", "Payment Service", fmt.Sprintf("Failed to carry over usage of subscription item %d: %v", p.SubscriptionItemID, err))
+					continue
+				}
+				p = *current
+			}
+			key := fmt.Sprintf("%d/%d", p.SubscriptionItemID, p.PeriodStart.UnixNano())
+			if done[key] {
+				continue
+			}
+			if err := app.Billing.CreateUsageRecord(ctx, p.SubscriptionItemID, p.Quantity, payment.UsageSet); err != nil {
+				app.Producer.publishMessage("key", "Payment Service", fmt.Sprintf("Failed to report usage of subscription item %d: %v", p.SubscriptionItemID, err))
+				continue
+			}
+			if err := app.Models.Usage.MarkReported(ctx, p.SubscriptionItemID, p.PeriodStart, p.Quantity, time.Now()); err != nil {
+				return reported, err
+			}
+			done[key] = true
+			reported++
+			progress = true
+		}
+		// Stop when every period was listed, or when the ones left all failed.
+		if len(periods) < usageReportBatchSize || !progress {
+			return reported, nil
+		}
+	}
+}
+
+// carryOverUsage moves the unreported usage of a period that has ended into the current period of its
+// subscription item, which is looked up in Lemon Squeezy if it isn't stored, and returns the current period.
+func (app *Config) carryOverUsage(ctx context.Context, ended data.UsagePeriod, now time.Time) (*data.UsagePeriod, error) {
+	current, err := app.usagePeriod(ctx, &data.Payment{SubscriptionID: ended.SubscriptionID, SubscriptionItemID: ended.SubscriptionItemID}, now)
+	if err != nil {
+		return nil, err
+	}
+	err = app.Models.RunInTx(ctx, func(tx data.Models) error {
+		return tx.Usage.CarryOver(ctx, ended, current.PeriodStart, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return app.Models.Usage.FindPeriod(ctx, ended.SubscriptionItemID, now)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"payment-service/grpc/usage"
+	"payment-service/payment"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultUsageGrpcAddr is where UsageService listens when USAGE_GRPC_ADDR is not set.
+const defaultUsageGrpcAddr = ":50052"
+
+// usageServer implements UsageService for the services on the internal network that meter usage.
+type usageServer struct {
+	usage.UnimplementedUsageServiceServer // Embedding for forward compatibility.
+}
+
+// RecordUsage records a usage event like POST /usage does.
+func (s *usageServer) RecordUsage(ctx context.Context, req *usage.RecordUsageRequest) (*usage.RecordUsageResponse, error) {
+	e := usageEvent{UserID: req.UserId, SubscriptionID: req.SubscriptionId, Quantity: req.Quantity, IdempotencyKey: req.IdempotencyKey}
+	if req.OccurredAt != 0 {
+		e.OccurredAt = time.Unix(req.OccurredAt, 0)
+	}
+	event, duplicate, err := app.recordUsage(ctx, e)
+	if err != nil {
+		return nil, usageStatus(err)
+	}
+	period, err := app.Models.Usage.FindPeriod(ctx, event.SubscriptionItemID, event.PeriodStart)
+	if err != nil {
+		return nil, usageStatus(err)
+	}
+	return &usage.RecordUsageResponse{
+		EventId:        event.ID,
+		Duplicate:      duplicate,
+		SubscriptionId: event.SubscriptionID,
+		PeriodStart:    period.PeriodStart.Unix(),
+		PeriodEnd:      period.PeriodEnd.Unix(),
+	}, nil
+}
+
+// GetCurrentUsage returns the usage of the current billing period like GET /billing/usage does.
+func (s *usageServer) GetCurrentUsage(ctx context.Context, req *usage.GetCurrentUsageRequest) (*usage.GetCurrentUsageResponse, error) {
+	period, err := app.currentUsage(ctx, usageEvent{UserID: req.UserId, SubscriptionID: req.SubscriptionId})
+	if err != nil {
+		return nil, usageStatus(err)
+	}
+	return &usage.GetCurrentUsageResponse{
+		SubscriptionId:   period.SubscriptionID,
+		PeriodStart:      period.PeriodStart.Unix(),
+		PeriodEnd:        period.PeriodEnd.Unix(),
+		Quantity:         period.Quantity,
+		ReportedQuantity: period.ReportedQuantity,
+	}, nil
+}
+
+// usageStatus converts the errors of recordUsage and currentUsage into gRPC statuses, with the same
+// meaning as the HTTP statuses usageError answers with.
+func usageStatus(err error) error {
+	switch {
+	case errors.Is(err, errUsageInvalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errUsageNoSubscription):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errUsageKeyReused):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, errUsageNotMetered), errors.Is(err, errUsageOutsidePeriod):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errBillingDisabled), errors.Is(err, payment.ErrRateLimited), errors.Is(err, payment.ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		app.Producer.publishMessage("key", "Payment Service", "Failed to record usage: "+err.Error())
+		return status.Error(codes.Internal, "failed to record usage")
+	}
+}
+
+// serveUsageGrpc serves UsageService on USAGE_GRPC_ADDR, or on defaultUsageGrpcAddr if it is not set.
+func serveUsageGrpc() {
+	addr := os.Getenv("USAGE_GRPC_ADDR")
+	if addr == "" {
+		addr = defaultUsageGrpcAddr
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	s := grpc.NewServer()
+	usage.RegisterUsageServiceServer(s, &usageServer{})
+
+	log.Printf("Usage service listening at %v", lis.Addr())
+	if err := s.Serve(lis); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
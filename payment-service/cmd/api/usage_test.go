@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"payment-service/data"
+	"payment-service/payment"
+	"payment-service/payment/lemonsqueezytest"
+	"testing"
+	"time"
+)
+
+func TestReportUsageAfterPeriodEnd(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	boundary := now.Add(-time.Minute)
+	server := lemonsqueezytest.NewServer("test-api-key")
+	t.Cleanup(server.Close)
+	server.AddSubscriptionItem("71", boundary, boundary.AddDate(0, 1, 0))
+
+	models := data.NewMemoryModels()
+	ended := data.UsagePeriod{SubscriptionItemID: 71, SubscriptionID: "7", PeriodStart: boundary.AddDate(0, -1, 0), PeriodEnd: boundary}
+	current := data.UsagePeriod{SubscriptionItemID: 71, SubscriptionID: "7", PeriodStart: boundary, PeriodEnd: boundary.AddDate(0, 1, 0)}
+	for _, p := range []data.UsagePeriod{ended, current} {
+		if err := models.Usage.AddPeriod(ctx, p); err != nil {
+			t.Fatalf("AddPeriod() error = %v", err)
+		}
+	}
+	// 3 units were reported before the boundary, 2 more were recorded just before it, and 1 after it.
+	for _, e := range []data.UsageEvent{
+		{IdempotencyKey: "a", Quantity: 3, PeriodStart: ended.PeriodStart, OccurredAt: boundary.Add(-time.Hour)},
+		{IdempotencyKey: "b", Quantity: 2, PeriodStart: ended.PeriodStart, OccurredAt: boundary.Add(-time.Second)},
+		{IdempotencyKey: "c", Quantity: 1, PeriodStart: current.PeriodStart, OccurredAt: now},
+	} {
+		e.SubscriptionItemID, e.SubscriptionID = 71, "7"
+		if _, err := models.Usage.Record(ctx, e); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+		if e.IdempotencyKey == "a" {
+			if err := models.Usage.MarkReported(ctx, 71, ended.PeriodStart, 3, boundary.Add(-time.Hour)); err != nil {
+				t.Fatalf("MarkReported() error = %v", err)
+			}
+		}
+	}
+
+	reporter := &Config{Models: models, Producer: app.Producer, Billing: payment.NewPaymentService(payment.Config{APIKey: "test-api-key", BaseURL: server.URL})}
+	reported, err := reporter.reportUsage(ctx)
+	if err != nil || reported != 1 {
+		t.Fatalf("reportUsage() = %d, %v, want 1 period reported", reported, err)
+	}
+	// The usage left over from the ended period is billed with the current one, without replacing its own.
+	if usage := server.Usage("71"); usage != 3 {
+		t.Errorf("Lemon Squeezy usage = %d, want 3", usage)
+	}
+	for _, p := range []data.UsagePeriod{ended, current} {
+		stored, err := models.Usage.FindPeriod(ctx, 71, p.PeriodStart)
+		if err != nil || stored.ReportedQuantity != stored.Quantity {
+			t.Errorf("FindPeriod(%s) = %+v, error %v, want all usage reported", p.PeriodStart, stored, err)
+		}
+	}
+
+	if reported, err := reporter.reportUsage(ctx); err != nil || reported != 0 {
+		t.Errorf("reportUsage() again = %d, %v, want nothing to report", reported, err)
+	}
+}
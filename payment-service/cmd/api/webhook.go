@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"payment-service/data"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// webhookHandler processes one kind of Lemon Squeezy webhook.
+type webhookHandler struct {
+	// resource is the data.type the event carries. Webhooks of another type are rejected.
+	resource string
+	// handle stores the event. body is the raw webhook and webhook the parsed body.
+	// It runs in the transaction of tx, which also records the delivery.
+	handle func(ctx context.Context, tx data.Models, body []byte, webhook *data.Webhook) error
+	// failureMail is the mail type of the notification sent when the webhook fails permanently, or "" to send none.
+	failureMail string
+}
+
+// webhookHandlers maps the Lemon Squeezy events payment-service processes to their handlers.
+// Events missing from the map are acknowledged and logged, so subscribing the webhook to more
+// events than are handled here doesn't make Lemon Squeezy retry them.
+func (app *Config) webhookHandlers() map[string]webhookHandler {
+	// update projects a subscription event onto the stored payment and notifies the subscription service
+	// with the given mail type and the subscription's status, which the subscription service stores as the
+	// user's and grants the plan by.
+	update := func(mailType, failureMail string) webhookHandler {
+		return webhookHandler{
+			resource: data.ResourceSubscription,
+			handle: func(ctx context.Context, tx data.Models, body []byte, webhook *data.Webhook) error {
+				payment, err := webhook.Payment()
+				if err != nil {
+					return err
+				}
+				return updatePayment(ctx, tx, webhook.EventName, body, payment, mailType, payment.Status)
+			},
+			failureMail: failureMail,
+		}
+	}
+	// invoice applies a subscription invoice to the stored payment and notifies the subscription service
+	// with the given mail type.
+	invoice := func(mailType string) webhookHandler {
+		return webhookHandler{
+			resource: data.ResourceSubscriptionInvoice,
+			handle: func(ctx context.Context, tx data.Models, body []byte, webhook *data.Webhook) error {
+				return applyInvoice(ctx, tx, body, webhook, mailType)
+			},
+		}
+	}
+	return map[string]webhookHandler{
+		"subscription_created": {
+			resource: data.ResourceSubscription,
+			handle: func(ctx context.Context, tx data.Models, body []byte, webhook *data.Webhook) error {
+				payment, err := webhook.Payment()
+				if err != nil {
+					return err
+				}
+				return createPayment(ctx, tx, webhook.EventName, body, payment)
+			},
+			failureMail: "failed create",
+		},
+		"subscription_updated":           update("success update", "failed update"),
+		"subscription_cancelled":         update("success cancel", "failed cancel"),
+		"subscription_resumed":           update("success resume", "failed resume"),
+		"subscription_expired":           update("expired", ""),
+		"subscription_paused":            update("paused", ""),
+		"subscription_unpaused":          update("unpaused", ""),
+		"subscription_plan_changed":      update("changed", ""),
+		"subscription_payment_failed":    invoice("payment"),
+		"subscription_payment_success":   invoice("payment success"),
+		"subscription_payment_recovered": invoice("recovered"),
+		"subscription_payment_refunded":  invoice("refunded"),
+	}
+}
+
+// errWrongResource is returned for a webhook whose data.type is not the one its event carries.
+var errWrongResource = errors.New("webhook carries the wrong resource type")
+
+// isPermanent reports whether a webhook failed in a way that retrying it can't fix: it is malformed,
+// it refers to a subscription payment-service doesn't know, or the database rejects its values.
+// Other failures, such as the database being unreachable or a transaction that kept conflicting with
+// others, are transient, and Lemon Squeezy is asked to retry the webhook.
+func isPermanent(err error) bool {
+	var validationErr *data.ValidationError
+	var syntaxErr *json.SyntaxError
+	return errors.As(err, &validationErr) || errors.As(err, &syntaxErr) || errors.Is(err, errWrongResource) ||
+		errors.Is(err, data.ErrNotFound) || data.IsConstraintViolation(err)
+}
+
+// webhookOutcome is the result of an attempt at processing a webhook.
+type webhookOutcome struct {
+	eventName string // Event the webhook was dispatched on, or "" if it had none.
+	status    string // Status recorded in the archive, one of the data.Webhook status constants, or "" to keep the recorded one.
+	code      int    // HTTP status Lemon Squeezy is answered with.
+	message   string // Response body.
+	err       error  // Why the attempt failed, or nil.
+}
+
+// archivedHeaders returns the request headers to archive with a webhook. Credentials are left out.
+func archivedHeaders(header http.Header) map[string]string {
+	headers := map[string]string{}
+	for name, values := range header {
+		if name == "Authorization" || name == "Cookie" || len(values) == 0 {
+			continue
+		}
+		headers[name] = values[0]
+	}
+	return headers
+}
+
+// lemonSqueezyWebhook receives every Lemon Squeezy webhook and dispatches it on its event name.
+func (app *Config) lemonSqueezyWebhook(c echo.Context) error {
+	return app.receiveWebhook(c, "")
+}
+
+// legacyWebhook returns the handler of a route from before /webhooks/lemonsqueezy, when each event
+// had a route of its own. Every request to it is handled as eventName.
+//
+// Deprecated: point the Lemon Squeezy webhook at /webhooks/lemonsqueezy; these routes will be removed.
+func (app *Config) legacyWebhook(eventName string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return app.receiveWebhook(c, eventName)
+	}
+}
+
+// receiveWebhook archives a webhook request, whose signature has been verified, and processes it.
+// Retries of a delivery are archived as the same webhook, so its archived status is that of the latest attempt.
+// eventName is the event the route is for, or "" to read it from the request.
+// If the request can't be archived it is answered with 500, so Lemon Squeezy retries it.
+func (app *Config) receiveWebhook(c echo.Context, eventName string) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to read webhook"+err.Error())
+		return c.JSON(http.StatusBadRequest, "failed to read webhook")
+	}
+	ctx := c.Request().Context()
+	headers := archivedHeaders(c.Request().Header)
+	id, err := app.Models.Archive.Add(ctx, data.ArchivedWebhook{EventName: eventName, Headers: headers}, body)
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to archive webhook"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "failed to process webhook")
+	}
+	outcome := app.processWebhook(ctx, id, eventName, headers["X-Event-Name"], body, false)
+	return c.JSON(outcome.code, outcome.message)
+}
+
+// processWebhook runs the archived webhook id with the given body through the pipeline and records the outcome in the archive.
+//
+// eventName is the event to dispatch the webhook on, or "" to use meta.event_name, which is signed.
+// The X-Event-Name header is only used when the body has none, and a webhook whose header names a
+// different event is rejected. A replay of a webhook that was processed before reprocesses it; the
+// delivery key that stops retries of Lemon Squeezy from being processed twice doesn't apply to it.
+func (app *Config) processWebhook(ctx context.Context, id int64, eventName, header string, body []byte, replay bool) webhookOutcome {
+	var outcome webhookOutcome
+	if eventName == "" {
+		eventName, outcome = resolveEventName(body, header)
+	}
+	if outcome.err != nil {
+		outcome = app.rejectWebhook(ctx, id, eventName, body, outcome.code, outcome.err, "", nil)
+	} else {
+		outcome = app.dispatchWebhook(ctx, id, eventName, body, replay)
+	}
+	outcome.eventName = eventName
+	// Dead letters are recorded in the transaction that rejects them, and a duplicate keeps the outcome of the delivery it repeats.
+	if outcome.status != "" && outcome.status != data.WebhookDeadLettered {
+		reason := ""
+		if outcome.err != nil {
+			reason = outcome.err.Error()
+		}
+		if err := app.Models.Archive.SetStatus(ctx, id, eventName, outcome.status, reason); err != nil {
+			app.Producer.publishMessage("key", "Payment Service", "Failed to record the outcome of webhook "+strconv.FormatInt(id, 10)+err.Error())
+		}
+	}
+	return outcome
+}
+
+// resolveEventName returns the event name of a webhook for the new endpoint. If it has none, the
+// returned outcome holds the error and the status to answer with.
+func resolveEventName(body []byte, header string) (string, webhookOutcome) {
+	eventName, err := data.WebhookEventName(body)
+	switch {
+	case err != nil:
+		return header, webhookOutcome{code: http.StatusBadRequest, err: fmt.Errorf("invalid webhook body: %w", err)}
+	case eventName == "" && header == "":
+		return "", webhookOutcome{code: http.StatusBadRequest, err: errors.New("webhook has no event name")}
+	case eventName == "":
+		return header, webhookOutcome{}
+	case header != "" && header != eventName:
+		return eventName, webhookOutcome{code: http.StatusBadRequest, err: fmt.Errorf("X-Event-Name %s does not match meta.event_name", header)}
+	}
+	return eventName, webhookOutcome{}
+}
+
+// dispatchWebhook runs the handler registered for eventName on the archived webhook id.
+//
+// The handler runs in one transaction with the recording of the delivery key, so a delivery that
+// Lemon Squeezy retries, or that arrives at both the new and a legacy route, is processed once and
+// acknowledged without side effects after that. Webhooks older than the stored subscription are
+// recorded in its history but otherwise ignored. Webhooks that fail permanently are dead-lettered
+// and acknowledged, and those that fail transiently are answered with 500 so Lemon Squeezy retries them.
+func (app *Config) dispatchWebhook(ctx context.Context, id int64, eventName string, body []byte, replay bool) webhookOutcome {
+	handler, ok := app.webhookHandlers()[eventName]
+	if !ok {
+		app.Producer.publishMessage("key", "Payment Service", "Ignoring unhandled webhook event "+eventName)
+		return webhookOutcome{status: data.WebhookIgnored, code: http.StatusOK, message: "event ignored"}
+	}
+	webhook, err := data.ParseWebhook(body)
+	if err == nil && webhook.Type != handler.resource {
+		err = fmt.Errorf("%w: %s webhook carries %s, want %s", errWrongResource, eventName, webhook.Type, handler.resource)
+	}
+	if err != nil {
+		// A body that doesn't parse won't parse on a retry either.
+		return app.rejectWebhook(ctx, id, eventName, body, http.StatusOK, fmt.Errorf("invalid %s webhook: %w", eventName, err), "", nil)
+	}
+	// Legacy routes name the event in the path; it wins over the body so they keep working as before.
+	webhook.EventName = eventName
+
+	stale := false
+	err = app.Models.RunInTx(ctx, func(tx data.Models) error {
+		stale = false
+		if err := recordDelivery(ctx, tx, eventName, body, replay); err != nil {
+			return err
+		}
+		err := handler.handle(ctx, tx, body, webhook)
+		if errors.Is(err, errStaleEvent) {
+			// Commit the delivery and the history, but nothing else.
+			stale = true
+			return nil
+		}
+		return err
+	})
+	switch {
+	case errors.Is(err, data.ErrDuplicate):
+		app.Producer.publishMessage("key", "Payment Service", "Ignoring duplicate delivery of "+eventName+" webhook for "+webhook.ID)
+		return webhookOutcome{code: http.StatusOK, message: "duplicate delivery ignored"}
+	case err != nil && isPermanent(err):
+		var payment *data.Payment
+		if handler.failureMail != "" && !replay { // The user was told when the webhook first failed.
+			payment, _ = webhook.Payment()
+		}
+		return app.rejectWebhook(ctx, id, eventName, body, http.StatusOK, err, handler.failureMail, payment)
+	case err != nil:
+		app.Producer.publishMessage("key", "Payment Service", "Failed to process "+eventName+" webhook, asking for a retry: "+err.Error())
+		return webhookOutcome{status: data.WebhookFailed, code: http.StatusInternalServerError, message: "failed to process webhook", err: err}
+	case stale:
+		app.Producer.publishMessage("key", "Payment Service", "Ignoring stale "+eventName+" webhook for subscription "+webhook.ID)
+		return webhookOutcome{status: data.WebhookStale, code: http.StatusOK, message: "stale event ignored"}
+	}
+	app.Producer.publishMessage("key", "Payment Service", "Processed "+eventName+" webhook")
+	return webhookOutcome{status: data.WebhookProcessed, code: http.StatusOK, message: "event processed"}
+}
+
+// recordDelivery records the delivery key of a webhook in the transaction of tx, or returns
+// data.ErrDuplicate if it was already processed. Replays are processed even if it was.
+func recordDelivery(ctx context.Context, tx data.Models, eventName string, body []byte, replay bool) error {
+	err := tx.Deliveries.Record(ctx, data.WebhookDeliveryKey(eventName, body))
+	if replay && errors.Is(err, data.ErrDuplicate) {
+		return nil
+	}
+	return err
+}
+
+// rejectWebhook dead-letters the archived webhook id, which failed permanently with reason, and answers
+// it with code. If failureMail is set, the subscription service is told that payment failed.
+//
+// The delivery key is recorded with the dead letter, so a retry of the webhook is answered the same
+// way without being dead-lettered twice. If the dead letter can't be recorded the webhook is answered
+// with 500 instead, so Lemon Squeezy retries it and it isn't lost.
+func (app *Config) rejectWebhook(ctx context.Context, id int64, eventName string, body []byte, code int, reason error, failureMail string, payment *data.Payment) webhookOutcome {
+	app.Producer.publishMessage("key", "Payment Service", "Dead-lettering "+eventName+" webhook: "+reason.Error())
+	err := app.Models.RunInTx(ctx, func(tx data.Models) error {
+		if err := tx.Deliveries.Record(ctx, data.WebhookDeliveryKey(eventName, body)); err != nil && !errors.Is(err, data.ErrDuplicate) {
+			return err
+		}
+		if err := tx.Archive.SetStatus(ctx, id, eventName, data.WebhookDeadLettered, reason.Error()); err != nil {
+			return err
+		}
+		if failureMail == "" || payment == nil {
+			return nil
+		}
+		return notifySubscription(ctx, tx, failureMail, "failed", payment)
+	})
+	if err != nil {
+		app.Producer.publishMessage("key", "Payment Service", "Failed to dead-letter "+eventName+" webhook"+err.Error())
+		return webhookOutcome{status: data.WebhookFailed, code: http.StatusInternalServerError, message: "failed to process webhook", err: err}
+	}
+	return webhookOutcome{status: data.WebhookDeadLettered, code: code, message: "webhook rejected: " + reason.Error(), err: reason}
+}
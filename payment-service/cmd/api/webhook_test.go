@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"payment-service/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The webhook handlers are unexported, so unlike the tests in test/unit_test this one lives in package main.
+
+// readFixture returns the Lemon Squeezy webhook fixture with the given name from test/unit_test/testdata.
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("..", "..", "test", "unit_test", "testdata", "lemonsqueezy", name+".json"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	return string(body)
+}
+
+// handleWebhooks runs the handler of each webhook in bodies in a transaction of its own, like the webhook route.
+func handleWebhooks(t *testing.T, models data.Models, bodies ...string) {
+	t.Helper()
+	ctx := context.Background()
+	handlers := (&Config{Models: models}).webhookHandlers()
+	for _, body := range bodies {
+		webhook, err := data.ParseWebhook([]byte(body))
+		if err != nil {
+			t.Fatalf("ParseWebhook() error = %v", err)
+		}
+		err = models.RunInTx(ctx, func(tx data.Models) error {
+			return handlers[webhook.EventName].handle(ctx, tx, []byte(body), webhook)
+		})
+		if err != nil {
+			t.Fatalf("%s handler error = %v", webhook.EventName, err)
+		}
+	}
+}
+
+// claimNotifications claims the notifications in the outbox of models that weren't claimed yet.
+func claimNotifications(t *testing.T, models data.Models) []data.SubscriptionNotification {
+	t.Helper()
+	events, err := models.Outbox.Claim(context.Background(), 100, time.Minute)
+	if err != nil {
+		t.Fatalf("Claim() error = %v", err)
+	}
+	var notifications []data.SubscriptionNotification
+	for _, event := range events {
+		var n data.SubscriptionNotification
+		if err := json.Unmarshal(event.Payload, &n); err != nil {
+			t.Fatalf("failed to decode notification: %v", err)
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications
+}
+
+func TestSubscriptionUpdatedKeepsStatus(t *testing.T) {
+	created := readFixture(t, "subscription_created")
+	updated := strings.Replace(created, `"event_name": "subscription_created"`, `"event_name": "subscription_updated"`, 1)
+	updated = strings.Replace(updated, `"updated_at": "2024-01-01T00:00:00.000000Z"`, `"updated_at": "2024-01-02T00:00:00.000000Z"`, 1)
+
+	models := data.NewMemoryModels()
+	handleWebhooks(t, models, created, updated)
+
+	notifications := claimNotifications(t, models)
+	found := false
+	for _, n := range notifications {
+		if n.MailType != "success update" {
+			continue
+		}
+		found = true
+		// The subscription service stores this status as the user's, and grants no plan for anything but active ones.
+		if n.SubscriptionStatus != "active" || n.VariantID != 101 {
+			t.Errorf("subscription_updated notification = %+v, want status active and variant 101", n)
+		}
+	}
+	if !found {
+		t.Fatalf("no success update notification among %d events", len(notifications))
+	}
+}
+
+func TestInvoiceKeepsSubscriptionStatus(t *testing.T) {
+	paid := readFixture(t, "subscription_payment_success")
+	refunded := strings.Replace(paid, `"event_name": "subscription_payment_success"`, `"event_name": "subscription_payment_refunded"`, 1)
+	refunded = strings.Replace(refunded, `"status": "paid"`, `"status": "refunded"`, 1)
+
+	models := data.NewMemoryModels()
+	handleWebhooks(t, models, readFixture(t, "subscription_created"), paid, refunded)
+
+	// The invoice's status is not the subscription's: a refunded invoice leaves the subscription active.
+	invoices := 0
+	for _, n := range claimNotifications(t, models) {
+		if n.MailType != "payment success" && n.MailType != "refunded" {
+			continue
+		}
+		invoices++
+		if n.SubscriptionStatus != "active" {
+			t.Errorf("%s notification status = %q, want the subscription's status active", n.MailType, n.SubscriptionStatus)
+		}
+	}
+	if invoices != 2 {
+		t.Fatalf("got %d invoice notifications, want 2", invoices)
+	}
+}
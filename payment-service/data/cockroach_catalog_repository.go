@@ -0,0 +1,109 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// CockroachCatalogRepository implements CatalogRepository on top of the products and variants tables.
+type CockroachCatalogRepository struct {
+	db DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+}
+
+// NewCockroachCatalogRepository creates a CatalogRepository that reads and writes the products and variants tables.
+func NewCockroachCatalogRepository(db DB) *CockroachCatalogRepository {
+	return &CockroachCatalogRepository{db: db}
+}
+
+// variantColumns are the columns of variants in the order scanVariant reads them.
+const variantColumns = `id, product_id, name, slug, description, status, price_amount, currency, is_subscription,
+    billing_interval, billing_interval_count, has_free_trial, trial_interval, trial_interval_count, sort, updated_at, synced_at, deleted_at`
+
+// Sync upserts products and variants with synced_at set to syncedAt, then marks the rows an earlier sync wrote as deleted.
+func (r *CockroachCatalogRepository) Sync(ctx context.Context, products []Product, variants []Variant, syncedAt time.Time) error {
+	for _, p := range products {
+		query := `
+        INSERT INTO products (id, store_id, name, slug, description, status, buy_now_url, updated_at, synced_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        ON CONFLICT (id) DO UPDATE SET store_id = excluded.store_id, name = excluded.name, slug = excluded.slug,
+            description = excluded.description, status = excluded.status, buy_now_url = excluded.buy_now_url,
+            updated_at = excluded.updated_at, synced_at = excluded.synced_at, deleted_at = NULL`
+		if _, err := r.db.Exec(ctx, query, p.ID, p.StoreID, p.Name, p.Slug, p.Description, p.Status, p.BuyNowURL, p.UpdatedAt, syncedAt); err != nil {
+			return fmt.Errorf("storing product %d: %w", p.ID, err)
+		}
+	}
+	for _, v := range variants {
+		query := `
+        INSERT INTO variants (id, product_id, name, slug, description, status, price_amount, currency, is_subscription,
+            billing_interval, billing_interval_count, has_free_trial, trial_interval, trial_interval_count, sort, updated_at, synced_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+        ON CONFLICT (id) DO UPDATE SET product_id = excluded.product_id, name = excluded.name, slug = excluded.slug,
+            description = excluded.description, status = excluded.status, price_amount = excluded.price_amount,
+            currency = excluded.currency, is_subscription = excluded.is_subscription, billing_interval = excluded.billing_interval,
+            billing_interval_count = excluded.billing_interval_count, has_free_trial = excluded.has_free_trial,
+            trial_interval = excluded.trial_interval, trial_interval_count = excluded.trial_interval_count, sort = excluded.sort,
+            updated_at = excluded.updated_at, synced_at = excluded.synced_at, deleted_at = NULL`
+		_, err := r.db.Exec(ctx, query, v.ID, v.ProductID, v.Name, v.Slug, v.Description, v.Status, v.Price.Amount, v.Price.Currency,
+			v.IsSubscription, v.Interval, v.IntervalCount, v.HasFreeTrial, v.TrialInterval, v.TrialIntervalCount, v.Sort, v.UpdatedAt, syncedAt)
+		if err != nil {
+			return fmt.Errorf("storing variant %d: %w", v.ID, err)
+		}
+	}
+	if _, err := r.db.Exec(ctx, `UPDATE variants SET deleted_at = $1 WHERE synced_at < $1 AND deleted_at IS NULL`, syncedAt); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(ctx, `UPDATE products SET deleted_at = $1 WHERE synced_at < $1 AND deleted_at IS NULL`, syncedAt)
+	return err
+}
+
+// ListPlans returns the published products with their variants on sale.
+func (r *CockroachCatalogRepository) ListPlans(ctx context.Context) ([]Plan, error) {
+	query := `
+    SELECT p.id, p.store_id, p.name, p.slug, p.description, p.status, p.buy_now_url, p.updated_at, p.synced_at,
+        v.id, v.product_id, v.name, v.slug, v.description, v.status, v.price_amount, v.currency, v.is_subscription,
+        v.billing_interval, v.billing_interval_count, v.has_free_trial, v.trial_interval, v.trial_interval_count, v.sort, v.updated_at, v.synced_at
+    FROM products p JOIN variants v ON v.product_id = p.id
+    WHERE p.status = 'published' AND p.deleted_at IS NULL AND v.status IN ('published', 'pending') AND v.deleted_at IS NULL
+    ORDER BY p.name, p.id, v.sort, v.id`
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []Plan{}
+	for rows.Next() {
+		var p Product
+		var v Variant
+		err := rows.Scan(&p.ID, &p.StoreID, &p.Name, &p.Slug, &p.Description, &p.Status, &p.BuyNowURL, &p.UpdatedAt, &p.SyncedAt,
+			&v.ID, &v.ProductID, &v.Name, &v.Slug, &v.Description, &v.Status, &v.Price.Amount, &v.Price.Currency, &v.IsSubscription,
+			&v.Interval, &v.IntervalCount, &v.HasFreeTrial, &v.TrialInterval, &v.TrialIntervalCount, &v.Sort, &v.UpdatedAt, &v.SyncedAt)
+		if err != nil {
+			return nil, err
+		}
+		if len(plans) == 0 || plans[len(plans)-1].ID != p.ID {
+			plans = append(plans, Plan{Product: p})
+		}
+		plans[len(plans)-1].Variants = append(plans[len(plans)-1].Variants, v)
+	}
+	return plans, rows.Err()
+}
+
+// GetVariant fetches a variant by ID, deleted or not.
+func (r *CockroachCatalogRepository) GetVariant(ctx context.Context, id int64) (*Variant, error) {
+	var v Variant
+	err := r.db.QueryRow(ctx, `SELECT `+variantColumns+` FROM variants WHERE id = $1`, id).Scan(
+		&v.ID, &v.ProductID, &v.Name, &v.Slug, &v.Description, &v.Status, &v.Price.Amount, &v.Price.Currency, &v.IsSubscription,
+		&v.Interval, &v.IntervalCount, &v.HasFreeTrial, &v.TrialInterval, &v.TrialIntervalCount, &v.Sort, &v.UpdatedAt, &v.SyncedAt, &v.DeletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no variant with id %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
@@ -0,0 +1,250 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// paymentColumns lists the columns read for every payment lookup.
+// Payments written before card_last_four was encrypted still have it in the plaintext column.
+const paymentColumns = `id, customer_id, COALESCE(user_id, 0), subscription_id, order_id, status, variant_name, variant_id, product_id, product_name,
+    card_brand, COALESCE(card_last_four_ciphertext, card_last_four), COALESCE(currency, ''), subtotal_amount, discount_amount, tax_amount, total_amount,
+    user_name, user_email, renews_at, created_at, updated_at, version, COALESCE(subscription_item_id, 0), trial_ends_at`
+
+// cardLastFourColumn is the associated data of card_last_four ciphertexts.
+const cardLastFourColumn = "payments.card_last_four"
+
+// CockroachPaymentRepository implements PaymentRepository on top of a CockroachDB connection pool.
+// The last four digits of the card are encrypted with the key ring.
+type CockroachPaymentRepository struct {
+	db   DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+	keys *KeyRing
+}
+
+// NewCockroachPaymentRepository creates a PaymentRepository that reads and writes the payments table.
+func NewCockroachPaymentRepository(db DB, keys *KeyRing) *CockroachPaymentRepository {
+	return &CockroachPaymentRepository{db: db, keys: keys}
+}
+
+// scanPayment scans a row selected with paymentColumns into a Payment and decrypts card_last_four.
+// pgx.ErrNoRows is translated into ErrNotFound.
+func (r *CockroachPaymentRepository) scanPayment(row pgx.Row) (*Payment, error) {
+	var p Payment
+	var currency string
+	err := row.Scan(&p.ID, &p.CustomerID, &p.UserID, &p.SubscriptionID, &p.OrderID, &p.Status, &p.VariantName, &p.VariantID, &p.ProductID, &p.ProductName,
+		&p.CardBrand, &p.CardLastFour, &currency, &p.Subtotal.Amount, &p.Discount.Amount, &p.Tax.Amount, &p.Total.Amount,
+		&p.UserName, &p.UserEmail, &p.RenewsAt, &p.CreatedAt, &p.UpdatedAt, &p.Version, &p.SubscriptionItemID, &p.TrialEndsAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.CardLastFour, err = r.keys.Decrypt(cardLastFourColumn, p.CardLastFour); err != nil {
+		return nil, err
+	}
+	p.setCurrency(currency)
+	return &p, nil
+}
+
+// encryptCardLastFour checks and encrypts the last four digits of the card.
+// The database can't check the length of the encrypted value, so it is checked here.
+func (r *CockroachPaymentRepository) encryptCardLastFour(cardLastFour string) (string, error) {
+	if len(cardLastFour) != 4 {
+		return "", constraintViolation("violates check constraint on card_last_four")
+	}
+	return r.keys.Encrypt(cardLastFourColumn, cardLastFour)
+}
+
+// CreatePayment updated to include new fields
+func (r *CockroachPaymentRepository) CreatePayment(ctx context.Context, p Payment) (int64, error) {
+	var id int64 // Variable to store the ID of the created payment
+	cardLastFour, err := r.encryptCardLastFour(p.CardLastFour)
+	if err != nil {
+		return 0, err
+	}
+	currency, err := p.currency()
+	if err != nil {
+		return 0, err
+	}
+	query := `
+    INSERT INTO payments (customer_id, subscription_id, order_id, status, variant_name, variant_id, product_id, product_name, card_brand, card_last_four_ciphertext,
+        currency, subtotal_amount, discount_amount, tax_amount, total_amount, user_name, user_email, renews_at, created_at, updated_at, user_id, subscription_item_id, trial_ends_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), $12, $13, $14, $15, $16, $17, $18, $19, $20, NULLIF($21::INT8, 0), NULLIF($22::INT8, 0), $23)
+    RETURNING id;`
+
+	err = r.db.QueryRow(ctx, query,
+		p.CustomerID, p.SubscriptionID, p.OrderID, p.Status, p.VariantName, p.VariantID, p.ProductID, p.ProductName, p.CardBrand, cardLastFour,
+		currency, p.Subtotal.Amount, p.Discount.Amount, p.Tax.Amount, p.Total.Amount, p.UserName, p.UserEmail, p.RenewsAt, p.CreatedAt, p.UpdatedAt, p.UserID, p.SubscriptionItemID, p.TrialEndsAt).Scan(&id)
+	if err != nil {
+		log.Printf("Failed to create payment: %v", err)
+		return 0, err // Return 0 for the ID in case of an error
+	}
+	return id, nil // Return the ID of the created payment and nil for the error
+}
+
+// GetPaymentByID updated to include new fields
+func (r *CockroachPaymentRepository) GetPaymentByID(ctx context.Context, id int64) (*Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE id = $1;`
+
+	p, err := r.scanPayment(r.db.QueryRow(ctx, query, id))
+	if errors.Is(err, ErrNotFound) {
+		// Custom error message when no rows are found
+		return nil, fmt.Errorf("%w: no payment found with the given ID", ErrNotFound)
+	}
+	if err != nil {
+		log.Printf("Failed to get payment by ID: %v", err)
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetPaymentBySubscriptionID retrieves a payment record based on the subscription ID.
+func (r *CockroachPaymentRepository) GetPaymentBySubscriptionID(ctx context.Context, subscriptionID string) (*Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE subscription_id = $1;`
+
+	p, err := r.scanPayment(r.db.QueryRow(ctx, query, subscriptionID))
+	if errors.Is(err, ErrNotFound) {
+		// Custom error message when no rows are found
+		return nil, fmt.Errorf("%w: no payment found with the given SubscriptionID", ErrNotFound)
+	}
+	if err != nil {
+		log.Printf("Failed to get payment by SubscriptionID: %v", err)
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetLatestPaymentByUserID retrieves the most recently created payment of a subscription-service user.
+func (r *CockroachPaymentRepository) GetLatestPaymentByUserID(ctx context.Context, userID int64) (*Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT 1;`
+
+	p, err := r.scanPayment(r.db.QueryRow(ctx, query, userID))
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: no payment found for the given user", ErrNotFound)
+	}
+	if err != nil {
+		log.Printf("Failed to get payment by user ID: %v", err)
+		return nil, err
+	}
+	return p, nil
+}
+
+// UpdatePayment updated to include new fields
+// updated_at is set to p.UpdatedAt, the time Lemon Squeezy updated the subscription, or to now if it is zero.
+// Every update increments the payment's version. If p.Version is set, the row is only updated if it still has that version.
+// It returns ErrNotFound if no payment has the ID p.ID, and ErrConflict if the version does not match.
+func (r *CockroachPaymentRepository) UpdatePayment(ctx context.Context, p Payment) error {
+	cardLastFour, err := r.encryptCardLastFour(p.CardLastFour)
+	if err != nil {
+		return err
+	}
+	currency, err := p.currency()
+	if err != nil {
+		return err
+	}
+	updatedAt := p.UpdatedAt
+	if updatedAt.IsZero() {
+		updatedAt = time.Now()
+	}
+	query := `
+    UPDATE payments
+    SET customer_id = $2, subscription_id = $3, order_id = $4, status = $5, variant_name = $6, variant_id = $7, product_id = $8, product_name = $9, card_brand = $10, card_last_four_ciphertext = $11, card_last_four = NULL,
+        currency = NULLIF($12, ''), subtotal_amount = $13, discount_amount = $14, tax_amount = $15, total_amount = $16, user_name = $17, user_email = $18, renews_at = $19, updated_at = $20, version = version + 1,
+        user_id = NULLIF($22::INT8, 0), subscription_item_id = NULLIF($23::INT8, 0), trial_ends_at = $24
+    WHERE id = $1 AND ($21::INT8 = 0 OR version = $21);`
+
+	result, err := r.db.Exec(ctx, query, p.ID, p.CustomerID, p.SubscriptionID, p.OrderID, p.Status, p.VariantName, p.VariantID, p.ProductID, p.ProductName, p.CardBrand, cardLastFour,
+		currency, p.Subtotal.Amount, p.Discount.Amount, p.Tax.Amount, p.Total.Amount, p.UserName, p.UserEmail, p.RenewsAt, updatedAt, p.Version, p.UserID, p.SubscriptionItemID, p.TrialEndsAt)
+	if err != nil {
+		log.Printf("Failed to update payment: %v", err)
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return r.notUpdated(ctx, p.ID)
+	}
+	return nil
+}
+
+// ListRenewing retrieves the payments of active subscriptions renewing in the range, using the index on renews_at.
+func (r *CockroachPaymentRepository) ListRenewing(ctx context.Context, from, to time.Time) ([]Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments
+    WHERE status = 'active' AND renews_at > $1 AND renews_at <= $2
+    ORDER BY renews_at, id;`
+	rows, err := r.db.Query(ctx, query, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		p, err := r.scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, *p)
+	}
+	return payments, rows.Err()
+}
+
+// notUpdated explains why an update of the payment with the given ID matched no rows:
+// ErrNotFound if the payment does not exist, otherwise ErrConflict because its version changed.
+func (r *CockroachPaymentRepository) notUpdated(ctx context.Context, id int64) error {
+	var version int64
+	err := r.db.QueryRow(ctx, `SELECT version FROM payments WHERE id = $1;`, id).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: no payment found with id %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: payment %d is at version %d", ErrConflict, id, version)
+}
+
+// Reencrypt rewrites up to batchSize payments whose card_last_four is not encrypted with the active
+// key, and returns how many it rewrote. Call it until it returns 0 after adding a key to the ring and
+// making it active. Re-encryption doesn't change the payment, so it doesn't increment the version;
+// a payment updated while it is being re-encrypted is skipped and picked up by a later call.
+func (r *CockroachPaymentRepository) Reencrypt(ctx context.Context, batchSize int) (int, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments
+    WHERE card_last_four_ciphertext IS NULL OR card_last_four_ciphertext NOT LIKE $1
+    LIMIT $2;`
+	rows, err := r.db.Query(ctx, query, r.keys.ActivePrefix()+"%", batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var payments []*Payment
+	for rows.Next() {
+		p, err := r.scanPayment(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		payments = append(payments, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, p := range payments {
+		cardLastFour, err := r.keys.Encrypt(cardLastFourColumn, p.CardLastFour)
+		if err != nil {
+			return rewritten, err
+		}
+		result, err := r.db.Exec(ctx, `UPDATE payments SET card_last_four_ciphertext = $1, card_last_four = NULL WHERE id = $2 AND version = $3;`,
+			cardLastFour, p.ID, p.Version)
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += int(result.RowsAffected())
+	}
+	return rewritten, nil
+}
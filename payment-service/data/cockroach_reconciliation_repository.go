@@ -0,0 +1,83 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// CockroachReconciliationRepository implements ReconciliationRepository on top of the reconciliation_runs
+// and reconciliation_issues tables.
+type CockroachReconciliationRepository struct {
+	db DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+}
+
+// NewCockroachReconciliationRepository creates a ReconciliationRepository that reads and writes the reconciliation tables.
+func NewCockroachReconciliationRepository(db DB) *CockroachReconciliationRepository {
+	return &CockroachReconciliationRepository{db: db}
+}
+
+// SaveRun inserts the run and then its issues. Call it in a transaction so a run is never stored without its issues.
+func (r *CockroachReconciliationRepository) SaveRun(ctx context.Context, run ReconciliationRun) (int64, error) {
+	query := `
+    INSERT INTO reconciliation_runs (started_at, finished_at, subscriptions, corrected, flagged, error)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    RETURNING id`
+	var id int64
+	err := r.db.QueryRow(ctx, query, run.StartedAt, run.FinishedAt, run.Subscriptions, run.Corrected, run.Flagged, run.Error).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	for _, issue := range run.Issues {
+		query := `
+        INSERT INTO reconciliation_issues (run_id, subscription_id, user_id, kind, detail, corrected)
+        VALUES ($1, $2, $3, $4, $5, $6)`
+		if _, err := r.db.Exec(ctx, query, id, issue.SubscriptionID, issue.UserID, issue.Kind, issue.Detail, issue.Corrected); err != nil {
+			return 0, fmt.Errorf("storing issue of subscription %s: %w", issue.SubscriptionID, err)
+		}
+	}
+	return id, nil
+}
+
+// GetRun fetches a run by ID with its issues.
+func (r *CockroachReconciliationRepository) GetRun(ctx context.Context, id int64) (*ReconciliationRun, error) {
+	return r.getRun(ctx, `WHERE id = $1`, id)
+}
+
+// LatestRun fetches the run with the latest started_at with its issues.
+func (r *CockroachReconciliationRepository) LatestRun(ctx context.Context) (*ReconciliationRun, error) {
+	return r.getRun(ctx, `ORDER BY started_at DESC, id DESC LIMIT 1`)
+}
+
+func (r *CockroachReconciliationRepository) getRun(ctx context.Context, where string, args ...interface{}) (*ReconciliationRun, error) {
+	query := `SELECT id, started_at, finished_at, subscriptions, corrected, flagged, error FROM reconciliation_runs ` + where
+	var run ReconciliationRun
+	err := r.db.QueryRow(ctx, query, args...).Scan(&run.ID, &run.StartedAt, &run.FinishedAt, &run.Subscriptions, &run.Corrected, &run.Flagged, &run.Error)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no reconciliation run", ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+    SELECT id, run_id, subscription_id, user_id, kind, detail, corrected
+    FROM reconciliation_issues WHERE run_id = $1 ORDER BY id`
+	rows, err := r.db.Query(ctx, query, run.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	run.Issues = []ReconciliationIssue{}
+	for rows.Next() {
+		var issue ReconciliationIssue
+		if err := rows.Scan(&issue.ID, &issue.RunID, &issue.SubscriptionID, &issue.UserID, &issue.Kind, &issue.Detail, &issue.Corrected); err != nil {
+			return nil, err
+		}
+		run.Issues = append(run.Issues, issue)
+	}
+	return &run, rows.Err()
+}
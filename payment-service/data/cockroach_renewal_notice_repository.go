@@ -0,0 +1,56 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// CockroachRenewalNoticeRepository implements RenewalNoticeRepository on top of the renewal_notices table.
+type CockroachRenewalNoticeRepository struct {
+	db DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+}
+
+// NewCockroachRenewalNoticeRepository creates a RenewalNoticeRepository that reads and writes the renewal_notices table.
+func NewCockroachRenewalNoticeRepository(db DB) *CockroachRenewalNoticeRepository {
+	return &CockroachRenewalNoticeRepository{db: db}
+}
+
+// Record inserts n unless the primary key already holds a notice for its subscription, renewal and window.
+func (r *CockroachRenewalNoticeRepository) Record(ctx context.Context, n RenewalNotice) (bool, error) {
+	sentAt := n.SentAt
+	if sentAt.IsZero() {
+		sentAt = time.Now()
+	}
+	query := `
+    INSERT INTO renewal_notices (subscription_id, renews_at, days_before, sent_at)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (subscription_id, renews_at, days_before) DO NOTHING`
+	result, err := r.db.Exec(ctx, query, n.SubscriptionID, n.RenewsAt, n.DaysBefore, sentAt)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// ListNotices fetches the notices of a subscription.
+func (r *CockroachRenewalNoticeRepository) ListNotices(ctx context.Context, subscriptionID string) ([]RenewalNotice, error) {
+	query := `
+    SELECT subscription_id, renews_at, days_before, sent_at
+    FROM renewal_notices WHERE subscription_id = $1
+    ORDER BY sent_at, renews_at, days_before DESC`
+	rows, err := r.db.Query(ctx, query, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notices := []RenewalNotice{}
+	for rows.Next() {
+		var n RenewalNotice
+		if err := rows.Scan(&n.SubscriptionID, &n.RenewsAt, &n.DaysBefore, &n.SentAt); err != nil {
+			return nil, err
+		}
+		notices = append(notices, n)
+	}
+	return notices, rows.Err()
+}
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// webhookPayloadColumn is the associated data of webhook body ciphertexts.
+const webhookPayloadColumn = "webhook_payloads.body"
+
+// CockroachSubscriptionEventRepository implements SubscriptionEventRepository on top of the
+// subscription_events and webhook_payloads tables. Webhook bodies contain card and customer
+// details, so they are encrypted with the key ring like the payments columns.
+type CockroachSubscriptionEventRepository struct {
+	db   DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+	keys *KeyRing
+}
+
+// NewCockroachSubscriptionEventRepository creates a SubscriptionEventRepository that reads and writes the subscription_events table.
+func NewCockroachSubscriptionEventRepository(db DB, keys *KeyRing) *CockroachSubscriptionEventRepository {
+	return &CockroachSubscriptionEventRepository{db: db, keys: keys}
+}
+
+// Append records e and its raw webhook body.
+// Parameters:
+// - e: The event; its ID, PayloadDigest and ReceivedAt are ignored.
+// - payload: The raw webhook body the event was parsed from.
+// Returns:
+// - The generated ID of the event.
+// - An error if the body can't be encrypted or a query fails.
+func (r *CockroachSubscriptionEventRepository) Append(ctx context.Context, e SubscriptionEvent, payload []byte) (int64, error) {
+	digest, err := storeWebhookPayload(ctx, r.db, r.keys, payload)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	query := `
+    INSERT INTO subscription_events (subscription_id, event_name, status_before, status_after, payload_digest)
+    VALUES ($1, $2, $3, $4, $5)
+    RETURNING id`
+	err = r.db.QueryRow(ctx, query, e.SubscriptionID, e.EventName, e.StatusBefore, e.StatusAfter, digest).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// storeWebhookPayload encrypts a raw webhook body into the webhook_payloads table and returns its digest.
+// A redelivered webhook has the same body; the first copy is kept.
+func storeWebhookPayload(ctx context.Context, db DB, keys *KeyRing, payload []byte) (string, error) {
+	digest := payloadDigest(payload)
+	body, err := keys.Encrypt(webhookPayloadColumn, string(payload))
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(ctx, `INSERT INTO webhook_payloads (digest, body) VALUES ($1, $2) ON CONFLICT (digest) DO NOTHING`, digest, body)
+	if err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// ListBySubscriptionID returns the events of a subscription, oldest first.
+func (r *CockroachSubscriptionEventRepository) ListBySubscriptionID(ctx context.Context, subscriptionID string) ([]SubscriptionEvent, error) {
+	query := `
+    SELECT id, subscription_id, event_name, status_before, status_after, payload_digest, received_at
+    FROM subscription_events WHERE subscription_id = $1
+    ORDER BY received_at, id`
+	rows, err := r.db.Query(ctx, query, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []SubscriptionEvent{}
+	for rows.Next() {
+		var e SubscriptionEvent
+		if err := rows.Scan(&e.ID, &e.SubscriptionID, &e.EventName, &e.StatusBefore, &e.StatusAfter, &e.PayloadDigest, &e.ReceivedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Payload returns the raw webhook body with the given digest.
+func (r *CockroachSubscriptionEventRepository) Payload(ctx context.Context, digest string) ([]byte, error) {
+	var body string
+	err := r.db.QueryRow(ctx, `SELECT body FROM webhook_payloads WHERE digest = $1`, digest).Scan(&body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no webhook payload with digest %s", ErrNotFound, digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, err := r.keys.Decrypt(webhookPayloadColumn, body)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(payload), nil
+}
+
+// Reencrypt rewrites up to batchSize webhook bodies that are not encrypted with the active key
+// and returns how many it rewrote. Bodies never change, so there is no conflict to check for.
+func (r *CockroachSubscriptionEventRepository) Reencrypt(ctx context.Context, batchSize int) (int, error) {
+	rows, err := r.db.Query(ctx, `SELECT digest, body FROM webhook_payloads WHERE body NOT LIKE $1 LIMIT $2`, r.keys.ActivePrefix()+"%", batchSize)
+	if err != nil {
+		return 0, err
+	}
+	bodies := map[string]string{}
+	for rows.Next() {
+		var digest, body string
+		if err := rows.Scan(&digest, &body); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		bodies[digest] = body
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for digest, body := range bodies {
+		payload, err := r.keys.Decrypt(webhookPayloadColumn, body)
+		if err != nil {
+			return rewritten, err
+		}
+		if body, err = r.keys.Encrypt(webhookPayloadColumn, payload); err != nil {
+			return rewritten, err
+		}
+		result, err := r.db.Exec(ctx, `UPDATE webhook_payloads SET body = $1 WHERE digest = $2`, body, digest)
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += int(result.RowsAffected())
+	}
+	return rewritten, nil
+}
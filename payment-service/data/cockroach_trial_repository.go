@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// CockroachTrialRepository implements TrialRepository on top of the trials table.
+type CockroachTrialRepository struct {
+	db DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+}
+
+// NewCockroachTrialRepository creates a TrialRepository that reads and writes the trials table.
+func NewCockroachTrialRepository(db DB) *CockroachTrialRepository {
+	return &CockroachTrialRepository{db: db}
+}
+
+// Track inserts t, or updates the stored trial of its subscription while it has no outcome.
+func (r *CockroachTrialRepository) Track(ctx context.Context, t Trial) error {
+	query := `
+    INSERT INTO trials (subscription_id, user_id, variant_id, variant_name, started_at, ends_at)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (subscription_id) DO UPDATE
+    SET user_id = excluded.user_id, variant_id = excluded.variant_id, variant_name = excluded.variant_name, ends_at = excluded.ends_at
+    WHERE trials.outcome = ''`
+	_, err := r.db.Exec(ctx, query, t.SubscriptionID, t.UserID, t.VariantID, t.VariantName, t.StartedAt, t.EndsAt)
+	return err
+}
+
+// End records the outcome of the trial of a subscription unless it already has one.
+func (r *CockroachTrialRepository) End(ctx context.Context, subscriptionID, outcome string, at time.Time) error {
+	query := `UPDATE trials SET outcome = $2, ended_at = $3 WHERE subscription_id = $1 AND outcome = ''`
+	result, err := r.db.Exec(ctx, query, subscriptionID, outcome, at)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no running trial of subscription %s", ErrNotFound, subscriptionID)
+	}
+	return nil
+}
+
+// GetTrial fetches the trial of a subscription.
+func (r *CockroachTrialRepository) GetTrial(ctx context.Context, subscriptionID string) (*Trial, error) {
+	query := `
+    SELECT subscription_id, user_id, variant_id, variant_name, started_at, ends_at, outcome, ended_at
+    FROM trials WHERE subscription_id = $1`
+	var t Trial
+	err := r.db.QueryRow(ctx, query, subscriptionID).Scan(&t.SubscriptionID, &t.UserID, &t.VariantID, &t.VariantName, &t.StartedAt, &t.EndsAt, &t.Outcome, &t.EndedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no trial of subscription %s", ErrNotFound, subscriptionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Stats counts the trials started in the range per variant, using the index on started_at.
+func (r *CockroachTrialRepository) Stats(ctx context.Context, from, to time.Time) ([]TrialStats, error) {
+	query := `
+    SELECT variant_id, (array_agg(variant_name ORDER BY started_at DESC))[1], count(*),
+        count(*) FILTER (WHERE outcome = 'converted'), count(*) FILTER (WHERE outcome = 'expired')
+    FROM trials WHERE started_at >= $1 AND started_at < $2
+    GROUP BY variant_id ORDER BY variant_id`
+	rows, err := r.db.Query(ctx, query, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []TrialStats{}
+	for rows.Next() {
+		var s TrialStats
+		if err := rows.Scan(&s.VariantID, &s.VariantName, &s.Started, &s.Converted, &s.Expired); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
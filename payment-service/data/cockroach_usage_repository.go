@@ -0,0 +1,152 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// CockroachUsageRepository implements UsageRepository on top of the usage_periods and usage_events tables.
+type CockroachUsageRepository struct {
+	db DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+}
+
+// NewCockroachUsageRepository creates a UsageRepository that reads and writes the usage tables.
+func NewCockroachUsageRepository(db DB) *CockroachUsageRepository {
+	return &CockroachUsageRepository{db: db}
+}
+
+// usagePeriodColumns are the columns of usage_periods in the order scanUsagePeriod reads them.
+const usagePeriodColumns = `subscription_item_id, subscription_id, period_start, period_end, quantity, reported_quantity, reported_at`
+
+func scanUsagePeriod(row pgx.Row) (*UsagePeriod, error) {
+	var p UsagePeriod
+	if err := row.Scan(&p.SubscriptionItemID, &p.SubscriptionID, &p.PeriodStart, &p.PeriodEnd, &p.Quantity, &p.ReportedQuantity, &p.ReportedAt); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// AddPeriod inserts the period unless its primary key is taken.
+func (r *CockroachUsageRepository) AddPeriod(ctx context.Context, p UsagePeriod) error {
+	query := `
+    INSERT INTO usage_periods (subscription_item_id, subscription_id, period_start, period_end)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (subscription_item_id, period_start) DO NOTHING`
+	_, err := r.db.Exec(ctx, query, p.SubscriptionItemID, p.SubscriptionID, p.PeriodStart, p.PeriodEnd)
+	return err
+}
+
+// FindPeriod returns the period of the item that includes at.
+func (r *CockroachUsageRepository) FindPeriod(ctx context.Context, subscriptionItemID int64, at time.Time) (*UsagePeriod, error) {
+	query := `
+    SELECT ` + usagePeriodColumns + ` FROM usage_periods
+    WHERE subscription_item_id = $1 AND period_start <= $2 AND period_end > $2
+    ORDER BY period_start DESC LIMIT 1`
+	p, err := scanUsagePeriod(r.db.QueryRow(ctx, query, subscriptionItemID, at))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no usage period of subscription item %d at %s", ErrNotFound, subscriptionItemID, at.Format(time.RFC3339))
+	}
+	return p, err
+}
+
+// Record inserts the event and adds its quantity to its period. The unique key on the item and idempotency
+// key makes concurrent retries of the same event conflict, so only one of them is counted.
+func (r *CockroachUsageRepository) Record(ctx context.Context, e UsageEvent) (*UsageEvent, error) {
+	query := `
+    INSERT INTO usage_events (subscription_item_id, idempotency_key, subscription_id, quantity, period_start, occurred_at)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (subscription_item_id, idempotency_key) DO NOTHING
+    RETURNING id, received_at`
+	err := r.db.QueryRow(ctx, query, e.SubscriptionItemID, e.IdempotencyKey, e.SubscriptionID, e.Quantity, e.PeriodStart, e.OccurredAt).Scan(&e.ID, &e.ReceivedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		stored, err := r.getEvent(ctx, e.SubscriptionItemID, e.IdempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+		return stored, fmt.Errorf("%w: usage event %s of subscription item %d was already recorded", ErrDuplicate, e.IdempotencyKey, e.SubscriptionItemID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query = `UPDATE usage_periods SET quantity = quantity + $3 WHERE subscription_item_id = $1 AND period_start = $2`
+	if _, err := r.db.Exec(ctx, query, e.SubscriptionItemID, e.PeriodStart, e.Quantity); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (r *CockroachUsageRepository) getEvent(ctx context.Context, subscriptionItemID int64, idempotencyKey string) (*UsageEvent, error) {
+	query := `
+    SELECT id, subscription_item_id, subscription_id, idempotency_key, quantity, period_start, occurred_at, received_at
+    FROM usage_events WHERE subscription_item_id = $1 AND idempotency_key = $2`
+	var e UsageEvent
+	err := r.db.QueryRow(ctx, query, subscriptionItemID, idempotencyKey).Scan(
+		&e.ID, &e.SubscriptionItemID, &e.SubscriptionID, &e.IdempotencyKey, &e.Quantity, &e.PeriodStart, &e.OccurredAt, &e.ReceivedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ListUnreported returns the periods the partial index on period_end covers.
+func (r *CockroachUsageRepository) ListUnreported(ctx context.Context, limit int) ([]UsagePeriod, error) {
+	query := `
+    SELECT ` + usagePeriodColumns + ` FROM usage_periods
+    WHERE quantity > reported_quantity
+    ORDER BY period_end LIMIT $1`
+	rows, err := r.db.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := []UsagePeriod{}
+	for rows.Next() {
+		p, err := scanUsagePeriod(rows)
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, *p)
+	}
+	return periods, rows.Err()
+}
+
+// MarkReported stores the reported quantity unless a larger one is stored.
+func (r *CockroachUsageRepository) MarkReported(ctx context.Context, subscriptionItemID int64, periodStart time.Time, quantity int64, reportedAt time.Time) error {
+	query := `
+    UPDATE usage_periods SET reported_quantity = $3, reported_at = $4
+    WHERE subscription_item_id = $1 AND period_start = $2 AND reported_quantity < $3`
+	_, err := r.db.Exec(ctx, query, subscriptionItemID, periodStart, quantity, reportedAt)
+	return err
+}
+
+// CarryOver marks from reported only if its quantities are still the ones read, so two replicas can't move
+// the same usage twice, and then adds the usage to the target period.
+func (r *CockroachUsageRepository) CarryOver(ctx context.Context, from UsagePeriod, toStart time.Time, reportedAt time.Time) error {
+	result, err := r.db.Exec(ctx, `
+    UPDATE usage_periods SET reported_quantity = quantity, reported_at = $5
+    WHERE subscription_item_id = $1 AND period_start = $2 AND quantity = $3 AND reported_quantity = $4`,
+		from.SubscriptionItemID, from.PeriodStart, from.Quantity, from.ReportedQuantity, reportedAt)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: usage of subscription item %d changed since it was read", ErrConflict, from.SubscriptionItemID)
+	}
+	result, err = r.db.Exec(ctx, `
+    UPDATE usage_periods SET quantity = quantity + $3
+    WHERE subscription_item_id = $1 AND period_start = $2`,
+		from.SubscriptionItemID, toStart, from.Quantity-from.ReportedQuantity)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no period of subscription item %d starts at %s", ErrNotFound, from.SubscriptionItemID, toStart)
+	}
+	return nil
+}
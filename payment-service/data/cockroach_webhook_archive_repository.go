@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// CockroachWebhookArchiveRepository implements WebhookArchiveRepository on top of the webhook_archive table.
+// Bodies are encrypted into webhook_payloads like those of the subscription events.
+type CockroachWebhookArchiveRepository struct {
+	db   DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+	keys *KeyRing
+}
+
+// NewCockroachWebhookArchiveRepository creates a WebhookArchiveRepository that reads and writes the webhook_archive table.
+func NewCockroachWebhookArchiveRepository(db DB, keys *KeyRing) *CockroachWebhookArchiveRepository {
+	return &CockroachWebhookArchiveRepository{db: db, keys: keys}
+}
+
+// archiveColumns are the columns of webhook_archive in the order scanArchivedWebhook reads them.
+const archiveColumns = `id, event_name, headers, payload_digest, status, error, attempts, received_at, processed_at`
+
+// Add records w and its raw body, or replaces the headers of the webhook with the same body, and returns its ID.
+func (r *CockroachWebhookArchiveRepository) Add(ctx context.Context, w ArchivedWebhook, payload []byte) (int64, error) {
+	headers, err := json.Marshal(w.Headers)
+	if err != nil {
+		return 0, err
+	}
+	digest, err := storeWebhookPayload(ctx, r.db, r.keys, payload)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	query := `
+    INSERT INTO webhook_archive (event_name, headers, payload_digest) VALUES ($1, $2::JSONB, $3)
+    ON CONFLICT (payload_digest) DO UPDATE SET headers = excluded.headers
+    RETURNING id`
+	if err := r.db.QueryRow(ctx, query, w.EventName, string(headers), digest).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Get fetches an archived webhook by ID.
+func (r *CockroachWebhookArchiveRepository) Get(ctx context.Context, id int64) (*ArchivedWebhook, error) {
+	w, err := scanArchivedWebhook(r.db.QueryRow(ctx, `SELECT `+archiveColumns+` FROM webhook_archive WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no archived webhook with id %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// List returns the archived webhooks matching f, oldest first.
+func (r *CockroachWebhookArchiveRepository) List(ctx context.Context, f ArchiveFilter) ([]ArchivedWebhook, error) {
+	query := `SELECT ` + archiveColumns + ` FROM webhook_archive WHERE true`
+	var args []interface{}
+	if len(f.Statuses) > 0 {
+		args = append(args, f.Statuses)
+		query += fmt.Sprintf(` AND status = ANY($%d)`, len(args))
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		query += fmt.Sprintf(` AND received_at >= $%d`, len(args))
+	}
+	if !f.To.IsZero() {
+		args = append(args, f.To)
+		query += fmt.Sprintf(` AND received_at < $%d`, len(args))
+	}
+	query += ` ORDER BY received_at, id`
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []ArchivedWebhook{}
+	for rows.Next() {
+		w, err := scanArchivedWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *w)
+	}
+	return webhooks, rows.Err()
+}
+
+// SetStatus records the outcome of an attempt at processing the webhook id.
+func (r *CockroachWebhookArchiveRepository) SetStatus(ctx context.Context, id int64, eventName, status, reason string) error {
+	query := `
+    UPDATE webhook_archive
+    SET event_name = $2, status = $3, error = $4, attempts = attempts + 1, processed_at = now()
+    WHERE id = $1`
+	result, err := r.db.Exec(ctx, query, id, eventName, status, reason)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no archived webhook with id %d", ErrNotFound, id)
+	}
+	return nil
+}
+
+// scanArchivedWebhook reads a row of archiveColumns.
+func scanArchivedWebhook(row pgx.Row) (*ArchivedWebhook, error) {
+	var w ArchivedWebhook
+	var headers []byte
+	var processedAt *time.Time
+	if err := row.Scan(&w.ID, &w.EventName, &headers, &w.PayloadDigest, &w.Status, &w.Error, &w.Attempts, &w.ReceivedAt, &processedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(headers, &w.Headers); err != nil {
+		return nil, err
+	}
+	w.ProcessedAt = processedAt
+	return &w, nil
+}
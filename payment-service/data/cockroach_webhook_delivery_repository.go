@@ -0,0 +1,29 @@
+package data
+
+import (
+	"context"
+	"fmt"
+)
+
+// CockroachWebhookDeliveryRepository implements WebhookDeliveryRepository on top of the webhook_deliveries table.
+type CockroachWebhookDeliveryRepository struct {
+	db DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+}
+
+// NewCockroachWebhookDeliveryRepository creates a WebhookDeliveryRepository that writes the webhook_deliveries table.
+func NewCockroachWebhookDeliveryRepository(db DB) *CockroachWebhookDeliveryRepository {
+	return &CockroachWebhookDeliveryRepository{db: db}
+}
+
+// Record inserts the delivery key. The primary key on event_key makes concurrent deliveries of the
+// same webhook conflict, so only one of their transactions commits.
+func (r *CockroachWebhookDeliveryRepository) Record(ctx context.Context, key string) error {
+	result, err := r.db.Exec(ctx, `INSERT INTO webhook_deliveries (event_key) VALUES ($1) ON CONFLICT (event_key) DO NOTHING;`, key)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: webhook delivery %s was already processed", ErrDuplicate, key)
+	}
+	return nil
+}
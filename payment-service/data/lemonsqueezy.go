@@ -0,0 +1,347 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resource types of the objects Lemon Squeezy sends in the data of a webhook.
+const (
+	ResourceSubscription        = "subscriptions"
+	ResourceSubscriptionInvoice = "subscription-invoices"
+	ResourceOrder               = "orders"
+	ResourceLicenseKey          = "license-keys"
+)
+
+// Webhook is a parsed Lemon Squeezy webhook body.
+// Exactly one of the resource fields is set, the one matching Type.
+type Webhook struct {
+	EventName string // meta.event_name, e.g. subscription_paused.
+	UserID    int64  // meta.custom_data.user_id set by subscription-service's checkout link, or 0.
+	Type      string // data.type, one of the Resource constants.
+	ID        string // data.id, the ID of the resource.
+
+	Subscription        *SubscriptionAttributes        // Set for subscriptions.
+	SubscriptionInvoice *SubscriptionInvoiceAttributes // Set for subscription-invoices.
+	Order               *OrderAttributes               // Set for orders.
+	LicenseKey          *LicenseKeyAttributes          // Set for license-keys.
+}
+
+// SubscriptionAttributes are the attributes of a subscriptions resource.
+type SubscriptionAttributes struct {
+	StoreID      int64      `json:"store_id"`
+	CustomerID   int64      `json:"customer_id"`
+	OrderID      int64      `json:"order_id"`
+	OrderItemID  int64      `json:"order_item_id"`
+	ProductID    int64      `json:"product_id"`
+	VariantID    int64      `json:"variant_id"`
+	ProductName  string     `json:"product_name"`
+	VariantName  string     `json:"variant_name"`
+	UserName     string     `json:"user_name"`
+	UserEmail    string     `json:"user_email"`
+	Status       string     `json:"status"`
+	CardBrand    string     `json:"card_brand"`     // Empty for payment methods without a card.
+	CardLastFour string     `json:"card_last_four"` // Empty for payment methods without a card.
+	Cancelled    bool       `json:"cancelled"`
+	TrialEndsAt  *time.Time `json:"trial_ends_at"`
+	RenewsAt     time.Time  `json:"renews_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	TestMode     bool       `json:"test_mode"`
+
+	// FirstSubscriptionItem is the item usage is reported against, or nil in webhooks without it.
+	FirstSubscriptionItem *SubscriptionItemAttributes `json:"first_subscription_item"`
+}
+
+// SubscriptionItemAttributes are the attributes of the item of a subscription.
+type SubscriptionItemAttributes struct {
+	ID           int64 `json:"id"`
+	PriceID      int64 `json:"price_id"`
+	Quantity     int64 `json:"quantity"`
+	IsUsageBased bool  `json:"is_usage_based"` // Whether the item's price is billed on reported usage.
+}
+
+// SubscriptionInvoiceAttributes are the attributes of a subscription-invoices resource,
+// sent with the subscription_payment_* events. Amounts are in minor units of Currency.
+type SubscriptionInvoiceAttributes struct {
+	StoreID        int64      `json:"store_id"`
+	SubscriptionID int64      `json:"subscription_id"`
+	CustomerID     int64      `json:"customer_id"`
+	UserName       string     `json:"user_name"`
+	UserEmail      string     `json:"user_email"`
+	BillingReason  string     `json:"billing_reason"` // initial or renewal.
+	CardBrand      string     `json:"card_brand"`
+	CardLastFour   string     `json:"card_last_four"`
+	Currency       string     `json:"currency"`
+	Status         string     `json:"status"` // pending, paid, void, refunded or partial_refund.
+	Refunded       bool       `json:"refunded"`
+	RefundedAt     *time.Time `json:"refunded_at"`
+	Subtotal       int64      `json:"subtotal"`
+	DiscountTotal  int64      `json:"discount_total"`
+	Tax            int64      `json:"tax"`
+	Total          int64      `json:"total"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	TestMode       bool       `json:"test_mode"`
+}
+
+// OrderAttributes are the attributes of an orders resource. Amounts are in minor units of Currency.
+type OrderAttributes struct {
+	StoreID        int64  `json:"store_id"`
+	CustomerID     int64  `json:"customer_id"`
+	Identifier     string `json:"identifier"`
+	OrderNumber    int64  `json:"order_number"`
+	UserName       string `json:"user_name"`
+	UserEmail      string `json:"user_email"`
+	Currency       string `json:"currency"`
+	Subtotal       int64  `json:"subtotal"`
+	DiscountTotal  int64  `json:"discount_total"`
+	Tax            int64  `json:"tax"`
+	Total          int64  `json:"total"`
+	Status         string `json:"status"`
+	Refunded       bool   `json:"refunded"`
+	FirstOrderItem struct {
+		ProductID   int64  `json:"product_id"`
+		VariantID   int64  `json:"variant_id"`
+		ProductName string `json:"product_name"`
+		VariantName string `json:"variant_name"`
+		Price       int64  `json:"price"`
+	} `json:"first_order_item"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	TestMode  bool      `json:"test_mode"`
+}
+
+// LicenseKeyAttributes are the attributes of a license-keys resource.
+// The key itself is not decoded; only its last characters are kept.
+type LicenseKeyAttributes struct {
+	StoreID         int64      `json:"store_id"`
+	CustomerID      int64      `json:"customer_id"`
+	OrderID         int64      `json:"order_id"`
+	OrderItemID     int64      `json:"order_item_id"`
+	ProductID       int64      `json:"product_id"`
+	UserName        string     `json:"user_name"`
+	UserEmail       string     `json:"user_email"`
+	KeyShort        string     `json:"key_short"`
+	ActivationLimit *int64     `json:"activation_limit"` // nil for unlimited activations.
+	InstancesCount  int64      `json:"instances_count"`
+	Disabled        bool       `json:"disabled"`
+	Status          string     `json:"status"`
+	ExpiresAt       *time.Time `json:"expires_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	TestMode        bool       `json:"test_mode"`
+}
+
+// FieldError is one problem with a field of a webhook body.
+type FieldError struct {
+	Field   string `json:"field"`   // Path of the field, e.g. data.attributes.renews_at.
+	Problem string `json:"problem"` // What is wrong with it, e.g. "is missing".
+}
+
+// ValidationError is returned by ParseWebhook for a body that is valid JSON but not a valid webhook.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.Field + " " + f.Problem
+	}
+	return "invalid webhook: " + strings.Join(problems, "; ")
+}
+
+// add records a problem with a field.
+func (e *ValidationError) add(field, problem string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Problem: problem})
+}
+
+// require records field as missing if missing is true.
+func (e *ValidationError) require(field string, missing bool) {
+	if missing {
+		e.add(field, "is missing")
+	}
+}
+
+// webhookEnvelope is the part of a webhook body shared by every resource type.
+type webhookEnvelope struct {
+	Meta struct {
+		EventName  string `json:"event_name"`
+		CustomData struct {
+			// Custom data from checkout links arrives as strings and custom data from the API as numbers.
+			UserID json.RawMessage `json:"user_id"`
+		} `json:"custom_data"`
+	} `json:"meta"`
+	Data struct {
+		Type       string          `json:"type"`
+		ID         string          `json:"id"`
+		Attributes json.RawMessage `json:"attributes"`
+	} `json:"data"`
+}
+
+// ParseWebhook parses a Lemon Squeezy webhook body into the typed attributes of its data.type.
+// It returns a *ValidationError listing the missing and mistyped fields if the body is JSON but not
+// a valid webhook of a supported resource type, and the JSON error if it is not JSON at all.
+// Identifiers and amounts are decoded straight into integers, so large values keep every digit.
+func ParseWebhook(body []byte) (*Webhook, error) {
+	var envelope webhookEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, typeError(err, "")
+	}
+	invalid := &ValidationError{}
+	webhook := &Webhook{EventName: envelope.Meta.EventName, Type: envelope.Data.Type, ID: envelope.Data.ID}
+	webhook.UserID = parseCustomUserID(envelope.Meta.CustomData.UserID, invalid)
+	invalid.require("data.id", webhook.ID == "")
+
+	var attributes interface{}
+	switch webhook.Type {
+	case ResourceSubscription:
+		webhook.Subscription = &SubscriptionAttributes{}
+		attributes = webhook.Subscription
+	case ResourceSubscriptionInvoice:
+		webhook.SubscriptionInvoice = &SubscriptionInvoiceAttributes{}
+		attributes = webhook.SubscriptionInvoice
+	case ResourceOrder:
+		webhook.Order = &OrderAttributes{}
+		attributes = webhook.Order
+	case ResourceLicenseKey:
+		webhook.LicenseKey = &LicenseKeyAttributes{}
+		attributes = webhook.LicenseKey
+	case "":
+		invalid.add("data.type", "is missing")
+		return nil, invalid
+	default:
+		invalid.add("data.type", fmt.Sprintf("has unsupported value %q", webhook.Type))
+		return nil, invalid
+	}
+	if len(envelope.Data.Attributes) == 0 || string(envelope.Data.Attributes) == "null" {
+		invalid.add("data.attributes", "is missing")
+		return nil, invalid
+	}
+	if err := json.Unmarshal(envelope.Data.Attributes, attributes); err != nil {
+		return nil, typeError(err, "data.attributes.")
+	}
+
+	switch {
+	case webhook.Subscription != nil:
+		a := webhook.Subscription
+		invalid.require("data.attributes.status", a.Status == "")
+		invalid.require("data.attributes.renews_at", a.RenewsAt.IsZero())
+		invalid.require("data.attributes.created_at", a.CreatedAt.IsZero())
+		invalid.require("data.attributes.updated_at", a.UpdatedAt.IsZero())
+	case webhook.SubscriptionInvoice != nil:
+		a := webhook.SubscriptionInvoice
+		invalid.require("data.attributes.subscription_id", a.SubscriptionID == 0)
+		invalid.require("data.attributes.status", a.Status == "")
+		a.Currency = validateCurrency(a.Currency, invalid)
+		invalid.require("data.attributes.created_at", a.CreatedAt.IsZero())
+		invalid.require("data.attributes.updated_at", a.UpdatedAt.IsZero())
+	case webhook.Order != nil:
+		a := webhook.Order
+		invalid.require("data.attributes.status", a.Status == "")
+		a.Currency = validateCurrency(a.Currency, invalid)
+		invalid.require("data.attributes.created_at", a.CreatedAt.IsZero())
+	case webhook.LicenseKey != nil:
+		invalid.require("data.attributes.created_at", webhook.LicenseKey.CreatedAt.IsZero())
+	}
+	if len(invalid.Fields) > 0 {
+		return nil, invalid
+	}
+	return webhook, nil
+}
+
+// typeError turns a JSON error caused by a value of the wrong type into a ValidationError.
+// prefix is the path of the object that was being decoded. Other errors are returned unchanged.
+func typeError(err error, prefix string) error {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	return &ValidationError{Fields: []FieldError{{Field: prefix + typeErr.Field, Problem: "must be a " + typeErr.Type.String()}}}
+}
+
+// parseCustomUserID decodes meta.custom_data.user_id, given either as a number or as a string holding one.
+func parseCustomUserID(raw json.RawMessage, invalid *ValidationError) int64 {
+	s := strings.Trim(string(raw), `"`)
+	if s == "" || s == "null" {
+		return 0
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		invalid.add("meta.custom_data.user_id", "must be an integer")
+		return 0
+	}
+	return id
+}
+
+// validateCurrency returns currency as an upper case ISO 4217 code, recording a problem if it isn't one.
+func validateCurrency(currency string, invalid *ValidationError) string {
+	if currency == "" {
+		invalid.add("data.attributes.currency", "is missing")
+		return ""
+	}
+	m, err := NewMoney(0, currency)
+	if err != nil {
+		invalid.add("data.attributes.currency", "must be an ISO 4217 code")
+		return currency
+	}
+	return m.Currency
+}
+
+// Payment returns the payment described by a subscriptions webhook.
+// It has no amounts; Lemon Squeezy sends those with the subscription's invoices.
+func (w *Webhook) Payment() (*Payment, error) {
+	if w.Subscription == nil {
+		return nil, fmt.Errorf("%s webhook has a %s, not a subscription", w.EventName, w.Type)
+	}
+	a := w.Subscription
+	payment := &Payment{
+		CustomerID:     a.CustomerID,
+		UserID:         w.UserID,
+		SubscriptionID: w.ID,
+		OrderID:        a.OrderID,
+		Status:         a.Status,
+		VariantName:    a.VariantName,
+		VariantID:      a.VariantID,
+		ProductID:      a.ProductID,
+		ProductName:    a.ProductName,
+		CardBrand:      a.CardBrand,
+		CardLastFour:   a.CardLastFour,
+		UserName:       a.UserName,
+		UserEmail:      a.UserEmail,
+		RenewsAt:       a.RenewsAt,
+		CreatedAt:      a.CreatedAt,
+		UpdatedAt:      a.UpdatedAt,
+		TrialEndsAt:    a.TrialEndsAt,
+	}
+	if a.FirstSubscriptionItem != nil {
+		payment.SubscriptionItemID = a.FirstSubscriptionItem.ID
+	}
+	return payment, nil
+}
+
+// Amounts returns the subtotal, discount, tax and total of the invoice.
+func (a *SubscriptionInvoiceAttributes) Amounts() (subtotal, discount, tax, total Money) {
+	return Money{Amount: a.Subtotal, Currency: a.Currency}, Money{Amount: a.DiscountTotal, Currency: a.Currency},
+		Money{Amount: a.Tax, Currency: a.Currency}, Money{Amount: a.Total, Currency: a.Currency}
+}
+
+// WebhookEventName returns meta.event_name of a Lemon Squeezy webhook body, or "" if the body has none.
+// Unlike the X-Event-Name header, the event name in the body is covered by the webhook signature.
+func WebhookEventName(body []byte) (string, error) {
+	var params struct {
+		Meta struct {
+			EventName string `json:"event_name"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return "", err
+	}
+	return params.Meta.EventName, nil
+}
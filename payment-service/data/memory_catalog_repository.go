@@ -0,0 +1,131 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryCatalogRepository is an in-memory implementation of CatalogRepository.
+// It enforces the same foreign key and currency check as the variants table.
+type MemoryCatalogRepository struct {
+	mu       sync.Mutex
+	products map[int64]Product
+	variants map[int64]Variant
+}
+
+// NewMemoryCatalogRepository creates an empty in-memory catalog.
+func NewMemoryCatalogRepository() *MemoryCatalogRepository {
+	return &MemoryCatalogRepository{products: map[int64]Product{}, variants: map[int64]Variant{}}
+}
+
+// Sync stores products and variants as found at syncedAt and marks the others as deleted.
+func (r *MemoryCatalogRepository) Sync(ctx context.Context, products []Product, variants []Variant, syncedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range products {
+		p.SyncedAt, p.DeletedAt = syncedAt, nil
+		r.products[p.ID] = p
+	}
+	for _, v := range variants {
+		if _, ok := r.products[v.ProductID]; !ok {
+			return constraintViolation(fmt.Sprintf("variant %d references missing product %d", v.ID, v.ProductID))
+		}
+		if !currencyPattern.MatchString(v.Price.Currency) {
+			return constraintViolation("violates check constraint on currency")
+		}
+		v.SyncedAt, v.DeletedAt = syncedAt, nil
+		r.variants[v.ID] = v
+	}
+	deletedAt := syncedAt
+	for id, p := range r.products {
+		if p.SyncedAt.Before(syncedAt) && p.DeletedAt == nil {
+			p.DeletedAt = &deletedAt
+			r.products[id] = p
+		}
+	}
+	for id, v := range r.variants {
+		if v.SyncedAt.Before(syncedAt) && v.DeletedAt == nil {
+			v.DeletedAt = &deletedAt
+			r.variants[id] = v
+		}
+	}
+	return nil
+}
+
+// ListPlans returns the published products with their variants on sale.
+func (r *MemoryCatalogRepository) ListPlans(ctx context.Context) ([]Plan, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byProduct := map[int64][]Variant{}
+	for _, v := range r.variants {
+		if v.onSale() {
+			byProduct[v.ProductID] = append(byProduct[v.ProductID], v)
+		}
+	}
+	plans := []Plan{}
+	for _, p := range r.products {
+		if p.Status != "published" || p.DeletedAt != nil || len(byProduct[p.ID]) == 0 {
+			continue
+		}
+		variants := byProduct[p.ID]
+		sort.Slice(variants, func(i, j int) bool {
+			if variants[i].Sort != variants[j].Sort {
+				return variants[i].Sort < variants[j].Sort
+			}
+			return variants[i].ID < variants[j].ID
+		})
+		plans = append(plans, Plan{Product: p, Variants: variants})
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		if plans[i].Name != plans[j].Name {
+			return plans[i].Name < plans[j].Name
+		}
+		return plans[i].ID < plans[j].ID
+	})
+	return plans, nil
+}
+
+// GetVariant fetches a variant by ID, deleted or not.
+func (r *MemoryCatalogRepository) GetVariant(ctx context.Context, id int64) (*Variant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.variants[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: no variant with id %d", ErrNotFound, id)
+	}
+	return &v, nil
+}
+
+// memoryCatalog is a copy of the catalog for rolling back a transaction.
+type memoryCatalog struct {
+	products map[int64]Product
+	variants map[int64]Variant
+}
+
+// snapshot returns a copy of the products and variants.
+func (r *MemoryCatalogRepository) snapshot() memoryCatalog {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := memoryCatalog{products: make(map[int64]Product, len(r.products)), variants: make(map[int64]Variant, len(r.variants))}
+	for id, p := range r.products {
+		s.products[id] = p
+	}
+	for id, v := range r.variants {
+		s.variants[id] = v
+	}
+	return s
+}
+
+// restore replaces the products and variants with a snapshot.
+func (r *MemoryCatalogRepository) restore(s memoryCatalog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.products, r.variants = s.products, s.variants
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"context"
+	"sync"
+)
+
+// NewMemoryModels creates Models backed by in-memory repositories, for tests.
+func NewMemoryModels() Models {
+	events := NewMemorySubscriptionEventRepository()
+	runner := &memoryTxRunner{
+		payments:   NewMemoryPaymentRepository(),
+		events:     events,
+		deliveries: NewMemoryWebhookDeliveryRepository(),
+		archive:    NewMemoryWebhookArchiveRepository(events),
+		outbox:     NewMemoryOutboxRepository(),
+		catalog:    NewMemoryCatalogRepository(),
+		usage:      NewMemoryUsageRepository(),
+		reports:    NewMemoryReconciliationRepository(),
+		trials:     NewMemoryTrialRepository(),
+		renewals:   NewMemoryRenewalNoticeRepository(),
+	}
+	return Models{Payments: runner.payments, Events: runner.events, Deliveries: runner.deliveries, Archive: runner.archive, Outbox: runner.outbox, Catalog: runner.catalog, Usage: runner.usage, Reports: runner.reports, Trials: runner.trials, Renewals: runner.renewals, tx: runner}
+}
+
+// memoryTxRunner runs Models.RunInTx callbacks one at a time against the in-memory repositories.
+// If a callback fails, every repository is restored to the state it had before the callback started.
+type memoryTxRunner struct {
+	mu         sync.Mutex // mu serializes transactions.
+	payments   *MemoryPaymentRepository
+	events     *MemorySubscriptionEventRepository
+	deliveries *MemoryWebhookDeliveryRepository
+	archive    *MemoryWebhookArchiveRepository
+	outbox     *MemoryOutboxRepository
+	catalog    *MemoryCatalogRepository
+	usage      *MemoryUsageRepository
+	reports    *MemoryReconciliationRepository
+	trials     *MemoryTrialRepository
+	renewals   *MemoryRenewalNoticeRepository
+}
+
+func (r *memoryTxRunner) runInTx(ctx context.Context, fn func(tx Models) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payments, history, deliveries, archive, events, catalog, usage, reports, trials, renewals := r.payments.snapshot(), r.events.snapshot(), r.deliveries.snapshot(), r.archive.snapshot(), r.outbox.snapshot(), r.catalog.snapshot(), r.usage.snapshot(), r.reports.snapshot(), r.trials.snapshot(), r.renewals.snapshot()
+	if err := fn(Models{Payments: r.payments, Events: r.events, Deliveries: r.deliveries, Archive: r.archive, Outbox: r.outbox, Catalog: r.catalog, Usage: r.usage, Reports: r.reports, Trials: r.trials, Renewals: r.renewals, tx: r, inTx: true}); err != nil {
+		r.payments.restore(payments)
+		r.events.restore(history)
+		r.deliveries.restore(deliveries)
+		r.archive.restore(archive)
+		r.outbox.restore(events)
+		r.catalog.restore(catalog)
+		r.usage.restore(usage)
+		r.reports.restore(reports)
+		r.trials.restore(trials)
+		r.renewals.restore(renewals)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Patterns mirroring the CHECK constraints on the payments table.
+var (
+	userNamePattern  = regexp.MustCompile(`^[A-Za-z ]+$`)
+	userEmailPattern = regexp.MustCompile(`(?i)^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$`)
+)
+
+// MemoryPaymentRepository is an in-memory implementation of PaymentRepository.
+// It enforces the same uniqueness and check constraints as the payments table so that
+// tests written against it behave the same way against CockroachDB.
+type MemoryPaymentRepository struct {
+	mu       sync.Mutex
+	payments map[int64]Payment
+	nextID   int64
+}
+
+// NewMemoryPaymentRepository creates an empty in-memory payment repository.
+// IDs start from a large time-based value, like CockroachDB's unique_rowid, so tests can't depend on small sequential IDs.
+func NewMemoryPaymentRepository() *MemoryPaymentRepository {
+	return &MemoryPaymentRepository{
+		payments: map[int64]Payment{},
+		nextID:   time.Now().UnixNano(),
+	}
+}
+
+// CreatePayment stores a new payment and returns the generated ID.
+func (r *MemoryPaymentRepository) CreatePayment(ctx context.Context, p Payment) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	p.ID = r.nextID
+	p.Version = 1
+	if err := r.checkConstraints(p); err != nil {
+		return 0, err
+	}
+	r.payments[p.ID] = p
+	return p.ID, nil
+}
+
+// GetPaymentByID fetches a payment by ID.
+func (r *MemoryPaymentRepository) GetPaymentByID(ctx context.Context, id int64) (*Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.payments[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: no payment found with the given ID", ErrNotFound)
+	}
+	return &p, nil
+}
+
+// GetPaymentBySubscriptionID fetches the payment of a Lemon Squeezy subscription.
+func (r *MemoryPaymentRepository) GetPaymentBySubscriptionID(ctx context.Context, subscriptionID string) (*Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.payments {
+		if p.SubscriptionID == subscriptionID {
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no payment found with the given SubscriptionID", ErrNotFound)
+}
+
+// GetLatestPaymentByUserID returns the user's payment created last, the one with the highest ID among equal times.
+func (r *MemoryPaymentRepository) GetLatestPaymentByUserID(ctx context.Context, userID int64) (*Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var latest *Payment
+	for _, p := range r.payments {
+		if p.UserID != userID || userID == 0 {
+			continue
+		}
+		if latest == nil || p.CreatedAt.After(latest.CreatedAt) || (p.CreatedAt.Equal(latest.CreatedAt) && p.ID > latest.ID) {
+			p := p
+			latest = &p
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("%w: no payment found for the given user", ErrNotFound)
+	}
+	return latest, nil
+}
+
+// UpdatePayment overwrites the stored payment with the ID p.ID and increments its version.
+// A zero UpdatedAt is stored as now.
+// If p.Version is set, the payment must still be at that version.
+func (r *MemoryPaymentRepository) UpdatePayment(ctx context.Context, p Payment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.payments[p.ID]
+	if !ok {
+		return fmt.Errorf("%w: no payment found with id %d", ErrNotFound, p.ID)
+	}
+	if p.Version != 0 && p.Version != existing.Version {
+		return fmt.Errorf("%w: payment %d is at version %d", ErrConflict, p.ID, existing.Version)
+	}
+	p.CreatedAt = existing.CreatedAt // created_at is not part of the update.
+	if p.UpdatedAt.IsZero() {
+		p.UpdatedAt = time.Now()
+	}
+	p.Version = existing.Version + 1
+	if err := r.checkConstraints(p); err != nil {
+		return err
+	}
+	r.payments[p.ID] = p
+	return nil
+}
+
+// ListRenewing returns the payments of active subscriptions renewing in the range, ordered by renews_at and ID.
+func (r *MemoryPaymentRepository) ListRenewing(ctx context.Context, from, to time.Time) ([]Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payments := []Payment{}
+	for _, p := range r.payments {
+		if p.Status == "active" && p.RenewsAt.After(from) && !p.RenewsAt.After(to) {
+			payments = append(payments, p)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		if !payments[i].RenewsAt.Equal(payments[j].RenewsAt) {
+			return payments[i].RenewsAt.Before(payments[j].RenewsAt)
+		}
+		return payments[i].ID < payments[j].ID
+	})
+	return payments, nil
+}
+
+// checkConstraints validates p against the column and uniqueness constraints of the payments table.
+// The caller must hold r.mu.
+func (r *MemoryPaymentRepository) checkConstraints(p Payment) error {
+	switch {
+	case p.SubscriptionID == "":
+		return constraintViolation("null value in column subscription_id")
+	case len(p.Status) > 50:
+		return constraintViolation("value too long for status")
+	case len(p.CardLastFour) != 4: // Checked in Go by CockroachPaymentRepository too, since the column is encrypted.
+		return constraintViolation("violates check constraint on card_last_four")
+	case !userNamePattern.MatchString(p.UserName):
+		return constraintViolation("violates check constraint on user_name")
+	case !userEmailPattern.MatchString(p.UserEmail):
+		return constraintViolation("violates check constraint on user_email")
+	case p.RenewsAt.Before(p.CreatedAt):
+		return constraintViolation("violates check constraint on renews_at")
+	}
+	if _, err := p.currency(); err != nil {
+		return err
+	}
+
+	for id, other := range r.payments {
+		if id != p.ID && other.OrderID == p.OrderID {
+			return constraintViolation("duplicate key value violates unique constraint on order_id")
+		}
+	}
+	return nil
+}
+
+// snapshot returns a copy of the stored payments for rolling back a transaction.
+func (r *MemoryPaymentRepository) snapshot() map[int64]Payment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payments := make(map[int64]Payment, len(r.payments))
+	for id, payment := range r.payments {
+		payments[id] = payment
+	}
+	return payments
+}
+
+// restore replaces the stored payments with a snapshot.
+func (r *MemoryPaymentRepository) restore(payments map[int64]Payment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payments = payments
+}
@@ -0,0 +1,93 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MemoryReconciliationRepository is an in-memory implementation of ReconciliationRepository.
+type MemoryReconciliationRepository struct {
+	mu     sync.Mutex
+	runs   []ReconciliationRun // runs are in the order they were saved.
+	nextID int64
+}
+
+// NewMemoryReconciliationRepository creates an empty in-memory store of reconciliation reports.
+func NewMemoryReconciliationRepository() *MemoryReconciliationRepository {
+	return &MemoryReconciliationRepository{}
+}
+
+// SaveRun stores a copy of the run and its issues.
+func (r *MemoryReconciliationRepository) SaveRun(ctx context.Context, run ReconciliationRun) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	run.ID = r.nextID
+	issues := make([]ReconciliationIssue, len(run.Issues))
+	for i, issue := range run.Issues {
+		r.nextID++
+		issue.ID, issue.RunID = r.nextID, run.ID
+		issues[i] = issue
+	}
+	run.Issues = issues
+	r.runs = append(r.runs, run)
+	return run.ID, nil
+}
+
+// GetRun fetches a run by ID.
+func (r *MemoryReconciliationRepository) GetRun(ctx context.Context, id int64) (*ReconciliationRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, run := range r.runs {
+		if run.ID == id {
+			return copyRun(run), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no reconciliation run with id %d", ErrNotFound, id)
+}
+
+// LatestRun fetches the run that started last, the one saved last among those that started at the same time.
+func (r *MemoryReconciliationRepository) LatestRun(ctx context.Context) (*ReconciliationRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var latest *ReconciliationRun
+	for i := range r.runs {
+		if latest == nil || !r.runs[i].StartedAt.Before(latest.StartedAt) {
+			latest = &r.runs[i]
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("%w: no reconciliation run", ErrNotFound)
+	}
+	return copyRun(*latest), nil
+}
+
+// copyRun returns a copy of run that doesn't share its issues.
+func copyRun(run ReconciliationRun) *ReconciliationRun {
+	run.Issues = append([]ReconciliationIssue{}, run.Issues...)
+	return &run
+}
+
+// memoryReconciliation is a copy of the reports for rolling back a transaction.
+type memoryReconciliation struct {
+	runs   []ReconciliationRun
+	nextID int64
+}
+
+// snapshot returns a copy of the runs.
+func (r *MemoryReconciliationRepository) snapshot() memoryReconciliation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return memoryReconciliation{runs: append([]ReconciliationRun(nil), r.runs...), nextID: r.nextID}
+}
+
+// restore replaces the runs with a snapshot.
+func (r *MemoryReconciliationRepository) restore(s memoryReconciliation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs, r.nextID = s.runs, s.nextID
+}
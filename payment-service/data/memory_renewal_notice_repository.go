@@ -0,0 +1,91 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// renewalNoticeKey identifies a notice the way the primary key of renewal_notices does.
+type renewalNoticeKey struct {
+	subscriptionID string
+	renewsAt       int64 // renewsAt is in Unix nanoseconds, so equal times in different locations match.
+	daysBefore     int
+}
+
+// MemoryRenewalNoticeRepository is an in-memory implementation of RenewalNoticeRepository.
+type MemoryRenewalNoticeRepository struct {
+	mu      sync.Mutex
+	notices map[renewalNoticeKey]RenewalNotice
+}
+
+// NewMemoryRenewalNoticeRepository creates an empty in-memory store of renewal notices.
+func NewMemoryRenewalNoticeRepository() *MemoryRenewalNoticeRepository {
+	return &MemoryRenewalNoticeRepository{notices: map[renewalNoticeKey]RenewalNotice{}}
+}
+
+// Record stores n unless a notice with the same subscription, renewal and window is stored.
+func (r *MemoryRenewalNoticeRepository) Record(ctx context.Context, n RenewalNotice) (bool, error) {
+	if n.SubscriptionID == "" {
+		return false, constraintViolation("null value in column subscription_id")
+	}
+	if n.DaysBefore <= 0 {
+		return false, constraintViolation("violates check constraint on days_before")
+	}
+	if n.SentAt.IsZero() {
+		n.SentAt = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := renewalNoticeKey{n.SubscriptionID, n.RenewsAt.UnixNano(), n.DaysBefore}
+	if _, ok := r.notices[key]; ok {
+		return false, nil
+	}
+	r.notices[key] = n
+	return true, nil
+}
+
+// ListNotices returns the notices of a subscription.
+func (r *MemoryRenewalNoticeRepository) ListNotices(ctx context.Context, subscriptionID string) ([]RenewalNotice, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	notices := []RenewalNotice{}
+	for _, n := range r.notices {
+		if n.SubscriptionID == subscriptionID {
+			notices = append(notices, n)
+		}
+	}
+	sort.Slice(notices, func(i, j int) bool {
+		a, b := notices[i], notices[j]
+		if !a.SentAt.Equal(b.SentAt) {
+			return a.SentAt.Before(b.SentAt)
+		}
+		if !a.RenewsAt.Equal(b.RenewsAt) {
+			return a.RenewsAt.Before(b.RenewsAt)
+		}
+		return a.DaysBefore > b.DaysBefore
+	})
+	return notices, nil
+}
+
+// snapshot returns a copy of the notices.
+func (r *MemoryRenewalNoticeRepository) snapshot() map[renewalNoticeKey]RenewalNotice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := make(map[renewalNoticeKey]RenewalNotice, len(r.notices))
+	for k, n := range r.notices {
+		s[k] = n
+	}
+	return s
+}
+
+// restore replaces the notices with a snapshot.
+func (r *MemoryRenewalNoticeRepository) restore(s map[renewalNoticeKey]RenewalNotice) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notices = s
+}
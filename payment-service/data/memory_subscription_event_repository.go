@@ -0,0 +1,96 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemorySubscriptionEventRepository is an in-memory implementation of SubscriptionEventRepository.
+type MemorySubscriptionEventRepository struct {
+	mu       sync.Mutex
+	events   []SubscriptionEvent
+	payloads map[string][]byte
+	nextID   int64
+}
+
+// NewMemorySubscriptionEventRepository creates an empty in-memory event history.
+func NewMemorySubscriptionEventRepository() *MemorySubscriptionEventRepository {
+	return &MemorySubscriptionEventRepository{payloads: map[string][]byte{}}
+}
+
+// Append records e and its raw webhook body and returns the generated ID.
+func (r *MemorySubscriptionEventRepository) Append(ctx context.Context, e SubscriptionEvent, payload []byte) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e.PayloadDigest = r.storePayload(payload)
+	r.nextID++
+	e.ID = r.nextID
+	e.ReceivedAt = time.Now()
+	r.events = append(r.events, e)
+	return e.ID, nil
+}
+
+// storePayload stores a raw webhook body unless it is already stored and returns its digest.
+// The caller must hold r.mu.
+func (r *MemorySubscriptionEventRepository) storePayload(payload []byte) string {
+	digest := payloadDigest(payload)
+	if _, ok := r.payloads[digest]; !ok {
+		r.payloads[digest] = append([]byte(nil), payload...)
+	}
+	return digest
+}
+
+// ListBySubscriptionID returns the events of a subscription, oldest first.
+func (r *MemorySubscriptionEventRepository) ListBySubscriptionID(ctx context.Context, subscriptionID string) ([]SubscriptionEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := []SubscriptionEvent{}
+	for _, e := range r.events {
+		if e.SubscriptionID == subscriptionID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// Payload returns the raw webhook body with the given digest.
+func (r *MemorySubscriptionEventRepository) Payload(ctx context.Context, digest string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payload, ok := r.payloads[digest]
+	if !ok {
+		return nil, fmt.Errorf("%w: no webhook payload with digest %s", ErrNotFound, digest)
+	}
+	return payload, nil
+}
+
+// memoryEventSnapshot is the state of a MemorySubscriptionEventRepository saved for rolling back a transaction.
+type memoryEventSnapshot struct {
+	events   []SubscriptionEvent
+	payloads map[string][]byte
+	nextID   int64
+}
+
+// snapshot returns a copy of the stored events for rolling back a transaction.
+func (r *MemorySubscriptionEventRepository) snapshot() memoryEventSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payloads := make(map[string][]byte, len(r.payloads))
+	for digest, payload := range r.payloads {
+		payloads[digest] = payload
+	}
+	return memoryEventSnapshot{events: append([]SubscriptionEvent(nil), r.events...), payloads: payloads, nextID: r.nextID}
+}
+
+// restore replaces the stored events with a snapshot.
+func (r *MemorySubscriptionEventRepository) restore(s memoryEventSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events, r.payloads, r.nextID = s.events, s.payloads, s.nextID
+}
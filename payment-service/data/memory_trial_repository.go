@@ -0,0 +1,121 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryTrialRepository is an in-memory implementation of TrialRepository.
+type MemoryTrialRepository struct {
+	mu     sync.Mutex
+	trials map[string]Trial // trials are keyed by subscription ID.
+}
+
+// NewMemoryTrialRepository creates an empty in-memory store of trials.
+func NewMemoryTrialRepository() *MemoryTrialRepository {
+	return &MemoryTrialRepository{trials: map[string]Trial{}}
+}
+
+// Track stores t, or updates the stored trial of its subscription while it has no outcome.
+func (r *MemoryTrialRepository) Track(ctx context.Context, t Trial) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.trials[t.SubscriptionID]
+	if !ok {
+		t.Outcome, t.EndedAt = "", nil
+		r.trials[t.SubscriptionID] = t
+		return nil
+	}
+	if stored.Outcome == "" {
+		stored.UserID, stored.VariantID, stored.VariantName, stored.EndsAt = t.UserID, t.VariantID, t.VariantName, t.EndsAt
+		r.trials[t.SubscriptionID] = stored
+	}
+	return nil
+}
+
+// End records the outcome of the trial of a subscription.
+func (r *MemoryTrialRepository) End(ctx context.Context, subscriptionID, outcome string, at time.Time) error {
+	if outcome != TrialConverted && outcome != TrialExpired {
+		return constraintViolation("violates check constraint on outcome")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.trials[subscriptionID]
+	if !ok || t.Outcome != "" {
+		return fmt.Errorf("%w: no running trial of subscription %s", ErrNotFound, subscriptionID)
+	}
+	t.Outcome, t.EndedAt = outcome, &at
+	r.trials[subscriptionID] = t
+	return nil
+}
+
+// GetTrial fetches the trial of a subscription.
+func (r *MemoryTrialRepository) GetTrial(ctx context.Context, subscriptionID string) (*Trial, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.trials[subscriptionID]
+	if !ok {
+		return nil, fmt.Errorf("%w: no trial of subscription %s", ErrNotFound, subscriptionID)
+	}
+	return &t, nil
+}
+
+// Stats counts the trials started in the range per variant.
+func (r *MemoryTrialRepository) Stats(ctx context.Context, from, to time.Time) ([]TrialStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byVariant := map[int64]*TrialStats{}
+	latest := map[int64]time.Time{}
+	for _, t := range r.trials {
+		if t.StartedAt.Before(from) || !t.StartedAt.Before(to) {
+			continue
+		}
+		s, ok := byVariant[t.VariantID]
+		if !ok {
+			s = &TrialStats{VariantID: t.VariantID}
+			byVariant[t.VariantID] = s
+		}
+		if !t.StartedAt.Before(latest[t.VariantID]) {
+			s.VariantName, latest[t.VariantID] = t.VariantName, t.StartedAt
+		}
+		s.Started++
+		switch t.Outcome {
+		case TrialConverted:
+			s.Converted++
+		case TrialExpired:
+			s.Expired++
+		}
+	}
+	stats := []TrialStats{}
+	for _, s := range byVariant {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].VariantID < stats[j].VariantID })
+	return stats, nil
+}
+
+// snapshot returns a copy of the trials.
+func (r *MemoryTrialRepository) snapshot() map[string]Trial {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := make(map[string]Trial, len(r.trials))
+	for k, t := range r.trials {
+		s[k] = t
+	}
+	return s
+}
+
+// restore replaces the trials with a snapshot.
+func (r *MemoryTrialRepository) restore(s map[string]Trial) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trials = s
+}
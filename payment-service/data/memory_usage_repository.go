@@ -0,0 +1,179 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryUsageKey identifies a usage period, or a usage event when idempotencyKey is set.
+type memoryUsageKey struct {
+	subscriptionItemID int64
+	periodStart        time.Time
+	idempotencyKey     string
+}
+
+// MemoryUsageRepository is an in-memory implementation of UsageRepository.
+// It enforces the same checks and foreign key as the usage tables.
+type MemoryUsageRepository struct {
+	mu      sync.Mutex
+	periods map[memoryUsageKey]UsagePeriod
+	events  map[memoryUsageKey]UsageEvent
+	nextID  int64
+}
+
+// NewMemoryUsageRepository creates an empty in-memory usage store.
+func NewMemoryUsageRepository() *MemoryUsageRepository {
+	return &MemoryUsageRepository{periods: map[memoryUsageKey]UsagePeriod{}, events: map[memoryUsageKey]UsageEvent{}}
+}
+
+func periodKey(subscriptionItemID int64, periodStart time.Time) memoryUsageKey {
+	return memoryUsageKey{subscriptionItemID: subscriptionItemID, periodStart: periodStart.UTC()}
+}
+
+// AddPeriod stores the period unless one of the same item starting at the same time is stored.
+func (r *MemoryUsageRepository) AddPeriod(ctx context.Context, p UsagePeriod) error {
+	if !p.PeriodEnd.After(p.PeriodStart) {
+		return constraintViolation("violates check constraint on period_end")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := periodKey(p.SubscriptionItemID, p.PeriodStart)
+	if _, ok := r.periods[key]; !ok {
+		r.periods[key] = UsagePeriod{SubscriptionItemID: p.SubscriptionItemID, SubscriptionID: p.SubscriptionID, PeriodStart: p.PeriodStart, PeriodEnd: p.PeriodEnd}
+	}
+	return nil
+}
+
+// FindPeriod returns the period of the item that includes at.
+func (r *MemoryUsageRepository) FindPeriod(ctx context.Context, subscriptionItemID int64, at time.Time) (*UsagePeriod, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var found *UsagePeriod
+	for _, p := range r.periods {
+		if p.SubscriptionItemID != subscriptionItemID || p.PeriodStart.After(at) || !p.PeriodEnd.After(at) {
+			continue
+		}
+		if found == nil || p.PeriodStart.After(found.PeriodStart) {
+			p := p
+			found = &p
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: no usage period of subscription item %d at %s", ErrNotFound, subscriptionItemID, at.Format(time.RFC3339))
+	}
+	return found, nil
+}
+
+// Record stores the event and adds its quantity to its period.
+func (r *MemoryUsageRepository) Record(ctx context.Context, e UsageEvent) (*UsageEvent, error) {
+	if len(e.IdempotencyKey) < 1 || len(e.IdempotencyKey) > 255 {
+		return nil, constraintViolation("violates check constraint on idempotency_key")
+	}
+	if e.Quantity <= 0 {
+		return nil, constraintViolation("violates check constraint on quantity")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	eventKey := memoryUsageKey{subscriptionItemID: e.SubscriptionItemID, idempotencyKey: e.IdempotencyKey}
+	if stored, ok := r.events[eventKey]; ok {
+		return &stored, fmt.Errorf("%w: usage event %s of subscription item %d was already recorded", ErrDuplicate, e.IdempotencyKey, e.SubscriptionItemID)
+	}
+	key := periodKey(e.SubscriptionItemID, e.PeriodStart)
+	period, ok := r.periods[key]
+	if !ok {
+		return nil, constraintViolation(fmt.Sprintf("usage event references missing period of subscription item %d", e.SubscriptionItemID))
+	}
+
+	r.nextID++
+	e.ID, e.ReceivedAt = r.nextID, time.Now()
+	r.events[eventKey] = e
+	period.Quantity += e.Quantity
+	r.periods[key] = period
+	return &e, nil
+}
+
+// ListUnreported returns the periods that have unreported usage, the ones ending first first.
+func (r *MemoryUsageRepository) ListUnreported(ctx context.Context, limit int) ([]UsagePeriod, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	periods := []UsagePeriod{}
+	for _, p := range r.periods {
+		if p.Quantity > p.ReportedQuantity {
+			periods = append(periods, p)
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].PeriodEnd.Before(periods[j].PeriodEnd) })
+	if len(periods) > limit {
+		periods = periods[:limit]
+	}
+	return periods, nil
+}
+
+// MarkReported stores the reported quantity unless a larger one is stored.
+func (r *MemoryUsageRepository) MarkReported(ctx context.Context, subscriptionItemID int64, periodStart time.Time, quantity int64, reportedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := periodKey(subscriptionItemID, periodStart)
+	if p, ok := r.periods[key]; ok && p.ReportedQuantity < quantity {
+		p.ReportedQuantity, p.ReportedAt = quantity, &reportedAt
+		r.periods[key] = p
+	}
+	return nil
+}
+
+// CarryOver moves the unreported usage of from into the period starting at toStart, if from is unchanged.
+func (r *MemoryUsageRepository) CarryOver(ctx context.Context, from UsagePeriod, toStart time.Time, reportedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fromKey, toKey := periodKey(from.SubscriptionItemID, from.PeriodStart), periodKey(from.SubscriptionItemID, toStart)
+	stored, ok := r.periods[fromKey]
+	if !ok || stored.Quantity != from.Quantity || stored.ReportedQuantity != from.ReportedQuantity {
+		return fmt.Errorf("%w: usage of subscription item %d changed since it was read", ErrConflict, from.SubscriptionItemID)
+	}
+	to, ok := r.periods[toKey]
+	if !ok {
+		return fmt.Errorf("%w: no period of subscription item %d starts at %s", ErrNotFound, from.SubscriptionItemID, toStart)
+	}
+	to.Quantity += from.Quantity - from.ReportedQuantity
+	stored.ReportedQuantity, stored.ReportedAt = stored.Quantity, &reportedAt
+	r.periods[toKey], r.periods[fromKey] = to, stored
+	return nil
+}
+
+// memoryUsage is a copy of the usage for rolling back a transaction.
+type memoryUsage struct {
+	periods map[memoryUsageKey]UsagePeriod
+	events  map[memoryUsageKey]UsageEvent
+	nextID  int64
+}
+
+// snapshot returns a copy of the periods and events.
+func (r *MemoryUsageRepository) snapshot() memoryUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := memoryUsage{periods: make(map[memoryUsageKey]UsagePeriod, len(r.periods)), events: make(map[memoryUsageKey]UsageEvent, len(r.events)), nextID: r.nextID}
+	for k, p := range r.periods {
+		s.periods[k] = p
+	}
+	for k, e := range r.events {
+		s.events[k] = e
+	}
+	return s
+}
+
+// restore replaces the periods and events with a snapshot.
+func (r *MemoryUsageRepository) restore(s memoryUsage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.periods, r.events, r.nextID = s.periods, s.events, s.nextID
+}
@@ -0,0 +1,133 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryWebhookArchiveRepository is an in-memory implementation of WebhookArchiveRepository.
+type MemoryWebhookArchiveRepository struct {
+	mu       sync.Mutex
+	webhooks []ArchivedWebhook
+	nextID   int64
+	events   *MemorySubscriptionEventRepository // events stores the bodies, as webhook_payloads does.
+}
+
+// NewMemoryWebhookArchiveRepository creates an empty in-memory archive that keeps bodies in events.
+func NewMemoryWebhookArchiveRepository(events *MemorySubscriptionEventRepository) *MemoryWebhookArchiveRepository {
+	return &MemoryWebhookArchiveRepository{events: events}
+}
+
+// Add records w and its raw body, or replaces the headers of the webhook with the same body, and returns its ID.
+func (r *MemoryWebhookArchiveRepository) Add(ctx context.Context, w ArchivedWebhook, payload []byte) (int64, error) {
+	r.events.mu.Lock()
+	digest := r.events.storePayload(payload)
+	r.events.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	headers := make(map[string]string, len(w.Headers))
+	for name, value := range w.Headers {
+		headers[name] = value
+	}
+	for i := range r.webhooks {
+		if r.webhooks[i].PayloadDigest == digest {
+			r.webhooks[i].Headers = headers
+			return r.webhooks[i].ID, nil
+		}
+	}
+	r.nextID++
+	r.webhooks = append(r.webhooks, ArchivedWebhook{
+		ID:            r.nextID,
+		EventName:     w.EventName,
+		Headers:       headers,
+		PayloadDigest: digest,
+		Status:        WebhookReceived,
+		ReceivedAt:    time.Now(),
+	})
+	return r.nextID, nil
+}
+
+// Get fetches an archived webhook by ID.
+func (r *MemoryWebhookArchiveRepository) Get(ctx context.Context, id int64) (*ArchivedWebhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, w := range r.webhooks {
+		if w.ID == id {
+			return &w, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no archived webhook with id %d", ErrNotFound, id)
+}
+
+// List returns the archived webhooks matching f, oldest first.
+func (r *MemoryWebhookArchiveRepository) List(ctx context.Context, f ArchiveFilter) ([]ArchivedWebhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	webhooks := []ArchivedWebhook{}
+	for _, w := range r.webhooks {
+		if f.Limit > 0 && len(webhooks) == f.Limit {
+			break
+		}
+		if len(f.Statuses) > 0 && !containsString(f.Statuses, w.Status) {
+			continue
+		}
+		if (!f.From.IsZero() && w.ReceivedAt.Before(f.From)) || (!f.To.IsZero() && !w.ReceivedAt.Before(f.To)) {
+			continue
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, nil
+}
+
+// SetStatus records the outcome of an attempt at processing the webhook id.
+func (r *MemoryWebhookArchiveRepository) SetStatus(ctx context.Context, id int64, eventName, status, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.webhooks {
+		if r.webhooks[i].ID == id {
+			now := time.Now()
+			w := &r.webhooks[i]
+			w.EventName, w.Status, w.Error, w.ProcessedAt = eventName, status, reason, &now
+			w.Attempts++
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no archived webhook with id %d", ErrNotFound, id)
+}
+
+// containsString reports whether values contains s.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryArchiveSnapshot is the state of a MemoryWebhookArchiveRepository saved for rolling back a transaction.
+type memoryArchiveSnapshot struct {
+	webhooks []ArchivedWebhook
+	nextID   int64
+}
+
+// snapshot returns a copy of the archive for rolling back a transaction.
+// The bodies are part of the snapshot of events.
+func (r *MemoryWebhookArchiveRepository) snapshot() memoryArchiveSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return memoryArchiveSnapshot{webhooks: append([]ArchivedWebhook(nil), r.webhooks...), nextID: r.nextID}
+}
+
+// restore replaces the archive with a snapshot.
+func (r *MemoryWebhookArchiveRepository) restore(s memoryArchiveSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.webhooks, r.nextID = s.webhooks, s.nextID
+}
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MemoryWebhookDeliveryRepository is an in-memory implementation of WebhookDeliveryRepository.
+type MemoryWebhookDeliveryRepository struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// NewMemoryWebhookDeliveryRepository creates an empty in-memory record of processed deliveries.
+func NewMemoryWebhookDeliveryRepository() *MemoryWebhookDeliveryRepository {
+	return &MemoryWebhookDeliveryRepository{keys: map[string]bool{}}
+}
+
+// Record marks the delivery with the given key as processed, or returns ErrDuplicate if it already was.
+func (r *MemoryWebhookDeliveryRepository) Record(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.keys[key] {
+		return fmt.Errorf("%w: webhook delivery %s was already processed", ErrDuplicate, key)
+	}
+	r.keys[key] = true
+	return nil
+}
+
+// snapshot returns a copy of the recorded keys for rolling back a transaction.
+func (r *MemoryWebhookDeliveryRepository) snapshot() map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make(map[string]bool, len(r.keys))
+	for key := range r.keys {
+		keys[key] = true
+	}
+	return keys
+}
+
+// restore replaces the recorded keys with a snapshot.
+func (r *MemoryWebhookDeliveryRepository) restore(keys map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+}
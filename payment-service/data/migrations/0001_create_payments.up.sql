@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS payments (
+    id SERIAL PRIMARY KEY,
+    customer_id FLOAT NOT NULL,
+    subscription_id VARCHAR(255) NOT NULL,
+    order_id FLOAT UNIQUE NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    variant_name VARCHAR(255),
+    variant_id FLOAT NOT NULL,
+    product_id FLOAT NOT NULL,
+    product_name VARCHAR(255),
+    card_brand VARCHAR(50),
+    card_last_four CHAR(4) NOT NULL CHECK (LENGTH(card_last_four) = 4),
+    user_name VARCHAR(255) NOT NULL CHECK (user_name <> '' AND user_name ~ '^[A-Za-z ]+$'),
+    user_email VARCHAR(255) NOT NULL CHECK (user_email <> '' AND user_email ~* '^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$'),
+    renews_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (renews_at >= created_at)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS payment_outbox (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    event_type VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    attempts INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ,
+    published_at TIMESTAMPTZ,
+    last_error TEXT,
+    INDEX payment_outbox_pending_idx (created_at) WHERE published_at IS NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS version INT8 NOT NULL DEFAULT 1;
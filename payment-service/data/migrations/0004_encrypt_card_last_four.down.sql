@@ -0,0 +1,7 @@
+-- The plaintext of encrypted card_last_four values is gone, and the database can't decrypt them, so
+-- rolling back while any are left would lose them. Refuse until they have been decrypted into
+-- card_last_four and their ciphertext cleared.
+SELECT crdb_internal.force_error('55000', 'cannot roll back 0004_encrypt_card_last_four: payments have an encrypted card_last_four; decrypt them into card_last_four and clear card_last_four_ciphertext first')
+FROM payments WHERE card_last_four_ciphertext IS NOT NULL LIMIT 1;
+ALTER TABLE payments ALTER COLUMN card_last_four SET NOT NULL;
+ALTER TABLE payments DROP COLUMN IF EXISTS card_last_four_ciphertext;
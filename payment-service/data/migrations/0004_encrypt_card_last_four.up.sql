@@ -0,0 +1,5 @@
+-- card_last_four moves to an encrypted column. Changing the type of the CHAR(4) column would
+-- rewrite the table, so the ciphertext gets a column of its own and the plaintext column is
+-- cleared as payments are written or re-encrypted.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS card_last_four_ciphertext STRING;
+ALTER TABLE payments ALTER COLUMN card_last_four DROP NOT NULL;
@@ -0,0 +1,9 @@
+ALTER TABLE payments DROP COLUMN IF EXISTS product_id_int;
+ALTER TABLE payments DROP COLUMN IF EXISTS variant_id_int;
+ALTER TABLE payments DROP COLUMN IF EXISTS order_id_int;
+ALTER TABLE payments DROP COLUMN IF EXISTS customer_id_int;
+ALTER TABLE payments DROP COLUMN IF EXISTS total_amount;
+ALTER TABLE payments DROP COLUMN IF EXISTS tax_amount;
+ALTER TABLE payments DROP COLUMN IF EXISTS discount_amount;
+ALTER TABLE payments DROP COLUMN IF EXISTS subtotal_amount;
+ALTER TABLE payments DROP COLUMN IF EXISTS currency;
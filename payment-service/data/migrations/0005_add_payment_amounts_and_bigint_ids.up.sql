@@ -0,0 +1,13 @@
+-- Amounts are in the minor unit of the currency, as Lemon Squeezy sends them.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS currency STRING CHECK (currency ~ '^[A-Z]{3}$');
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS subtotal_amount INT8 NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS discount_amount INT8 NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS tax_amount INT8 NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS total_amount INT8 NOT NULL DEFAULT 0;
+-- The FLOAT identifiers are replaced by INT8 columns in migrations 5 to 8. CockroachDB can't change
+-- a column's type inside a transaction, and every migration runs in one, so the new columns are
+-- added here, filled in 6, the old ones dropped in 7 and the new ones renamed in 8.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS customer_id_int INT8;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS order_id_int INT8;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS variant_id_int INT8;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS product_id_int INT8;
@@ -0,0 +1,2 @@
+UPDATE payments SET customer_id = customer_id_int::FLOAT, order_id = order_id_int::FLOAT,
+    variant_id = variant_id_int::FLOAT, product_id = product_id_int::FLOAT;
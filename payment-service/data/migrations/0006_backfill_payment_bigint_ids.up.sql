@@ -0,0 +1,3 @@
+-- The FLOAT identifiers hold integers below 2^53, so the conversion is exact.
+UPDATE payments SET customer_id_int = customer_id::INT8, order_id_int = order_id::INT8,
+    variant_id_int = variant_id::INT8, product_id_int = product_id::INT8;
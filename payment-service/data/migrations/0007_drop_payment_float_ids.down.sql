@@ -0,0 +1,6 @@
+-- The columns come back nullable and without the unique constraint on order_id; migration 6's
+-- down step fills them from the INT8 columns.
+ALTER TABLE payments ADD COLUMN customer_id FLOAT;
+ALTER TABLE payments ADD COLUMN order_id FLOAT;
+ALTER TABLE payments ADD COLUMN variant_id FLOAT;
+ALTER TABLE payments ADD COLUMN product_id FLOAT;
@@ -0,0 +1,6 @@
+-- Migration 8 recreates the unique index on the INT8 order_id.
+DROP INDEX IF EXISTS payments@payments_order_id_key CASCADE;
+ALTER TABLE payments DROP COLUMN customer_id;
+ALTER TABLE payments DROP COLUMN order_id;
+ALTER TABLE payments DROP COLUMN variant_id;
+ALTER TABLE payments DROP COLUMN product_id;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS payments@payments_order_id_key;
+ALTER TABLE payments ALTER COLUMN product_id DROP NOT NULL;
+ALTER TABLE payments ALTER COLUMN variant_id DROP NOT NULL;
+ALTER TABLE payments ALTER COLUMN order_id DROP NOT NULL;
+ALTER TABLE payments ALTER COLUMN customer_id DROP NOT NULL;
+ALTER TABLE payments RENAME COLUMN product_id TO product_id_int;
+ALTER TABLE payments RENAME COLUMN variant_id TO variant_id_int;
+ALTER TABLE payments RENAME COLUMN order_id TO order_id_int;
+ALTER TABLE payments RENAME COLUMN customer_id TO customer_id_int;
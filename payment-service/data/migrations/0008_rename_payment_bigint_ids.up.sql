@@ -0,0 +1,9 @@
+ALTER TABLE payments RENAME COLUMN customer_id_int TO customer_id;
+ALTER TABLE payments RENAME COLUMN order_id_int TO order_id;
+ALTER TABLE payments RENAME COLUMN variant_id_int TO variant_id;
+ALTER TABLE payments RENAME COLUMN product_id_int TO product_id;
+ALTER TABLE payments ALTER COLUMN customer_id SET NOT NULL;
+ALTER TABLE payments ALTER COLUMN order_id SET NOT NULL;
+ALTER TABLE payments ALTER COLUMN variant_id SET NOT NULL;
+ALTER TABLE payments ALTER COLUMN product_id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS payments_order_id_key ON payments (order_id);
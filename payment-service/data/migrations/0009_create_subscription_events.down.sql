@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS subscription_events;
+DROP TABLE IF EXISTS webhook_payloads;
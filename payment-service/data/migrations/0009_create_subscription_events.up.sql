@@ -0,0 +1,17 @@
+-- Raw webhook bodies, encrypted, keyed by the hex SHA-256 of the plaintext body.
+CREATE TABLE IF NOT EXISTS webhook_payloads (
+    digest STRING PRIMARY KEY,
+    body STRING NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+-- One row per webhook received for a subscription. Rows are never updated or deleted.
+CREATE TABLE IF NOT EXISTS subscription_events (
+    id INT8 PRIMARY KEY DEFAULT unique_rowid(),
+    subscription_id VARCHAR(255) NOT NULL,
+    event_name VARCHAR(255) NOT NULL,
+    status_before VARCHAR(50) NOT NULL DEFAULT '',
+    status_after VARCHAR(50) NOT NULL,
+    payload_digest STRING NOT NULL REFERENCES webhook_payloads (digest),
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX subscription_events_subscription_id_idx (subscription_id, received_at)
+);
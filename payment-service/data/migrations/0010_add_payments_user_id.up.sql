@@ -0,0 +1,3 @@
+-- ID of the subscription-service user who checked out, passed to Lemon Squeezy as custom data.
+-- NULL for payments made before it was recorded, until subscriptionApp backfill-payment-users links them by email.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS user_id INT8;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS payments@payments_user_id_idx;
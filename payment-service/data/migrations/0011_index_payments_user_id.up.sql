@@ -0,0 +1,2 @@
+-- The index is created in its own migration because CockroachDB can't index a column added earlier in the same transaction.
+CREATE INDEX IF NOT EXISTS payments_user_id_idx ON payments (user_id);
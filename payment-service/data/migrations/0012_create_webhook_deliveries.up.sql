@@ -0,0 +1,6 @@
+-- Keys of the webhook deliveries that have been processed, so retried deliveries are only processed once.
+-- The key is the event name and the SHA-256 of the body, see data.WebhookDeliveryKey.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    event_key STRING PRIMARY KEY,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,10 @@
+-- Webhooks that failed in a way retrying can't fix. They were acknowledged to Lemon Squeezy, so this is the
+-- only record of them. Their bodies are stored in webhook_payloads alongside the subscription events.
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id INT8 PRIMARY KEY DEFAULT unique_rowid(),
+    event_name VARCHAR(255) NOT NULL DEFAULT '',
+    reason STRING NOT NULL,
+    payload_digest STRING NOT NULL REFERENCES webhook_payloads (digest),
+    failed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX webhook_dead_letters_failed_at_idx (failed_at)
+);
@@ -0,0 +1,16 @@
+-- Every webhook delivery received, with the outcome of the last attempt at processing it. Retries of a delivery
+-- have the same body, so they share a row. Dead-lettered deliveries are the dead-letter queue.
+-- Bodies are stored in webhook_payloads alongside the subscription events.
+CREATE TABLE IF NOT EXISTS webhook_archive (
+    id INT8 PRIMARY KEY DEFAULT unique_rowid(),
+    event_name VARCHAR(255) NOT NULL DEFAULT '',
+    headers JSONB NOT NULL DEFAULT '{}',
+    payload_digest STRING NOT NULL UNIQUE REFERENCES webhook_payloads (digest),
+    status VARCHAR(20) NOT NULL DEFAULT 'received',
+    error STRING NOT NULL DEFAULT '',
+    attempts INT8 NOT NULL DEFAULT 0,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    processed_at TIMESTAMPTZ,
+    INDEX webhook_archive_received_at_idx (received_at),
+    INDEX webhook_archive_status_idx (status, received_at)
+);
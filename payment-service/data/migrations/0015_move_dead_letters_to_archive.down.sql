@@ -0,0 +1,3 @@
+INSERT INTO webhook_dead_letters (event_name, reason, payload_digest, failed_at)
+SELECT event_name, error, payload_digest, COALESCE(processed_at, received_at) FROM webhook_archive WHERE status = 'dead_lettered';
+DELETE FROM webhook_archive WHERE status = 'dead_lettered';
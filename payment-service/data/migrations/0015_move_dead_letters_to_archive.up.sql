@@ -0,0 +1,4 @@
+-- Dead letters became archived webhooks with the dead_lettered status. Their headers were never stored.
+INSERT INTO webhook_archive (event_name, payload_digest, status, error, attempts, received_at, processed_at)
+SELECT event_name, payload_digest, 'dead_lettered', reason, 1, failed_at, failed_at FROM webhook_dead_letters
+ON CONFLICT (payload_digest) DO NOTHING;
@@ -0,0 +1,36 @@
+-- The products and variants of the Lemon Squeezy stores, synced from the API. Rows the API no longer returns
+-- are kept with deleted_at set, since subscriptions to a deleted variant still reference it.
+CREATE TABLE IF NOT EXISTS products (
+    id INT8 PRIMARY KEY,
+    store_id INT8 NOT NULL,
+    name STRING NOT NULL,
+    slug STRING NOT NULL DEFAULT '',
+    description STRING NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL,
+    buy_now_url STRING NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL,
+    synced_at TIMESTAMPTZ NOT NULL,
+    deleted_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS variants (
+    id INT8 PRIMARY KEY,
+    product_id INT8 NOT NULL REFERENCES products (id),
+    name STRING NOT NULL,
+    slug STRING NOT NULL DEFAULT '',
+    description STRING NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL,
+    price_amount INT8 NOT NULL,
+    currency STRING NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    is_subscription BOOL NOT NULL DEFAULT false,
+    billing_interval VARCHAR(10) NOT NULL DEFAULT '',
+    billing_interval_count INT8 NOT NULL DEFAULT 0,
+    has_free_trial BOOL NOT NULL DEFAULT false,
+    trial_interval VARCHAR(10) NOT NULL DEFAULT '',
+    trial_interval_count INT8 NOT NULL DEFAULT 0,
+    sort INT8 NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL,
+    synced_at TIMESTAMPTZ NOT NULL,
+    deleted_at TIMESTAMPTZ,
+    INDEX variants_product_id_idx (product_id, sort)
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS usage_events;
+DROP TABLE IF EXISTS usage_periods;
+ALTER TABLE payments DROP COLUMN IF EXISTS subscription_item_id;
@@ -0,0 +1,30 @@
+-- The subscription item usage is reported against. Lemon Squeezy sends it as first_subscription_item.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS subscription_item_id INT8;
+
+-- Usage of each subscription item per billing period, and how much of it was reported to Lemon Squeezy.
+CREATE TABLE IF NOT EXISTS usage_periods (
+    subscription_item_id INT8 NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    subscription_id STRING NOT NULL,
+    quantity INT8 NOT NULL DEFAULT 0,
+    reported_quantity INT8 NOT NULL DEFAULT 0,
+    reported_at TIMESTAMPTZ,
+    PRIMARY KEY (subscription_item_id, period_start),
+    CHECK (period_end > period_start),
+    INDEX usage_periods_unreported_idx (period_end) WHERE quantity > reported_quantity
+);
+
+-- Usage events as ingested. Senders retry with the same idempotency key, which is unique per subscription item.
+CREATE TABLE IF NOT EXISTS usage_events (
+    id INT8 PRIMARY KEY DEFAULT unique_rowid(),
+    subscription_item_id INT8 NOT NULL,
+    idempotency_key STRING NOT NULL CHECK (length(idempotency_key) BETWEEN 1 AND 255),
+    subscription_id STRING NOT NULL,
+    quantity INT8 NOT NULL CHECK (quantity > 0),
+    period_start TIMESTAMPTZ NOT NULL,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (subscription_item_id, idempotency_key),
+    FOREIGN KEY (subscription_item_id, period_start) REFERENCES usage_periods (subscription_item_id, period_start)
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS reconciliation_issues;
+DROP TABLE IF EXISTS reconciliation_runs;
@@ -0,0 +1,23 @@
+-- Reports of the comparisons of the Lemon Squeezy subscriptions with payments and users.
+CREATE TABLE IF NOT EXISTS reconciliation_runs (
+    id INT8 PRIMARY KEY DEFAULT unique_rowid(),
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL,
+    subscriptions INT8 NOT NULL DEFAULT 0,
+    corrected INT8 NOT NULL DEFAULT 0,
+    flagged INT8 NOT NULL DEFAULT 0,
+    error STRING NOT NULL DEFAULT '',
+    INDEX reconciliation_runs_started_at_idx (started_at DESC)
+);
+
+-- Differences found by a run, corrected or left for people to look into.
+CREATE TABLE IF NOT EXISTS reconciliation_issues (
+    id INT8 PRIMARY KEY DEFAULT unique_rowid(),
+    run_id INT8 NOT NULL REFERENCES reconciliation_runs (id) ON DELETE CASCADE,
+    subscription_id STRING NOT NULL,
+    user_id INT8 NOT NULL DEFAULT 0,
+    kind STRING NOT NULL,
+    detail STRING NOT NULL DEFAULT '',
+    corrected BOOL NOT NULL DEFAULT false,
+    INDEX reconciliation_issues_run_id_idx (run_id, id)
+);
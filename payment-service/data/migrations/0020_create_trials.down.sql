@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS trials;
+ALTER TABLE payments DROP COLUMN IF EXISTS trial_ends_at;
@@ -0,0 +1,17 @@
+-- When the subscription's free trial ends. Lemon Squeezy sends it as trial_ends_at.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS trial_ends_at TIMESTAMPTZ;
+
+-- Free trials of subscriptions and whether they converted into paid subscriptions or expired.
+CREATE TABLE IF NOT EXISTS trials (
+    subscription_id STRING PRIMARY KEY,
+    user_id INT8 NOT NULL DEFAULT 0,
+    variant_id INT8 NOT NULL DEFAULT 0,
+    variant_name STRING NOT NULL DEFAULT '',
+    started_at TIMESTAMPTZ NOT NULL,
+    ends_at TIMESTAMPTZ NOT NULL,
+    outcome STRING NOT NULL DEFAULT '',
+    ended_at TIMESTAMPTZ,
+    CHECK (outcome IN ('', 'converted', 'expired')),
+    CHECK ((outcome = '') = (ended_at IS NULL)),
+    INDEX trials_started_at_idx (started_at)
+);
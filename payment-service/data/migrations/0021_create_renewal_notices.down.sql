@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS renewal_notices;
+DROP INDEX IF EXISTS payments@payments_renews_at_idx;
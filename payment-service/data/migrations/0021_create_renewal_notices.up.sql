@@ -0,0 +1,12 @@
+-- Finds the subscriptions renewing soon, to send them renewal notices.
+CREATE INDEX IF NOT EXISTS payments_renews_at_idx ON payments (renews_at) WHERE status = 'active';
+
+-- Notices of upcoming renewals sent to customers. A renewal is announced at most once per window,
+-- and a renewal moved to another time is a new renewal.
+CREATE TABLE IF NOT EXISTS renewal_notices (
+    subscription_id STRING NOT NULL,
+    renews_at TIMESTAMPTZ NOT NULL,
+    days_before INT8 NOT NULL CHECK (days_before > 0),
+    sent_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (subscription_id, renews_at, days_before)
+);
@@ -0,0 +1 @@
+ALTER TABLE payment_outbox DROP COLUMN IF EXISTS dead_at;
@@ -3,200 +3,517 @@ package data
 
 import (
 	"context" // Used for managing the lifetime of database operations.
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"  // Used for logging errors.
 	"time" // Used for handling time-related data.
-
-	"github.com/jackc/pgx/v4" // PostgreSQL driver for Go.
 )
 
 // Payment represents a single payment transaction.
 // It includes details such as the user, subscription, and transaction IDs, the amount, currency, and method of payment,
 // the status of the payment, and timestamps for the payment, next billing date, and record creation and update.
+//
+// UserID is serialized as accountId because userId has long been the JSON name of CustomerID, the Lemon Squeezy
+// customer, and encoding/json leaves out both fields when two of them have the same name.
 type Payment struct {
 	ID             int64     `json:"id"`             // Unique identifier for the payment record.
-	CustomerID     float64   `json:"userId"`         // Unique identifier for the user making the payment.
+	CustomerID     int64     `json:"userId"`         // Unique identifier for the user making the payment.
+	UserID         int64     `json:"accountId"`      // ID of the subscription-service user who checked out, or 0 if it wasn't recorded.
 	SubscriptionID string    `json:"subscriptionId"` // Identifier for the subscription the payment is for.
-	OrderID        float64   `json:"orderId"`        // Unique identifier for the order.
+	OrderID        int64     `json:"orderId"`        // Unique identifier for the order.
 	Status         string    `json:"status"`         // The status of the payment (e.g., completed, pending).
 	VariantName    string    `json:"variantName"`    // Name of the variant.
-	VariantID      float64   `json:"variantId"`      // Unique identifier for the variant.
-	ProductID      float64   `json:"productId"`      // Unique identifier for the product.
+	VariantID      int64     `json:"variantId"`      // Unique identifier for the variant.
+	ProductID      int64     `json:"productId"`      // Unique identifier for the product.
 	ProductName    string    `json:"productName"`    // Name of the product.
 	CardBrand      string    `json:"cardBrand"`      // Brand of the card used for payment.
 	CardLastFour   string    `json:"cardLastFour"`   // Last four digits of the card used for payment.
+	Subtotal       Money     `json:"subtotal"`       // Amount before discount and tax.
+	Discount       Money     `json:"discount"`       // Discount applied to the subtotal.
+	Tax            Money     `json:"tax"`            // Tax charged on top of the discounted subtotal.
+	Total          Money     `json:"total"`          // Amount charged.
 	UserName       string    `json:"userName"`       // Name of the user making the payment.
 	UserEmail      string    `json:"userEmail"`      // Email of the user making the payment.
 	RenewsAt       time.Time `json:"renewsAt"`       // Timestamp of when the subscription renews.
 	CreatedAt      time.Time `json:"createdAt"`      // Timestamp of when the record was created.
-	UpdatedAt      time.Time `json:"updatedAt"`      // Timestamp of the last update to the record.
+	UpdatedAt      time.Time `json:"updatedAt"`      // Time Lemon Squeezy last updated the subscription, used to ignore stale webhooks.
+	Version        int64     `json:"version"`        // Version of the record, incremented by every update.
+
+	// SubscriptionItemID is the Lemon Squeezy subscription item usage is reported against, or 0 if it isn't known.
+	SubscriptionItemID int64 `json:"subscriptionItemId"`
+	// TrialEndsAt is when the subscription's free trial ends, or nil if it has none.
+	TrialEndsAt *time.Time `json:"trialEndsAt"`
 }
 
-// connection holds a global database connection, shared across instances of Models.
-// This allows for a single database connection to be reused for multiple operations, improving efficiency.
-var connection *pgx.Conn
+// currency returns the currency shared by the amounts of p, or "" if p has no amounts.
+// The payments table has a single currency column, so amounts in different currencies are rejected.
+func (p Payment) currency() (string, error) {
+	currency := ""
+	for _, m := range []Money{p.Subtotal, p.Discount, p.Tax, p.Total} {
+		switch {
+		case m.Currency == "" && m.Amount == 0:
+			continue
+		case !currencyPattern.MatchString(m.Currency):
+			return "", constraintViolation("violates check constraint on currency")
+		case currency != "" && m.Currency != currency:
+			return "", constraintViolation(fmt.Sprintf("payment amounts are in both %s and %s", currency, m.Currency))
+		}
+		currency = m.Currency
+	}
+	return currency, nil
+}
 
-// Models wraps all the models in the application for easy access.
-// Currently, it only contains a Payment model, but it can be expanded to include more models.
-type Models struct {
-	Payment Payment // Instance of the Payment model.
+// setCurrency sets the currency of every amount of p, as read from the payments table.
+func (p *Payment) setCurrency(currency string) {
+	p.Subtotal.Currency, p.Discount.Currency, p.Tax.Currency, p.Total.Currency = currency, currency, currency, currency
 }
 
-// NewModels initializes a new instance of Models with a database connection.
-// It sets the global database connection and ensures the necessary table exists in the database.
-func NewModels(conn *pgx.Conn) Models {
-	connection = conn       // Set the global connection.
-	ensureTableExists(conn) // Ensure the payments table exists in the database.
-	return Models{
-		Payment: Payment{}, // Initialize the Payment model.
-	}
+// ErrNotFound is returned by repositories when the requested record does not exist.
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned by conditional updates when the record was changed since it was read.
+var ErrConflict = errors.New("record was modified concurrently")
+
+// ErrDuplicate is returned when a record that must be unique already exists.
+var ErrDuplicate = errors.New("record already exists")
+
+// ErrConstraintViolation is matched by the errors repositories return for values the table's
+// constraints reject, whatever their message. Writing the same values again fails the same way.
+// CockroachDB reports most of these as a *pgconn.PgError instead; IsConstraintViolation checks both.
+var ErrConstraintViolation = errors.New("value violates a table constraint")
+
+// constraintViolation is a constraint error with its own message that matches ErrConstraintViolation.
+type constraintViolation string
+
+func (e constraintViolation) Error() string { return string(e) }
+
+func (e constraintViolation) Is(target error) bool { return target == ErrConstraintViolation }
+
+// PaymentRepository defines the storage operations available for payments.
+// CockroachPaymentRepository is used in production and MemoryPaymentRepository in tests;
+// both must behave the same way, including the column constraints of the payments table.
+type PaymentRepository interface {
+	// CreatePayment stores a new payment and returns the generated ID.
+	CreatePayment(ctx context.Context, p Payment) (int64, error)
+	// GetPaymentByID fetches a payment by ID.
+	GetPaymentByID(ctx context.Context, id int64) (*Payment, error)
+	// GetPaymentBySubscriptionID fetches the payment of a Lemon Squeezy subscription.
+	GetPaymentBySubscriptionID(ctx context.Context, subscriptionID string) (*Payment, error)
+	// GetLatestPaymentByUserID fetches the most recently created payment of a subscription-service user.
+	GetLatestPaymentByUserID(ctx context.Context, userID int64) (*Payment, error)
+	// UpdatePayment overwrites the stored payment with the ID p.ID. p.UpdatedAt is stored as given, or as now if it is zero.
+	// If p.Version is set, the update only applies to that version of the payment and returns ErrConflict otherwise.
+	UpdatePayment(ctx context.Context, p Payment) error
+	// ListRenewing returns the payments of active subscriptions that renew after from and no later than to,
+	// ordered by renews_at.
+	ListRenewing(ctx context.Context, from, to time.Time) ([]Payment, error)
 }
 
-// ensureTableExists updated to include new fields
-func ensureTableExists(conn *pgx.Conn) {
-	query := `
-    CREATE TABLE IF NOT EXISTS payments (
-    id SERIAL PRIMARY KEY,
-    customer_id FLOAT NOT NULL,
-    subscription_id VARCHAR(255) NOT NULL,
-    order_id FLOAT UNIQUE NOT NULL,
-    status VARCHAR(50) NOT NULL,
-    variant_name VARCHAR(255),
-    variant_id FLOAT NOT NULL,
-    product_id FLOAT NOT NULL,
-    product_name VARCHAR(255),
-    card_brand VARCHAR(50),
-    card_last_four CHAR(4) NOT NULL CHECK (LENGTH(card_last_four) = 4),
-    user_name VARCHAR(255) NOT NULL CHECK (user_name <> '' AND user_name ~ '^[A-Za-z ]+$'),
-    user_email VARCHAR(255) NOT NULL CHECK (user_email <> '' AND user_email ~* '^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$'),
-    renews_at TIMESTAMP NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    CHECK (renews_at >= created_at)
-);`
-
-	if _, err := conn.Exec(context.Background(), query); err != nil {
-		log.Fatalf("Failed to ensure payments table exists: %v", err)
-	}
+// SubscriptionEvent is one webhook received for a subscription, as recorded in the subscription_events table.
+// The events of a subscription are its history; the subscription's payments row holds the state after the latest one.
+type SubscriptionEvent struct {
+	ID             int64     `json:"id"`             // Unique identifier of the event.
+	SubscriptionID string    `json:"subscriptionId"` // Lemon Squeezy subscription the event is about.
+	EventName      string    `json:"eventName"`      // Lemon Squeezy event name, e.g. subscription_paused.
+	StatusBefore   string    `json:"statusBefore"`   // Subscription status before the event, empty for the event that created it.
+	StatusAfter    string    `json:"statusAfter"`    // Subscription status after the event.
+	PayloadDigest  string    `json:"payloadDigest"`  // Hex SHA-256 of the raw webhook body, see SubscriptionEventRepository.Payload.
+	ReceivedAt     time.Time `json:"receivedAt"`     // Time the event was recorded.
 }
 
-// CreatePayment updated to include new fields
-func (m *Models) CreatePayment(connection *pgx.Conn, p Payment) (int, error) {
-	var id int // Variable to store the ID of the created payment
-	query := `
-    INSERT INTO payments (customer_id, subscription_id, order_id, status, variant_name, variant_id, product_id, product_name, card_brand, card_last_four, user_name, user_email, renews_at, created_at, updated_at)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
-    RETURNING id;`
+// SubscriptionEventRepository stores the append-only history of subscription webhooks.
+// Events are appended in the same transaction as the payments update they cause.
+type SubscriptionEventRepository interface {
+	// Append records e together with the raw webhook body it was parsed from and returns the event's ID.
+	// ID, PayloadDigest and ReceivedAt are set by Append. Identical bodies are stored once.
+	Append(ctx context.Context, e SubscriptionEvent, payload []byte) (int64, error)
+	// ListBySubscriptionID returns the events of a subscription, oldest first.
+	ListBySubscriptionID(ctx context.Context, subscriptionID string) ([]SubscriptionEvent, error)
+	// Payload returns the raw webhook body with the given digest, or ErrNotFound.
+	Payload(ctx context.Context, digest string) ([]byte, error)
+}
 
-	err := connection.QueryRow(context.Background(), query,
-		p.CustomerID, p.SubscriptionID, p.OrderID, p.Status, p.VariantName, p.VariantID, p.ProductID, p.ProductName, p.CardBrand, p.CardLastFour, p.UserName, p.UserEmail, p.RenewsAt, p.CreatedAt, p.UpdatedAt).Scan(&id)
-	if err != nil {
-		log.Printf("Failed to create payment: %v", err)
-		return 0, err // Return 0 for the ID in case of an error
-	}
-	return id, nil // Return the ID of the created payment and nil for the error
+// WebhookDeliveryRepository records which webhook deliveries have been processed.
+// Lemon Squeezy retries deliveries it doesn't see acknowledged, so the same webhook can arrive more than once.
+type WebhookDeliveryRepository interface {
+	// Record marks the delivery with the given key as processed, or returns ErrDuplicate if it already was.
+	// Called in the transaction that processes the delivery, so the key is recorded if and only if the processing commits.
+	Record(ctx context.Context, key string) error
 }
 
-// GetPaymentByID updated to include new fields
-func (m *Models) GetPaymentByID(connection *pgx.Conn, id int) (*Payment, error) {
-	query := `
-    SELECT id, customer_id, subscription_id, order_id, status, variant_name, variant_id, product_id, product_name, card_brand, card_last_four, user_name, user_email, renews_at, created_at, updated_at
-    FROM payments
-    WHERE id = $1;`
+// WebhookDeliveryKey returns the key of a webhook delivery: its event name and the digest of its body.
+// A retried delivery has the same body, so retries share the key of the original delivery.
+func WebhookDeliveryKey(eventName string, body []byte) string {
+	return eventName + ":" + payloadDigest(body)
+}
 
-	var p Payment
-	err := connection.QueryRow(context.Background(), query, id).Scan(&p.ID, &p.CustomerID, &p.SubscriptionID, &p.OrderID, &p.Status, &p.VariantName, &p.VariantID, &p.ProductID, &p.ProductName, &p.CardBrand, &p.CardLastFour, &p.UserName, &p.UserEmail, &p.RenewsAt, &p.CreatedAt, &p.UpdatedAt)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			// Custom error message when no rows are found
-			return nil, errors.New("no payment found with the given ID")
-		}
-		log.Printf("Failed to get payment by ID: %v", err)
-		return nil, err
-	}
-	return &p, nil
+// payloadDigest returns the key under which a raw webhook body is stored.
+func payloadDigest(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
 }
 
-// GetPaymentBySubscriptionID updated to include new fields
-// GetPaymentBySubscriptionID retrieves a payment record based on the subscription ID.
-func (m *Models) GetPaymentBySubscriptionID(connection *pgx.Conn, subscriptionID string) (*Payment, error) {
-	query := `
-    SELECT id, customer_id, subscription_id, order_id, status, variant_name, variant_id, product_id, product_name, card_brand, card_last_four, user_name, user_email, renews_at, created_at, updated_at
-    FROM payments
-    WHERE subscription_id = $1;`
+// Statuses of an ArchivedWebhook.
+const (
+	WebhookReceived     = "received"      // Stored and not processed yet, or the service stopped while processing it.
+	WebhookProcessed    = "processed"     // Its changes were committed.
+	WebhookIgnored      = "ignored"       // There is no handler for its event.
+	WebhookStale        = "stale"         // It is older than the stored subscription, so only its history was recorded.
+	WebhookFailed       = "failed"        // It failed transiently and Lemon Squeezy was asked to retry it.
+	WebhookDeadLettered = "dead_lettered" // It failed in a way retrying can't fix and was acknowledged.
+)
 
-	var p Payment
-	err := connection.QueryRow(context.Background(), query, subscriptionID).Scan(&p.ID, &p.CustomerID, &p.SubscriptionID, &p.OrderID, &p.Status, &p.VariantName, &p.VariantID, &p.ProductID, &p.ProductName, &p.CardBrand, &p.CardLastFour, &p.UserName, &p.UserEmail, &p.RenewsAt, &p.CreatedAt, &p.UpdatedAt)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			// Custom error message when no rows are found
-			return nil, errors.New("no payment found with the given SubscriptionID")
-		}
-		log.Printf("Failed to get payment by SubscriptionID: %v", err)
-		return nil, err
-	}
-	return &p, nil
+// ArchivedWebhook is a webhook delivery as received, recorded in the webhook_archive table with the outcome of processing it.
+// Lemon Squeezy resends the same body when it retries a delivery, so all requests with the same body share one
+// archived webhook. The dead-lettered webhooks of the archive are its dead-letter queue.
+type ArchivedWebhook struct {
+	ID            int64             `json:"id"`            // Unique identifier of the request.
+	EventName     string            `json:"eventName"`     // Lemon Squeezy event name it was dispatched on, or "" if it had none.
+	Headers       map[string]string `json:"headers"`       // Headers of the latest request, without credentials.
+	PayloadDigest string            `json:"payloadDigest"` // Hex SHA-256 of the raw body, see SubscriptionEventRepository.Payload.
+	Status        string            `json:"status"`        // Outcome of the last attempt, one of the Webhook status constants.
+	Error         string            `json:"error"`         // Why the last attempt failed, or "".
+	Attempts      int               `json:"attempts"`      // Number of times the webhook was processed, including retries and replays.
+	ReceivedAt    time.Time         `json:"receivedAt"`    // Time the first request was received.
+	ProcessedAt   *time.Time        `json:"processedAt"`   // Time of the last attempt, or nil if there was none.
 }
 
-// UpdatePayment updated to include new fields
-func (m *Models) UpdatePayment(connection *pgx.Conn, p Payment) error {
-	query := `
-    UPDATE payments
-    SET customer_id = $2, subscription_id = $3, order_id = $4, status = $5, variant_name = $6, variant_id = $7, product_id = $8, product_name = $9, card_brand = $10, card_last_four = $11, user_name = $12, user_email = $13, renews_at = $14, updated_at = $15
-    WHERE id = $1;`
+// ArchiveFilter selects archived webhooks. Zero fields don't restrict the selection.
+type ArchiveFilter struct {
+	Statuses []string  // Statuses the webhooks must have one of.
+	From     time.Time // Earliest time of receipt, inclusive.
+	To       time.Time // Latest time of receipt, exclusive.
+	Limit    int       // Maximum number of webhooks returned.
+}
 
-	_, err := connection.Exec(context.Background(), query, p.ID, p.CustomerID, p.SubscriptionID, p.OrderID, p.Status, p.VariantName, p.VariantID, p.ProductID, p.ProductName, p.CardBrand, p.CardLastFour, p.UserName, p.UserEmail, p.RenewsAt, time.Now())
-	if err != nil {
-		log.Printf("Failed to update payment: %v", err)
-		return err
-	}
-	return nil
+// WebhookArchiveRepository stores every webhook delivery received, so failed ones can be looked into and replayed.
+// Bodies are stored with the bodies of the subscription events, so SubscriptionEventRepository.Payload reads them.
+type WebhookArchiveRepository interface {
+	// Add records w with status WebhookReceived together with the raw body and returns its ID. If a webhook
+	// with the same body was archived before, Add only replaces its headers and returns its ID.
+	// ID, PayloadDigest, Status, Error, Attempts, ReceivedAt and ProcessedAt are set by Add.
+	Add(ctx context.Context, w ArchivedWebhook, payload []byte) (int64, error)
+	// Get fetches an archived webhook by ID, or returns ErrNotFound.
+	Get(ctx context.Context, id int64) (*ArchivedWebhook, error)
+	// List returns the archived webhooks matching f, oldest first.
+	List(ctx context.Context, f ArchiveFilter) ([]ArchivedWebhook, error)
+	// SetStatus records the outcome of an attempt at processing the webhook id, and the event name it was dispatched on.
+	// reason is why the attempt failed, or "". It returns ErrNotFound if there is no such webhook.
+	SetStatus(ctx context.Context, id int64, eventName, status, reason string) error
 }
 
-// GetPayment updated to include new fields
-// GetPayment parses the JSON request body and returns a Payment object.
-func GetPayment(body []byte) (*Payment, error) {
-	var params map[string]interface{}
-	err := json.Unmarshal(body, &params)
-	if err != nil {
-		return nil, err
-	}
-	renew_string := params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["renews_at"].(string)
-	created_string := params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["created_at"].(string)
-	updated_string := params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["updated_at"].(string)
+// Product is a Lemon Squeezy product, a plan, as stored in the products table by the catalog sync.
+type Product struct {
+	ID          int64      `json:"id"`          // Lemon Squeezy product ID.
+	StoreID     int64      `json:"storeId"`     // Lemon Squeezy store the product is sold in.
+	Name        string     `json:"name"`        // Name of the product.
+	Slug        string     `json:"slug"`        // URL slug of the product.
+	Description string     `json:"description"` // Description of the product, in HTML.
+	Status      string     `json:"status"`      // draft or published.
+	BuyNowURL   string     `json:"buyNowUrl"`   // Lemon Squeezy checkout page of the product.
+	UpdatedAt   time.Time  `json:"updatedAt"`   // Time Lemon Squeezy last updated the product.
+	SyncedAt    time.Time  `json:"-"`           // Time of the last sync that found the product.
+	DeletedAt   *time.Time `json:"-"`           // Time of the first sync that no longer found the product, or nil.
+}
 
-	// Parse the time strings into time.Time objects
-	renewsAt, err := time.Parse(time.RFC3339, renew_string)
-	if err != nil {
-		return nil, err
-	}
+// Variant is a Lemon Squeezy variant, a price of a product, as stored in the variants table by the catalog sync.
+// Subscriptions and payments refer to their plan by variant ID.
+type Variant struct {
+	ID                 int64      `json:"id"`                 // Lemon Squeezy variant ID.
+	ProductID          int64      `json:"productId"`          // Product the variant is a price of.
+	Name               string     `json:"name"`               // Name of the variant.
+	Slug               string     `json:"slug"`               // Lemon Squeezy checkout link slug of the variant.
+	Description        string     `json:"description"`        // Description of the variant, in HTML.
+	Status             string     `json:"status"`             // pending for the only variant of a product, draft or published.
+	Price              Money      `json:"price"`              // Price per interval, in the store's currency.
+	IsSubscription     bool       `json:"isSubscription"`     // Whether the variant is billed repeatedly.
+	Interval           string     `json:"interval"`           // day, week, month or year, for subscriptions.
+	IntervalCount      int        `json:"intervalCount"`      // Number of intervals between charges.
+	HasFreeTrial       bool       `json:"hasFreeTrial"`       // Whether subscriptions start with a free trial.
+	TrialInterval      string     `json:"trialInterval"`      // Unit of TrialIntervalCount: day, week, month or year.
+	TrialIntervalCount int        `json:"trialIntervalCount"` // Length of the free trial.
+	Sort               int        `json:"sort"`               // Position of the variant among those of its product.
+	UpdatedAt          time.Time  `json:"updatedAt"`          // Time Lemon Squeezy last updated the variant.
+	SyncedAt           time.Time  `json:"-"`                  // Time of the last sync that found the variant.
+	DeletedAt          *time.Time `json:"-"`                  // Time of the first sync that no longer found the variant, or nil.
+}
 
-	createdAt, err := time.Parse(time.RFC3339, created_string)
-	if err != nil {
-		return nil, err
+// onSale reports whether customers can check out v: published, or the only, pending, variant of its product.
+func (v Variant) onSale() bool {
+	return v.DeletedAt == nil && (v.Status == "published" || v.Status == "pending")
+}
+
+// Plan is a published product with the variants it is on sale with.
+type Plan struct {
+	Product
+	Variants []Variant `json:"variants"`
+}
+
+// CatalogRepository stores the products and variants synced from Lemon Squeezy.
+type CatalogRepository interface {
+	// Sync stores products and variants as found at syncedAt, and marks the stored ones they don't include as
+	// deleted. Every variant must belong to one of products; run it in a transaction so readers never see half a sync.
+	Sync(ctx context.Context, products []Product, variants []Variant, syncedAt time.Time) error
+	// ListPlans returns the published products that are not deleted with their variants on sale, ordered by
+	// product name and by the sort order of the variants. Products without such variants are left out.
+	ListPlans(ctx context.Context) ([]Plan, error)
+	// GetVariant fetches a variant by its Lemon Squeezy ID, deleted or not, or returns ErrNotFound.
+	GetVariant(ctx context.Context, id int64) (*Variant, error)
+}
+
+// UsagePeriod is the usage of a subscription item in one of its billing periods, as stored in the usage_periods table.
+type UsagePeriod struct {
+	SubscriptionItemID int64      `json:"subscriptionItemId"` // Lemon Squeezy subscription item the usage is billed to.
+	SubscriptionID     string     `json:"subscriptionId"`     // Lemon Squeezy subscription of the item.
+	PeriodStart        time.Time  `json:"periodStart"`        // Start of the billing period, inclusive.
+	PeriodEnd          time.Time  `json:"periodEnd"`          // End of the billing period, exclusive.
+	Quantity           int64      `json:"quantity"`           // Sum of the quantities of the usage events in the period, plus usage carried over into it.
+	ReportedQuantity   int64      `json:"reportedQuantity"`   // Quantity last reported to Lemon Squeezy.
+	ReportedAt         *time.Time `json:"reportedAt"`         // Time of the last report, or nil if there was none.
+}
+
+// UsageEvent is one usage event as ingested, recorded in the usage_events table.
+type UsageEvent struct {
+	ID                 int64     `json:"id"`                 // Unique identifier of the event.
+	SubscriptionItemID int64     `json:"subscriptionItemId"` // Lemon Squeezy subscription item the usage is billed to.
+	SubscriptionID     string    `json:"subscriptionId"`     // Lemon Squeezy subscription of the item.
+	IdempotencyKey     string    `json:"idempotencyKey"`     // Key chosen by the sender, unique per subscription item.
+	Quantity           int64     `json:"quantity"`           // Amount used, more than 0.
+	PeriodStart        time.Time `json:"periodStart"`        // Start of the billing period the event counts towards.
+	OccurredAt         time.Time `json:"occurredAt"`         // Time the usage happened, according to the sender.
+	ReceivedAt         time.Time `json:"receivedAt"`         // Time the event was recorded.
+}
+
+// UsageRepository stores usage events and their sums per subscription item and billing period.
+type UsageRepository interface {
+	// AddPeriod stores p with no usage, unless a period of the same item starting at the same time is stored.
+	AddPeriod(ctx context.Context, p UsagePeriod) error
+	// FindPeriod returns the stored period of a subscription item that includes at, or ErrNotFound.
+	FindPeriod(ctx context.Context, subscriptionItemID int64, at time.Time) (*UsagePeriod, error)
+	// Record stores e and adds its quantity to the period it counts towards, which must be stored.
+	// ID and ReceivedAt are set by Record. If an event with the same subscription item and idempotency key
+	// was recorded before, nothing is stored and Record returns that event with ErrDuplicate.
+	// Run it in a transaction so the event and the sum are stored together.
+	Record(ctx context.Context, e UsageEvent) (*UsageEvent, error)
+	// ListUnreported returns up to limit periods with usage that wasn't reported, the ones ending first first.
+	// Periods that have ended are included, since their usage must still be carried over with CarryOver.
+	ListUnreported(ctx context.Context, limit int) ([]UsagePeriod, error)
+	// MarkReported records that the period's usage was reported as quantity at reportedAt. It has no effect if
+	// a larger quantity was reported already.
+	MarkReported(ctx context.Context, subscriptionItemID int64, periodStart time.Time, quantity int64, reportedAt time.Time) error
+	// CarryOver moves the usage of from that wasn't reported into the period of the same item starting at
+	// toStart, and marks all of from's usage reported at reportedAt. It is used for usage left unreported when
+	// its period ended, which Lemon Squeezy can only bill with a later period. It returns ErrConflict if from's
+	// quantities changed since it was read, and ErrNotFound if the target period isn't stored.
+	// Run it in a transaction so the usage is moved in one step.
+	CarryOver(ctx context.Context, from UsagePeriod, toStart time.Time, reportedAt time.Time) error
+}
+
+// Kinds of reconciliation issues. The ones that are corrected automatically are noted; the others are only reported.
+const (
+	IssuePaymentStale   = "payment_stale"   // Lemon Squeezy changed the subscription after the payment was last updated. Corrected.
+	IssueUserStatus     = "user_status"     // The user's subscription status or plan differs from the subscription's. Corrected.
+	IssueMissingPayment = "missing_payment" // There is no payment for the subscription.
+	IssuePaymentAhead   = "payment_ahead"   // The payment was updated after Lemon Squeezy last changed the subscription, and differs from it.
+	IssueUnlinkedUser   = "unlinked_user"   // The payment isn't linked to a subscription-service user, so the user couldn't be checked.
+	IssueUnknownUser    = "unknown_user"    // The payment is linked to a user that doesn't exist in subscription-service.
+)
+
+// ReconciliationIssue is a difference between a Lemon Squeezy subscription and the local state found by a
+// reconciliation run, as stored in the reconciliation_issues table.
+type ReconciliationIssue struct {
+	ID             int64  `json:"id"`             // Unique identifier of the issue.
+	RunID          int64  `json:"runId"`          // Run that found the issue.
+	SubscriptionID string `json:"subscriptionId"` // Lemon Squeezy subscription that differs.
+	UserID         int64  `json:"userId"`         // subscription-service user of the subscription, or 0 if it isn't known.
+	Kind           string `json:"kind"`           // One of the Issue constants.
+	Detail         string `json:"detail"`         // The differing values, for people.
+	Corrected      bool   `json:"corrected"`      // Whether the run corrected the local state.
+}
+
+// ReconciliationRun is a comparison of every Lemon Squeezy subscription with the local state, as stored in
+// the reconciliation_runs table.
+type ReconciliationRun struct {
+	ID            int64                 `json:"id"`            // Unique identifier of the run.
+	StartedAt     time.Time             `json:"startedAt"`     // Time the run started.
+	FinishedAt    time.Time             `json:"finishedAt"`    // Time the run finished.
+	Subscriptions int                   `json:"subscriptions"` // Number of subscriptions compared.
+	Corrected     int                   `json:"corrected"`     // Number of issues corrected.
+	Flagged       int                   `json:"flagged"`       // Number of issues left for people.
+	Error         string                `json:"error"`         // Why the run stopped before comparing every subscription, or "".
+	Issues        []ReconciliationIssue `json:"issues"`        // Issues found, in the order they were found.
+}
+
+// ReconciliationRepository stores the reports of reconciliation runs.
+type ReconciliationRepository interface {
+	// SaveRun stores r and its issues and returns the run's ID. The IDs of r and its issues are set by SaveRun.
+	SaveRun(ctx context.Context, r ReconciliationRun) (int64, error)
+	// GetRun fetches a run with its issues by ID, or returns ErrNotFound.
+	GetRun(ctx context.Context, id int64) (*ReconciliationRun, error)
+	// LatestRun fetches the run that started last with its issues, or returns ErrNotFound if there was none.
+	LatestRun(ctx context.Context) (*ReconciliationRun, error)
+}
+
+// Outcomes of trials.
+const (
+	TrialConverted = "converted" // The subscription became active after the trial.
+	TrialExpired   = "expired"   // The subscription expired or went unpaid after the trial.
+)
+
+// Trial is the free trial of a subscription, as stored in the trials table.
+type Trial struct {
+	SubscriptionID string     `json:"subscriptionId"` // Lemon Squeezy subscription on trial.
+	UserID         int64      `json:"userId"`         // subscription-service user of the subscription, or 0 if it isn't known.
+	VariantID      int64      `json:"variantId"`      // Variant the trial is of.
+	VariantName    string     `json:"variantName"`    // Name of the variant.
+	StartedAt      time.Time  `json:"startedAt"`      // Time the subscription was created.
+	EndsAt         time.Time  `json:"endsAt"`         // Time the trial ends, moved if it is extended.
+	Outcome        string     `json:"outcome"`        // One of the Trial constants, or "" while the outcome isn't known.
+	EndedAt        *time.Time `json:"endedAt"`        // Time the outcome was recorded, or nil.
+}
+
+// TrialStats counts the trials of a variant started in a time range by outcome.
+type TrialStats struct {
+	VariantID   int64  `json:"variantId"`   // Variant the trials are of.
+	VariantName string `json:"variantName"` // Name of the variant when its last trial started.
+	Started     int    `json:"started"`     // Number of trials started.
+	Converted   int    `json:"converted"`   // Number of them that converted.
+	Expired     int    `json:"expired"`     // Number of them that expired.
+}
+
+// TrialRepository stores the trials of subscriptions and their outcomes.
+type TrialRepository interface {
+	// Track stores t, or updates the end, variant and user of the stored trial of t.SubscriptionID
+	// while it has no outcome. The start of a stored trial is kept.
+	Track(ctx context.Context, t Trial) error
+	// End records the outcome of the trial of a subscription at the given time. It returns ErrNotFound if
+	// the subscription has no trial without an outcome.
+	End(ctx context.Context, subscriptionID, outcome string, at time.Time) error
+	// GetTrial fetches the trial of a subscription, or returns ErrNotFound.
+	GetTrial(ctx context.Context, subscriptionID string) (*Trial, error)
+	// Stats counts the trials started at or after from and before to, per variant, sorted by variant ID.
+	Stats(ctx context.Context, from, to time.Time) ([]TrialStats, error)
+}
+
+// RenewalNotice is a notice of an upcoming renewal sent to the customer, as recorded in the renewal_notices table.
+type RenewalNotice struct {
+	SubscriptionID string    `json:"subscriptionId"` // Lemon Squeezy subscription that renews.
+	RenewsAt       time.Time `json:"renewsAt"`       // Time the subscription renews at, as announced.
+	DaysBefore     int       `json:"daysBefore"`     // Notice window the notice was sent in, such as 7 for a week before.
+	SentAt         time.Time `json:"sentAt"`         // Time the notice was enqueued.
+}
+
+// RenewalNoticeRepository records the renewal notices sent, so each renewal is announced once per window.
+// Notices are recorded in the same transaction as the notification that delivers them.
+type RenewalNoticeRepository interface {
+	// Record stores n and reports whether it is new. It returns false, and stores nothing, if a notice was
+	// already recorded for the same subscription, renewal and window.
+	Record(ctx context.Context, n RenewalNotice) (bool, error)
+	// ListNotices returns the notices recorded for a subscription, ordered by the time they were sent.
+	ListNotices(ctx context.Context, subscriptionID string) ([]RenewalNotice, error)
+}
+
+// Outbox event types.
+const (
+	EventSubscriptionNotification = "subscription.notification" // The subscription service must be told about a subscription change.
+)
+
+// OutboxEvent is a domain event recorded in the payment_outbox table.
+type OutboxEvent struct {
+	ID        string          `json:"id"`        // Unique identifier of the event, used by receivers to deduplicate deliveries.
+	Type      string          `json:"type"`      // Type of the event, one of the Event constants.
+	Payload   json.RawMessage `json:"payload"`   // JSON encoded event data.
+	CreatedAt time.Time       `json:"createdAt"` // Time the event was recorded.
+	Attempts  int             `json:"attempts"`  // Number of times the event has been claimed for delivery.
+	LastError string          `json:"lastError"` // Why the latest delivery failed, if it did.
+}
+
+// SubscriptionNotification is the payload of an EventSubscriptionNotification event.
+// Its fields map one to one onto the subscription service's SubscriptionRequest.
+type SubscriptionNotification struct {
+	MailType           string `json:"mailType"`           // Kind of notification, e.g. "success update".
+	UserID             int64  `json:"userId"`             // ID of the user the subscription belongs to, or 0 if it wasn't recorded.
+	EmailID            string `json:"emailId"`            // Email of the user the subscription belongs to.
+	SubscriptionStatus string `json:"subscriptionStatus"` // Status of the subscription.
+	ProductName        string `json:"productName"`        // Name of the product.
+	VariantName        string `json:"variantName"`        // Name of the variant.
+	VariantID          int64  `json:"variantId"`          // Lemon Squeezy ID of the variant, or 0 in notifications enqueued before it was sent.
+	SubscriptionID     string `json:"subscriptionId"`     // Lemon Squeezy ID of the subscription, or "" in notifications enqueued before it was sent.
+	TrialEndsAt        int64  `json:"trialEndsAt"`        // Unix time the subscription's trial ends, or 0 if it has none.
+	RenewsAt           int64  `json:"renewsAt"`           // Unix time the subscription renews, set in renewal notices only.
+	RenewalAmount      string `json:"renewalAmount"`      // Amount the renewal is charged, such as "9.99 USD", set in renewal notices only.
+}
+
+// OutboxRepository stores domain events until they have been delivered.
+// Events are enqueued in the same transaction as the state change they describe, so an event
+// exists if and only if the change was committed. A relay then claims and delivers them.
+type OutboxRepository interface {
+	// Enqueue records an event of the given type with payload encoded as JSON and returns its ID.
+	Enqueue(ctx context.Context, eventType string, payload interface{}) (string, error)
+	// Claim leases up to limit undelivered events that aren't dead, oldest first. Claimed events are not
+	// returned again until the lease expires, so an event whose relay died is eventually redelivered.
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error)
+	// MarkPublished records that an event was delivered.
+	MarkPublished(ctx context.Context, id string) error
+	// MarkFailed records why a delivery failed. The event is retried once its lease expires.
+	MarkFailed(ctx context.Context, id string, reason error) error
+	// MarkDead records why the last delivery of an event failed and stops it from being claimed again.
+	MarkDead(ctx context.Context, id string, reason error) error
+	// ListDead returns up to limit dead events, the ones that died last first.
+	ListDead(ctx context.Context, limit int) ([]OutboxEvent, error)
+}
+
+// Models wraps all the models in the application for easy access.
+type Models struct {
+	Payments   PaymentRepository           // Payments provides access to stored payments.
+	Events     SubscriptionEventRepository // Events holds the history of subscription webhooks.
+	Deliveries WebhookDeliveryRepository   // Deliveries records the webhook deliveries already processed.
+	Archive    WebhookArchiveRepository    // Archive holds every webhook request received and the outcome of processing it.
+	Outbox     OutboxRepository            // Outbox holds domain events waiting to be delivered.
+	Catalog    CatalogRepository           // Catalog holds the products and variants synced from Lemon Squeezy.
+	Usage      UsageRepository             // Usage holds the usage of metered subscriptions.
+	Reports    ReconciliationRepository    // Reports holds the reports of the reconciliations with Lemon Squeezy.
+	Trials     TrialRepository             // Trials holds the free trials of subscriptions and their outcomes.
+	Renewals   RenewalNoticeRepository     // Renewals records the notices of upcoming renewals sent.
+	tx         txRunner                    // tx starts transactions spanning all the repositories.
+	inTx       bool                        // inTx is true for the Models passed to a RunInTx callback.
+}
+
+// txRunner starts a transaction and calls fn with Models bound to it.
+type txRunner interface {
+	runInTx(ctx context.Context, fn func(tx Models) error) error
+}
+
+// NewModels initializes a new instance of Models backed by CockroachDB.
+// It applies any pending migrations first and exits if the schema is newer than this build understands.
+func NewModels(db DB, keys *KeyRing) Models {
+	ensureSchema(db) // Bring the database schema up to date.
+	return NewCockroachModels(db, keys)
+}
+
+// RunInTx runs fn with Models whose repositories all operate in one transaction.
+// The transaction is committed if fn returns nil and rolled back otherwise. fn may be retried, so it
+// must not have side effects outside the repositories; anything else belongs in the outbox.
+// Calling RunInTx on the Models passed to fn runs the nested fn in the enclosing transaction.
+func (m Models) RunInTx(ctx context.Context, fn func(tx Models) error) error {
+	if m.inTx {
+		return fn(m)
 	}
+	return m.tx.runInTx(ctx, fn)
+}
 
-	updatedAt, err := time.Parse(time.RFC3339, updated_string)
+// ensureSchema runs the embedded migrations on startup.
+// Concurrent replicas serialize on the migration lock, and a database migrated by a newer
+// build causes the service to refuse to start rather than run against an unknown schema.
+func ensureSchema(db DB) {
+	migrator, err := NewMigrator(db)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Failed to load migrations: %v", err)
 	}
-	payment := Payment{
-		CustomerID:     params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["customer_id"].(float64),
-		SubscriptionID: params["data"].(map[string]interface{})["id"].(string),
-		OrderID:        params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["order_id"].(float64),
-		Status:         params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["status"].(string),
-		VariantName:    params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["variant_name"].(string),
-		VariantID:      params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["variant_id"].(float64),
-		ProductID:      params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["product_id"].(float64),
-		ProductName:    params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["product_name"].(string),
-		CardBrand:      params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["card_brand"].(string),
-		CardLastFour:   params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["card_last_four"].(string),
-		UserName:       params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["user_name"].(string),
-		UserEmail:      params["data"].(map[string]interface{})["attributes"].(map[string]interface{})["user_email"].(string),
-		RenewsAt:       renewsAt,
-		CreatedAt:      createdAt,
-		UpdatedAt:      updatedAt,
+	if err := migrator.Up(context.Background()); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
 	}
-	return &payment, nil
 }
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// currencyPattern matches ISO 4217 alphabetic currency codes.
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// minorUnitDigits lists the ISO 4217 currencies whose minor unit is not a hundredth of the major unit.
+var minorUnitDigits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// Money is an amount of a currency, counted in the currency's minor unit, such as cents for USD.
+// Lemon Squeezy reports amounts in minor units too, so they are stored exactly as received and
+// never pass through a float64.
+type Money struct {
+	Amount   int64  `json:"amount"`   // Amount in minor units.
+	Currency string `json:"currency"` // ISO 4217 currency code, such as USD.
+}
+
+// NewMoney returns amount minor units of currency. currency must be an ISO 4217 code.
+func NewMoney(amount int64, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	if !currencyPattern.MatchString(currency) {
+		return Money{}, fmt.Errorf("invalid currency code %q", currency)
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// String formats m in major units followed by its currency, such as "12.34 USD".
+func (m Money) String() string {
+	digits, ok := minorUnitDigits[m.Currency]
+	if !ok {
+		digits = 2
+	}
+	amount := strconv.FormatInt(m.Amount, 10)
+	sign := ""
+	if m.Amount < 0 {
+		sign, amount = "-", amount[1:]
+	}
+	if digits > 0 {
+		if len(amount) <= digits {
+			amount = strings.Repeat("0", digits-len(amount)+1) + amount
+		}
+		amount = amount[:len(amount)-digits] + "." + amount[len(amount)-digits:]
+	}
+	return strings.TrimSpace(sign + amount + " " + m.Currency)
+}
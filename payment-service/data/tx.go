@@ -0,0 +1,104 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// maxTxAttempts bounds how many times RunInTx retries a transaction after a serialization failure.
+const maxTxAttempts = 10
+
+// DB is the subset of *pgxpool.Pool, *pgx.Conn and pgx.Tx used by the data layer.
+type DB interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// RunInTx runs fn inside a transaction and commits it if fn returns nil.
+//
+// CockroachDB aborts transactions that conflict with each other with a 40001 serialization failure
+// and expects the client to retry them. RunInTx uses CockroachDB's savepoint protocol: it opens the
+// cockroach_restart savepoint at the start of the transaction and, when fn or the release of the
+// savepoint fails with a retryable error, rolls back to the savepoint and runs fn again. fn must
+// therefore only have side effects on the database through tx, since it may run more than once.
+func RunInTx(ctx context.Context, db DB, fn func(tx pgx.Tx) error) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // No-op once the transaction has been committed.
+
+	if _, err := tx.Exec(ctx, "SAVEPOINT cockroach_restart"); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn(tx)
+		if err == nil {
+			// Releasing the savepoint is where CockroachDB reports most serialization failures.
+			if _, err = tx.Exec(ctx, "RELEASE SAVEPOINT cockroach_restart"); err == nil {
+				return tx.Commit(ctx)
+			}
+		}
+		if !IsRetryable(err) || attempt >= maxTxAttempts {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "ROLLBACK TO SAVEPOINT cockroach_restart"); err != nil {
+			return err
+		}
+	}
+}
+
+// IsRetryable reports whether err is a serialization failure that should be retried.
+func IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "40001"
+}
+
+// IsConstraintViolation reports whether err is a write rejected because of the values written:
+// a constraint checked by a repository, or a CockroachDB data exception (class 22) or integrity
+// constraint violation (class 23), such as a value too long for its column or a duplicate key.
+func IsConstraintViolation(err error) bool {
+	if errors.Is(err, ErrConstraintViolation) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23"))
+}
+
+// NewCockroachModels creates Models backed by CockroachDB without running migrations.
+// keys encrypts the columns that hold card details.
+func NewCockroachModels(db DB, keys *KeyRing) Models {
+	return Models{
+		Payments:   NewCockroachPaymentRepository(db, keys),           // Initialize the payment repository.
+		Events:     NewCockroachSubscriptionEventRepository(db, keys), // Initialize the subscription event history.
+		Deliveries: NewCockroachWebhookDeliveryRepository(db),         // Initialize the processed webhook deliveries.
+		Archive:    NewCockroachWebhookArchiveRepository(db, keys),    // Initialize the archive of received webhooks.
+		Outbox:     NewCockroachOutboxRepository(db),                  // Initialize the outbox repository.
+		Catalog:    NewCockroachCatalogRepository(db),                 // Initialize the product catalog.
+		Usage:      NewCockroachUsageRepository(db),                   // Initialize the usage of metered subscriptions.
+		Reports:    NewCockroachReconciliationRepository(db),          // Initialize the reconciliation reports.
+		Trials:     NewCockroachTrialRepository(db),                   // Initialize the trials of subscriptions.
+		Renewals:   NewCockroachRenewalNoticeRepository(db),           // Initialize the renewal notices sent.
+		tx:         cockroachTxRunner{db, keys},
+	}
+}
+
+// cockroachTxRunner runs Models.RunInTx callbacks in a CockroachDB transaction using RunInTx.
+type cockroachTxRunner struct {
+	db   DB
+	keys *KeyRing
+}
+
+func (r cockroachTxRunner) runInTx(ctx context.Context, fn func(tx Models) error) error {
+	return RunInTx(ctx, r.db, func(tx pgx.Tx) error {
+		models := NewCockroachModels(tx, r.keys)
+		models.inTx = true
+		return fn(models)
+	})
+}
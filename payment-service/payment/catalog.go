@@ -0,0 +1,88 @@
+package payment
+
+import (
+	"context"
+	"time"
+)
+
+// Store is a Lemon Squeezy store. Its currency is the currency of the prices of its variants.
+type Store struct {
+	ID       string `json:"-"`
+	Name     string `json:"name"`
+	Currency string `json:"currency"` // ISO 4217 code.
+}
+
+// Product is a Lemon Squeezy product, a plan whose variants are the ways of paying for it.
+type Product struct {
+	ID          string    `json:"-"`
+	StoreID     int64     `json:"store_id"`
+	Name        string    `json:"name"`
+	Slug        string    `json:"slug"`
+	Description string    `json:"description"` // HTML.
+	Status      string    `json:"status"`      // draft or published.
+	BuyNowURL   string    `json:"buy_now_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Variant is a Lemon Squeezy variant: a price of a product, and for subscriptions its billing interval and trial.
+type Variant struct {
+	ID                 string    `json:"-"`
+	ProductID          int64     `json:"product_id"`
+	Name               string    `json:"name"`
+	Slug               string    `json:"slug"`
+	Description        string    `json:"description"` // HTML.
+	Status             string    `json:"status"`      // pending, draft or published.
+	Price              int64     `json:"price"`       // In minor units of the store's currency.
+	IsSubscription     bool      `json:"is_subscription"`
+	Interval           string    `json:"interval"`       // day, week, month or year; empty unless IsSubscription.
+	IntervalCount      int       `json:"interval_count"` // Number of intervals between charges.
+	HasFreeTrial       bool      `json:"has_free_trial"`
+	TrialInterval      string    `json:"trial_interval"`       // day, week, month or year.
+	TrialIntervalCount int       `json:"trial_interval_count"` // Length of the trial in TrialInterval units.
+	Sort               int       `json:"sort"`                 // Position of the variant among those of its product.
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// ListStores retrieves the stores the API key has access to.
+func (p *PaymentService) ListStores(ctx context.Context) ([]*Store, error) {
+	var stores []*Store
+	err := p.listAll(ctx, "/v1/stores", func(r resource) error {
+		store := &Store{ID: r.ID}
+		stores = append(stores, store)
+		return r.decode("store", store)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stores, nil
+}
+
+// ListProducts retrieves the products of the stores the API key has access to.
+func (p *PaymentService) ListProducts(ctx context.Context) ([]*Product, error) {
+	var products []*Product
+	err := p.listAll(ctx, "/v1/products", func(r resource) error {
+		product := &Product{ID: r.ID}
+		products = append(products, product)
+		return r.decode("product", product)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// ListVariants retrieves the variants of the products of the stores the API key has access to.
+func (p *PaymentService) ListVariants(ctx context.Context) ([]*Variant, error) {
+	var variants []*Variant
+	err := p.listAll(ctx, "/v1/variants", func(r resource) error {
+		variant := &Variant{ID: r.ID}
+		variants = append(variants, variant)
+		return r.decode("variant", variant)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return variants, nil
+}
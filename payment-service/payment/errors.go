@@ -0,0 +1,68 @@
+package payment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors matched by the errors the Lemon Squeezy client returns, with errors.Is.
+var (
+	ErrNotFound     = errors.New("lemon squeezy: resource not found")
+	ErrUnauthorized = errors.New("lemon squeezy: API key is missing or invalid")
+	ErrInvalid      = errors.New("lemon squeezy: request was rejected")
+	ErrRateLimited  = errors.New("lemon squeezy: rate limit exceeded")
+	ErrUnavailable  = errors.New("lemon squeezy: service unavailable")
+)
+
+// APIError is an error response of the Lemon Squeezy API.
+// It matches one of the Err variables depending on its status code.
+type APIError struct {
+	StatusCode int    // HTTP status of the response.
+	Title      string // Title of the first JSON:API error, if any.
+	Detail     string // Detail of the first JSON:API error, if any.
+}
+
+func (e *APIError) Error() string {
+	message := e.Detail
+	if message == "" {
+		message = e.Title
+	}
+	if message == "" {
+		message = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("lemon squeezy: %d %s", e.StatusCode, message)
+}
+
+// Is reports whether target is the Err variable for the status code of e.
+func (e *APIError) Is(target error) bool {
+	switch {
+	case e.StatusCode == http.StatusNotFound:
+		return target == ErrNotFound
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return target == ErrUnauthorized
+	case e.StatusCode == http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case e.StatusCode >= 500:
+		return target == ErrUnavailable
+	case e.StatusCode >= 400:
+		return target == ErrInvalid
+	}
+	return false
+}
+
+// newAPIError builds the APIError of a response with the given status code and JSON:API error body.
+func newAPIError(statusCode int, body []byte) *APIError {
+	var document struct {
+		Errors []struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		} `json:"errors"`
+	}
+	apiErr := &APIError{StatusCode: statusCode}
+	if json.Unmarshal(body, &document) == nil && len(document.Errors) > 0 {
+		apiErr.Title, apiErr.Detail = document.Errors[0].Title, document.Errors[0].Detail
+	}
+	return apiErr
+}
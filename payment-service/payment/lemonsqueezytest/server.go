@@ -0,0 +1,498 @@
+// Package lemonsqueezytest provides a local stand-in for the Lemon Squeezy API, for testing clients offline.
+//
+// The Server implements the JSON:API subscription, checkout, catalog and usage endpoints the payment package uses, with the same
+// authentication, pagination and error documents as Lemon Squeezy, and can be told to fail requests
+// to exercise retries.
+package lemonsqueezytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a running stand-in for the Lemon Squeezy API.
+type Server struct {
+	URL string // Base URL of the server, for payment.Config.BaseURL.
+
+	server        *httptest.Server
+	apiKey        string
+	mu            sync.Mutex
+	subscriptions map[string]map[string]interface{}            // Attributes of the subscriptions by ID.
+	catalog       map[string]map[string]map[string]interface{} // Attributes of the stores, products and variants by type and ID.
+	items         map[string]*subscriptionItem                 // Usage-based subscription items by ID.
+	checkouts     map[string]map[string]interface{}            // Attributes of the checkouts created, by ID.
+	failures      []failure                                    // Responses to send instead of handling the next requests.
+	requests      int
+}
+
+// subscriptionItem is the current billing period of a usage-based subscription item and its usage.
+type subscriptionItem struct {
+	periodStart, periodEnd time.Time
+	quantity               int64
+}
+
+// failure is a response queued by FailNext.
+type failure struct {
+	status     int
+	retryAfter string
+}
+
+// NewServer starts a stand-in that accepts requests authenticated with apiKey.
+// Close it when done.
+func NewServer(apiKey string) *Server {
+	s := &Server{apiKey: apiKey, subscriptions: map[string]map[string]interface{}{}, catalog: map[string]map[string]map[string]interface{}{}, items: map[string]*subscriptionItem{}, checkouts: map[string]map[string]interface{}{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/subscriptions", s.listHandler("subscriptions", s.subscriptions))
+	mux.HandleFunc("/v1/subscriptions/", s.subscription)
+	for _, typ := range []string{"stores", "products", "variants"} {
+		s.catalog[typ] = map[string]map[string]interface{}{}
+		mux.HandleFunc("/v1/"+typ, s.listHandler(typ, s.catalog[typ]))
+	}
+	mux.HandleFunc("/v1/checkouts", s.createCheckout)
+	mux.HandleFunc("/v1/usage-records", s.usageRecord)
+	mux.HandleFunc("/v1/subscription-items/", s.currentUsage)
+	s.server = httptest.NewServer(s.authenticate(mux))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// AddSubscription stores a subscription with the given ID and JSON:API attributes, replacing any with the same ID.
+func (s *Server) AddSubscription(id string, attributes map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := make(map[string]interface{}, len(attributes))
+	for name, value := range attributes {
+		copied[name] = value
+	}
+	s.subscriptions[id] = copied
+}
+
+// AddStore stores a store with the given ID and JSON:API attributes, replacing any with the same ID.
+func (s *Server) AddStore(id string, attributes map[string]interface{}) {
+	s.addCatalog("stores", id, attributes)
+}
+
+// AddProduct stores a product with the given ID and JSON:API attributes, replacing any with the same ID.
+func (s *Server) AddProduct(id string, attributes map[string]interface{}) {
+	s.addCatalog("products", id, attributes)
+}
+
+// AddVariant stores a variant with the given ID and JSON:API attributes, replacing any with the same ID.
+func (s *Server) AddVariant(id string, attributes map[string]interface{}) {
+	s.addCatalog("variants", id, attributes)
+}
+
+// RemoveVariant deletes the variant with the given ID, as if it was deleted in the dashboard.
+func (s *Server) RemoveVariant(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.catalog["variants"], id)
+}
+
+func (s *Server) addCatalog(typ, id string, attributes map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := make(map[string]interface{}, len(attributes))
+	for name, value := range attributes {
+		copied[name] = value
+	}
+	s.catalog[typ][id] = copied
+}
+
+// AddSubscriptionItem stores a usage-based subscription item with the given ID, in the billing period from
+// periodStart to periodEnd and without usage, replacing any with the same ID.
+func (s *Server) AddSubscriptionItem(id string, periodStart, periodEnd time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[id] = &subscriptionItem{periodStart: periodStart, periodEnd: periodEnd}
+}
+
+// Usage returns the usage reported for the current billing period of the subscription item with the given ID.
+func (s *Server) Usage(id string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item, ok := s.items[id]; ok {
+		return item.quantity
+	}
+	return 0
+}
+
+// Subscription returns the attributes of the subscription with the given ID, or nil if there is none.
+func (s *Server) Subscription(id string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subscriptions[id]
+}
+
+// FailNext makes the next n requests fail with status. retryAfter is sent as the Retry-After header if not empty.
+func (s *Server) FailNext(n, status int, retryAfter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, failure{status: status, retryAfter: retryAfter})
+	}
+}
+
+// Checkout returns the attributes of the checkout with the given ID, or nil if none was created.
+func (s *Server) Checkout(id string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkouts[id]
+}
+
+// Requests returns the number of requests received, including failed ones.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// authenticate counts requests, sends queued failures and checks the API key before calling next.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		var queued *failure
+		if len(s.failures) > 0 {
+			queued = &s.failures[0]
+			s.failures = s.failures[1:]
+		}
+		s.mu.Unlock()
+
+		if queued != nil {
+			if queued.retryAfter != "" {
+				w.Header().Set("Retry-After", queued.retryAfter)
+			}
+			writeError(w, queued.status, http.StatusText(queued.status))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+s.apiKey {
+			writeError(w, http.StatusUnauthorized, "Unauthenticated.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listHandler serves GET /v1/{typ}, the resources in items ordered by ID, with page[number] and page[size].
+func (s *Server) listHandler(typ string, items map[string]map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+			return
+		}
+		number, size := queryInt(r, "page[number]", 1), queryInt(r, "page[size]", 10)
+		if number < 1 || size < 1 || size > 100 {
+			writeError(w, http.StatusBadRequest, "Invalid page.")
+			return
+		}
+
+		s.mu.Lock()
+		ids := make([]string, 0, len(items))
+		for id := range items {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			// Lemon Squeezy IDs are numbers; order them numerically when they are.
+			a, errA := strconv.ParseInt(ids[i], 10, 64)
+			b, errB := strconv.ParseInt(ids[j], 10, 64)
+			if errA == nil && errB == nil {
+				return a < b
+			}
+			return ids[i] < ids[j]
+		})
+		lastPage := (len(ids) + size - 1) / size
+		if lastPage == 0 {
+			lastPage = 1
+		}
+		data := []interface{}{}
+		for i := (number - 1) * size; i < len(ids) && i < number*size; i++ {
+			if typ == "subscriptions" {
+				data = append(data, s.resource(ids[i]))
+			} else {
+				data = append(data, map[string]interface{}{
+					"type":       typ,
+					"id":         ids[i],
+					"attributes": items[ids[i]],
+					"links":      map[string]string{"self": s.URL + "/v1/" + typ + "/" + ids[i]},
+				})
+			}
+		}
+		s.mu.Unlock()
+
+		links := map[string]interface{}{
+			"first": s.pageURL(typ, 1, size),
+			"last":  s.pageURL(typ, lastPage, size),
+		}
+		if number < lastPage {
+			links["next"] = s.pageURL(typ, number+1, size)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"jsonapi": map[string]string{"version": "1.0"},
+			"meta": map[string]interface{}{"page": map[string]int{
+				"currentPage": number,
+				"lastPage":    lastPage,
+				"perPage":     size,
+				"total":       len(ids),
+			}},
+			"links": links,
+			"data":  data,
+		})
+	}
+}
+
+// subscription serves GET, PATCH and DELETE /v1/subscriptions/{id}.
+// DELETE cancels the subscription, as it does on Lemon Squeezy.
+func (s *Server) subscription(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/subscriptions/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attributes, ok := s.subscriptions[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var request struct {
+			Data struct {
+				Type       string                 `json:"type"`
+				ID         string                 `json:"id"`
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &request); err != nil || request.Data.Type != "subscriptions" || request.Data.ID != id {
+			writeError(w, http.StatusUnprocessableEntity, "The data must be a subscriptions resource with the ID of the URL.")
+			return
+		}
+		for name, value := range request.Data.Attributes {
+			attributes[name] = value
+		}
+		if cancelled, ok := request.Data.Attributes["cancelled"].(bool); ok {
+			attributes["status"] = map[bool]string{true: "cancelled", false: "active"}[cancelled]
+		}
+		if pause, ok := request.Data.Attributes["pause"]; ok {
+			attributes["status"] = map[bool]string{true: "active", false: "paused"}[pause == nil]
+		}
+	case http.MethodDelete:
+		attributes["cancelled"] = true
+		attributes["status"] = "cancelled"
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jsonapi": map[string]string{"version": "1.0"},
+		"data":    s.resource(id),
+	})
+}
+
+// resource returns the JSON:API resource of a subscription. The caller must hold s.mu.
+// Unless the subscription was added with its own, its urls point at this server, like the signed
+// links Lemon Squeezy generates for each response.
+func (s *Server) resource(id string) map[string]interface{} {
+	attributes := make(map[string]interface{}, len(s.subscriptions[id])+1)
+	for name, value := range s.subscriptions[id] {
+		attributes[name] = value
+	}
+	if _, ok := attributes["urls"]; !ok {
+		attributes["urls"] = map[string]string{
+			"update_payment_method": s.URL + "/subscription/" + id + "/payment-details?signature=test",
+			"customer_portal":       s.URL + "/billing?signature=test",
+		}
+	}
+	return map[string]interface{}{
+		"type":       "subscriptions",
+		"id":         id,
+		"attributes": attributes,
+		"links":      map[string]string{"self": s.URL + "/v1/subscriptions/" + id},
+	}
+}
+
+// createCheckout serves POST /v1/checkouts, which creates a checkout for a variant added with AddVariant.
+func (s *Server) createCheckout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	type relationship struct {
+		Data struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+		} `json:"data"`
+	}
+	var request struct {
+		Data struct {
+			Type          string                 `json:"type"`
+			Attributes    map[string]interface{} `json:"attributes"`
+			Relationships struct {
+				Store   relationship `json:"store"`
+				Variant relationship `json:"variant"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &request); err != nil || request.Data.Type != "checkouts" || request.Data.Relationships.Store.Data.ID == "" {
+		writeError(w, http.StatusUnprocessableEntity, "The data must be a checkouts resource with a store and a variant.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	variantID := request.Data.Relationships.Variant.Data.ID
+	if _, ok := s.catalog["variants"][variantID]; !ok {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	id := strconv.Itoa(len(s.checkouts) + 1)
+	attributes := request.Data.Attributes
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	attributes["store_id"], _ = strconv.Atoi(request.Data.Relationships.Store.Data.ID)
+	attributes["variant_id"], _ = strconv.Atoi(variantID)
+	attributes["url"] = s.URL + "/checkout/custom/" + id + "?signature=test"
+	s.checkouts[id] = attributes
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"jsonapi": map[string]string{"version": "1.0"},
+		"data": map[string]interface{}{
+			"type":       "checkouts",
+			"id":         id,
+			"attributes": attributes,
+			"links":      map[string]string{"self": s.URL + "/v1/checkouts/" + id},
+		},
+	})
+}
+
+// usageRecord serves POST /v1/usage-records, which adds to or sets the usage of a subscription item.
+func (s *Server) usageRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	var request struct {
+		Data struct {
+			Type       string `json:"type"`
+			Attributes struct {
+				Quantity *int64 `json:"quantity"`
+				Action   string `json:"action"`
+			} `json:"attributes"`
+			Relationships struct {
+				SubscriptionItem struct {
+					Data struct {
+						Type string `json:"type"`
+						ID   string `json:"id"`
+					} `json:"data"`
+				} `json:"subscription-item"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &request); err != nil || request.Data.Type != "usage-records" {
+		writeError(w, http.StatusUnprocessableEntity, "The data must be a usage-records resource.")
+		return
+	}
+	attributes := request.Data.Attributes
+	if attributes.Quantity == nil || *attributes.Quantity < 0 || (attributes.Action != "increment" && attributes.Action != "set") {
+		writeError(w, http.StatusUnprocessableEntity, "The quantity must be at least 0 and the action increment or set.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := request.Data.Relationships.SubscriptionItem.Data.ID
+	item, ok := s.items[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	if attributes.Action == "set" {
+		item.quantity = *attributes.Quantity
+	} else {
+		item.quantity += *attributes.Quantity
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"jsonapi": map[string]string{"version": "1.0"},
+		"data": map[string]interface{}{
+			"type": "usage-records",
+			"id":   strconv.Itoa(s.requests),
+			"attributes": map[string]interface{}{
+				"subscription_item_id": id,
+				"quantity":             *attributes.Quantity,
+				"action":               attributes.Action,
+			},
+		},
+	})
+}
+
+// currentUsage serves GET /v1/subscription-items/{id}/current-usage.
+func (s *Server) currentUsage(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/subscription-items/"), "/current-usage")
+	if !ok || r.Method != http.MethodGet {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jsonapi": map[string]string{"version": "1.0"},
+		"meta": map[string]interface{}{
+			"period_start":      item.periodStart.Format(time.RFC3339),
+			"period_end":        item.periodEnd.Format(time.RFC3339),
+			"quantity":          item.quantity,
+			"interval_unit":     "month",
+			"interval_quantity": 1,
+		},
+	})
+}
+
+func (s *Server) pageURL(typ string, number, size int) string {
+	return fmt.Sprintf("%s/v1/%s?page%%5Bnumber%%5D=%d&page%%5Bsize%%5D=%d", s.URL, typ, number, size)
+}
+
+// queryInt returns the integer query parameter name of r, or def if it is missing or not an integer.
+func queryInt(r *http.Request, name string, def int) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get(name)); err == nil {
+		return n
+	}
+	return def
+}
+
+// writeError writes a JSON:API error document.
+func writeError(w http.ResponseWriter, status int, detail string) {
+	writeJSON(w, status, map[string]interface{}{
+		"jsonapi": map[string]string{"version": "1.0"},
+		"errors": []map[string]string{{
+			"status": strconv.Itoa(status),
+			"title":  http.StatusText(status),
+			"detail": detail,
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, document interface{}) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(document)
+}
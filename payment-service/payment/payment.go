@@ -2,7 +2,18 @@
 package payment
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os" // Used for accessing environment variables.
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/NdoleStudio/lemonsqueezy-go" // Import the Lemon Squeezy Go SDK for payment processing.
 	"github.com/joho/godotenv"               // Import godotenv for loading environment variables from a .env file.
@@ -11,70 +22,396 @@ import (
 // Payment is an interface that defines the methods that a payment service should implement.
 // This allows for easy swapping of payment service implementations if needed.
 type Payment interface {
-	CreateSubscription(planID string, customerEmail string, otherDetails map[string]interface{}) (*lemonsqueezy.Subscription, error)
-	CancelSubscription(subscriptionID string) error
-	GetAllSubscriptions() ([]*lemonsqueezy.Subscription, error)
-	UpdateSubscription(subscriptionID string, updates map[string]interface{}) (*lemonsqueezy.Subscription, error)
-	GetSubscription(subscriptionID string) (*lemonsqueezy.Subscription, error)
+	CreateSubscription(ctx context.Context, planID string, customerEmail string, otherDetails map[string]interface{}) (*Checkout, error)
+	CancelSubscription(ctx context.Context, subscriptionID string) error
+	GetAllSubscriptions(ctx context.Context) ([]*Subscription, error)
+	UpdateSubscription(ctx context.Context, subscriptionID string, updates map[string]interface{}) (*Subscription, error)
+	GetSubscription(ctx context.Context, subscriptionID string) (*Subscription, error)
+	ListStores(ctx context.Context) ([]*Store, error)
+	ListProducts(ctx context.Context) ([]*Product, error)
+	ListVariants(ctx context.Context) ([]*Variant, error)
+	CreateUsageRecord(ctx context.Context, subscriptionItemID, quantity int64, action string) error
+	GetCurrentUsage(ctx context.Context, subscriptionItemID int64) (*Usage, error)
+}
+
+// Subscription is a Lemon Squeezy subscription: its ID and the attributes decoded by the SDK.
+type Subscription struct {
+	ID string `json:"id"` // Lemon Squeezy subscription ID, as used in webhooks and payments.subscription_id.
+	lemonsqueezy.Subscription
+	URLs SubscriptionURLs `json:"urls"` // Links for the customer, the SDK's Urls.
+	// FirstSubscriptionItem is the item usage is reported against, or nil if Lemon Squeezy didn't send it.
+	// It is the SDK's FirstSubscriptionItem with 64-bit IDs, like the other IDs of this package.
+	FirstSubscriptionItem *SubscriptionItem `json:"first_subscription_item"`
+}
+
+// newSubscription returns the Subscription of a subscription resource decoded by the SDK.
+func newSubscription(data lemonsqueezy.ApiResponseData[lemonsqueezy.Subscription, lemonsqueezy.ApiResponseRelationshipsSubscription]) *Subscription {
+	subscription := &Subscription{ID: data.ID, Subscription: data.Attributes, URLs: SubscriptionURLs(data.Attributes.Urls)}
+	if item := data.Attributes.FirstSubscriptionItem; item != nil {
+		subscription.FirstSubscriptionItem = &SubscriptionItem{
+			ID:             int64(item.ID),
+			SubscriptionID: int64(item.SubscriptionID),
+			PriceID:        int64(item.PriceID),
+			Quantity:       int64(item.Quantity),
+			IsUsageBased:   item.IsUsageBased,
+		}
+	}
+	return subscription
+}
+
+// Checkout is a Lemon Squeezy checkout. Lemon Squeezy has no API for creating subscriptions: one is created
+// when a customer completes a checkout for a subscription variant.
+type Checkout struct {
+	ID        string     `json:"id"`
+	URL       string     `json:"url"`        // Page where the customer pays.
+	ExpiresAt *time.Time `json:"expires_at"` // Nil if the checkout doesn't expire.
+}
+
+// SubscriptionURLs are the signed links Lemon Squeezy returns with a subscription. They expire after 24 hours,
+// so they are fetched again whenever they are shown.
+type SubscriptionURLs struct {
+	UpdatePaymentMethod string `json:"update_payment_method"` // Page where the customer changes their card.
+	CustomerPortal      string `json:"customer_portal"`       // Customer portal, signed in as the subscription's customer.
+}
+
+// DefaultBaseURL is the URL of the Lemon Squeezy API.
+const DefaultBaseURL = "https://api.lemonsqueezy.com"
+
+// listPageSize is the number of resources requested per page, the maximum Lemon Squeezy allows.
+const listPageSize = 100
+
+// Config configures a PaymentService.
+type Config struct {
+	APIKey     string        // API key sent as a bearer token.
+	StoreID    int           // Store that CreateSubscription creates checkouts in.
+	BaseURL    string        // URL of the API, DefaultBaseURL if empty. Tests point it at a lemonsqueezytest.Server.
+	HTTPClient *http.Client  // Client whose transport sends the requests, http.DefaultClient if nil.
+	MaxRetries int           // Number of retries of rate-limited requests, and of idempotent ones that got no response.
+	Backoff    time.Duration // Wait before the first retry of a request that got no response, doubled for each retry.
+	MaxWait    time.Duration // Longest wait before a retry; requests Lemon Squeezy asks to wait longer for fail with ErrRateLimited.
 }
 
 // PaymentService struct implements the Payment interface using the Lemon Squeezy API.
 type PaymentService struct {
-	Client *lemonsqueezy.Client // Holds the Lemon Squeezy client instance.
+	Client     *lemonsqueezy.Client // Holds the Lemon Squeezy client instance.
+	httpClient *http.Client         // httpClient retries requests; Client sends its requests through it too.
+	baseURL    string
+	apiKey     string
+	storeID    int
 }
 
 // NewPayment initializes a new payment client using environment variables.
-// It loads the environment variables from a .env file and uses the LEMON_SQUEEZY_API_KEY for authentication.
+// It authenticates with LEMON_SQUEEZY_API_KEY and sends requests to LEMON_SQUEEZY_API_URL, or to
+// DefaultBaseURL if it is not set. Checkouts are created in the store LEMON_SQUEEZY_STORE_ID, if set.
+// A .env file is loaded first if there is one.
 // Returns a Payment interface implementation and any error encountered during initialization.
 func NewPayment() (Payment, error) {
-	// Load environment variables from a .env file.
-	if err := godotenv.Load(".env"); err != nil {
-		return nil, err // Return nil and the error if loading fails.
+	// Load environment variables from a .env file; in containers they are set directly.
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
 	}
 
 	// Retrieve the API key from the environment variables.
 	apiKey := os.Getenv("LEMON_SQUEEZY_API_KEY")
+	if apiKey == "" {
+		return nil, fmt.Errorf("LEMON_SQUEEZY_API_KEY is not set")
+	}
+	var storeID int
+	if value := os.Getenv("LEMON_SQUEEZY_STORE_ID"); value != "" {
+		var err error
+		if storeID, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid LEMON_SQUEEZY_STORE_ID %q", value)
+		}
+	}
+	return NewPaymentService(Config{
+		APIKey:     apiKey,
+		StoreID:    storeID,
+		BaseURL:    os.Getenv("LEMON_SQUEEZY_API_URL"),
+		MaxRetries: 3,
+		Backoff:    time.Second,
+		MaxWait:    time.Minute,
+	}), nil
+}
 
-	// Initialize a new Lemon Squeezy client with the API key.
-	client := lemonsqueezy.New(lemonsqueezy.WithAPIKey(apiKey))
+// NewPaymentService creates a PaymentService from cfg.
+func NewPaymentService(cfg Config) *PaymentService {
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	next := http.DefaultTransport
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if cfg.HTTPClient != nil {
+		if cfg.HTTPClient.Transport != nil {
+			next = cfg.HTTPClient.Transport
+		}
+		httpClient.Timeout = cfg.HTTPClient.Timeout
+	}
+	retries := &retryTransport{next: next, maxRetries: cfg.MaxRetries, backoff: cfg.Backoff, maxWait: cfg.MaxWait}
+	httpClient.Transport = &pageTransport{next: retries}
 
-	// Return a new PaymentService instance with the initialized client.
-	return &PaymentService{
-		Client: client,
-	}, nil
+	// Initialize a new Lemon Squeezy client with the API key.
+	client := lemonsqueezy.New(
+		lemonsqueezy.WithAPIKey(cfg.APIKey),
+		lemonsqueezy.WithBaseURL(baseURL),
+		lemonsqueezy.WithHTTPClient(httpClient),
+	)
+	return &PaymentService{Client: client, httpClient: httpClient, baseURL: baseURL, apiKey: cfg.APIKey, storeID: cfg.StoreID}
 }
 
-// CreateSubscription creates a new subscription for a customer with the specified plan ID and other details.
-// Returns the created subscription object or an error if the operation fails.
-func (p *PaymentService) CreateSubscription(planID string, customerEmail string, otherDetails map[string]interface{}) (*lemonsqueezy.Subscription, error) {
-	// Implementation goes here.
-	return nil, nil
+// CreateSubscription creates a checkout for the variant planID, prefilled with customerEmail if not empty
+// and carrying otherDetails as custom data, which Lemon Squeezy returns in meta.custom_data of the webhooks
+// of the subscription. The subscription is created once the customer pays, so the checkout is returned.
+func (p *PaymentService) CreateSubscription(ctx context.Context, planID string, customerEmail string, otherDetails map[string]interface{}) (*Checkout, error) {
+	if p.storeID == 0 {
+		return nil, fmt.Errorf("LEMON_SQUEEZY_STORE_ID is not set")
+	}
+	variantID, err := strconv.Atoi(planID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid variant %q", ErrInvalid, planID)
+	}
+	attributes := &lemonsqueezy.CheckoutCreateAttributes{
+		CheckoutData: lemonsqueezy.CheckoutCreateData{Email: customerEmail, Custom: otherDetails},
+	}
+	checkout, response, err := p.Client.Checkouts.Create(ctx, p.storeID, variantID, attributes)
+	if err != nil {
+		return nil, apiError(response, err)
+	}
+	return &Checkout{ID: checkout.Data.ID, URL: checkout.Data.Attributes.URL, ExpiresAt: checkout.Data.Attributes.ExpiresAt}, nil
 }
 
 // CancelSubscription cancels an ongoing subscription identified by the subscriptionID.
+// The subscription stays active until the end of the billing period and can be resumed until then.
 // Returns an error if the operation fails.
-func (p *PaymentService) CancelSubscription(subscriptionID string) error {
-	// Implementation goes here.
-	return nil
+func (p *PaymentService) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	_, response, err := p.Client.Subscriptions.Cancel(ctx, subscriptionID)
+	return apiError(response, err)
 }
 
-// GetAllSubscriptions retrieves all subscriptions managed by the payment service.
+// GetAllSubscriptions retrieves all subscriptions of the stores the API key has access to, following
+// the pages of the list. The SDK lists the first page only, so each page is asked for through the context.
 // Returns a slice of subscription objects or an error if the operation fails.
-func (p *PaymentService) GetAllSubscriptions() ([]*lemonsqueezy.Subscription, error) {
-	// Implementation goes here.
-	return nil, nil
+func (p *PaymentService) GetAllSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	var subscriptions []*Subscription
+	for page := 1; ; page++ {
+		list, response, err := p.Client.Subscriptions.List(withPage(ctx, page))
+		if err != nil {
+			return nil, apiError(response, err)
+		}
+		for _, data := range list.Data {
+			subscriptions = append(subscriptions, newSubscription(data))
+		}
+		if len(list.Data) == 0 || list.Meta.Page.CurrentPage >= list.Meta.Page.LastPage {
+			return subscriptions, nil
+		}
+	}
+}
+
+// sdkUpdateAttributes are the attributes the SDK's update parameters can send.
+var sdkUpdateAttributes = map[string]bool{
+	"product_id": true, "variant_id": true, "billing_anchor": true, "cancelled": true,
+	"pause": true, "invoice_immediately": true, "disable_prorations": true,
 }
 
 // UpdateSubscription updates an existing subscription identified by the subscriptionID with the provided updates.
+// updates are JSON:API attributes, such as variant_id, pause or cancelled, and are sent through the SDK.
+// The SDK sends cancelled with every update, so unless updates set it, the subscription is fetched first
+// to keep it as it is. The SDK can't send a pause without resumes_at, or a null pause to unpause, so those
+// updates are sent as they are.
 // Returns the updated subscription object or an error if the operation fails.
-func (p *PaymentService) UpdateSubscription(subscriptionID string, updates map[string]interface{}) (*lemonsqueezy.Subscription, error) {
-	// Implementation goes here.
-	return nil, nil
+func (p *PaymentService) UpdateSubscription(ctx context.Context, subscriptionID string, updates map[string]interface{}) (*Subscription, error) {
+	attributes, ok := sdkUpdate(updates)
+	if !ok {
+		return p.patchSubscription(ctx, subscriptionID, updates)
+	}
+	if _, ok := updates["cancelled"]; !ok {
+		current, err := p.GetSubscription(ctx, subscriptionID)
+		if err != nil {
+			return nil, err
+		}
+		attributes.Cancelled = current.Cancelled
+	}
+	params := &lemonsqueezy.SubscriptionUpdateParams{ID: subscriptionID, Attributes: attributes}
+	subscription, response, err := p.Client.Subscriptions.Update(ctx, params)
+	if err != nil {
+		return nil, apiError(response, err)
+	}
+	return newSubscription(subscription.Data), nil
+}
+
+// sdkUpdate returns the SDK's update parameters for updates, or false if they can't express them.
+func sdkUpdate(updates map[string]interface{}) (lemonsqueezy.SubscriptionUpdateParamsAttributes, bool) {
+	var attributes lemonsqueezy.SubscriptionUpdateParamsAttributes
+	for name, value := range updates {
+		if !sdkUpdateAttributes[name] {
+			return attributes, false
+		}
+		if pause, ok := value.(map[string]interface{}); name == "pause" && (!ok || pause["resumes_at"] == nil) {
+			return attributes, false
+		}
+	}
+	encoded, err := json.Marshal(updates)
+	if err != nil || json.Unmarshal(encoded, &attributes) != nil {
+		return attributes, false
+	}
+	return attributes, true
+}
+
+// patchSubscription sends updates the SDK can't express as they are.
+func (p *PaymentService) patchSubscription(ctx context.Context, subscriptionID string, updates map[string]interface{}) (*Subscription, error) {
+	request := map[string]interface{}{
+		"data": map[string]interface{}{"type": "subscriptions", "id": subscriptionID, "attributes": updates},
+	}
+	var document lemonsqueezy.SubscriptionApiResponse
+	if err := p.do(ctx, http.MethodPatch, "/v1/subscriptions/"+url.PathEscape(subscriptionID), request, &document); err != nil {
+		return nil, err
+	}
+	return newSubscription(document.Data), nil
 }
 
-// GetSubscription retrieves a specific subscription identified by the subscriptionID.
+// GetSubscription retrieves a specific subscription identified by the subscriptionID, with fresh URLs.
 // Returns the subscription object or an error if the operation fails.
-func (p *PaymentService) GetSubscription(subscriptionID string) (*lemonsqueezy.Subscription, error) {
-	// Implementation goes here.
-	return nil, nil
+func (p *PaymentService) GetSubscription(ctx context.Context, subscriptionID string) (*Subscription, error) {
+	subscription, response, err := p.Client.Subscriptions.Get(ctx, url.PathEscape(subscriptionID))
+	if err != nil {
+		return nil, apiError(response, err)
+	}
+	return newSubscription(subscription.Data), nil
+}
+
+// pageKey is the context key of the page of a list that pageTransport asks for.
+type pageKey struct{}
+
+// withPage returns a copy of ctx whose list requests ask for the given page of listPageSize resources.
+func withPage(ctx context.Context, page int) context.Context {
+	return context.WithValue(ctx, pageKey{}, page)
+}
+
+// pageTransport adds the page of the request's context, set by withPage, to the query of a GET request.
+// The SDK's List methods take no paging parameters.
+type pageTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip sends req, asking for the page of its context if it has one.
+func (t *pageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	page, ok := req.Context().Value(pageKey{}).(int)
+	if !ok || req.Method != http.MethodGet {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Set("page[number]", strconv.Itoa(page))
+	query.Set("page[size]", strconv.Itoa(listPageSize))
+	req.URL.RawQuery = query.Encode()
+	return t.next.RoundTrip(req)
+}
+
+// resource is a resource of a JSON:API document.
+type resource struct {
+	ID         string          `json:"id"`
+	Attributes json.RawMessage `json:"attributes"`
+}
+
+// decode decodes the attributes of r, a resource of the given kind, into v.
+func (r resource) decode(kind string, v interface{}) error {
+	if err := json.Unmarshal(r.Attributes, v); err != nil {
+		return fmt.Errorf("decoding %s %s: %w", kind, r.ID, err)
+	}
+	return nil
+}
+
+// listAll calls each for every resource of the JSON:API list at path, requesting its pages in turn.
+func (p *PaymentService) listAll(ctx context.Context, path string, each func(resource) error) error {
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("page[number]", strconv.Itoa(page))
+		query.Set("page[size]", strconv.Itoa(listPageSize))
+		var document struct {
+			Data []resource `json:"data"`
+			Meta struct {
+				Page struct {
+					CurrentPage int `json:"currentPage"`
+					LastPage    int `json:"lastPage"`
+				} `json:"page"`
+			} `json:"meta"`
+		}
+		if err := p.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil, &document); err != nil {
+			return err
+		}
+		for _, r := range document.Data {
+			if err := each(r); err != nil {
+				return err
+			}
+		}
+		if len(document.Data) == 0 || document.Meta.Page.CurrentPage >= document.Meta.Page.LastPage {
+			return nil
+		}
+	}
+}
+
+// do sends a JSON:API request with body, if not nil, and decodes the response into out.
+// Error responses are returned as an *APIError.
+func (p *PaymentService) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.api+json")
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return transportError(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// apiError turns the result of an SDK call into the errors of this package: an *APIError for an
+// error response, an error matching ErrUnavailable if there was no response, or the SDK's error if
+// the response couldn't be decoded.
+func apiError(response *lemonsqueezy.Response, err error) error {
+	if err == nil {
+		return nil
+	}
+	if response != nil && response.HTTPResponse != nil {
+		if response.HTTPResponse.StatusCode < 400 {
+			return fmt.Errorf("decoding response: %w", err)
+		}
+		var body []byte
+		if response.Body != nil {
+			body = *response.Body
+		}
+		return newAPIError(response.HTTPResponse.StatusCode, body)
+	}
+	return transportError(err)
+}
+
+// transportError wraps an error of a request that got no response so it matches ErrUnavailable,
+// unless the caller's context ended it.
+func transportError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
 }
@@ -0,0 +1,91 @@
+package payment
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryTransport retries Lemon Squeezy requests that are safe to send again. Lemon Squeezy allows 300
+// requests a minute and answers 429 with a Retry-After header beyond that, and 503 with one while it is
+// down for maintenance; it didn't act on those requests, so they are retried, whatever their method,
+// after waiting as long as it says. A request that failed without a response may have been applied, so
+// it is only retried, with exponential backoff, if its method is idempotent. Other responses, including
+// 429 and 503 without Retry-After, are returned to the caller.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int           // Number of retries after the first attempt.
+	backoff    time.Duration // Wait before the first retry of a request that got no response, doubled for each retry.
+	maxWait    time.Duration // Longest wait before a retry; a longer Retry-After is returned to the caller instead.
+}
+
+// RoundTrip sends req, retrying it as described on retryTransport. Requests with a body are only
+// retried if the body can be read again through req.GetBody, which http.NewRequest sets up.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return t.next.RoundTrip(req)
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+		resp, err := t.next.RoundTrip(attemptReq)
+		if attempt >= t.maxRetries {
+			return resp, err
+		}
+		wait, retry := t.retryAfter(req, resp, err, attempt)
+		if !retry || wait > t.maxWait {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryAfter reports whether the outcome of an attempt of req is worth retrying and how long to wait first.
+func (t *retryTransport) retryAfter(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if err != nil {
+		// The caller's context ends the retries if it was cancelled.
+		return t.backoff << attempt, idempotent(req.Method)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// idempotent reports whether sending a request with method twice has the same effect as sending it once.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
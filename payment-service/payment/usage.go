@@ -0,0 +1,71 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SubscriptionItem is the item of a subscription that usage is reported against. Lemon Squeezy subscriptions
+// have one item, the subscription's first_subscription_item.
+type SubscriptionItem struct {
+	ID             int64 `json:"id"`
+	SubscriptionID int64 `json:"subscription_id"`
+	PriceID        int64 `json:"price_id"`
+	Quantity       int64 `json:"quantity"`
+	IsUsageBased   bool  `json:"is_usage_based"` // Whether the item's price is billed on reported usage.
+}
+
+// Usage is the usage of a subscription item in its current billing period, as Lemon Squeezy counts it.
+type Usage struct {
+	PeriodStart      time.Time `json:"period_start"`
+	PeriodEnd        time.Time `json:"period_end"`
+	Quantity         int64     `json:"quantity"`
+	IntervalUnit     string    `json:"interval_unit"`     // day, week, month or year.
+	IntervalQuantity int       `json:"interval_quantity"` // Number of IntervalUnit in a billing period.
+}
+
+// Actions of a usage record.
+const (
+	UsageIncrement = "increment" // Adds the quantity to the usage of the current billing period.
+	UsageSet       = "set"       // Replaces the usage of the current billing period with the quantity.
+)
+
+// CreateUsageRecord reports quantity for the current billing period of a usage-based subscription item,
+// added to its usage or replacing it depending on action. Lemon Squeezy bills the usage of a period when
+// it ends, so usage reported after that counts towards the next period.
+func (p *PaymentService) CreateUsageRecord(ctx context.Context, subscriptionItemID, quantity int64, action string) error {
+	request := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":       "usage-records",
+			"attributes": map[string]interface{}{"quantity": quantity, "action": action},
+			"relationships": map[string]interface{}{
+				"subscription-item": map[string]interface{}{
+					"data": map[string]string{"type": "subscription-items", "id": strconv.FormatInt(subscriptionItemID, 10)},
+				},
+			},
+		},
+	}
+	var document struct {
+		Data resource `json:"data"`
+	}
+	return p.do(ctx, http.MethodPost, "/v1/usage-records", request, &document)
+}
+
+// GetCurrentUsage retrieves the current billing period of a usage-based subscription item and the usage
+// reported for it so far.
+func (p *PaymentService) GetCurrentUsage(ctx context.Context, subscriptionItemID int64) (*Usage, error) {
+	var document struct {
+		Meta *Usage `json:"meta"`
+	}
+	path := fmt.Sprintf("/v1/subscription-items/%d/current-usage", subscriptionItemID)
+	if err := p.do(ctx, http.MethodGet, path, nil, &document); err != nil {
+		return nil, err
+	}
+	if document.Meta == nil {
+		return nil, fmt.Errorf("decoding usage of subscription item %d: meta is missing", subscriptionItemID)
+	}
+	return document.Meta, nil
+}
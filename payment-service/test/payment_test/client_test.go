@@ -0,0 +1,332 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-service/payment"
+	"payment-service/payment/lemonsqueezytest"
+	"testing"
+	"time"
+)
+
+const testAPIKey = "test-api-key"
+
+// newTestService starts a stand-in API with n subscriptions and returns a client for it.
+func newTestService(t *testing.T, n int) (*payment.PaymentService, *lemonsqueezytest.Server) {
+	t.Helper()
+	server := lemonsqueezytest.NewServer(testAPIKey)
+	t.Cleanup(server.Close)
+	for i := 1; i <= n; i++ {
+		server.AddSubscription(fmt.Sprint(i), map[string]interface{}{
+			"status":       "active",
+			"product_name": "Pro",
+			"variant_name": "Monthly",
+			"user_email":   fmt.Sprintf("user%d@example.com", i),
+			"renews_at":    "2024-02-01T00:00:00.000000Z",
+			"created_at":   "2024-01-01T00:00:00.000000Z",
+			"updated_at":   "2024-01-01T00:00:00.000000Z",
+		})
+	}
+	service := payment.NewPaymentService(payment.Config{
+		APIKey:     testAPIKey,
+		StoreID:    1,
+		BaseURL:    server.URL,
+		MaxRetries: 2,
+		Backoff:    time.Millisecond,
+		MaxWait:    time.Second,
+	})
+	return service, server
+}
+
+func TestGetSubscription(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestService(t, 1)
+
+	subscription, err := service.GetSubscription(ctx, "1")
+	if err != nil {
+		t.Fatalf("GetSubscription() error = %v", err)
+	}
+	if subscription.ID != "1" || subscription.Status != "active" || subscription.UserEmail != "user1@example.com" || subscription.RenewsAt.IsZero() {
+		t.Errorf("GetSubscription() = %+v", subscription)
+	}
+	if subscription.URLs.UpdatePaymentMethod == "" || subscription.URLs.CustomerPortal == "" {
+		t.Errorf("GetSubscription() URLs = %+v, want the update payment method and customer portal links", subscription.URLs)
+	}
+
+	_, err = service.GetSubscription(ctx, "404")
+	var apiErr *payment.APIError
+	if !errors.Is(err, payment.ErrNotFound) || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("GetSubscription() of a missing subscription error = %v, want %v", err, payment.ErrNotFound)
+	}
+}
+
+func TestGetAllSubscriptions(t *testing.T) {
+	// More than one page of 100.
+	service, server := newTestService(t, 250)
+	subscriptions, err := service.GetAllSubscriptions(context.Background())
+	if err != nil {
+		t.Fatalf("GetAllSubscriptions() error = %v", err)
+	}
+	if len(subscriptions) != 250 || subscriptions[0].ID != "1" || subscriptions[249].ID != "250" {
+		t.Fatalf("GetAllSubscriptions() returned %d subscriptions", len(subscriptions))
+	}
+	if server.Requests() != 3 {
+		t.Errorf("GetAllSubscriptions() sent %d requests, want 3", server.Requests())
+	}
+
+	empty, _ := newTestService(t, 0)
+	if subscriptions, err := empty.GetAllSubscriptions(context.Background()); err != nil || len(subscriptions) != 0 {
+		t.Errorf("GetAllSubscriptions() without subscriptions = %v, error %v", subscriptions, err)
+	}
+}
+
+func TestListCatalog(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t, 0)
+	server.AddStore("1", map[string]interface{}{"name": "Acme", "currency": "EUR"})
+	server.AddProduct("10", map[string]interface{}{"store_id": 1, "name": "Pro", "status": "published"})
+	server.AddVariant("100", map[string]interface{}{
+		"product_id":           10,
+		"name":                 "Monthly",
+		"status":               "published",
+		"price":                999,
+		"is_subscription":      true,
+		"interval":             "month",
+		"interval_count":       1,
+		"has_free_trial":       true,
+		"trial_interval":       "day",
+		"trial_interval_count": 14,
+	})
+
+	stores, err := service.ListStores(ctx)
+	if err != nil || len(stores) != 1 || stores[0].ID != "1" || stores[0].Currency != "EUR" {
+		t.Errorf("ListStores() = %+v, error %v", stores, err)
+	}
+	products, err := service.ListProducts(ctx)
+	if err != nil || len(products) != 1 || products[0].ID != "10" || products[0].StoreID != 1 || products[0].Status != "published" {
+		t.Errorf("ListProducts() = %+v, error %v", products, err)
+	}
+	variants, err := service.ListVariants(ctx)
+	if err != nil || len(variants) != 1 {
+		t.Fatalf("ListVariants() = %+v, error %v", variants, err)
+	}
+	if v := variants[0]; v.ID != "100" || v.ProductID != 10 || v.Price != 999 || v.Interval != "month" || !v.HasFreeTrial || v.TrialIntervalCount != 14 {
+		t.Errorf("ListVariants() = %+v", v)
+	}
+
+	server.RemoveVariant("100")
+	if variants, err := service.ListVariants(ctx); err != nil || len(variants) != 0 {
+		t.Errorf("ListVariants() after removal = %+v, error %v", variants, err)
+	}
+}
+
+func TestUpdateAndCancelSubscription(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t, 1)
+
+	subscription, err := service.UpdateSubscription(ctx, "1", map[string]interface{}{"pause": map[string]string{"mode": "void"}})
+	if err != nil {
+		t.Fatalf("UpdateSubscription() error = %v", err)
+	}
+	if subscription.Status != "paused" || server.Subscription("1")["pause"] == nil {
+		t.Errorf("UpdateSubscription() = %+v", subscription)
+	}
+
+	if err := service.CancelSubscription(ctx, "1"); err != nil {
+		t.Fatalf("CancelSubscription() error = %v", err)
+	}
+	if server.Subscription("1")["status"] != "cancelled" {
+		t.Errorf("CancelSubscription() left status %v", server.Subscription("1")["status"])
+	}
+	if err := service.CancelSubscription(ctx, "404"); !errors.Is(err, payment.ErrNotFound) {
+		t.Errorf("CancelSubscription() of a missing subscription error = %v, want %v", err, payment.ErrNotFound)
+	}
+
+	// Changing the plan of a cancelled subscription leaves it cancelled, though the SDK sends cancelled.
+	subscription, err = service.UpdateSubscription(ctx, "1", map[string]interface{}{"variant_id": 102})
+	if err != nil {
+		t.Fatalf("UpdateSubscription() of the variant error = %v", err)
+	}
+	if subscription.VariantID != 102 || subscription.Status != "cancelled" || !subscription.Cancelled {
+		t.Errorf("UpdateSubscription() of the variant = %+v, want variant 102 and still cancelled", subscription)
+	}
+	// Resuming sends cancelled itself, and unpausing a null pause, which the SDK can't.
+	if subscription, err := service.UpdateSubscription(ctx, "1", map[string]interface{}{"cancelled": false}); err != nil || subscription.Status != "active" {
+		t.Errorf("UpdateSubscription() resuming = %+v, error %v, want active", subscription, err)
+	}
+	if _, err := service.UpdateSubscription(ctx, "1", map[string]interface{}{"pause": nil}); err != nil || server.Subscription("1")["pause"] != nil {
+		t.Errorf("UpdateSubscription() unpausing error = %v, pause %v, want none", err, server.Subscription("1")["pause"])
+	}
+}
+
+func TestCreateSubscription(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t, 0)
+	server.AddVariant("100", map[string]interface{}{"product_id": 10, "name": "Monthly", "is_subscription": true})
+
+	checkout, err := service.CreateSubscription(ctx, "100", "user@example.com", map[string]interface{}{"user_id": "7"})
+	if err != nil {
+		t.Fatalf("CreateSubscription() error = %v", err)
+	}
+	if checkout.ID == "" || checkout.URL == "" {
+		t.Fatalf("CreateSubscription() = %+v, want a checkout with a URL", checkout)
+	}
+	created := server.Checkout(checkout.ID)
+	data, _ := created["checkout_data"].(map[string]interface{})
+	custom, _ := data["custom"].(map[string]interface{})
+	if created["store_id"] != 1 || created["variant_id"] != 100 || data["email"] != "user@example.com" || custom["user_id"] != "7" {
+		t.Errorf("CreateSubscription() created %+v, want store 1, variant 100, the email and the user ID", created)
+	}
+
+	if _, err := service.CreateSubscription(ctx, "404", "", nil); !errors.Is(err, payment.ErrNotFound) {
+		t.Errorf("CreateSubscription() of a missing variant error = %v, want %v", err, payment.ErrNotFound)
+	}
+	if _, err := service.CreateSubscription(ctx, "monthly", "", nil); !errors.Is(err, payment.ErrInvalid) {
+		t.Errorf("CreateSubscription() of an invalid variant error = %v, want %v", err, payment.ErrInvalid)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t, 0)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	server.AddSubscriptionItem("7", start, start.AddDate(0, 1, 0))
+
+	if err := service.CreateUsageRecord(ctx, 7, 5, payment.UsageIncrement); err != nil {
+		t.Fatalf("CreateUsageRecord() error = %v", err)
+	}
+	if err := service.CreateUsageRecord(ctx, 7, 3, payment.UsageIncrement); err != nil {
+		t.Fatalf("CreateUsageRecord() error = %v", err)
+	}
+	usage, err := service.GetCurrentUsage(ctx, 7)
+	if err != nil {
+		t.Fatalf("GetCurrentUsage() error = %v", err)
+	}
+	if usage.Quantity != 8 || !usage.PeriodStart.Equal(start) || !usage.PeriodEnd.Equal(start.AddDate(0, 1, 0)) {
+		t.Errorf("GetCurrentUsage() = %+v, want 8 in January", usage)
+	}
+
+	// Setting the usage replaces it, so the same total can be reported again.
+	for i := 0; i < 2; i++ {
+		if err := service.CreateUsageRecord(ctx, 7, 12, payment.UsageSet); err != nil {
+			t.Fatalf("CreateUsageRecord() error = %v", err)
+		}
+	}
+	if got := server.Usage("7"); got != 12 {
+		t.Errorf("usage after set = %d, want 12", got)
+	}
+
+	if err := service.CreateUsageRecord(ctx, 404, 1, payment.UsageIncrement); !errors.Is(err, payment.ErrNotFound) {
+		t.Errorf("CreateUsageRecord() of a missing item error = %v, want %v", err, payment.ErrNotFound)
+	}
+	if _, err := service.GetCurrentUsage(ctx, 404); !errors.Is(err, payment.ErrNotFound) {
+		t.Errorf("GetCurrentUsage() of a missing item error = %v, want %v", err, payment.ErrNotFound)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("RateLimited", func(t *testing.T) {
+		service, server := newTestService(t, 1)
+		server.FailNext(2, http.StatusTooManyRequests, "0")
+		if _, err := service.GetSubscription(ctx, "1"); err != nil {
+			t.Fatalf("GetSubscription() error = %v", err)
+		}
+		if server.Requests() != 3 {
+			t.Errorf("GetSubscription() sent %d requests, want 3", server.Requests())
+		}
+	})
+
+	t.Run("RetriedBody", func(t *testing.T) {
+		service, server := newTestService(t, 1)
+		server.FailNext(1, http.StatusServiceUnavailable, "0")
+		if _, err := service.UpdateSubscription(ctx, "1", map[string]interface{}{"cancelled": true}); err != nil {
+			t.Fatalf("UpdateSubscription() error = %v", err)
+		}
+		if server.Subscription("1")["status"] != "cancelled" {
+			t.Errorf("retried UpdateSubscription() left status %v", server.Subscription("1")["status"])
+		}
+	})
+
+	t.Run("TooManyFailures", func(t *testing.T) {
+		service, server := newTestService(t, 1)
+		server.FailNext(3, http.StatusServiceUnavailable, "0")
+		if _, err := service.GetSubscription(ctx, "1"); !errors.Is(err, payment.ErrUnavailable) || server.Requests() != 3 {
+			t.Errorf("GetSubscription() error = %v after %d requests, want %v after 3", err, server.Requests(), payment.ErrUnavailable)
+		}
+	})
+
+	t.Run("NoRetryAfter", func(t *testing.T) {
+		// Without Retry-After, Lemon Squeezy may have acted on the request.
+		for _, status := range []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable} {
+			service, server := newTestService(t, 1)
+			server.FailNext(1, status, "")
+			if _, err := service.UpdateSubscription(ctx, "1", map[string]interface{}{"cancelled": true}); err == nil || server.Requests() != 1 {
+				t.Errorf("UpdateSubscription() answered %d: error = %v after %d requests, want an error after 1", status, err, server.Requests())
+			}
+		}
+	})
+
+	t.Run("NetworkError", func(t *testing.T) {
+		// A request that got no response is only sent again if sending it twice does no harm.
+		transport := &failingTransport{next: http.DefaultTransport, failures: 1}
+		server := lemonsqueezytest.NewServer(testAPIKey)
+		t.Cleanup(server.Close)
+		server.AddSubscription("1", map[string]interface{}{"status": "active"})
+		server.AddSubscriptionItem("7", time.Now(), time.Now().AddDate(0, 1, 0))
+		service := payment.NewPaymentService(payment.Config{APIKey: testAPIKey, BaseURL: server.URL, HTTPClient: &http.Client{Transport: transport}, MaxRetries: 2, Backoff: time.Millisecond, MaxWait: time.Second})
+
+		if _, err := service.GetSubscription(ctx, "1"); err != nil || server.Requests() != 1 {
+			t.Errorf("GetSubscription() after a network error = %v with %d requests, want it retried", err, server.Requests())
+		}
+		transport.failures = 1
+		if err := service.CreateUsageRecord(ctx, 7, 1, payment.UsageIncrement); !errors.Is(err, payment.ErrUnavailable) || server.Usage("7") != 0 {
+			t.Errorf("CreateUsageRecord() after a network error = %v with usage %d, want %v and no retry", err, server.Usage("7"), payment.ErrUnavailable)
+		}
+	})
+
+	t.Run("RetryAfterTooLong", func(t *testing.T) {
+		service, server := newTestService(t, 1)
+		server.FailNext(1, http.StatusTooManyRequests, "3600")
+		if _, err := service.GetSubscription(ctx, "1"); !errors.Is(err, payment.ErrRateLimited) {
+			t.Errorf("GetSubscription() error = %v, want %v", err, payment.ErrRateLimited)
+		}
+		if server.Requests() != 1 {
+			t.Errorf("GetSubscription() sent %d requests, want 1", server.Requests())
+		}
+	})
+
+	t.Run("NotRetried", func(t *testing.T) {
+		service, server := newTestService(t, 1)
+		server.FailNext(1, http.StatusUnprocessableEntity, "")
+		if _, err := service.GetSubscription(ctx, "1"); !errors.Is(err, payment.ErrInvalid) || server.Requests() != 1 {
+			t.Errorf("GetSubscription() error = %v after %d requests, want %v after 1", err, server.Requests(), payment.ErrInvalid)
+		}
+	})
+}
+
+// failingTransport fails its next failures requests without sending them.
+type failingTransport struct {
+	next     http.RoundTripper
+	failures int
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.failures > 0 {
+		t.failures--
+		return nil, errors.New("connection reset by peer")
+	}
+	return t.next.RoundTrip(req)
+}
+
+func TestUnauthorized(t *testing.T) {
+	server := lemonsqueezytest.NewServer(testAPIKey)
+	defer server.Close()
+	service := payment.NewPaymentService(payment.Config{APIKey: "wrong", BaseURL: server.URL})
+	if _, err := service.GetAllSubscriptions(context.Background()); !errors.Is(err, payment.ErrUnauthorized) {
+		t.Errorf("GetAllSubscriptions() error = %v, want %v", err, payment.ErrUnauthorized)
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"testing"
+	"time"
+)
+
+func TestCatalogSync(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	products := []data.Product{
+		{ID: 1, StoreID: 10, Name: "Pro", Status: "published"},
+		{ID: 2, StoreID: 10, Name: "Draft", Status: "draft"},
+	}
+	variants := []data.Variant{
+		{ID: 12, ProductID: 1, Name: "Yearly", Status: "published", Price: data.Money{Amount: 9900, Currency: "USD"}, IsSubscription: true, Interval: "year", IntervalCount: 1, Sort: 2},
+		{ID: 11, ProductID: 1, Name: "Monthly", Status: "published", Price: data.Money{Amount: 999, Currency: "USD"}, IsSubscription: true, Interval: "month", IntervalCount: 1, HasFreeTrial: true, TrialInterval: "day", TrialIntervalCount: 14, Sort: 1},
+		{ID: 21, ProductID: 2, Name: "Default", Status: "published", Price: data.Money{Amount: 100, Currency: "USD"}},
+	}
+	if err := models.Catalog.Sync(ctx, products, variants, first); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	// Only published products are listed, with their variants in sort order.
+	plans, err := models.Catalog.ListPlans(ctx)
+	if err != nil {
+		t.Fatalf("ListPlans() error = %v", err)
+	}
+	if len(plans) != 1 || plans[0].ID != 1 || len(plans[0].Variants) != 2 || plans[0].Variants[0].ID != 11 || plans[0].Variants[1].ID != 12 {
+		t.Fatalf("ListPlans() = %+v, want product 1 with variants 11 and 12", plans)
+	}
+	if v := plans[0].Variants[0]; v.TrialIntervalCount != 14 || v.Price != (data.Money{Amount: 999, Currency: "USD"}) {
+		t.Errorf("ListPlans() variant = %+v, want the trial and price stored", v)
+	}
+
+	// Variants missing from the next sync are marked deleted, but can still be looked up by
+	// subscriptions that reference them.
+	if err := models.Catalog.Sync(ctx, products[:1], variants[1:2], first.Add(time.Hour)); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	plans, err = models.Catalog.ListPlans(ctx)
+	if err != nil || len(plans) != 1 || len(plans[0].Variants) != 1 || plans[0].Variants[0].ID != 11 {
+		t.Fatalf("ListPlans() after removal = %+v, error %v, want only variant 11", plans, err)
+	}
+	removed, err := models.Catalog.GetVariant(ctx, 12)
+	if err != nil || removed.DeletedAt == nil {
+		t.Errorf("GetVariant(12) = %+v, error %v, want it marked deleted", removed, err)
+	}
+	if _, err := models.Catalog.GetVariant(ctx, 99); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetVariant(99) error = %v, want %v", err, data.ErrNotFound)
+	}
+}
+
+func TestCatalogSyncRollsBack(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	products := []data.Product{{ID: 1, Name: "Pro", Status: "published"}}
+	variants := []data.Variant{{ID: 11, ProductID: 1, Status: "published", Price: data.Money{Amount: 999, Currency: "USD"}}}
+	if err := models.Catalog.Sync(ctx, products, variants, time.Now()); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	// A variant of a product that wasn't synced violates the foreign key, and the whole sync is rolled back.
+	orphan := data.Variant{ID: 31, ProductID: 3, Status: "published", Price: data.Money{Amount: 100, Currency: "USD"}}
+	err := models.RunInTx(ctx, func(tx data.Models) error {
+		return tx.Catalog.Sync(ctx, nil, []data.Variant{orphan}, time.Now())
+	})
+	if !errors.Is(err, data.ErrConstraintViolation) {
+		t.Fatalf("Sync() error = %v, want %v", err, data.ErrConstraintViolation)
+	}
+	plans, err := models.Catalog.ListPlans(ctx)
+	if err != nil || len(plans) != 1 || len(plans[0].Variants) != 1 {
+		t.Errorf("ListPlans() after rollback = %+v, error %v, want the first sync", plans, err)
+	}
+}
@@ -0,0 +1,31 @@
+package test
+
+import (
+	"payment-service/data"
+	"testing"
+)
+
+func TestMoneyString(t *testing.T) {
+	testCases := []struct {
+		money data.Money
+		want  string
+	}{
+		{data.Money{Amount: 1999, Currency: "USD"}, "19.99 USD"},
+		{data.Money{Amount: 5, Currency: "EUR"}, "0.05 EUR"},
+		{data.Money{Amount: -250, Currency: "GBP"}, "-2.50 GBP"},
+		{data.Money{Amount: 1500, Currency: "JPY"}, "1500 JPY"},
+		{data.Money{Amount: 1234, Currency: "KWD"}, "1.234 KWD"},
+	}
+	for _, tc := range testCases {
+		if got := tc.money.String(); got != tc.want {
+			t.Errorf("Money{%d, %s}.String() = %q, want %q", tc.money.Amount, tc.money.Currency, got, tc.want)
+		}
+	}
+
+	if _, err := data.NewMoney(100, "dollars"); err == nil {
+		t.Errorf("NewMoney() with invalid currency succeeded")
+	}
+	if m, err := data.NewMoney(100, "usd"); err != nil || m.Currency != "USD" {
+		t.Errorf("NewMoney() = %+v, error %v, want currency USD", m, err)
+	}
+}
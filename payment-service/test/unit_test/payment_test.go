@@ -2,66 +2,62 @@ package test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"payment-service/data"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 )
 
+// PaymentSuite is the conformance suite every data.PaymentRepository implementation must pass.
+// The repositories are reached through data.Models so that transactions can be tested too.
 type PaymentSuite struct {
-	connection     *pgx.Conn
-	paymentId      []int
+	models         data.Models
+	connection     *pgx.Conn // connection is only set when running against CockroachDB.
+	paymentId      []int64
 	subscriptionId []string
-	model          data.Models
 }
 
-func (suite *PaymentSuite) SetupSuite() {
+// SetupSuite connects to the local CockroachDB and resets the payments table.
+// It returns an error instead of failing so the suite can be skipped when no database is running.
+func (suite *PaymentSuite) SetupSuite() error {
 	url := "postgres://root@localhost:26257/defaultdb?sslmode=disable" // Database connection URL.
 	conn, err := pgx.Connect(context.Background(), url)                // Attempt to connect to the database.
 	if err != nil {
-		log.Fatalf("Failed to connect to the database: %v", err) // Log and exit if the connection fails.
+		return err
 	}
 	fmt.Println("Connected to the database") // Confirm successful connection.
 	ensureTableExists(conn)                  // Ensure the table exists.
 	suite.connection = conn
-	suite.model = data.NewModels(conn)
+	suite.models = data.NewCockroachModels(conn, newTestKeyRing("k1"))
+	return nil
 }
 
-// ensureTableExists updated to include new fields
+// ensureTableExists applies the service's migrations, so the suite runs against the schema the service uses,
+// and empties the payments table.
 func ensureTableExists(conn *pgx.Conn) {
-	query := `
-	DROP TABLE IF EXISTS payments;
-    CREATE TABLE IF NOT EXISTS payments (
-    id SERIAL PRIMARY KEY,
-    customer_id FLOAT NOT NULL,
-    subscription_id VARCHAR(255) NOT NULL,
-    order_id FLOAT UNIQUE NOT NULL,
-    status VARCHAR(50) NOT NULL,
-    variant_name VARCHAR(255),
-    variant_id FLOAT NOT NULL,
-    product_id FLOAT NOT NULL,
-    product_name VARCHAR(255),
-    card_brand VARCHAR(50),
-    card_last_four CHAR(4) NOT NULL CHECK (LENGTH(card_last_four) = 4),
-    user_name VARCHAR(255) NOT NULL CHECK (user_name <> '' AND user_name ~ '^[A-Za-z ]+$'),
-    user_email VARCHAR(255) NOT NULL CHECK (user_email <> '' AND user_email ~* '^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$'),
-    renews_at TIMESTAMP NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    CHECK (renews_at >= created_at)
-);`
-
-	if _, err := conn.Exec(context.Background(), query); err != nil {
-		log.Fatalf("Failed to ensure payments table exists: %v", err)
+	ctx := context.Background()
+	migrator, err := data.NewMigrator(conn)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	if err := migrator.Up(ctx); err != nil {
+		log.Fatalf("Failed to migrate the database: %v", err)
+	}
+	if _, err := conn.Exec(ctx, `TRUNCATE payments;`); err != nil {
+		log.Fatalf("Failed to empty the payments table: %v", err)
 	}
 }
 
 func (suite *PaymentSuite) TearDown() {
-	suite.connection.Close(context.Background())
-	fmt.Println("Connection to the database closed")
+	if suite.connection != nil {
+		suite.connection.Close(context.Background())
+		fmt.Println("Connection to the database closed")
+	}
 }
 
 func (suite *PaymentSuite) TestCreatePayment(t *testing.T) {
@@ -316,7 +312,7 @@ func (suite *PaymentSuite) TestCreatePayment(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			id, err := suite.model.CreatePayment(suite.connection, tc.payment)
+			id, err := suite.models.Payments.CreatePayment(context.Background(), tc.payment)
 			if err != nil && !tc.wantErr {
 				t.Errorf("CreatePayment() error = %v, wantErr %v", err, tc.wantErr)
 				return
@@ -331,7 +327,7 @@ func (suite *PaymentSuite) TestCreatePayment(t *testing.T) {
 func (suite *PaymentSuite) TestGetPaymentByID(t *testing.T) {
 	testCases := []struct {
 		name    string
-		id      int
+		id      int64
 		wantErr bool
 	}{
 		{"Valid ID - Existing Payment", suite.paymentId[0], false},
@@ -346,7 +342,7 @@ func (suite *PaymentSuite) TestGetPaymentByID(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			payment, err := suite.model.GetPaymentByID(suite.connection, tc.id)
+			payment, err := suite.models.Payments.GetPaymentByID(context.Background(), tc.id)
 			if err != nil {
 				if !tc.wantErr {
 					t.Errorf("GetPaymentByID() error = %v, wantErr %v", err, tc.wantErr)
@@ -363,7 +359,7 @@ func (suite *PaymentSuite) TestGetPaymentByID(t *testing.T) {
 				t.Errorf("GetPaymentByID() returned nil payment, but error was also nil")
 				return
 			}
-			if tc.id != int(payment.ID) {
+			if tc.id != payment.ID {
 				t.Errorf("GetPaymentByID() got ID = %v, want %v", payment.ID, tc.id)
 			}
 		})
@@ -387,7 +383,7 @@ func (suite *PaymentSuite) TestGetSubscriptionByID(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			subscription, err := suite.model.GetPaymentBySubscriptionID(suite.connection, tc.id)
+			subscription, err := suite.models.Payments.GetPaymentBySubscriptionID(context.Background(), tc.id)
 			if err != nil {
 				if !tc.wantErr {
 					t.Errorf("GetSubscriptionByID() error = %v, wantErr %v", err, tc.wantErr)
@@ -411,16 +407,326 @@ func (suite *PaymentSuite) TestGetSubscriptionByID(t *testing.T) {
 	}
 }
 
-func TestPaymentSuite(t *testing.T) {
+func (suite *PaymentSuite) TestUpdatePayment(t *testing.T) {
+	existing, err := suite.models.Payments.GetPaymentBySubscriptionID(context.Background(), suite.subscriptionId[0])
+	if err != nil {
+		t.Fatalf("GetPaymentBySubscriptionID() error = %v", err)
+	}
 
-	paymentSuite := PaymentSuite{}
+	updated := *existing
+	updated.Status = "cancelled"
+	updated.UpdatedAt = existing.UpdatedAt.Add(time.Hour).Truncate(time.Microsecond)
+	if err := suite.models.Payments.UpdatePayment(context.Background(), updated); err != nil {
+		t.Fatalf("UpdatePayment() error = %v", err)
+	}
+	got, err := suite.models.Payments.GetPaymentByID(context.Background(), existing.ID)
+	if err != nil {
+		t.Fatalf("GetPaymentByID() error = %v", err)
+	}
+	if got.Status != "cancelled" {
+		t.Errorf("UpdatePayment() status = %v, want %v", got.Status, "cancelled")
+	}
+	if got.Version != existing.Version+1 {
+		t.Errorf("UpdatePayment() version = %v, want %v", got.Version, existing.Version+1)
+	}
+	// updated_at is the time Lemon Squeezy updated the subscription, so stale webhooks can be detected.
+	if !got.UpdatedAt.Equal(updated.UpdatedAt) {
+		t.Errorf("UpdatePayment() updated_at = %v, want %v", got.UpdatedAt, updated.UpdatedAt)
+	}
 
-	paymentSuite.SetupSuite()
+	// A second webhook that read the same version must not overwrite the first one.
+	stale := *existing
+	stale.Status = "expired"
+	if err := suite.models.Payments.UpdatePayment(context.Background(), stale); !errors.Is(err, data.ErrConflict) {
+		t.Errorf("UpdatePayment() with stale version error = %v, want %v", err, data.ErrConflict)
+	}
+	if got, err := suite.models.Payments.GetPaymentByID(context.Background(), existing.ID); err != nil || got.Status != "cancelled" {
+		t.Errorf("UpdatePayment() with stale version got payment %+v, error %v", got, err)
+	}
 
-	defer paymentSuite.TearDown()
+	missing := *existing
+	missing.ID = 999
+	if err := suite.models.Payments.UpdatePayment(context.Background(), missing); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("UpdatePayment() on missing payment error = %v, want %v", err, data.ErrNotFound)
+	}
+}
+
+func (suite *PaymentSuite) TestRunInTx(t *testing.T) {
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	existing, err := suite.models.Payments.GetPaymentBySubscriptionID(ctx, suite.subscriptionId[1])
+	if err != nil {
+		t.Fatalf("GetPaymentBySubscriptionID() error = %v", err)
+	}
+
+	// A failing transaction must leave no trace.
+	err = suite.models.RunInTx(ctx, func(tx data.Models) error {
+		rolledBack := *existing
+		rolledBack.Status = "rolled back"
+		if err := tx.Payments.UpdatePayment(ctx, rolledBack); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, errAbort)
+	}
+	if p, err := suite.models.Payments.GetPaymentByID(ctx, existing.ID); err != nil || p.Status == "rolled back" {
+		t.Errorf("RunInTx() rollback got payment %+v, error %v", p, err)
+	}
+
+	// A successful transaction, including a nested one, must be committed.
+	err = suite.models.RunInTx(ctx, func(tx data.Models) error {
+		return tx.RunInTx(ctx, func(tx data.Models) error {
+			committed := *existing
+			committed.Status = "committed"
+			return tx.Payments.UpdatePayment(ctx, committed)
+		})
+	})
+	if err != nil {
+		t.Fatalf("RunInTx() error = %v", err)
+	}
+	if p, err := suite.models.Payments.GetPaymentByID(ctx, existing.ID); err != nil || p.Status != "committed" {
+		t.Errorf("RunInTx() commit got payment %+v, error %v", p, err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"SerializationFailure", &pgconn.PgError{Code: "40001"}, true},
+		{"WrappedSerializationFailure", fmt.Errorf("update failed: %w", &pgconn.PgError{Code: "40001"}), true},
+		{"UniqueViolation", &pgconn.PgError{Code: "23505"}, false},
+		{"NotFound", data.ErrNotFound, false},
+		{"Nil", nil, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := data.IsRetryable(tc.err); got != tc.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsConstraintViolation(t *testing.T) {
+	_, checkErr := data.NewMemoryModels().Payments.CreatePayment(context.Background(), data.Payment{SubscriptionID: "1", CardLastFour: "42"})
+	if checkErr == nil || checkErr.Error() != "violates check constraint on card_last_four" {
+		t.Fatalf("CreatePayment() error = %v", checkErr)
+	}
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"RepositoryCheck", checkErr, true},
+		{"WrappedRepositoryCheck", fmt.Errorf("create failed: %w", checkErr), true},
+		{"UniqueViolation", &pgconn.PgError{Code: "23505"}, true},
+		{"StringTooLong", &pgconn.PgError{Code: "22001"}, true},
+		{"SerializationFailure", &pgconn.PgError{Code: "40001"}, false},
+		{"NotFound", data.ErrNotFound, false},
+		{"Conflict", data.ErrConflict, false},
+		{"Nil", nil, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := data.IsConstraintViolation(tc.err); got != tc.want {
+				t.Errorf("IsConstraintViolation(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func (suite *PaymentSuite) TestPaymentAmounts(t *testing.T) {
+	ctx := context.Background()
+	payment := data.Payment{
+		CustomerID:     9007199254740993, // 2^53 + 1, which a float64 can't hold.
+		SubscriptionID: "sub_amounts",
+		OrderID:        9007199254740995,
+		Status:         "active",
+		VariantID:      101,
+		ProductID:      201,
+		CardLastFour:   "4242",
+		Subtotal:       data.Money{Amount: 1999, Currency: "USD"},
+		Discount:       data.Money{Amount: 500, Currency: "USD"},
+		Tax:            data.Money{Amount: 150, Currency: "USD"},
+		Total:          data.Money{Amount: 1649, Currency: "USD"},
+		UserName:       "Jane Doe",
+		UserEmail:      "jane.doe@example.com",
+		RenewsAt:       time.Now().AddDate(0, 1, 0),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	id, err := suite.models.Payments.CreatePayment(ctx, payment)
+	if err != nil {
+		t.Fatalf("CreatePayment() error = %v", err)
+	}
+	got, err := suite.models.Payments.GetPaymentByID(ctx, id)
+	if err != nil {
+		t.Fatalf("GetPaymentByID() error = %v", err)
+	}
+	if got.CustomerID != payment.CustomerID || got.OrderID != payment.OrderID {
+		t.Errorf("GetPaymentByID() ids = %d, %d, want %d, %d", got.CustomerID, got.OrderID, payment.CustomerID, payment.OrderID)
+	}
+	if got.Subtotal != payment.Subtotal || got.Discount != payment.Discount || got.Tax != payment.Tax || got.Total != payment.Total {
+		t.Errorf("GetPaymentByID() amounts = %v, %v, %v, %v", got.Subtotal, got.Discount, got.Tax, got.Total)
+	}
+
+	// The payments table has one currency column, so mixed currencies are rejected.
+	payment.SubscriptionID, payment.OrderID = "sub_mixed", 9007199254740997
+	payment.Tax = data.Money{Amount: 150, Currency: "EUR"}
+	if _, err := suite.models.Payments.CreatePayment(ctx, payment); err == nil {
+		t.Errorf("CreatePayment() with mixed currencies succeeded")
+	}
+}
 
-	t.Run("TestCreatePayment", paymentSuite.TestCreatePayment)
-	t.Run("TestGetPaymentByID", paymentSuite.TestGetPaymentByID)
-	t.Run("TestGetPaymentBySubscriptionID", paymentSuite.TestGetSubscriptionByID)
+func (suite *PaymentSuite) TestPaymentUserID(t *testing.T) {
+	ctx := context.Background()
+	payment := data.Payment{
+		CustomerID:     301,
+		UserID:         9007199254740993,
+		SubscriptionID: "sub_user_id",
+		OrderID:        401,
+		Status:         "active",
+		VariantID:      101,
+		ProductID:      201,
+		CardLastFour:   "4242",
+		UserName:       "Jane Doe",
+		UserEmail:      "jane.doe@example.com",
+		RenewsAt:       time.Now().AddDate(0, 1, 0),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	id, err := suite.models.Payments.CreatePayment(ctx, payment)
+	if err != nil {
+		t.Fatalf("CreatePayment() error = %v", err)
+	}
+	got, err := suite.models.Payments.GetPaymentByID(ctx, id)
+	if err != nil {
+		t.Fatalf("GetPaymentByID() error = %v", err)
+	}
+	if got.UserID != payment.UserID {
+		t.Errorf("GetPaymentByID() UserID = %d, want %d", got.UserID, payment.UserID)
+	}
 
+	// Payments checked out without a user ID read back as 0.
+	got.UserID = 0
+	if err := suite.models.Payments.UpdatePayment(ctx, *got); err != nil {
+		t.Fatalf("UpdatePayment() error = %v", err)
+	}
+	if got, err = suite.models.Payments.GetPaymentByID(ctx, id); err != nil || got.UserID != 0 {
+		t.Errorf("GetPaymentByID() = %+v, error %v, want UserID 0", got, err)
+	}
+}
+
+func (suite *PaymentSuite) TestGetLatestPaymentByUserID(t *testing.T) {
+	ctx := context.Background()
+	const userID = 9007199254740995
+	payment := data.Payment{
+		CustomerID:   302,
+		UserID:       userID,
+		Status:       "expired",
+		VariantID:    101,
+		ProductID:    201,
+		CardLastFour: "4242",
+		UserName:     "Jane Doe",
+		UserEmail:    "jane.doe@example.com",
+		RenewsAt:     time.Now().AddDate(0, 1, 0),
+		CreatedAt:    time.Now().Add(-time.Hour),
+		UpdatedAt:    time.Now(),
+	}
+	payment.SubscriptionID, payment.OrderID = "sub_latest_old", 402
+	if _, err := suite.models.Payments.CreatePayment(ctx, payment); err != nil {
+		t.Fatalf("CreatePayment() error = %v", err)
+	}
+	payment.SubscriptionID, payment.OrderID, payment.Status, payment.CreatedAt = "sub_latest_new", 403, "active", time.Now()
+	if _, err := suite.models.Payments.CreatePayment(ctx, payment); err != nil {
+		t.Fatalf("CreatePayment() error = %v", err)
+	}
+
+	got, err := suite.models.Payments.GetLatestPaymentByUserID(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetLatestPaymentByUserID() error = %v", err)
+	}
+	if got.SubscriptionID != "sub_latest_new" {
+		t.Errorf("GetLatestPaymentByUserID() subscription = %q, want sub_latest_new", got.SubscriptionID)
+	}
+	if _, err := suite.models.Payments.GetLatestPaymentByUserID(ctx, userID+1); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetLatestPaymentByUserID() of a user without payments error = %v, want ErrNotFound", err)
+	}
+}
+
+func (suite *PaymentSuite) TestListRenewing(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	payment := data.Payment{
+		CustomerID:   303,
+		Status:       "active",
+		VariantID:    101,
+		ProductID:    201,
+		CardLastFour: "4242",
+		UserName:     "Jane Doe",
+		UserEmail:    "jane.doe@example.com",
+		CreatedAt:    now.AddDate(0, -1, 0),
+		UpdatedAt:    now,
+	}
+	for i, tc := range []struct {
+		subscriptionID string
+		status         string
+		renewsAt       time.Time
+	}{
+		{"sub_renewing_late", "active", now.AddDate(0, 0, 7)},
+		{"sub_renewing_soon", "active", now.Add(time.Hour)},
+		{"sub_renewing_later", "active", now.AddDate(0, 0, 8)},
+		{"sub_renewing_cancelled", "cancelled", now.Add(time.Hour)},
+		{"sub_renewing_past", "active", now},
+	} {
+		payment.SubscriptionID, payment.OrderID, payment.Status, payment.RenewsAt = tc.subscriptionID, int64(404+i), tc.status, tc.renewsAt
+		if _, err := suite.models.Payments.CreatePayment(ctx, payment); err != nil {
+			t.Fatalf("CreatePayment() error = %v", err)
+		}
+	}
+
+	got, err := suite.models.Payments.ListRenewing(ctx, now, now.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatalf("ListRenewing() error = %v", err)
+	}
+	var ids []string
+	for _, p := range got {
+		ids = append(ids, p.SubscriptionID)
+	}
+	if fmt.Sprint(ids) != "[sub_renewing_soon sub_renewing_late]" {
+		t.Errorf("ListRenewing() = %v, want [sub_renewing_soon sub_renewing_late]", ids)
+	}
+}
+
+// run executes the whole suite in order; later tests use the IDs created by TestCreatePayment.
+func (suite *PaymentSuite) run(t *testing.T) {
+	t.Run("TestCreatePayment", suite.TestCreatePayment)
+	t.Run("TestGetPaymentByID", suite.TestGetPaymentByID)
+	t.Run("TestGetPaymentBySubscriptionID", suite.TestGetSubscriptionByID)
+	t.Run("TestUpdatePayment", suite.TestUpdatePayment)
+	t.Run("TestPaymentAmounts", suite.TestPaymentAmounts)
+	t.Run("TestPaymentUserID", suite.TestPaymentUserID)
+	t.Run("TestGetLatestPaymentByUserID", suite.TestGetLatestPaymentByUserID)
+	t.Run("TestListRenewing", suite.TestListRenewing)
+	t.Run("TestRunInTx", suite.TestRunInTx)
+}
+
+func TestPaymentSuite(t *testing.T) {
+	paymentSuite := PaymentSuite{models: data.NewMemoryModels()}
+	paymentSuite.run(t)
+}
+
+func TestCockroachPaymentSuite(t *testing.T) {
+	paymentSuite := PaymentSuite{}
+	if err := paymentSuite.SetupSuite(); err != nil {
+		t.Skipf("CockroachDB is not available: %v", err)
+	}
+	defer paymentSuite.TearDown()
+	paymentSuite.run(t)
 }
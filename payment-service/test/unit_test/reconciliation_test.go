@@ -0,0 +1,72 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"testing"
+	"time"
+)
+
+func TestReconciliationReports(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	if _, err := models.Reports.LatestRun(ctx); !errors.Is(err, data.ErrNotFound) {
+		t.Fatalf("LatestRun() without runs error = %v, want %v", err, data.ErrNotFound)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := data.ReconciliationRun{
+		StartedAt:     start,
+		FinishedAt:    start.Add(time.Minute),
+		Subscriptions: 3,
+		Corrected:     1,
+		Flagged:       1,
+		Issues: []data.ReconciliationIssue{
+			{SubscriptionID: "1", UserID: 42, Kind: data.IssuePaymentStale, Detail: `status: payment "active", Lemon Squeezy "expired"`, Corrected: true},
+			{SubscriptionID: "2", Kind: data.IssueMissingPayment, Detail: "status active, variant 11, customer jane@example.com"},
+		},
+	}
+	firstID, err := models.Reports.SaveRun(ctx, first)
+	if err != nil {
+		t.Fatalf("SaveRun() error = %v", err)
+	}
+	second := data.ReconciliationRun{StartedAt: start.Add(time.Hour), FinishedAt: start.Add(time.Hour), Error: "listing subscriptions: unavailable"}
+	secondID, err := models.Reports.SaveRun(ctx, second)
+	if err != nil {
+		t.Fatalf("SaveRun() error = %v", err)
+	}
+
+	run, err := models.Reports.GetRun(ctx, firstID)
+	if err != nil {
+		t.Fatalf("GetRun() error = %v", err)
+	}
+	if run.Subscriptions != 3 || len(run.Issues) != 2 || run.Issues[0].Kind != data.IssuePaymentStale || !run.Issues[0].Corrected || run.Issues[1].RunID != firstID || run.Issues[1].ID == 0 {
+		t.Errorf("GetRun() = %+v, want the first run with its issues in order", run)
+	}
+	latest, err := models.Reports.LatestRun(ctx)
+	if err != nil || latest.ID != secondID || latest.Error == "" || len(latest.Issues) != 0 {
+		t.Errorf("LatestRun() = %+v, error %v, want the second run", latest, err)
+	}
+	if _, err := models.Reports.GetRun(ctx, 999); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetRun(999) error = %v, want %v", err, data.ErrNotFound)
+	}
+}
+
+func TestReconciliationReportRollsBack(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	failed := errors.New("failed")
+	err := models.RunInTx(ctx, func(tx data.Models) error {
+		if _, err := tx.Reports.SaveRun(ctx, data.ReconciliationRun{StartedAt: time.Now(), FinishedAt: time.Now()}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, failed)
+	}
+	if _, err := models.Reports.LatestRun(ctx); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("LatestRun() after rollback error = %v, want %v", err, data.ErrNotFound)
+	}
+}
@@ -0,0 +1,68 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"testing"
+	"time"
+)
+
+func TestRenewalNotices(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	renewsAt := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	notice := data.RenewalNotice{SubscriptionID: "1", RenewsAt: renewsAt, DaysBefore: 7, SentAt: renewsAt.AddDate(0, 0, -7)}
+	if isNew, err := models.Renewals.Record(ctx, notice); err != nil || !isNew {
+		t.Fatalf("Record() = %v, error %v, want a new notice", isNew, err)
+	}
+
+	// The same renewal is announced once per window, whenever it is found again.
+	again := notice
+	again.SentAt = renewsAt.AddDate(0, 0, -6)
+	again.RenewsAt = renewsAt.In(time.FixedZone("CET", 3600))
+	if isNew, err := models.Renewals.Record(ctx, again); err != nil || isNew {
+		t.Errorf("Record() of an announced renewal = %v, error %v, want it ignored", isNew, err)
+	}
+	for _, n := range []data.RenewalNotice{
+		{SubscriptionID: "1", RenewsAt: renewsAt, DaysBefore: 1, SentAt: renewsAt.AddDate(0, 0, -1)},
+		{SubscriptionID: "1", RenewsAt: renewsAt.AddDate(0, 1, 0), DaysBefore: 7, SentAt: renewsAt.AddDate(0, 1, -7)},
+		{SubscriptionID: "2", RenewsAt: renewsAt, DaysBefore: 7, SentAt: renewsAt.AddDate(0, 0, -7)},
+	} {
+		if isNew, err := models.Renewals.Record(ctx, n); err != nil || !isNew {
+			t.Fatalf("Record(%+v) = %v, error %v, want a new notice", n, isNew, err)
+		}
+	}
+	if _, err := models.Renewals.Record(ctx, data.RenewalNotice{SubscriptionID: "1", RenewsAt: renewsAt}); !data.IsConstraintViolation(err) {
+		t.Errorf("Record() without a window error = %v, want a constraint violation", err)
+	}
+
+	notices, err := models.Renewals.ListNotices(ctx, "1")
+	if err != nil {
+		t.Fatalf("ListNotices() error = %v", err)
+	}
+	if len(notices) != 3 || notices[0].DaysBefore != 7 || notices[1].DaysBefore != 1 || !notices[2].RenewsAt.Equal(renewsAt.AddDate(0, 1, 0)) {
+		t.Errorf("ListNotices() = %+v, want the 7 and 1 day notices of the renewal, then the 7 day notice of the next", notices)
+	}
+}
+
+func TestRenewalNoticesRollBack(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	renewsAt := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	notice := data.RenewalNotice{SubscriptionID: "1", RenewsAt: renewsAt, DaysBefore: 7}
+	errAbort := errors.New("abort")
+	err := models.RunInTx(ctx, func(tx data.Models) error {
+		if _, err := tx.Renewals.Record(ctx, notice); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, errAbort)
+	}
+	// A notice whose notification wasn't enqueued is sent again by the next run.
+	if isNew, err := models.Renewals.Record(ctx, notice); err != nil || !isNew {
+		t.Errorf("Record() after a rollback = %v, error %v, want a new notice", isNew, err)
+	}
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"testing"
+)
+
+func TestSubscriptionEvents(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	errAbort := errors.New("abort")
+
+	created := []byte(`{"meta": {"event_name": "subscription_created"}}`)
+	paused := []byte(`{"meta": {"event_name": "subscription_paused"}}`)
+	history := []data.SubscriptionEvent{
+		{SubscriptionID: "sub_1", EventName: "subscription_created", StatusAfter: "active"},
+		{SubscriptionID: "sub_1", EventName: "subscription_paused", StatusBefore: "active", StatusAfter: "paused"},
+		{SubscriptionID: "sub_1", EventName: "subscription_paused", StatusBefore: "paused", StatusAfter: "paused"}, // A redelivery.
+		{SubscriptionID: "sub_2", EventName: "subscription_created", StatusAfter: "active"},
+	}
+	payloads := [][]byte{created, paused, paused, created}
+	for i, e := range history {
+		if _, err := models.Events.Append(ctx, e, payloads[i]); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+
+	// An event appended in a rolled back transaction is not part of the history.
+	err := models.RunInTx(ctx, func(tx data.Models) error {
+		if _, err := tx.Events.Append(ctx, data.SubscriptionEvent{SubscriptionID: "sub_1", EventName: "subscription_expired", StatusAfter: "expired"}, []byte(`{}`)); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, errAbort)
+	}
+
+	events, err := models.Events.ListBySubscriptionID(ctx, "sub_1")
+	if err != nil {
+		t.Fatalf("ListBySubscriptionID() error = %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("ListBySubscriptionID() returned %d events, want 3", len(events))
+	}
+	for i, e := range events {
+		if e.EventName != history[i].EventName || e.StatusBefore != history[i].StatusBefore || e.StatusAfter != history[i].StatusAfter {
+			t.Errorf("ListBySubscriptionID()[%d] = %+v, want %+v", i, e, history[i])
+		}
+	}
+
+	// Redelivered bodies are stored once and can be read back by their digest.
+	if events[1].PayloadDigest != events[2].PayloadDigest {
+		t.Errorf("identical bodies got digests %s and %s", events[1].PayloadDigest, events[2].PayloadDigest)
+	}
+	if payload, err := models.Events.Payload(ctx, events[1].PayloadDigest); err != nil || string(payload) != string(paused) {
+		t.Errorf("Payload() = %s, error %v", payload, err)
+	}
+	if _, err := models.Events.Payload(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("Payload() of unknown digest error = %v, want %v", err, data.ErrNotFound)
+	}
+	if events, err := models.Events.ListBySubscriptionID(ctx, "sub_unknown"); err != nil || len(events) != 0 {
+		t.Errorf("ListBySubscriptionID() of unknown subscription = %+v, error %v", events, err)
+	}
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"testing"
+	"time"
+)
+
+func TestTrials(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	trial := data.Trial{SubscriptionID: "1", UserID: 42, VariantID: 101, VariantName: "Monthly", StartedAt: start, EndsAt: start.AddDate(0, 0, 14)}
+	if err := models.Trials.Track(ctx, trial); err != nil {
+		t.Fatalf("Track() error = %v", err)
+	}
+
+	// An extension moves the end and keeps the start.
+	extended := trial
+	extended.StartedAt, extended.EndsAt = start.AddDate(0, 0, 3), start.AddDate(0, 0, 21)
+	if err := models.Trials.Track(ctx, extended); err != nil {
+		t.Fatalf("Track() of an extension error = %v", err)
+	}
+	stored, err := models.Trials.GetTrial(ctx, "1")
+	if err != nil || !stored.StartedAt.Equal(start) || !stored.EndsAt.Equal(extended.EndsAt) || stored.Outcome != "" {
+		t.Fatalf("GetTrial() = %+v, error %v, want the extended trial started at %s", stored, err, start)
+	}
+
+	if err := models.Trials.End(ctx, "1", data.TrialConverted, start.AddDate(0, 0, 21)); err != nil {
+		t.Fatalf("End() error = %v", err)
+	}
+	// The outcome is recorded once, and a later webhook doesn't reopen the trial.
+	if err := models.Trials.End(ctx, "1", data.TrialExpired, start.AddDate(0, 1, 0)); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("End() of an ended trial error = %v, want %v", err, data.ErrNotFound)
+	}
+	if err := models.Trials.Track(ctx, trial); err != nil {
+		t.Fatalf("Track() error = %v", err)
+	}
+	if stored, _ := models.Trials.GetTrial(ctx, "1"); stored.Outcome != data.TrialConverted || stored.EndedAt == nil {
+		t.Errorf("GetTrial() = %+v, want it converted", stored)
+	}
+	if err := models.Trials.End(ctx, "2", data.TrialExpired, start); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("End() without a trial error = %v, want %v", err, data.ErrNotFound)
+	}
+
+	for _, tr := range []data.Trial{
+		{SubscriptionID: "2", VariantID: 101, VariantName: "Monthly", StartedAt: start.AddDate(0, 0, 1), EndsAt: start.AddDate(0, 0, 15)},
+		{SubscriptionID: "3", VariantID: 102, VariantName: "Yearly", StartedAt: start.AddDate(0, 0, 2), EndsAt: start.AddDate(0, 0, 16)},
+		{SubscriptionID: "4", VariantID: 101, VariantName: "Monthly", StartedAt: start.AddDate(0, 2, 0), EndsAt: start.AddDate(0, 2, 14)},
+	} {
+		if err := models.Trials.Track(ctx, tr); err != nil {
+			t.Fatalf("Track() error = %v", err)
+		}
+	}
+	if err := models.Trials.End(ctx, "2", data.TrialExpired, start.AddDate(0, 0, 15)); err != nil {
+		t.Fatalf("End() error = %v", err)
+	}
+	stats, err := models.Trials.Stats(ctx, start, start.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	want := []data.TrialStats{
+		{VariantID: 101, VariantName: "Monthly", Started: 2, Converted: 1, Expired: 1},
+		{VariantID: 102, VariantName: "Yearly", Started: 1},
+	}
+	if len(stats) != len(want) || stats[0] != want[0] || stats[1] != want[1] {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestTrialsRollBack(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	errAbort := errors.New("abort")
+	err := models.RunInTx(ctx, func(tx data.Models) error {
+		if err := tx.Trials.Track(ctx, data.Trial{SubscriptionID: "1", StartedAt: start, EndsAt: start.AddDate(0, 0, 14)}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, errAbort)
+	}
+	if _, err := models.Trials.GetTrial(ctx, "1"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetTrial() after a rollback error = %v, want %v", err, data.ErrNotFound)
+	}
+}
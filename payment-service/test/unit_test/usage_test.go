@@ -0,0 +1,192 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"testing"
+	"time"
+)
+
+func TestUsageRecord(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	period := data.UsagePeriod{SubscriptionItemID: 7, SubscriptionID: "1", PeriodStart: start, PeriodEnd: start.AddDate(0, 1, 0)}
+	if err := models.Usage.AddPeriod(ctx, period); err != nil {
+		t.Fatalf("AddPeriod() error = %v", err)
+	}
+
+	event := data.UsageEvent{SubscriptionItemID: 7, SubscriptionID: "1", IdempotencyKey: "a", Quantity: 5, PeriodStart: start, OccurredAt: start.Add(time.Hour)}
+	first, err := models.Usage.Record(ctx, event)
+	if err != nil || first.ID == 0 {
+		t.Fatalf("Record() = %+v, error %v", first, err)
+	}
+	// A retry is not counted again, and returns the event recorded first.
+	retry := event
+	retry.Quantity = 9
+	stored, err := models.Usage.Record(ctx, retry)
+	if !errors.Is(err, data.ErrDuplicate) || stored == nil || stored.ID != first.ID || stored.Quantity != 5 {
+		t.Fatalf("Record() of a retry = %+v, error %v, want the first event and %v", stored, err, data.ErrDuplicate)
+	}
+	event.IdempotencyKey = "b"
+	if _, err := models.Usage.Record(ctx, event); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	// Adding a period that is stored keeps its usage.
+	if err := models.Usage.AddPeriod(ctx, period); err != nil {
+		t.Fatalf("AddPeriod() error = %v", err)
+	}
+	found, err := models.Usage.FindPeriod(ctx, 7, start.AddDate(0, 0, 10))
+	if err != nil || found.Quantity != 10 {
+		t.Fatalf("FindPeriod() = %+v, error %v, want quantity 10", found, err)
+	}
+	if _, err := models.Usage.FindPeriod(ctx, 7, start.AddDate(0, 1, 0)); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("FindPeriod() at the end of the period error = %v, want %v", err, data.ErrNotFound)
+	}
+
+	// Events must count towards a stored period, with a positive quantity.
+	orphan := data.UsageEvent{SubscriptionItemID: 8, SubscriptionID: "2", IdempotencyKey: "a", Quantity: 1, PeriodStart: start, OccurredAt: start}
+	if _, err := models.Usage.Record(ctx, orphan); !errors.Is(err, data.ErrConstraintViolation) {
+		t.Errorf("Record() without a period error = %v, want %v", err, data.ErrConstraintViolation)
+	}
+	event.IdempotencyKey, event.Quantity = "c", 0
+	if _, err := models.Usage.Record(ctx, event); !errors.Is(err, data.ErrConstraintViolation) {
+		t.Errorf("Record() of quantity 0 error = %v, want %v", err, data.ErrConstraintViolation)
+	}
+}
+
+func TestUsageReporting(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.AddDate(0, 0, 15)
+	periods := []data.UsagePeriod{
+		{SubscriptionItemID: 1, SubscriptionID: "1", PeriodStart: start, PeriodEnd: start.AddDate(0, 1, 0)},
+		{SubscriptionItemID: 2, SubscriptionID: "2", PeriodStart: start, PeriodEnd: start.AddDate(0, 0, 20)},
+		{SubscriptionItemID: 3, SubscriptionID: "3", PeriodStart: start.AddDate(0, -1, 0), PeriodEnd: start.AddDate(0, 0, 10)}, // Ended.
+		{SubscriptionItemID: 4, SubscriptionID: "4", PeriodStart: start, PeriodEnd: start.AddDate(0, 1, 0)},                    // No usage.
+	}
+	for _, p := range periods {
+		if err := models.Usage.AddPeriod(ctx, p); err != nil {
+			t.Fatalf("AddPeriod() error = %v", err)
+		}
+		if p.SubscriptionItemID == 4 {
+			continue
+		}
+		e := data.UsageEvent{SubscriptionItemID: p.SubscriptionItemID, SubscriptionID: p.SubscriptionID, IdempotencyKey: "a", Quantity: 3, PeriodStart: p.PeriodStart, OccurredAt: p.PeriodStart}
+		if _, err := models.Usage.Record(ctx, e); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	// Periods with usage are listed whether or not they ended, the one ending first first.
+	unreported, err := models.Usage.ListUnreported(ctx, 10)
+	if err != nil || len(unreported) != 3 || unreported[0].SubscriptionItemID != 3 || unreported[1].SubscriptionItemID != 2 || unreported[2].SubscriptionItemID != 1 {
+		t.Fatalf("ListUnreported() = %+v, error %v, want items 3, 2 and 1", unreported, err)
+	}
+
+	if err := models.Usage.MarkReported(ctx, 2, start, 3, now); err != nil {
+		t.Fatalf("MarkReported() error = %v", err)
+	}
+	// A report of an older total doesn't undo a newer one.
+	if err := models.Usage.MarkReported(ctx, 2, start, 1, now.Add(time.Minute)); err != nil {
+		t.Fatalf("MarkReported() error = %v", err)
+	}
+	p, err := models.Usage.FindPeriod(ctx, 2, now)
+	if err != nil || p.ReportedQuantity != 3 || p.ReportedAt == nil || !p.ReportedAt.Equal(now) {
+		t.Fatalf("FindPeriod() after MarkReported() = %+v, error %v, want 3 reported at %s", p, err, now)
+	}
+	unreported, err = models.Usage.ListUnreported(ctx, 10)
+	if err != nil || len(unreported) != 2 || unreported[0].SubscriptionItemID != 3 || unreported[1].SubscriptionItemID != 1 {
+		t.Fatalf("ListUnreported() after MarkReported() = %+v, error %v, want items 3 and 1", unreported, err)
+	}
+
+	// Usage recorded after a report is listed again, with the new total.
+	e := data.UsageEvent{SubscriptionItemID: 2, SubscriptionID: "2", IdempotencyKey: "b", Quantity: 4, PeriodStart: start, OccurredAt: now}
+	if _, err := models.Usage.Record(ctx, e); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	unreported, err = models.Usage.ListUnreported(ctx, 2)
+	if err != nil || len(unreported) != 2 || unreported[1].SubscriptionItemID != 2 || unreported[1].Quantity != 7 {
+		t.Errorf("ListUnreported() after more usage = %+v, error %v, want item 2 with 7 second", unreported, err)
+	}
+}
+
+func TestUsageCarryOver(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	next := start.AddDate(0, 1, 0)
+	for _, p := range []data.UsagePeriod{
+		{SubscriptionItemID: 5, SubscriptionID: "5", PeriodStart: start, PeriodEnd: next},
+		{SubscriptionItemID: 5, SubscriptionID: "5", PeriodStart: next, PeriodEnd: next.AddDate(0, 1, 0)},
+	} {
+		if err := models.Usage.AddPeriod(ctx, p); err != nil {
+			t.Fatalf("AddPeriod() error = %v", err)
+		}
+	}
+	for key, quantity := range map[string]int64{"a": 3, "b": 4} {
+		e := data.UsageEvent{SubscriptionItemID: 5, SubscriptionID: "5", IdempotencyKey: key, Quantity: quantity, PeriodStart: start, OccurredAt: start}
+		if _, err := models.Usage.Record(ctx, e); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+	if err := models.Usage.MarkReported(ctx, 5, start, 3, start); err != nil {
+		t.Fatalf("MarkReported() error = %v", err)
+	}
+	ended, err := models.Usage.FindPeriod(ctx, 5, start)
+	if err != nil {
+		t.Fatalf("FindPeriod() error = %v", err)
+	}
+
+	// Usage recorded after the last report moves to the next period, and the ended one is done.
+	if err := models.Usage.CarryOver(ctx, *ended, next, next); err != nil {
+		t.Fatalf("CarryOver() error = %v", err)
+	}
+	current, err := models.Usage.FindPeriod(ctx, 5, next)
+	if err != nil || current.Quantity != 4 {
+		t.Fatalf("FindPeriod() of the next period = %+v, error %v, want quantity 4", current, err)
+	}
+	unreported, err := models.Usage.ListUnreported(ctx, 10)
+	if err != nil || len(unreported) != 1 || !unreported[0].PeriodStart.Equal(next) {
+		t.Fatalf("ListUnreported() after CarryOver() = %+v, error %v, want the next period", unreported, err)
+	}
+
+	// Carrying over usage read before it changed, as another replica would, moves nothing.
+	if err := models.Usage.CarryOver(ctx, *ended, next, next); !errors.Is(err, data.ErrConflict) {
+		t.Errorf("CarryOver() twice error = %v, want %v", err, data.ErrConflict)
+	}
+	if current, err := models.Usage.FindPeriod(ctx, 5, next); err != nil || current.Quantity != 4 {
+		t.Errorf("FindPeriod() after a conflict = %+v, error %v, want quantity 4", current, err)
+	}
+}
+
+func TestUsageRecordRollsBack(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := models.Usage.AddPeriod(ctx, data.UsagePeriod{SubscriptionItemID: 7, SubscriptionID: "1", PeriodStart: start, PeriodEnd: start.AddDate(0, 1, 0)}); err != nil {
+		t.Fatalf("AddPeriod() error = %v", err)
+	}
+
+	event := data.UsageEvent{SubscriptionItemID: 7, SubscriptionID: "1", IdempotencyKey: "a", Quantity: 5, PeriodStart: start, OccurredAt: start}
+	failed := errors.New("failed")
+	err := models.RunInTx(ctx, func(tx data.Models) error {
+		if _, err := tx.Usage.Record(ctx, event); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, failed)
+	}
+	// Neither the event nor its quantity was kept, so the key can be used again.
+	if p, err := models.Usage.FindPeriod(ctx, 7, start); err != nil || p.Quantity != 0 {
+		t.Errorf("FindPeriod() after rollback = %+v, error %v, want no usage", p, err)
+	}
+	if _, err := models.Usage.Record(ctx, event); err != nil {
+		t.Errorf("Record() after rollback error = %v", err)
+	}
+}
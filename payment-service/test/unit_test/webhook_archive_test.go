@@ -0,0 +1,95 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWebhookArchive(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	errAbort := errors.New("abort")
+
+	created := []byte(`{"meta": {"event_name": "subscription_created"}, "data": {"id": "1"}}`)
+	updated := []byte(`{"meta": {"event_name": "subscription_updated"}, "data": {"id": "1"}}`)
+	createdID, err := models.Archive.Add(ctx, data.ArchivedWebhook{Headers: map[string]string{"X-Event-Name": "subscription_created"}}, created)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	updatedID, err := models.Archive.Add(ctx, data.ArchivedWebhook{EventName: "subscription_updated"}, updated)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// A retry of a delivery has the same body and is archived as the same webhook.
+	retryID, err := models.Archive.Add(ctx, data.ArchivedWebhook{Headers: map[string]string{"X-Event-Name": "subscription_created", "X-Retry": "1"}}, created)
+	if err != nil || retryID != createdID {
+		t.Fatalf("Add() of a retry = %d, error %v, want %d", retryID, err, createdID)
+	}
+	w, err := models.Archive.Get(ctx, createdID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if w.Status != data.WebhookReceived || w.Attempts != 0 || w.ProcessedAt != nil || w.Headers["X-Retry"] != "1" {
+		t.Errorf("Get() = %+v, want a received webhook with the headers of the retry", w)
+	}
+	if payload, err := models.Events.Payload(ctx, w.PayloadDigest); err != nil || string(payload) != string(created) {
+		t.Errorf("Payload() = %s, error %v", payload, err)
+	}
+
+	if err := models.Archive.SetStatus(ctx, createdID, "subscription_created", data.WebhookFailed, "connection refused"); err != nil {
+		t.Fatalf("SetStatus() error = %v", err)
+	}
+	if err := models.Archive.SetStatus(ctx, updatedID, "subscription_updated", data.WebhookProcessed, ""); err != nil {
+		t.Fatalf("SetStatus() error = %v", err)
+	}
+	// A status set in a rolled back transaction is not recorded.
+	err = models.RunInTx(ctx, func(tx data.Models) error {
+		if err := tx.Archive.SetStatus(ctx, updatedID, "subscription_updated", data.WebhookDeadLettered, "rolled back"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, errAbort)
+	}
+	if err := models.Archive.SetStatus(ctx, 404, "", data.WebhookProcessed, ""); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("SetStatus() of a missing webhook error = %v, want %v", err, data.ErrNotFound)
+	}
+
+	w, _ = models.Archive.Get(ctx, createdID)
+	if w.EventName != "subscription_created" || w.Status != data.WebhookFailed || w.Error != "connection refused" || w.Attempts != 1 || w.ProcessedAt == nil {
+		t.Errorf("Get() after SetStatus() = %+v", w)
+	}
+
+	testCases := []struct {
+		name   string
+		filter data.ArchiveFilter
+		want   []int64
+	}{
+		{name: "All", filter: data.ArchiveFilter{}, want: []int64{createdID, updatedID}},
+		{name: "Failed", filter: data.ArchiveFilter{Statuses: []string{data.WebhookFailed, data.WebhookDeadLettered}}, want: []int64{createdID}},
+		{name: "Limit", filter: data.ArchiveFilter{Limit: 1}, want: []int64{createdID}},
+		{name: "Range", filter: data.ArchiveFilter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}, want: []int64{createdID, updatedID}},
+		{name: "Future", filter: data.ArchiveFilter{From: time.Now().Add(time.Hour)}, want: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			webhooks, err := models.Archive.List(ctx, tc.filter)
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			var got []int64
+			for _, w := range webhooks {
+				got = append(got, w.ID)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("List() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"payment-service/data"
+	"testing"
+)
+
+func TestWebhookDeliveries(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	errAbort := errors.New("abort")
+
+	paused := []byte(`{"meta": {"event_name": "subscription_paused"}, "data": {"id": "1"}}`)
+	key := data.WebhookDeliveryKey("subscription_paused", paused)
+	if other := data.WebhookDeliveryKey("subscription_paused", []byte(`{"meta": {"event_name": "subscription_paused"}, "data": {"id": "2"}}`)); other == key {
+		t.Errorf("WebhookDeliveryKey() is the same for different bodies")
+	}
+
+	// A delivery recorded in a rolled back transaction was not processed.
+	err := models.RunInTx(ctx, func(tx data.Models) error {
+		if err := tx.Deliveries.Record(ctx, key); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, errAbort)
+	}
+
+	if err := models.Deliveries.Record(ctx, key); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	if err := models.Deliveries.Record(ctx, key); !errors.Is(err, data.ErrDuplicate) {
+		t.Errorf("Record() of a redelivery error = %v, want %v", err, data.ErrDuplicate)
+	}
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"payment-service/data"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readFixture returns a webhook body from testdata/lemonsqueezy.
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "lemonsqueezy", name))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	return body
+}
+
+func TestParseWebhook(t *testing.T) {
+	t.Run("Subscription", func(t *testing.T) {
+		webhook, err := data.ParseWebhook(readFixture(t, "subscription_created.json"))
+		if err != nil {
+			t.Fatalf("ParseWebhook() error = %v", err)
+		}
+		if webhook.Type != data.ResourceSubscription || webhook.EventName != "subscription_created" || webhook.UserID != 42 {
+			t.Errorf("ParseWebhook() = %+v", webhook)
+		}
+		payment, err := webhook.Payment()
+		if err != nil {
+			t.Fatalf("Payment() error = %v", err)
+		}
+		// Identifiers above 2^53 keep every digit.
+		if payment.SubscriptionID != "9007199254740993" || payment.CustomerID != 9007199254740995 || payment.OrderID != 9007199254740997 {
+			t.Errorf("Payment() ids = %s, %d, %d", payment.SubscriptionID, payment.CustomerID, payment.OrderID)
+		}
+		if payment.UserID != 42 || payment.Status != "active" || payment.CardLastFour != "4242" || payment.Total != (data.Money{}) || payment.SubscriptionItemID != 71 {
+			t.Errorf("Payment() = %+v", payment)
+		}
+	})
+
+	t.Run("SubscriptionWithoutCard", func(t *testing.T) {
+		webhook, err := data.ParseWebhook(readFixture(t, "subscription_updated_paypal.json"))
+		if err != nil {
+			t.Fatalf("ParseWebhook() error = %v", err)
+		}
+		a := webhook.Subscription
+		if a.CardBrand != "" || a.CardLastFour != "" || a.EndsAt == nil || webhook.UserID != 0 {
+			t.Errorf("ParseWebhook() = %+v, attributes %+v", webhook, a)
+		}
+	})
+
+	t.Run("SubscriptionOnTrial", func(t *testing.T) {
+		webhook, err := data.ParseWebhook(readFixture(t, "subscription_updated_on_trial.json"))
+		if err != nil {
+			t.Fatalf("ParseWebhook() error = %v", err)
+		}
+		payment, err := webhook.Payment()
+		if err != nil {
+			t.Fatalf("Payment() error = %v", err)
+		}
+		if payment.Status != "on_trial" || payment.TrialEndsAt == nil || !payment.TrialEndsAt.Equal(time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Payment() status = %q, trial ends at %v, want on_trial until 2024-01-15", payment.Status, payment.TrialEndsAt)
+		}
+	})
+
+	t.Run("SubscriptionInvoice", func(t *testing.T) {
+		webhook, err := data.ParseWebhook(readFixture(t, "subscription_payment_success.json"))
+		if err != nil {
+			t.Fatalf("ParseWebhook() error = %v", err)
+		}
+		invoice := webhook.SubscriptionInvoice
+		if webhook.Type != data.ResourceSubscriptionInvoice || invoice == nil || invoice.SubscriptionID != 9007199254740993 || webhook.UserID != 42 {
+			t.Fatalf("ParseWebhook() = %+v", webhook)
+		}
+		subtotal, discount, tax, total := invoice.Amounts()
+		if subtotal.String() != "19.99 USD" || discount.Amount != 500 || tax.Amount != 150 || total != (data.Money{Amount: 1649, Currency: "USD"}) {
+			t.Errorf("Amounts() = %v, %v, %v, %v", subtotal, discount, tax, total)
+		}
+		// An invoice is not a subscription, so it can't replace the stored payment.
+		if _, err := webhook.Payment(); err == nil {
+			t.Errorf("Payment() of an invoice succeeded")
+		}
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		webhook, err := data.ParseWebhook(readFixture(t, "order_created.json"))
+		if err != nil {
+			t.Fatalf("ParseWebhook() error = %v", err)
+		}
+		if webhook.Order == nil || webhook.Order.Total != 1650 || webhook.Order.Currency != "JPY" || webhook.Order.FirstOrderItem.VariantID != 101 {
+			t.Errorf("ParseWebhook() = %+v", webhook)
+		}
+	})
+
+	t.Run("LicenseKey", func(t *testing.T) {
+		webhook, err := data.ParseWebhook(readFixture(t, "license_key_created.json"))
+		if err != nil {
+			t.Fatalf("ParseWebhook() error = %v", err)
+		}
+		if webhook.LicenseKey == nil || webhook.LicenseKey.KeyShort != "XXXX-8f9c98a48abe" || webhook.LicenseKey.ActivationLimit != nil {
+			t.Errorf("ParseWebhook() = %+v", webhook)
+		}
+	})
+
+	invalid := []struct {
+		fixture string
+		want    []data.FieldError
+	}{
+		{
+			fixture: "invalid_missing_fields.json",
+			want: []data.FieldError{
+				{Field: "meta.custom_data.user_id", Problem: "must be an integer"},
+				{Field: "data.id", Problem: "is missing"},
+				{Field: "data.attributes.renews_at", Problem: "is missing"},
+				{Field: "data.attributes.updated_at", Problem: "is missing"},
+			},
+		},
+		{
+			fixture: "invalid_wrong_type.json",
+			want:    []data.FieldError{{Field: "data.attributes.subscription_id", Problem: "must be a int64"}},
+		},
+		{
+			fixture: "invalid_unsupported_type.json",
+			want:    []data.FieldError{{Field: "data.type", Problem: `has unsupported value "affiliates"`}},
+		},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.fixture, func(t *testing.T) {
+			_, err := data.ParseWebhook(readFixture(t, tc.fixture))
+			var validationErr *data.ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("ParseWebhook() error = %v, want a *data.ValidationError", err)
+			}
+			if !reflect.DeepEqual(validationErr.Fields, tc.want) {
+				t.Errorf("ParseWebhook() fields = %+v, want %+v", validationErr.Fields, tc.want)
+			}
+		})
+	}
+
+	// A body that isn't JSON at all is not a validation error.
+	var validationErr *data.ValidationError
+	if _, err := data.ParseWebhook([]byte(`{"data":`)); err == nil || errors.As(err, &validationErr) {
+		t.Errorf("ParseWebhook() of truncated JSON error = %v, want a JSON syntax error", err)
+	}
+}
+
+func TestWebhookEventName(t *testing.T) {
+	testCases := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "EventName", body: `{"meta": {"event_name": "subscription_paused"}, "data": {}}`, want: "subscription_paused"},
+		{name: "NoMeta", body: `{"data": {}}`, want: ""},
+		{name: "InvalidJSON", body: `{"meta":`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := data.WebhookEventName([]byte(tc.body))
+			if (err != nil) != tc.wantErr || got != tc.want {
+				t.Errorf("WebhookEventName() = %q, error %v, want %q, error %v", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+}
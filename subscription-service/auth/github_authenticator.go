@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,14 +10,13 @@ import (
 	"subscription-service/data"
 	"subscription-service/util"
 
-	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"github.com/markbates/goth/providers/github"
 )
 
-var connection *pgx.Conn
+var models data.Models
 
 const (
 	key    = "random string"
@@ -86,7 +86,8 @@ func (g *GitHubAuthenticator) NewAuth() {
 //   - If authentication fails, logs the error, sends an HTTP 500 response, and returns an error.
 //
 // 4. Checks if the authenticated user already exists in the database by their GitHub ID.
-//   - If the user does not exist (indicated by pgx.ErrNoRows), a new user record is created with the information
+//   - The lookup and the insert below run in a single transaction.
+//   - If the user does not exist (indicated by data.ErrNotFound), a new user record is created with the information
 //     obtained from GitHub and inserted into the database.
 //   - If the user creation fails, sends an HTTP 500 response and returns an error.
 //   - If the user is successfully created, sends an HTTP 200 response indicating success.
@@ -112,30 +113,49 @@ func (g *GitHubAuthenticator) CallBack(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
-	// Initialize a variable to hold user data.
+	// Look the user up and create them if needed in one transaction, so two concurrent
+	// callbacks for the same GitHub account can't both create a user.
+	ctx := c.Request().Context()
 	var User data.User
-	// Check if the user exists in the database by their GitHub ID.
-	if err := User.GetByGitId(connection, user.UserID); err != nil {
-		// If the user does not exist, create a new user record.
-		if err == pgx.ErrNoRows {
-			// Populate the User struct with data from the authenticated GitHub user.
-			User.AccessToken = user.AccessToken
-			User.Email = user.Email
-			User.GithubId = user.UserID
-			User.UserName = user.Name
-			User.Bio = user.Description
-			User.AvatarUrl = user.AvatarURL
-			User.FirstName = user.FirstName
-			User.LastName = user.LastName
-			// Attempt to insert the new user into the database.
-			if err := User.InsertUser(connection, User); err != nil {
-				// Return an error response if user creation fails.
-				return c.JSON(http.StatusInternalServerError, "error while creating user")
-			} else {
-				// Return a success response if the user is created successfully.
-				return c.JSON(http.StatusOK, "Account created successfully!")
-			}
+	created := false
+	err = models.RunInTx(ctx, func(tx data.Models) error {
+		created = false // Reset in case the transaction is retried.
+		// Check if the user exists in the database by their GitHub ID.
+		existing, err := tx.Users.GetByGitId(ctx, user.UserID)
+		if err == nil {
+			User = existing
+			return nil
 		}
+		if !errors.Is(err, data.ErrNotFound) {
+			return err
+		}
+		// If the user does not exist, populate a new user record with data from the authenticated GitHub user.
+		User = data.User{
+			AccessToken: user.AccessToken,
+			Email:       user.Email,
+			GithubId:    user.UserID,
+			UserName:    user.Name,
+			Bio:         user.Description,
+			AvatarUrl:   user.AvatarURL,
+			FirstName:   user.FirstName,
+			LastName:    user.LastName,
+		}
+		// Attempt to insert the new user into the database.
+		created = true
+		_, err = tx.Users.InsertUser(ctx, User)
+		return err
+	})
+	if err != nil {
+		if created {
+			// Return an error response if user creation fails.
+			return c.JSON(http.StatusInternalServerError, "error while creating user")
+		}
+		log.Println("failed to fetch user: ", err.Error())
+		return c.JSON(http.StatusInternalServerError, "Failed to fetch user")
+	}
+	if created {
+		// Return a success response if the user is created successfully.
+		return c.JSON(http.StatusOK, "Account created successfully!")
 	}
 
 	// For existing users, generate a JWT token for session management.
@@ -193,7 +213,7 @@ func (g *GitHubAuthenticator) Auth(c echo.Context) error {
 
 // NewGitHubAuthenticator creates a new GitHubAuthenticator instance.
 // Returns a pointer to the instance.
-func NewGitHubAuthenticator(conn *pgx.Conn) *GitHubAuthenticator {
-	connection = conn
+func NewGitHubAuthenticator(m data.Models) *GitHubAuthenticator {
+	models = m
 	return &GitHubAuthenticator{}
 }
@@ -0,0 +1,147 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultAPIURL is the URL of the Lemon Squeezy API.
+const DefaultAPIURL = "https://api.lemonsqueezy.com"
+
+// ErrInvalidCheckout is returned by CreateCheckout when Lemon Squeezy rejects the checkout,
+// for instance because the variant does not exist or does not belong to the store.
+var ErrInvalidCheckout = errors.New("checkout rejected by Lemon Squeezy")
+
+// numericIDPattern matches the numeric IDs the Lemon Squeezy API uses for stores and variants.
+var numericIDPattern = regexp.MustCompile(`^[0-9]{1,19}$`)
+
+// CheckoutClient creates checkouts through the Lemon Squeezy API.
+type CheckoutClient struct {
+	APIKey     string       // API key sent as a bearer token.
+	StoreID    string       // Store the checkouts are created in.
+	BaseURL    string       // URL of the API, DefaultAPIURL if empty.
+	SuccessURL string       // Page the customer is sent to after paying, Lemon Squeezy's receipt page if empty.
+	HTTPClient *http.Client // Client sending the requests, http.DefaultClient if nil.
+}
+
+// Checkout holds the customer details of a checkout.
+type Checkout struct {
+	VariantID string // Numeric ID of the variant being bought.
+	UserID    int64  // ID of the user, returned in meta.custom_data.user_id of the subscription's webhooks.
+	Email     string // Prefills the email field, if not empty.
+	Name      string // Prefills the name field, if not empty.
+}
+
+// CreateCheckout creates a checkout for the variant and returns its URL.
+//
+// The user ID is passed as custom data, which Lemon Squeezy returns in meta.custom_data of every
+// webhook for the resulting subscription, so payment-service can link the payment to the user even
+// if they later change their email address. It is stored with the checkout rather than passed in
+// the link, so the customer can't change it.
+func (c *CheckoutClient) CreateCheckout(ctx context.Context, checkout Checkout) (string, error) {
+	if c.APIKey == "" || c.StoreID == "" {
+		return "", fmt.Errorf("LEMON_SQUEEZY_API_KEY and LEMON_SQUEEZY_STORE_ID must be set")
+	}
+	if !numericIDPattern.MatchString(checkout.VariantID) {
+		return "", fmt.Errorf("%w: invalid variant %q", ErrInvalidCheckout, checkout.VariantID)
+	}
+
+	checkoutData := map[string]interface{}{
+		"custom": map[string]string{"user_id": strconv.FormatInt(checkout.UserID, 10)},
+	}
+	if checkout.Email != "" {
+		checkoutData["email"] = checkout.Email
+	}
+	if checkout.Name != "" {
+		checkoutData["name"] = checkout.Name
+	}
+	productOptions := map[string]interface{}{}
+	if c.SuccessURL != "" {
+		productOptions["redirect_url"] = c.SuccessURL
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "checkouts",
+			"attributes": map[string]interface{}{
+				"checkout_data":   checkoutData,
+				"product_options": productOptions,
+			},
+			"relationships": map[string]interface{}{
+				"store":   map[string]interface{}{"data": map[string]string{"type": "stores", "id": c.StoreID}},
+				"variant": map[string]interface{}{"data": map[string]string{"type": "variants", "id": checkout.VariantID}},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	baseURL := strings.TrimSuffix(c.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultAPIURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/v1/checkouts", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.api+json")
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to create checkout: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read checkout response: %w", err)
+	}
+	// Lemon Squeezy answers 404 for an unknown variant and 422 for one it can't sell in the store.
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity {
+		return "", fmt.Errorf("%w: %s", ErrInvalidCheckout, errorDetail(respBody, resp.Status))
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to create checkout: %s", errorDetail(respBody, resp.Status))
+	}
+
+	var document struct {
+		Data struct {
+			Attributes struct {
+				URL string `json:"url"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &document); err != nil {
+		return "", fmt.Errorf("failed to decode checkout response: %w", err)
+	}
+	if document.Data.Attributes.URL == "" {
+		return "", fmt.Errorf("checkout response has no URL")
+	}
+	return document.Data.Attributes.URL, nil
+}
+
+// errorDetail returns the detail of the first error of a JSON:API error document, or status if there is none.
+func errorDetail(body []byte, status string) string {
+	var document struct {
+		Errors []struct {
+			Detail string `json:"detail"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &document) == nil && len(document.Errors) > 0 && document.Errors[0].Detail != "" {
+		return status + ": " + document.Errors[0].Detail
+	}
+	return status
+}
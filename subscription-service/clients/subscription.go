@@ -0,0 +1,67 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// UpdatePaymentMethodURL returns the page where the customer of a subscription changes their card.
+// Lemon Squeezy signs the link so it opens without a login, and it expires after 24 hours, so a
+// fresh one is retrieved every time it is sent rather than keeping one.
+func (c *CheckoutClient) UpdatePaymentMethodURL(ctx context.Context, subscriptionID string) (string, error) {
+	if c.APIKey == "" {
+		return "", fmt.Errorf("LEMON_SQUEEZY_API_KEY must be set")
+	}
+	if !numericIDPattern.MatchString(subscriptionID) {
+		return "", fmt.Errorf("invalid subscription %q", subscriptionID)
+	}
+
+	baseURL := strings.TrimSuffix(c.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultAPIURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/v1/subscriptions/"+subscriptionID, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.api+json")
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get subscription %s: %w", subscriptionID, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read subscription response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get subscription %s: %s", subscriptionID, errorDetail(respBody, resp.Status))
+	}
+
+	var document struct {
+		Data struct {
+			Attributes struct {
+				URLs struct {
+					UpdatePaymentMethod string `json:"update_payment_method"`
+				} `json:"urls"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &document); err != nil {
+		return "", fmt.Errorf("failed to decode subscription response: %w", err)
+	}
+	if document.Data.Attributes.URLs.UpdatePaymentMethod == "" {
+		return "", fmt.Errorf("subscription %s has no update payment method URL", subscriptionID)
+	}
+	return document.Data.Attributes.URLs.UpdatePaymentMethod, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"subscription-service/data"
+)
+
+// runBackfillPaymentUsers implements the "backfill-payment-users" subcommand, which links payments
+// made before checkout passed the user ID to the users with their email.
+// It connects only to the database and returns the process exit code.
+func runBackfillPaymentUsers(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: subscriptionApp backfill-payment-users")
+		return 2
+	}
+
+	keys, err := loadKeyRing()
+	if err != nil {
+		log.Printf("Failed to load the key ring: %v", err)
+		return 1
+	}
+	pool, err := connect() // Connect to the database.
+	if err != nil {
+		log.Printf("Failed to connect to the database: %v", err)
+		return 1
+	}
+	defer pool.Close()
+
+	models := data.NewModels(pool, keys)
+	result, err := data.BackfillPaymentUserIDs(context.Background(), pool, models.Users)
+	if err != nil {
+		log.Printf("backfill-payment-users failed after linking %d payments: %v", result.Linked, err)
+		return 1
+	}
+	fmt.Printf("Linked %d payments to their users; %d payment emails belong to no user\n", result.Linked, result.Unmatched)
+	return 0
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// errInvalidIfMatch is returned by parseIfMatch when the header is not an ETag produced by formatETag.
+var errInvalidIfMatch = errors.New("If-Match must be a single ETag returned by GET /account")
+
+// formatETag returns the strong ETag for a record version.
+func formatETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseIfMatch returns the record version the If-Match header requires.
+// An empty header or "*" places no requirement and returns 0, which repositories treat as unconditional.
+func parseIfMatch(header string) (int64, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	unquoted, err := strconv.Unquote(header)
+	if err != nil || !strings.HasPrefix(header, `"`) {
+		return 0, errInvalidIfMatch
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version < 1 {
+		return 0, errInvalidIfMatch
+	}
+	return version, nil
+}
@@ -3,12 +3,19 @@ package main
 
 import (
 	"context" // Import context to manage request-scoped values, cancelation signals, and deadlines.
-	"fmt"     // Import fmt for logging errors.
+	"errors"
+	"fmt" // Import fmt for logging errors.
+	"time"
 
+	"subscription-service/entitlements"
 	"subscription-service/grpc/pb"         // Import pb for gRPC service definitions.
 	"subscription-service/worker/workflow" // Import workflow to use the SubscriptionParams struct.
 
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client" // Import client to interact with Temporal service.
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // server struct implements the SubscriptionServiceServer interface generated by gRPC.
@@ -26,13 +33,41 @@ func NewServer() pb.SubscriptionServiceServer {
 // It implements the SubscriptionServiceServer interface.
 // This method takes a context and a SubscriptionRequest, and returns a SubscriptionResponse or an error.
 func (s *server) ProcessSubscription(ctx context.Context, req *pb.SubscriptionRequest) (*pb.SubscriptionResponse, error) {
+	// Renewal notices announce a renewal without changing the subscription, so they start no other workflow.
+	if req.MailType == renewalNoticeMail {
+		return sendRenewalNotice(req)
+	}
+	// Failed renewals are handled by the subscription's DunningWorkflow instead of a single notification.
+	// Older payment-service versions don't send the subscription ID, so they keep the single notification.
+	if req.SubscriptionId != "" {
+		switch req.MailType {
+		case paymentFailedMail:
+			return startDunning(req)
+		case paymentSucceededMail, paymentRecoveredMail:
+			if err := stopDunning(req.SubscriptionId); err != nil {
+				app.Producer.publishMessage("error", "Subscription-Service", "Failed to signal DunningWorkflow: "+err.Error())
+				return &pb.SubscriptionResponse{Success: false, Message: err.Error()}, nil
+			}
+		}
+	}
+	// Subscriptions with a trial are followed by their TrialWorkflow, on top of the usual notification.
+	// Invoice notifications carry the invoice's status, not the subscription's, so they are left out.
+	if req.SubscriptionId != "" && req.TrialEndsAt != 0 && !invoiceMail(req.MailType) {
+		if err := updateTrial(req); err != nil {
+			app.Producer.publishMessage("error", "Subscription-Service", "Failed to signal TrialWorkflow: "+err.Error())
+			return &pb.SubscriptionResponse{Success: false, Message: err.Error()}, nil
+		}
+	}
+
 	// Prepare the parameters for the workflow based on the request.
 	param := workflow.SubscriptionParams{
+		UserID:      req.UserId,             // User's ID, or zero for payments made before it was recorded.
 		Email:       req.EmailId,            // User's email ID.
 		Status:      req.SubscriptionStatus, // Subscription status (e.g., active, inactive).
 		Type:        req.MailType,           // Type of mail (e.g., promotional, transactional).
 		PlanName:    req.ProductName,        // Name of the subscription plan.
 		VariantName: req.VariantName,        // Name of the plan variant.
+		VariantID:   req.VariantId,          // ID of the plan variant, or zero from older payment-service versions.
 	}
 
 	// Define the workflow options for starting the workflow.
@@ -40,11 +75,23 @@ func (s *server) ProcessSubscription(ctx context.Context, req *pb.SubscriptionRe
 		ID:        "SubscriptionWorkflow" + param.Email, // Unique workflow ID using the user's email.
 		TaskQueue: "subscription-service",               // Task queue name for worker matching.
 	}
+	if req.EventId != "" {
+		// Payment-service delivers events at least once. Deriving the workflow ID from the event ID
+		// and never reusing it makes a redelivered event find the workflow it already started.
+		workflowOptions.ID = "SubscriptionWorkflow_" + req.EventId
+		workflowOptions.WorkflowIDReusePolicy = enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE
+		workflowOptions.WorkflowExecutionErrorWhenAlreadyStarted = true
+	}
 
 	// Execute the workflow with the prepared options and parameters.
 	// The context is explicitly set to Background to avoid using the gRPC request context.
 	// This is because the workflow may outlive the original request context.
 	_, err := app.Temporal.ExecuteWorkflow(context.Background(), workflowOptions, "SubscriptionWorkflow", param)
+	var alreadyStarted *serviceerror.WorkflowExecutionAlreadyStarted
+	if errors.As(err, &alreadyStarted) {
+		// The event was already processed; acknowledge it so the sender stops retrying.
+		return &pb.SubscriptionResponse{Success: true, Message: "Subscription already processed"}, nil
+	}
 	if err != nil {
 		// Log the error and notify via a message queue if starting the workflow fails.
 		fmt.Println(err) // Log the error to standard output.
@@ -56,3 +103,172 @@ func (s *server) ProcessSubscription(ctx context.Context, req *pb.SubscriptionRe
 	// Return a successful response if the workflow was started without errors.
 	return &pb.SubscriptionResponse{Success: true, Message: "Subscription successful"}, nil
 }
+
+// Mail types of the notifications payment-service sends for subscription invoices.
+const (
+	paymentFailedMail    = "payment"         // A renewal payment failed.
+	paymentSucceededMail = "payment success" // A renewal payment succeeded.
+	paymentRecoveredMail = "recovered"       // A renewal payment succeeded after failing.
+	paymentRefundedMail  = "refunded"        // A payment was refunded.
+)
+
+// renewalNoticeMail is the mail type of the notifications payment-service sends ahead of a renewal.
+const renewalNoticeMail = "renewal notice"
+
+// invoiceMail reports whether mailType is that of a notification about a subscription invoice.
+func invoiceMail(mailType string) bool {
+	switch mailType {
+	case paymentFailedMail, paymentSucceededMail, paymentRecoveredMail, paymentRefundedMail:
+		return true
+	}
+	return false
+}
+
+// startDunning starts the DunningWorkflow of the subscription of a failed renewal. If it is already
+// running, for a retry of the payment that failed again or a redelivered notification, it continues
+// on its schedule and the request is acknowledged.
+func startDunning(req *pb.SubscriptionRequest) (*pb.SubscriptionResponse, error) {
+	param := workflow.DunningParams{
+		SubscriptionID: req.SubscriptionId,
+		UserID:         req.UserId,
+		Email:          req.EmailId,
+		PlanName:       req.ProductName,
+		VariantName:    req.VariantName,
+		VariantID:      req.VariantId,
+		Schedule:       app.DunningSchedule,
+		GracePeriod:    app.DunningGracePeriod,
+	}
+	workflowOptions := client.StartWorkflowOptions{
+		ID:                                       workflow.DunningWorkflowID(req.SubscriptionId),
+		TaskQueue:                                "subscription-service",
+		WorkflowExecutionErrorWhenAlreadyStarted: true,
+	}
+	_, err := app.Temporal.ExecuteWorkflow(context.Background(), workflowOptions, "DunningWorkflow", param)
+	var alreadyStarted *serviceerror.WorkflowExecutionAlreadyStarted
+	if errors.As(err, &alreadyStarted) {
+		return &pb.SubscriptionResponse{Success: true, Message: "Dunning already in progress"}, nil
+	}
+	if err != nil {
+		app.Producer.publishMessage("error", "Subscription-Service", "Failed to start DunningWorkflow: "+err.Error())
+		return &pb.SubscriptionResponse{Success: false, Message: err.Error()}, nil
+	}
+	return &pb.SubscriptionResponse{Success: true, Message: "Dunning started"}, nil
+}
+
+// stopDunning signals the DunningWorkflow of a subscription that its payment recovered.
+// It returns nil if none is running, which is the case for most successful renewals.
+func stopDunning(subscriptionID string) error {
+	err := app.Temporal.SignalWorkflow(context.Background(), workflow.DunningWorkflowID(subscriptionID), "", workflow.PaymentRecoveredSignal, nil)
+	var notFound *serviceerror.NotFound
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	return err
+}
+
+// updateTrial tells the TrialWorkflow of the subscription of req about its status, starting the workflow
+// if the subscription is on trial and it isn't running. Requests about subscriptions that are no longer
+// on trial and have no workflow, such as the renewals of converted ones, are ignored.
+func updateTrial(req *pb.SubscriptionRequest) error {
+	update := workflow.TrialUpdate{Status: req.SubscriptionStatus, EndsAt: time.Unix(req.TrialEndsAt, 0).UTC()}
+	id := workflow.TrialWorkflowID(req.SubscriptionId)
+	if req.SubscriptionStatus != "on_trial" {
+		err := app.Temporal.SignalWorkflow(context.Background(), id, "", workflow.TrialUpdateSignal, update)
+		var notFound *serviceerror.NotFound
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	param := workflow.TrialParams{
+		SubscriptionID: req.SubscriptionId,
+		UserID:         req.UserId,
+		Email:          req.EmailId,
+		PlanName:       req.ProductName,
+		VariantName:    req.VariantName,
+		VariantID:      req.VariantId,
+		EndsAt:         update.EndsAt,
+		ReminderDays:   app.TrialReminderDays,
+	}
+	workflowOptions := client.StartWorkflowOptions{ID: id, TaskQueue: "subscription-service"}
+	_, err := app.Temporal.SignalWithStartWorkflow(context.Background(), id, workflow.TrialUpdateSignal, update, workflowOptions, "TrialWorkflow", param)
+	return err
+}
+
+// sendRenewalNotice starts the RenewalNoticeWorkflow of the notice in req. Payment-service records every notice
+// it sends, so the workflow ID is derived from the event ID only to drop redelivered notifications.
+func sendRenewalNotice(req *pb.SubscriptionRequest) (*pb.SubscriptionResponse, error) {
+	param := workflow.RenewalNoticeParams{
+		SubscriptionID: req.SubscriptionId,
+		UserID:         req.UserId,
+		Email:          req.EmailId,
+		PlanName:       req.ProductName,
+		VariantName:    req.VariantName,
+		RenewsAt:       time.Unix(req.RenewsAt, 0).UTC(),
+		Amount:         req.RenewalAmount,
+	}
+	workflowOptions := client.StartWorkflowOptions{
+		ID:                                       "RenewalNoticeWorkflow_" + req.EventId,
+		TaskQueue:                                "subscription-service",
+		WorkflowIDReusePolicy:                    enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+		WorkflowExecutionErrorWhenAlreadyStarted: true,
+	}
+	_, err := app.Temporal.ExecuteWorkflow(context.Background(), workflowOptions, "RenewalNoticeWorkflow", param)
+	var alreadyStarted *serviceerror.WorkflowExecutionAlreadyStarted
+	if errors.As(err, &alreadyStarted) {
+		return &pb.SubscriptionResponse{Success: true, Message: "Renewal notice already sent"}, nil
+	}
+	if err != nil {
+		app.Producer.publishMessage("error", "Subscription-Service", "Failed to start RenewalNoticeWorkflow: "+err.Error())
+		return &pb.SubscriptionResponse{Success: false, Message: err.Error()}, nil
+	}
+	return &pb.SubscriptionResponse{Success: true, Message: "Renewal notice sent"}, nil
+}
+
+// CheckEntitlement reports whether a user's plan grants a feature, and its limit.
+// It returns NotFound for unknown users.
+func (s *server) CheckEntitlement(ctx context.Context, req *pb.CheckEntitlementRequest) (*pb.CheckEntitlementResponse, error) {
+	if req.Feature == "" {
+		return nil, status.Error(codes.InvalidArgument, "feature is required")
+	}
+	decision, err := app.Entitlements.Check(ctx, req.UserId, req.Feature)
+	if err != nil {
+		return nil, entitlementError(err)
+	}
+	return &pb.CheckEntitlementResponse{
+		Allowed:      decision.Allowed,
+		Limit:        decision.Limit,
+		Plan:         decision.Plan,
+		Reason:       decision.Reason,
+		UpgradePlans: decision.UpgradePlans,
+		UpgradeUrl:   decision.UpgradeURL,
+	}, nil
+}
+
+// ListEntitlements returns a user's plan and the features and limits it grants.
+// It returns NotFound for unknown users.
+func (s *server) ListEntitlements(ctx context.Context, req *pb.ListEntitlementsRequest) (*pb.ListEntitlementsResponse, error) {
+	grant, err := app.Entitlements.ForUser(ctx, req.UserId)
+	if err != nil {
+		return nil, entitlementError(err)
+	}
+	response := &pb.ListEntitlementsResponse{
+		Plan:               grant.Plan,
+		SubscriptionStatus: grant.Status,
+		VariantId:          grant.VariantID,
+		Subscribed:         grant.Subscribed,
+	}
+	for _, e := range grant.List() {
+		response.Entitlements = append(response.Entitlements, &pb.Entitlement{Feature: e.Feature, Limit: e.Limit})
+	}
+	return response, nil
+}
+
+// entitlementError converts an error resolving entitlements into a gRPC status.
+func entitlementError(err error) error {
+	if errors.Is(err, entitlements.ErrUnknownUser) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	app.Producer.publishMessage("error", "Subscription-Service", "Failed to resolve entitlements: "+err.Error())
+	return status.Error(codes.Internal, "failed to resolve entitlements")
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
+	"subscription-service/clients"
 	"subscription-service/data"
+	"subscription-service/entitlements"
 	"subscription-service/util"
+	"subscription-service/worker/workflow"
 
-	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
 	"go.temporal.io/sdk/client"
 )
@@ -20,6 +22,11 @@ func (app *Config) pingHandler(c echo.Context) error {
 	return c.String(http.StatusOK, "The system is working fine")
 }
 
+// cacheStats reports the hit, miss and error counts of the user profile cache.
+func (app *Config) cacheStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, app.UserCache.Stats())
+}
+
 // signup handles the user registration process.
 func (app *Config) signup(c echo.Context) error {
 	// Initialize a User struct to store the user's registration details.
@@ -61,35 +68,26 @@ func (app *Config) signup(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, errorMessage)
 	}
 
-	// Insert the user into the database.
-	if err := user.InsertUser(app.Connection, user); err != nil {
-		// If insertion fails, publish an error message and return an internal server error response.
-		app.Producer.publishMessage("error", "Subscription-Service", "Failed to insert user: "+err.Error())
-		return c.JSON(http.StatusInternalServerError, err.Error())
-	}
-	go func() {
-		type Param struct {
-			To      string // Recipient email address
-			Name    string // Recipient name
-			Contact string // Recipient phone number
+	// Insert the user and record the signup event in one transaction. The outbox relay starts
+	// WelcomeWorkflow from the event, so the welcome messages are sent even if the process dies
+	// right after the user is committed.
+	ctx := c.Request().Context()
+	err = app.Models.RunInTx(ctx, func(tx data.Models) error {
+		if _, err := tx.Users.InsertUser(ctx, user); err != nil {
+			return err
 		}
-
-		param := Param{
+		_, err := tx.Outbox.Enqueue(ctx, data.EventUserSignedUp, workflow.WelcomeParams{
 			To:      user.Email,
 			Name:    user.UserName,
 			Contact: "+91" + user.Contact,
-		}
-		// Prepare the workflow options
-		workflowOptions := client.StartWorkflowOptions{
-			ID:        "WelcomeWorkflow_" + user.Email, // Unique ID for the workflow instance
-			TaskQueue: "subscription-service",          // The task queue name should match the one used in worker registration
-		}
-		_, err := app.Temporal.ExecuteWorkflow(context.Background(), workflowOptions, "WelcomeWorkflow", param)
-		if err != nil {
-			app.Producer.publishMessage("error", "Subscription-Service", "Failed to start WelcomeWorkflow: "+err.Error())
-		}
-
-	}()
+		})
+		return err
+	})
+	if err != nil {
+		// If insertion fails, publish an error message and return an internal server error response.
+		app.Producer.publishMessage("error", "Subscription-Service", "Failed to insert user: "+err.Error())
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
 	// Return a created response indicating successful account creation.
 	return c.JSON(http.StatusCreated, "account created successfully")
 }
@@ -127,14 +125,15 @@ func (app *Config) login(c echo.Context) error {
 
 	var hashedPassword string
 	// Initialize a User struct to hold the fetched user details.
-	user := data.User{}
+	var user data.User
+	var err error
 
 	// switch retreival function based on the credential type
 	if credential_type == "email" {
 		// Attempt to fetch the user by email from the database.
-		if err := user.GetByEmail(app.Connection, credential); err != nil {
+		if user, err = app.Models.Users.GetByEmail(c.Request().Context(), credential); err != nil {
 			// Check if the error is because the user does not exist in the database.
-			if err == pgx.ErrNoRows {
+			if errors.Is(err, data.ErrNotFound) {
 				// If the user does not exist, respond with HTTP 404 Not Found.
 				return c.JSON(http.StatusNotFound, "user does not exist")
 			}
@@ -145,9 +144,9 @@ func (app *Config) login(c echo.Context) error {
 		hashedPassword = user.Password
 	} else {
 		// Attempt to fetch the user by contact from the database.
-		if err := user.GetByContact(app.Connection, "+91"+credential); err != nil {
+		if user, err = app.Models.Users.GetByContact(c.Request().Context(), "+91"+credential); err != nil {
 			// Check if the error is because the user does not exist in the database.
-			if err == pgx.ErrNoRows {
+			if errors.Is(err, data.ErrNotFound) {
 				// If the user does not exist, respond with HTTP 404 Not Found.
 				return c.JSON(http.StatusNotFound, "user does not exist")
 			}
@@ -188,13 +187,10 @@ func (app *Config) deleteAccount(c echo.Context) error {
 	// Extract the userID from the context. This value is expected to be set by a previous middleware.
 	userId := c.Get("userID").(int64)
 
-	// Initialize a User struct. This struct will be used to call the DeleteUser method.
-	var user data.User
-
 	// Attempt to delete the user from the database using the DeleteUser method.
-	if err := user.DeleteUser(app.Connection, userId); err != nil {
+	if err := app.Models.Users.DeleteUser(c.Request().Context(), userId); err != nil {
 		// Check if the error is because the user does not exist in the database.
-		if err == pgx.ErrNoRows {
+		if errors.Is(err, data.ErrNotFound) {
 			// If the user does not exist, respond with HTTP 404 Not Found.
 			return c.JSON(http.StatusNotFound, "user does not exist")
 		}
@@ -213,13 +209,11 @@ func (app *Config) getAccount(c echo.Context) error {
 	// Extract the userID from the context, which is assumed to be set by a previous middleware.
 	userId := c.Get("userID").(int64)
 
-	// Initialize a User struct to hold the user details.
-	var user data.User
-
 	// Attempt to fetch the user details from the database using the userID.
-	if err := user.GetUser(app.Connection, int64(userId)); err != nil {
+	user, err := app.Models.Users.GetUser(c.Request().Context(), userId)
+	if err != nil {
 		// Check if the error is because the user does not exist in the database.
-		if err == pgx.ErrNoRows {
+		if errors.Is(err, data.ErrNotFound) {
 			// Respond with HTTP 404 Not Found if the user does not exist.
 			return c.JSON(http.StatusNotFound, "user does not exist")
 		}
@@ -229,6 +223,8 @@ func (app *Config) getAccount(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, "Failed to fetch user")
 	}
 
+	// The ETag lets the client send the update with If-Match, so it can't overwrite a change it hasn't seen.
+	c.Response().Header().Set("ETag", formatETag(user.Version))
 	// Respond with HTTP 200 OK and the user details in JSON format if the user is successfully retrieved.
 	return c.JSON(http.StatusOK, map[string]string{
 		"user_name": user.UserName,                         // User's username
@@ -241,7 +237,55 @@ func (app *Config) getAccount(c echo.Context) error {
 	})
 }
 
+// createCheckout creates a Lemon Squeezy checkout for the variant_id in the request body and responds
+// with its URL. The checkout is prefilled with the user's email and name and carries their ID as custom
+// data, and sends them to CHECKOUT_SUCCESS_URL once they paid. Lemon Squeezy has no cancel redirect, so
+// CHECKOUT_CANCEL_URL is returned alongside for the client to link back to.
+func (app *Config) createCheckout(c echo.Context) error {
+	userId := c.Get("userID").(int64)
+
+	var request struct {
+		VariantID string `json:"variant_id"`
+	}
+	if err := c.Bind(&request); err != nil || request.VariantID == "" {
+		return c.JSON(http.StatusBadRequest, "variant_id is required")
+	}
+
+	user, err := app.Models.Users.GetUser(c.Request().Context(), userId)
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, "user does not exist")
+		}
+		app.Producer.publishMessage("error", "Subscription-Service", "Failed to fetch user account"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "Failed to fetch user")
+	}
+
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if name == "" {
+		name = user.UserName
+	}
+	checkoutURL, err := app.Checkout.CreateCheckout(c.Request().Context(), clients.Checkout{
+		VariantID: request.VariantID,
+		UserID:    user.ID,
+		Email:     user.Email,
+		Name:      name,
+	})
+	if err != nil {
+		if errors.Is(err, clients.ErrInvalidCheckout) {
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
+		app.Producer.publishMessage("error", "Subscription-Service", "Failed to create checkout: "+err.Error())
+		return c.JSON(http.StatusBadGateway, "Failed to create checkout")
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"checkout_url": checkoutURL,
+		"cancel_url":   app.CheckoutCancelURL,
+	})
+}
+
 // updateAccount handles account updates.
+// If the request has an If-Match header, the update only applies if the account still has the version
+// in the ETag returned by getAccount, and responds with 409 Conflict otherwise.
 func (app *Config) updateAccount(c echo.Context) error {
 	// Define a struct to hold the new account details received from the request body.
 	var newDetails struct {
@@ -264,18 +308,38 @@ func (app *Config) updateAccount(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, "Failed to update user details")
 	}
 
+	version, err := parseIfMatch(c.Request().Header.Get("If-Match"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
 	// Update the user struct with the new details received from the request.
 	user.FirstName = newDetails.FirstName
 	user.LastName = newDetails.LastName
 	user.Email = newDetails.Email
 	user.Contact = newDetails.Contact
-	// Attempt to update the user in the database with the new details.
-	if err := user.UpdateUser(app.Connection, userId, user); err != nil {
+	user.Version = version
+	// Attempt to update the user in the database with the new details, and read back the new version for the ETag.
+	ctx := c.Request().Context()
+	var updated data.User
+	err = app.Models.RunInTx(ctx, func(tx data.Models) error {
+		if err := tx.Users.UpdateUser(ctx, userId, user); err != nil {
+			return err
+		}
+		var err error
+		updated, err = tx.Users.GetUser(ctx, userId)
+		return err
+	})
+	if err != nil {
 		// Check if the error is because the user does not exist in the database.
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, data.ErrNotFound) {
 			// Respond with HTTP 404 Not Found if the user is not found in the database.
 			return c.JSON(http.StatusNotFound, "user not found")
 		}
+		// Respond with HTTP 409 Conflict if the account changed since the client read it.
+		if errors.Is(err, data.ErrConflict) {
+			return c.JSON(http.StatusConflict, "account was modified, fetch it again and retry")
+		}
 		// Publish an error message indicating failure to update the user in the database.
 		app.Producer.publishMessage("error", "Subscription-Service", "Failed to update user: "+err.Error())
 		// Respond with HTTP 500 Internal Server Error indicating failure to update the user.
@@ -283,15 +347,16 @@ func (app *Config) updateAccount(c echo.Context) error {
 	}
 
 	// Respond with HTTP 200 OK on successful update of the user account.
+	c.Response().Header().Set("ETag", formatETag(updated.Version))
 	return c.JSON(http.StatusOK, "account updated successfully")
 }
 
 // GenerateOTP generates an OTP and sends it to the user's email or phone number.
 func (app *Config) GenerateOTP(c echo.Context) error {
 	userId := c.Get("userID").(int64)
-	var user data.User
-	if err := user.GetUser(app.Connection, userId); err != nil {
-		if err == pgx.ErrNoRows {
+	user, err := app.Models.Users.GetUser(c.Request().Context(), userId)
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
 			return c.JSON(http.StatusNotFound, "user does not exist")
 		}
 		app.Producer.publishMessage("error", "Subscription-Service", "Failed to get user by email"+err.Error())
@@ -330,15 +395,14 @@ func (app *Config) VerifyOTP(c echo.Context) error {
 		OTP string
 	}
 	var body Body
-	var user data.User
 
 	if err := c.Bind(&body); err != nil {
 		app.Producer.publishMessage("error", "Subscription-Service", "Failed to bind OTP: "+err.Error())
 		return c.JSON(http.StatusBadRequest, err.Error())
 	}
 	user_id := c.Get("userID").(int64)
-	if err := user.GetUser(app.Connection, user_id); err != nil {
-		if err == pgx.ErrNoRows {
+	if _, err := app.Models.Users.GetUser(c.Request().Context(), user_id); err != nil {
+		if errors.Is(err, data.ErrNotFound) {
 			return c.JSON(http.StatusNotFound, "user does not exist")
 		}
 		app.Producer.publishMessage("error", "Subscription-Service", "Failed to get user by email"+err.Error())
@@ -360,8 +424,16 @@ func (app *Config) VerifyOTP(c echo.Context) error {
 		}
 		if otp == body.OTP {
 			app.Redis.Del(ctx, key)
-			user.Verified = true
-			if err := user.UpdateUser(app.Connection, user_id, user); err != nil {
+			// Re-read the user and mark them verified in one transaction so the update can't
+			// overwrite a concurrent change to the account.
+			err := app.Models.RunInTx(ctx, func(tx data.Models) error {
+				user, err := tx.Users.GetUser(ctx, user_id)
+				if err != nil {
+					return err
+				}
+				return tx.Users.UpdateUser(ctx, user_id, data.User{Verified: true, Version: user.Version})
+			})
+			if err != nil {
 				app.Producer.publishMessage("error", "Subscription-Service", "Failed to update user: "+err.Error())
 				return c.JSON(http.StatusInternalServerError, "Failed to verify OTP")
 
@@ -372,3 +444,24 @@ func (app *Config) VerifyOTP(c echo.Context) error {
 	}
 	return c.JSON(http.StatusBadRequest, "OTP expired")
 }
+
+// getEntitlements responds with the caller's plan and the features and limits it grants.
+func (app *Config) getEntitlements(c echo.Context) error {
+	userId := c.Get("userID").(int64)
+
+	grant, err := app.Entitlements.ForUser(c.Request().Context(), userId)
+	if err != nil {
+		if errors.Is(err, entitlements.ErrUnknownUser) {
+			return c.JSON(http.StatusNotFound, "user does not exist")
+		}
+		app.Producer.publishMessage("error", "Subscription-Service", "Failed to resolve entitlements"+err.Error())
+		return c.JSON(http.StatusInternalServerError, "Failed to fetch entitlements")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"plan":                grant.Plan,
+		"subscription_status": grant.Status,
+		"variant_id":          grant.VariantID,
+		"subscribed":          grant.Subscribed,
+		"entitlements":        grant.List(),
+	})
+}
@@ -5,9 +5,13 @@ import (
 	"fmt"     // Used for formatting and printing output.
 	"log"     // Used for logging error messages.
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"subscription-service/auth" // Custom package for authentication.
 	"subscription-service/clients"
 	"subscription-service/data" // Custom package for data models.
+	"subscription-service/entitlements"
 	"subscription-service/grpc/pb"
 	"subscription-service/worker"
 	activity "subscription-service/worker/activities"
@@ -20,8 +24,8 @@ import (
 
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/go-redis/redis/v8"
-	"github.com/jackc/pgx/v4"     // PostgreSQL driver for Go.
-	"github.com/labstack/echo/v4" // Echo framework for building web applications.
+	"github.com/jackc/pgx/v4/pgxpool" // PostgreSQL connection pool for Go.
+	"github.com/labstack/echo/v4"     // Echo framework for building web applications.
 	"github.com/twilio/twilio-go"
 	"go.temporal.io/sdk/client"
 )
@@ -29,24 +33,65 @@ import (
 // Config holds the application-wide configurations.
 // yo
 type Config struct {
-	Models     data.Models        // Data models for the application.
-	Auth       auth.Authenticator // Authentication mechanism.
-	Producer   *Publisher         // Kafka producer for logging.
-	SES        *ses.SES           // SNS client for sending notifications.
-	TWILIO     *twilio.RestClient // Twilio client for sending SMS.
-	Temporal   client.Client      // Temporal client for starting workers.
-	Redis      *redis.Client      // Redis client for caching.
-	Connection *pgx.Conn          // Database connection.
+	Models   data.Models        // Data models for the application.
+	Auth     auth.Authenticator // Authentication mechanism.
+	Producer *Publisher         // Kafka producer for logging.
+	Events   *Publisher         // Kafka producer for outbox events.
+	SES      *ses.SES           // SNS client for sending notifications.
+	TWILIO   *twilio.RestClient // Twilio client for sending SMS.
+	Temporal client.Client      // Temporal client for starting workers.
+	Redis    *redis.Client      // Redis client for caching.
+	StoreURL string             // Lemon Squeezy store whose customer portal is the fallback billing link.
+
+	Checkout          *clients.CheckoutClient // Creates checkouts for /billing/checkout.
+	CheckoutCancelURL string                  // Page returned with checkouts for customers who leave them.
+
+	UserCache *data.CachedUserRepository // Read-through cache in front of Models.Users.
+
+	Entitlements *entitlements.Service // Resolves the features and limits of users' plans.
+
+	DunningSchedule    []time.Duration // Time after a failed renewal each payment reminder is sent at.
+	DunningGracePeriod time.Duration   // Time after a failed renewal the plan is downgraded at, unless payment recovered.
+	TrialReminderDays  []int           // Days before the end of a trial reminders are sent.
 }
 
+// defaultKeyDir is where the key ring is read from when PII_KEY_DIR is not set.
+const defaultKeyDir = "/keys"
+
+// Defaults of DUNNING_SCHEDULE and DUNNING_GRACE_PERIOD: reminders right away, after 3 days and after
+// a week, and a downgrade after two weeks, when Lemon Squeezy has stopped retrying the payment.
+const (
+	defaultDunningSchedule    = "0h,72h,168h"
+	defaultDunningGracePeriod = "336h"
+)
+
+// defaultTrialReminderDays is the default of TRIAL_REMINDER_DAYS: reminders 3 days and 1 day before a trial ends.
+const defaultTrialReminderDays = "3,1"
+
+// userCacheTTL bounds how long a cached user profile is served before it is read from the database again.
+const userCacheTTL = 5 * time.Minute
+
 var app *Config // Global variable to hold the application configuration.
 
-// init is called before the main function. It initializes the application configuration.
-func init() {
+// setup initializes the application configuration.
+// It is called from main instead of init so that the migrate subcommand can run without Kafka, Redis or Temporal.
+func setup() {
 	Producer := NewPublisher()                           // Create a new Kafka producer.
 	Producer.createKafkaProducer("kafka:9092", "logger") // Configure the Kafka producer.
+	Events := NewPublisher()                             // Create a Kafka producer for outbox events.
+	Events.createKafkaProducer("kafka:9092", "events")   // Configure the events producer.
 	app = &Config{                                       // Populate the global configuration.
 		Producer: Producer,
+		Events:   Events,
+		StoreURL: os.Getenv("LEMON_SQUEEZY_STORE_URL"),
+		Checkout: &clients.CheckoutClient{
+			APIKey:     os.Getenv("LEMON_SQUEEZY_API_KEY"),
+			StoreID:    os.Getenv("LEMON_SQUEEZY_STORE_ID"),
+			BaseURL:    os.Getenv("LEMON_SQUEEZY_API_URL"),
+			SuccessURL: os.Getenv("CHECKOUT_SUCCESS_URL"),
+			HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		},
+		CheckoutCancelURL: os.Getenv("CHECKOUT_CANCEL_URL"),
 	}
 	// Attempt to publish a startup message to Kafka.
 	err := Producer.publishMessage("key", "subscription-service", "Hello from subscription-service")
@@ -92,22 +137,61 @@ func init() {
 }
 
 func main() {
+	// Handle the migrate subcommand before connecting to any other services.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backfill-payment-users" {
+		os.Exit(runBackfillPaymentUsers(os.Args[2:]))
+	}
+
+	setup()
 	var wg sync.WaitGroup
-	conn, err := connect() // Connect to the database.
+	pool, err := connect() // Connect to the database.
 	if err != nil {
 		log.Fatalf("Failed to connect to the database: %v", err) // Log and exit if the connection fails.
 		app.Producer.publishMessage("key", "Subscription Service", "Failed to connect to the database")
 	}
 
-	defer conn.Close(context.Background())             // Ensure the database connection is closed on exit.
-	app.Connection = conn                              // Assign the database connection to the global configuration.
-	authenticator := auth.NewGitHubAuthenticator(conn) // Create a new GitHub authenticator.
-	app.Auth = authenticator                           // Assign the authenticator to the global configuration.
-	e := echo.New()                                    // Create a new Echo instance for the web server.
-	defer e.Close()                                    // Ensure the Echo server is closed on exit.
+	defer pool.Close() // Ensure the database connections are closed on exit.
+
+	keys, err := loadKeyRing() // Load the keys that encrypt personal data.
+	if err != nil {
+		log.Fatalf("Failed to load the key ring: %v", err)
+	}
+	models := data.NewModels(pool, keys) // Initialize the data models.
+
+	// Serve user profile lookups from Redis, falling back to the database.
+	app.UserCache = data.NewCachedUserRepository(models.Users, data.NewRedisCache(app.Redis), keys, userCacheTTL)
+	app.Models = models.WithUserCache(app.UserCache)
+
+	// Map plan variants to the features and limits they grant, from ENTITLEMENTS_FILE or the built-in free plan.
+	mapping, err := entitlements.Load(os.Getenv("ENTITLEMENTS_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load entitlements: %v", err)
+	}
+	app.Entitlements = entitlements.NewService(mapping, app.Models.Users)
+
+	// Remind users whose renewal failed on DUNNING_SCHEDULE, and downgrade them after DUNNING_GRACE_PERIOD.
+	app.DunningSchedule, app.DunningGracePeriod, err = loadDunningSchedule()
+	if err != nil {
+		log.Fatalf("Failed to load the dunning schedule: %v", err)
+	}
+	// Remind users on trial TRIAL_REMINDER_DAYS before it ends.
+	trialReminderDays := os.Getenv("TRIAL_REMINDER_DAYS")
+	if trialReminderDays == "" {
+		trialReminderDays = defaultTrialReminderDays
+	}
+	if app.TrialReminderDays, err = workflow.ParseTrialReminderDays(trialReminderDays); err != nil {
+		log.Fatalf("Failed to load the trial reminder days: %v", err)
+	}
+
+	authenticator := auth.NewGitHubAuthenticator(app.Models) // Create a new GitHub authenticator.
+	app.Auth = authenticator                                 // Assign the authenticator to the global configuration.
+	e := echo.New()                                          // Create a new Echo instance for the web server.
+	defer e.Close()                                          // Ensure the Echo server is closed on exit.
 
-	app.Models = data.NewModels(conn) // Initialize the data models.
-	app.routes(e)                     // Set up the web routes.
+	app.routes(e) // Set up the web routes.
 
 	app.Auth.NewAuth() // Initialize the authentication mechanism.
 	defer app.Temporal.Close()
@@ -135,17 +219,31 @@ func main() {
 	}()
 	wg.Add(1)
 	go func() {
-		activities := activity.NewActivities(app.SES, app.TWILIO, app.Redis, app.Connection)
+		activities := activity.NewActivities(app.SES, app.TWILIO, app.Redis, app.Models.Users, app.Checkout, billingURL())
 		w := workers.New(app.Temporal, "subscription-service", workers.Options{})
 		w.RegisterWorkflow(workflow.WelcomeWorkflow)
 		w.RegisterWorkflow(workflow.OTPWorkflow)
 		w.RegisterWorkflow(workflow.SubscriptionWorkflow)
+		w.RegisterWorkflow(workflow.DunningWorkflow)
+		w.RegisterWorkflow(workflow.TrialWorkflow)
+		w.RegisterWorkflow(workflow.RenewalNoticeWorkflow)
 		w.RegisterActivity(activities)
 		if err := w.Run(workers.InterruptCh()); err != nil {
 			app.Producer.publishMessage("key", "Subscription Service", "Failed to start Temporal worker"+err.Error())
 		}
 	}()
 	wg.Add(1)
+	go func() {
+		// Deliver the events recorded in the outbox, such as starting WelcomeWorkflow after a signup.
+		relay := NewOutboxRelay(app.Models.Outbox, app.Temporal, app.Events)
+		relay.Run(context.Background())
+	}()
+	wg.Add(1)
+	go func() {
+		// Move encrypted columns to the active key after a rotation.
+		runReencryption(context.Background(), data.NewCockroachUserRepository(pool, keys))
+	}()
+	wg.Add(1)
 	go func() {
 		lis, err := net.Listen("tcp", ":50051")
 		if err != nil {
@@ -162,14 +260,50 @@ func main() {
 	wg.Wait()
 }
 
-// connect establishes a connection to the CockroachDB database.
-// Returns a pointer to the database connection and an error, if any.
-func connect() (*pgx.Conn, error) {
+// loadKeyRing loads the key ring from PII_KEY_DIR, or from defaultKeyDir if it is not set.
+func loadKeyRing() (*data.KeyRing, error) {
+	keyDir := os.Getenv("PII_KEY_DIR")
+	if keyDir == "" {
+		keyDir = defaultKeyDir
+	}
+	return data.LoadKeyRing(keyDir, true)
+}
+
+// loadDunningSchedule parses DUNNING_SCHEDULE and DUNNING_GRACE_PERIOD, or their defaults if they are not set.
+func loadDunningSchedule() ([]time.Duration, time.Duration, error) {
+	schedule := os.Getenv("DUNNING_SCHEDULE")
+	if schedule == "" {
+		schedule = defaultDunningSchedule
+	}
+	gracePeriod := os.Getenv("DUNNING_GRACE_PERIOD")
+	if gracePeriod == "" {
+		gracePeriod = defaultDunningGracePeriod
+	}
+	return workflow.ParseDunningSchedule(schedule, gracePeriod)
+}
+
+// billingURL returns the page payment reminders link to when Lemon Squeezy's update payment method link
+// can't be retrieved: BILLING_URL, or else the customer portal of the store at LEMON_SQUEEZY_STORE_URL.
+func billingURL() string {
+	if u := os.Getenv("BILLING_URL"); u != "" {
+		return u
+	}
+	if app.StoreURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(app.StoreURL, "/") + "/billing"
+}
+
+// connect establishes a connection pool to the CockroachDB database.
+// A pool is used because the HTTP handlers, the gRPC server and the Temporal worker query the
+// database concurrently, and each transaction needs a connection of its own.
+// Returns a pointer to the connection pool and an error, if any.
+func connect() (*pgxpool.Pool, error) {
 	url := "postgres://root@cockroach:26257/defaultdb?sslmode=disable" // Database connection URL.
-	conn, err := pgx.Connect(context.Background(), url)                // Attempt to connect to the database.
+	pool, err := pgxpool.Connect(context.Background(), url)            // Attempt to connect to the database.
 	if err != nil {
 		return nil, err // Return the error if the connection fails.
 	}
 	fmt.Println("Connected to the database") // Confirm successful connection.
-	return conn, nil                         // Return the database connection.
+	return pool, nil                         // Return the connection pool.
 }
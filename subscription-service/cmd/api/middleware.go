@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/subtle"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 
@@ -94,3 +96,20 @@ func JWTAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 	}
 }
+
+// RequireAdminToken only lets through requests with an "Authorization: Bearer <ADMIN_TOKEN>" header.
+// The admin API is disabled while ADMIN_TOKEN is not set.
+func RequireAdminToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "Admin API is disabled")
+		}
+		got := c.Request().Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+			app.Producer.publishMessage("error", "Subscription-Service", "Unauthorized admin request from IP: "+c.RealIP())
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid admin token")
+		}
+		return next(c)
+	}
+}
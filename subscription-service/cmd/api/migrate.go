@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"subscription-service/data"
+	"text/tabwriter"
+	"time"
+)
+
+// runMigrate implements the "migrate up|down|status" subcommand.
+// It connects only to the database and returns the process exit code.
+func runMigrate(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: subscriptionApp migrate up|down|status")
+		return 2
+	}
+
+	pool, err := connect() // Connect to the database.
+	if err != nil {
+		log.Printf("Failed to connect to the database: %v", err)
+		return 1
+	}
+	defer pool.Close()
+
+	migrator, err := data.NewMigrator(pool)
+	if err != nil {
+		log.Printf("Failed to load migrations: %v", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		err = migrator.Up(ctx)
+	case "down":
+		err = migrator.Down(ctx)
+	case "status":
+		err = printMigrationStatus(ctx, migrator)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+		return 2
+	}
+	if err != nil {
+		log.Printf("migrate %s failed: %v", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// printMigrationStatus writes a table of known migrations and whether each has been applied.
+func printMigrationStatus(ctx context.Context, migrator *data.Migrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil && !errors.Is(err, data.ErrSchemaTooNew) {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.Applied {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+	}
+	if flushErr := w.Flush(); flushErr != nil {
+		return flushErr
+	}
+	// Report a newer schema after printing what we know so the operator still sees the table.
+	return err
+}
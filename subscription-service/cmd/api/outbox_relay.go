@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"subscription-service/data"
+	"subscription-service/worker/workflow"
+	"time"
+
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+)
+
+const (
+	outboxPollInterval = 2 * time.Second // How often the relay looks for new events.
+	outboxBatchSize    = 50              // Maximum number of events claimed per poll.
+	outboxLease        = time.Minute     // How long a claimed event is reserved before another relay may retry it.
+	outboxMaxAttempts  = 30              // Deliveries of an event tried, a lease apart, before it is marked dead.
+)
+
+// OutboxRelay delivers the events recorded in the outbox.
+//
+// Delivery is at least once: an event is only marked as published after every delivery step succeeded,
+// so a relay that dies mid-event leaves it to be claimed again once its lease expires. Each step is
+// deduplicated by the event ID, which is used as the Temporal workflow ID and as the Kafka message key.
+type OutboxRelay struct {
+	outbox    data.OutboxRepository // outbox is the store the events are claimed from.
+	temporal  client.Client         // temporal starts the workflows triggered by events.
+	publisher *Publisher            // publisher writes every event to the events topic.
+}
+
+// NewOutboxRelay creates a relay that reads from outbox and delivers to Temporal and Kafka.
+func NewOutboxRelay(outbox data.OutboxRepository, temporal client.Client, publisher *Publisher) *OutboxRelay {
+	return &OutboxRelay{outbox: outbox, temporal: temporal, publisher: publisher}
+}
+
+// Run polls the outbox and delivers events until ctx is cancelled.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep draining while full batches come back, so a backlog doesn't wait a poll interval per batch.
+		for {
+			delivered, err := r.relayBatch(ctx)
+			if err != nil {
+				log.Printf("outbox relay: %v", err)
+			}
+			if err != nil || delivered < outboxBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayBatch claims a batch of events and delivers them. An event that still fails after outboxMaxAttempts
+// deliveries is marked dead, so a poison event isn't retried forever; it is kept with its last error.
+// Returns the number of events claimed, and an error if the batch could not be claimed.
+func (r *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	events, err := r.outbox.Claim(ctx, outboxBatchSize, outboxLease)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim events: %w", err)
+	}
+	for _, event := range events {
+		if event.Attempts > outboxMaxAttempts {
+			// Relays died delivering it, before they could record a failure.
+			r.markDead(ctx, event, fmt.Errorf("claimed %d times without an outcome", event.Attempts))
+			continue
+		}
+		if err := r.deliver(ctx, event); err != nil {
+			if event.Attempts >= outboxMaxAttempts {
+				r.markDead(ctx, event, err)
+				continue
+			}
+			app.Producer.publishMessage("error", "Subscription-Service", fmt.Sprintf("Failed to deliver %s event %s: %v", event.Type, event.ID, err))
+			if err := r.outbox.MarkFailed(ctx, event.ID, err); err != nil {
+				log.Printf("outbox relay: failed to record failure of event %s: %v", event.ID, err)
+			}
+			continue
+		}
+		if err := r.outbox.MarkPublished(ctx, event.ID); err != nil {
+			// The event will be delivered again once its lease expires; consumers deduplicate it.
+			log.Printf("outbox relay: failed to mark event %s as published: %v", event.ID, err)
+		}
+	}
+	return len(events), nil
+}
+
+// markDead gives up on delivering event, which failed because of reason.
+func (r *OutboxRelay) markDead(ctx context.Context, event data.OutboxEvent, reason error) {
+	app.Producer.publishMessage("error", "Subscription-Service", fmt.Sprintf("Gave up on %s event %s after %d attempts: %v", event.Type, event.ID, event.Attempts, reason))
+	if err := r.outbox.MarkDead(ctx, event.ID, reason); err != nil {
+		log.Printf("outbox relay: failed to mark event %s as dead: %v", event.ID, err)
+	}
+}
+
+// deliver starts the workflow the event triggers, if any, and publishes the event to Kafka.
+func (r *OutboxRelay) deliver(ctx context.Context, event data.OutboxEvent) error {
+	switch event.Type {
+	case data.EventUserSignedUp:
+		var params workflow.WelcomeParams
+		if err := json.Unmarshal(event.Payload, &params); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		if err := r.startWorkflow(ctx, event.ID, "WelcomeWorkflow", params); err != nil {
+			return err
+		}
+	}
+	return r.publisher.publishEvent(ctx, event)
+}
+
+// startWorkflow starts a workflow whose ID is derived from the event ID.
+// Workflow IDs are never reused, so a redelivered event finds the workflow it already started,
+// even if that workflow has since completed, and the start is treated as a success.
+func (r *OutboxRelay) startWorkflow(ctx context.Context, eventID, name string, params interface{}) error {
+	workflowOptions := client.StartWorkflowOptions{
+		ID:                    name + "_" + eventID,
+		TaskQueue:             "subscription-service", // The task queue name should match the one used in worker registration
+		WorkflowIDReusePolicy: enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+		// Return an error rather than the existing run, so a duplicate start is reported the same way
+		// whether or not the first workflow is still running.
+		WorkflowExecutionErrorWhenAlreadyStarted: true,
+	}
+	_, err := r.temporal.ExecuteWorkflow(ctx, workflowOptions, name, params)
+	var alreadyStarted *serviceerror.WorkflowExecutionAlreadyStarted
+	if errors.As(err, &alreadyStarted) {
+		return nil
+	}
+	return err
+}
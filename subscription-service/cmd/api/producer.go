@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"subscription-service/data"
 
 	"github.com/segmentio/kafka-go"
 )
@@ -93,3 +94,27 @@ func (publisher *Publisher) publishMessage(key string, service, message string)
 func NewPublisher() *Publisher {
 	return &Publisher{}
 }
+
+// publishEvent sends an outbox event to the Kafka topic configured in the Publisher's writer.
+//
+// Parameters:
+// - ctx: The context controlling the write.
+// - event: The event to publish. Its ID is used as the message key, so consumers can drop redeliveries.
+//
+// Returns:
+// - An error if the event could not be marshaled into JSON or if writing the message to Kafka fails.
+func (publisher *Publisher) publishEvent(ctx context.Context, event data.OutboxEvent) error {
+	valueBytes, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	msg := kafka.Message{
+		Key:     []byte(event.ID), // The event ID, for partitioning and deduplication.
+		Value:   valueBytes,       // The JSON marshaled event.
+		Headers: []kafka.Header{{Key: "type", Value: []byte(event.Type)}},
+	}
+	if err := publisher.Writer.WriteMessages(ctx, msg); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"subscription-service/data"
+	"time"
+)
+
+const (
+	reencryptInterval  = 10 * time.Minute // How often the re-encryption job looks for values under old keys.
+	reencryptBatchSize = 100              // Maximum number of rows rewritten per batch.
+)
+
+// reencrypter rewrites rows whose encrypted columns are not encrypted with the active key.
+type reencrypter interface {
+	Reencrypt(ctx context.Context, afterID int64, batchSize int) (data.ReencryptResult, error)
+}
+
+// runReencryption moves encrypted columns to the active key until ctx is cancelled.
+// After a key rotation it drains the backlog in batches; afterwards it only has to pick up rows
+// that were skipped because they were updated while being re-encrypted.
+func runReencryption(ctx context.Context, r reencrypter) {
+	ticker := time.NewTicker(reencryptInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := reencryptAll(ctx, r); err != nil {
+			log.Printf("re-encryption: %v", err)
+			app.Producer.publishMessage("error", "Subscription-Service", "Failed to re-encrypt users: "+err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reencryptAll makes one pass over the users that need re-encryption, in batches in ID order.
+// Users that can't be decrypted are skipped, so they don't hold up the rest, and reported in the
+// returned error once the pass is over. They are tried again on every pass.
+func reencryptAll(ctx context.Context, r reencrypter) error {
+	var afterID int64
+	var failed []int64
+	for {
+		result, err := r.Reencrypt(ctx, afterID, reencryptBatchSize)
+		if err != nil {
+			return err
+		}
+		if result.Rewritten > 0 {
+			log.Printf("re-encryption: rewrote %d users", result.Rewritten)
+		}
+		failed = append(failed, result.Failed...)
+		if result.Selected < reencryptBatchSize {
+			break
+		}
+		afterID = result.LastID
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d users can't be decrypted with the key ring, the first: %d", len(failed), failed[0])
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"subscription-service/data"
+	"testing"
+)
+
+// The re-encryption job is unexported, so unlike the tests in test/unit_test this one lives in package main.
+
+// fakeReencrypter holds user IDs that need re-encryption; those in undecryptable are never rewritten.
+type fakeReencrypter struct {
+	pending       []int64
+	undecryptable map[int64]bool
+	calls         int
+}
+
+func (f *fakeReencrypter) Reencrypt(ctx context.Context, afterID int64, batchSize int) (data.ReencryptResult, error) {
+	f.calls++
+	result := data.ReencryptResult{LastID: afterID}
+	var kept []int64
+	for _, id := range f.pending {
+		if id <= afterID || result.Selected == batchSize {
+			kept = append(kept, id)
+			continue
+		}
+		result.Selected++
+		result.LastID = id
+		if f.undecryptable[id] {
+			result.Failed = append(result.Failed, id)
+			kept = append(kept, id)
+			continue
+		}
+		result.Rewritten++
+	}
+	f.pending = kept
+	return result, nil
+}
+
+func TestReencryptAllSkipsUndecryptableUsers(t *testing.T) {
+	// A full first batch of undecryptable users must not keep the job from reaching the users after them.
+	r := &fakeReencrypter{undecryptable: map[int64]bool{}}
+	for id := int64(1); id <= reencryptBatchSize+5; id++ {
+		r.pending = append(r.pending, id)
+		if id <= reencryptBatchSize {
+			r.undecryptable[id] = true
+		}
+	}
+
+	err := reencryptAll(context.Background(), r)
+	if err == nil || !strings.Contains(err.Error(), "100 users can't be decrypted") {
+		t.Errorf("reencryptAll() error = %v, want the undecryptable users reported", err)
+	}
+	if len(r.pending) != reencryptBatchSize || r.calls != 2 {
+		t.Errorf("reencryptAll() left %d users in %d calls, want only the %d undecryptable ones left in 2", len(r.pending), r.calls, reencryptBatchSize)
+	}
+}
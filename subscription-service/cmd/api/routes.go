@@ -19,4 +19,13 @@ func (app *Config) routes(e *echo.Echo) {
 	g.PUT("/", app.updateAccount)                        // Update account endpoint.
 	g.POST("/otp", app.GenerateOTP)                      // Generate OTP
 	g.POST("/verify", app.VerifyOTP)                     // Verify OTP
+	g.GET("/entitlements", app.getEntitlements)          // Features and limits of the caller's plan.
+
+	a := e.Group("/admin")
+	a.Use(RequireAdminToken)
+	a.GET("/metrics/cache", app.cacheStats) // User cache hit/miss counters.
+
+	b := e.Group("/billing")
+	b.Use(JWTAuthMiddleware)
+	b.POST("/checkout", app.createCheckout) // Create a checkout for a plan variant.
 }
@@ -0,0 +1,306 @@
+package data
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// userCacheKeyVersion is part of every user cache key. Bump it whenever the cached User encoding
+// changes, so entries written by older builds are ignored instead of decoded into the wrong shape.
+const userCacheKeyVersion = "v2"
+
+// userCacheColumn is the associated data of cached users, so that they can't be decrypted as a column value.
+const userCacheColumn = "cache.user"
+
+// userIDKey returns the cache key holding the user with the given ID.
+func userIDKey(id int64) string {
+	return "user:" + userCacheKeyVersion + ":id:" + strconv.FormatInt(id, 10)
+}
+
+// emailKey returns the cache key holding the ID of the user with the given email. The key holds the
+// email's blind index rather than the email, so that the cache doesn't reveal it.
+func (r *CachedUserRepository) emailKey(email string) string {
+	return "user:" + userCacheKeyVersion + ":email:" + hex.EncodeToString(r.keys.BlindIndex(emailColumn, email))
+}
+
+// contactKey returns the cache key holding the ID of the user with the given contact number, by its blind index.
+func (r *CachedUserRepository) contactKey(contact string) string {
+	return "user:" + userCacheKeyVersion + ":contact:" + hex.EncodeToString(r.keys.BlindIndex(contactColumn, contact))
+}
+
+// CacheStats counts the outcomes of cache lookups.
+type CacheStats struct {
+	Hits   int64 `json:"hits"`   // Lookups answered from the cache.
+	Misses int64 `json:"misses"` // Lookups that fell through to the database.
+	Errors int64 `json:"errors"` // Cache operations that failed; the lookup fell through to the database.
+}
+
+// CachedUserRepository is a read-through cache in front of another UserRepository.
+//
+// GetUser, GetByEmail and GetByContact are answered from the cache when possible; every other lookup
+// goes to the wrapped repository. Users are cached by ID, and emails and contact numbers map to user IDs,
+// so a write only has to remove the user's ID key: an email or contact key that points at a user with a
+// different email or contact number is ignored.
+// Cached users hold the same secrets as the users table, so they are encrypted with the key ring, and
+// emails and contact numbers appear in keys only as their blind indexes.
+// Writes remove the keys they affect; writes made in Models.RunInTx remove them once the transaction
+// commits. A lookup racing with a write can still cache the old user, so entries expire after ttl.
+// The cache is best effort: if it fails, lookups go to the wrapped repository.
+type CachedUserRepository struct {
+	users UserRepository
+	cache Cache
+	keys  *KeyRing
+	ttl   time.Duration
+
+	hits, misses, errors atomic.Int64
+}
+
+// NewCachedUserRepository wraps users with a cache whose entries are encrypted with keys and expire after ttl.
+// keys must have a blind index key.
+func NewCachedUserRepository(users UserRepository, cache Cache, keys *KeyRing, ttl time.Duration) *CachedUserRepository {
+	return &CachedUserRepository{users: users, cache: cache, keys: keys, ttl: ttl}
+}
+
+// Stats returns the number of cache hits, misses and errors so far.
+func (r *CachedUserRepository) Stats() CacheStats {
+	return CacheStats{Hits: r.hits.Load(), Misses: r.misses.Load(), Errors: r.errors.Load()}
+}
+
+// GetUser fetches a user by ID, from the cache if possible.
+func (r *CachedUserRepository) GetUser(ctx context.Context, id int64) (User, error) {
+	if user, ok := r.cachedUser(ctx, id); ok {
+		r.hits.Add(1)
+		return user, nil
+	}
+	r.misses.Add(1)
+	user, err := r.users.GetUser(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	r.store(ctx, user)
+	return user, nil
+}
+
+// GetByEmail fetches a user by email address, from the cache if possible.
+func (r *CachedUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	if user, ok := r.cachedUserAt(ctx, r.emailKey(email)); ok && user.Email == email {
+		r.hits.Add(1)
+		return user, nil
+	}
+	r.misses.Add(1)
+	user, err := r.users.GetByEmail(ctx, email)
+	if err != nil {
+		return User{}, err
+	}
+	r.store(ctx, user)
+	return user, nil
+}
+
+// GetByContact fetches a user by contact number, from the cache if possible.
+func (r *CachedUserRepository) GetByContact(ctx context.Context, contact string) (User, error) {
+	if user, ok := r.cachedUserAt(ctx, r.contactKey(contact)); ok && user.Contact == contact {
+		r.hits.Add(1)
+		return user, nil
+	}
+	r.misses.Add(1)
+	user, err := r.users.GetByContact(ctx, contact)
+	if err != nil {
+		return User{}, err
+	}
+	r.store(ctx, user)
+	return user, nil
+}
+
+// cachedUserAt returns the cached user whose ID is held by key, if there is one.
+func (r *CachedUserRepository) cachedUserAt(ctx context.Context, key string) (User, bool) {
+	id, err := r.cache.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, ErrCacheMiss) {
+			r.errors.Add(1)
+		}
+		return User{}, false
+	}
+	parsed, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return User{}, false
+	}
+	return r.cachedUser(ctx, parsed)
+}
+
+// cachedUser returns the cached user with the given ID, if there is one.
+func (r *CachedUserRepository) cachedUser(ctx context.Context, id int64) (User, bool) {
+	value, err := r.cache.Get(ctx, userIDKey(id))
+	if err != nil {
+		if !errors.Is(err, ErrCacheMiss) {
+			r.errors.Add(1)
+		}
+		return User{}, false
+	}
+	plaintext, err := r.keys.Decrypt(userCacheColumn, string(value))
+	if err != nil {
+		r.errors.Add(1)
+		return User{}, false
+	}
+	var user User
+	if err := json.Unmarshal([]byte(plaintext), &user); err != nil || user.ID != id {
+		r.errors.Add(1)
+		return User{}, false
+	}
+	return user, true
+}
+
+// store caches user, encrypted, under its ID, and its ID under its email and contact number.
+func (r *CachedUserRepository) store(ctx context.Context, user User) {
+	value, err := json.Marshal(user)
+	if err != nil {
+		r.errors.Add(1)
+		return
+	}
+	ciphertext, err := r.keys.Encrypt(userCacheColumn, string(value))
+	if err != nil {
+		r.errors.Add(1)
+		return
+	}
+	if err := r.cache.Set(ctx, userIDKey(user.ID), []byte(ciphertext), r.ttl); err != nil {
+		r.errors.Add(1)
+		return
+	}
+	id := []byte(strconv.FormatInt(user.ID, 10))
+	for _, lookup := range []struct{ value, key string }{{user.Email, r.emailKey(user.Email)}, {user.Contact, r.contactKey(user.Contact)}} {
+		if lookup.value == "" {
+			continue
+		}
+		if err := r.cache.Set(ctx, lookup.key, id, r.ttl); err != nil {
+			r.errors.Add(1)
+		}
+	}
+}
+
+// invalidate removes the given keys from the cache.
+func (r *CachedUserRepository) invalidate(ctx context.Context, keys ...string) {
+	if err := r.cache.Delete(ctx, keys...); err != nil {
+		r.errors.Add(1)
+	}
+}
+
+// InsertUser stores a new user and removes any cached lookup of its email and contact number.
+func (r *CachedUserRepository) InsertUser(ctx context.Context, user User) (int64, error) {
+	id, err := r.users.InsertUser(ctx, user)
+	if err == nil {
+		r.invalidate(ctx, r.emailKey(user.Email), r.contactKey(user.Contact))
+	}
+	return id, err
+}
+
+// UpdateUser updates the user and removes it from the cache.
+func (r *CachedUserRepository) UpdateUser(ctx context.Context, id int64, updatedUser User) error {
+	err := r.users.UpdateUser(ctx, id, updatedUser)
+	r.invalidate(ctx, userIDKey(id)) // Also after a failure: the cached user may be the reason for a conflict.
+	return err
+}
+
+// UpdateUserSubscription updates the user's subscription and removes the user from the cache.
+func (r *CachedUserRepository) UpdateUserSubscription(ctx context.Context, id int64, subscriptionStatus string, subscriptionId float64, variantID int64, subscriptionType string) error {
+	err := r.users.UpdateUserSubscription(ctx, id, subscriptionStatus, subscriptionId, variantID, subscriptionType)
+	r.invalidate(ctx, userIDKey(id))
+	return err
+}
+
+// DeleteUser removes the user and its cache entry.
+func (r *CachedUserRepository) DeleteUser(ctx context.Context, id int64) error {
+	err := r.users.DeleteUser(ctx, id)
+	r.invalidate(ctx, userIDKey(id))
+	return err
+}
+
+// GetByGitId fetches a user by GitHub ID from the wrapped repository.
+func (r *CachedUserRepository) GetByGitId(ctx context.Context, githubId string) (User, error) {
+	return r.users.GetByGitId(ctx, githubId)
+}
+
+// WithUserCache returns m with its Users served through users, which must wrap m.Users.
+// Transactions started from the returned Models bypass the cache, so they see their own writes,
+// and remove the users they wrote from the cache once they commit.
+func (m Models) WithUserCache(users *CachedUserRepository) Models {
+	m.Users = users
+	m.tx = cachedTxRunner{tx: m.tx, users: users}
+	return m
+}
+
+// cachedTxRunner runs transactions with the wrapped txRunner and invalidates the cache entries
+// of the users written in them after they commit.
+type cachedTxRunner struct {
+	tx    txRunner
+	users *CachedUserRepository
+}
+
+func (r cachedTxRunner) runInTx(ctx context.Context, fn func(tx Models) error) error {
+	written := &writtenUsers{}
+	err := r.tx.runInTx(ctx, func(tx Models) error {
+		tx.Users = &recordingUserRepository{UserRepository: tx.Users, cache: r.users, written: written}
+		return fn(tx)
+	})
+	if err == nil {
+		r.users.invalidate(ctx, written.keys()...)
+	}
+	return err
+}
+
+// writtenUsers collects the cache keys affected by the writes of a transaction.
+type writtenUsers struct {
+	mu      sync.Mutex
+	keySet  map[string]struct{}
+	ordered []string
+}
+
+func (w *writtenUsers) add(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keySet == nil {
+		w.keySet = map[string]struct{}{}
+	}
+	if _, ok := w.keySet[key]; !ok {
+		w.keySet[key] = struct{}{}
+		w.ordered = append(w.ordered, key)
+	}
+}
+
+func (w *writtenUsers) keys() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ordered
+}
+
+// recordingUserRepository records the cache keys affected by writes made through a transaction's UserRepository.
+type recordingUserRepository struct {
+	UserRepository
+	cache   *CachedUserRepository
+	written *writtenUsers
+}
+
+func (r *recordingUserRepository) InsertUser(ctx context.Context, user User) (int64, error) {
+	r.written.add(r.cache.emailKey(user.Email))
+	r.written.add(r.cache.contactKey(user.Contact))
+	return r.UserRepository.InsertUser(ctx, user)
+}
+
+func (r *recordingUserRepository) UpdateUser(ctx context.Context, id int64, updatedUser User) error {
+	r.written.add(userIDKey(id))
+	return r.UserRepository.UpdateUser(ctx, id, updatedUser)
+}
+
+func (r *recordingUserRepository) UpdateUserSubscription(ctx context.Context, id int64, subscriptionStatus string, subscriptionId float64, variantID int64, subscriptionType string) error {
+	r.written.add(userIDKey(id))
+	return r.UserRepository.UpdateUserSubscription(ctx, id, subscriptionStatus, subscriptionId, variantID, subscriptionType)
+}
+
+func (r *recordingUserRepository) DeleteUser(ctx context.Context, id int64) error {
+	r.written.add(userIDKey(id))
+	return r.UserRepository.DeleteUser(ctx, id)
+}
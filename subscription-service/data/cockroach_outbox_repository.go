@@ -0,0 +1,149 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CockroachOutboxRepository implements OutboxRepository on top of the outbox table.
+type CockroachOutboxRepository struct {
+	db DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+}
+
+// NewCockroachOutboxRepository creates an OutboxRepository that reads and writes the outbox table.
+func NewCockroachOutboxRepository(db DB) *CockroachOutboxRepository {
+	return &CockroachOutboxRepository{db: db}
+}
+
+// Enqueue inserts an event into the outbox.
+// Parameters:
+// - eventType: The type of the event, one of the Event constants.
+// - payload: The event data, encoded as JSON.
+// Returns:
+// - The generated ID of the event.
+// - An error if the payload can't be encoded or the query execution fails.
+func (r *CockroachOutboxRepository) Enqueue(ctx context.Context, eventType string, payload interface{}) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s payload: %w", eventType, err)
+	}
+	id := uuid.NewString()
+	query := `INSERT INTO outbox (id, event_type, payload) VALUES ($1, $2, $3)`
+	if _, err := r.db.Exec(ctx, query, id, eventType, string(body)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Claim leases up to limit undelivered events that aren't dead and whose previous lease, if any, has expired.
+// The select and the update run as one statement, so concurrent relays never claim the same event;
+// CockroachDB retries the statement itself if two relays conflict.
+// Parameters:
+// - limit: The maximum number of events to claim.
+// - lease: How long the events are reserved for the caller.
+// Returns:
+// - The claimed events, oldest first.
+// - An error if the query execution fails.
+func (r *CockroachOutboxRepository) Claim(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	query := `
+    UPDATE outbox SET locked_until = now() + ($2 * INTERVAL '1 second'), attempts = attempts + 1
+    WHERE id IN (
+        SELECT id FROM outbox
+        WHERE published_at IS NULL AND dead_at IS NULL AND (locked_until IS NULL OR locked_until < now())
+        ORDER BY created_at
+        LIMIT $1
+    )
+    RETURNING id::STRING, event_type, payload::STRING, created_at, attempts`
+	rows, err := r.db.Query(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var event OutboxEvent
+		var payload string
+		if err := rows.Scan(&event.ID, &event.Type, &payload, &event.CreatedAt, &event.Attempts); err != nil {
+			return nil, err
+		}
+		event.Payload = json.RawMessage(payload)
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING does not preserve the order of the subquery.
+	sort.Slice(events, func(i, j int) bool { return events[i].CreatedAt.Before(events[j].CreatedAt) })
+	return events, nil
+}
+
+// MarkPublished records that an event was delivered so it is never claimed again.
+func (r *CockroachOutboxRepository) MarkPublished(ctx context.Context, id string) error {
+	query := `UPDATE outbox SET published_at = now(), locked_until = NULL, last_error = NULL WHERE id = $1`
+	result, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no outbox event found with id %s", ErrNotFound, id)
+	}
+	return nil
+}
+
+// MarkFailed stores the reason a delivery failed.
+// The lease is left in place so the event is retried once it expires instead of on the next poll.
+func (r *CockroachOutboxRepository) MarkFailed(ctx context.Context, id string, reason error) error {
+	query := `UPDATE outbox SET last_error = $2 WHERE id = $1`
+	result, err := r.db.Exec(ctx, query, id, reason.Error())
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no outbox event found with id %s", ErrNotFound, id)
+	}
+	return nil
+}
+
+// MarkDead stores the reason the last delivery of an event failed and marks it dead, so it is never claimed again.
+func (r *CockroachOutboxRepository) MarkDead(ctx context.Context, id string, reason error) error {
+	query := `UPDATE outbox SET dead_at = now(), locked_until = NULL, last_error = $2 WHERE id = $1`
+	result, err := r.db.Exec(ctx, query, id, reason.Error())
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no outbox event found with id %s", ErrNotFound, id)
+	}
+	return nil
+}
+
+// ListDead returns up to limit dead events, the ones that died last first.
+func (r *CockroachOutboxRepository) ListDead(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	query := `
+    SELECT id::STRING, event_type, payload::STRING, created_at, attempts, COALESCE(last_error, '')
+    FROM outbox WHERE dead_at IS NOT NULL
+    ORDER BY dead_at DESC LIMIT $1`
+	rows, err := r.db.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var event OutboxEvent
+		var payload string
+		if err := rows.Scan(&event.ID, &event.Type, &payload, &event.CreatedAt, &event.Attempts, &event.LastError); err != nil {
+			return nil, err
+		}
+		event.Payload = json.RawMessage(payload)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
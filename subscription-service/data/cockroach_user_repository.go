@@ -0,0 +1,443 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// userColumns lists the columns read for every user lookup.
+// Nullable columns are coalesced so they can be scanned into plain Go types.
+const userColumns = `id, user_name, github_name, COALESCE(github_id, ''), COALESCE(first_name, ''), COALESCE(last_name, ''),
+    COALESCE(avatar_url, ''), COALESCE(access_token, ''), COALESCE(bio, ''), email, COALESCE(contact, ''), expires_at, password,
+    COALESCE(verified, false), COALESCE(subscription_status, ''), COALESCE(subscription_id, 0), COALESCE(subscription_type, ''), COALESCE(subscription_variant_id, 0), version`
+
+// Encrypted columns of the users table, also used as the associated data of their ciphertexts.
+const (
+	accessTokenColumn = "users.access_token"
+	emailColumn       = "users.email"
+	contactColumn     = "users.contact"
+)
+
+// CockroachUserRepository implements UserRepository on top of a CockroachDB connection pool.
+// The access token, email and contact columns are encrypted with the key ring; email and contact
+// are looked up through their blind indexes.
+type CockroachUserRepository struct {
+	db   DB // db is the pool, or the transaction when the repository was created by Models.RunInTx.
+	keys *KeyRing
+}
+
+// NewCockroachUserRepository creates a UserRepository that reads and writes the users table.
+func NewCockroachUserRepository(db DB, keys *KeyRing) *CockroachUserRepository {
+	return &CockroachUserRepository{db: db, keys: keys}
+}
+
+// scanUser scans a row selected with userColumns into a User and decrypts its encrypted columns.
+// pgx.ErrNoRows is translated into ErrNotFound.
+func (r *CockroachUserRepository) scanUser(row pgx.Row) (User, error) {
+	u, err := scanEncryptedUser(row)
+	if err != nil {
+		return User{}, err
+	}
+	if err := r.decryptUser(&u); err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// scanEncryptedUser scans a row selected with userColumns into a User, leaving its encrypted columns as stored.
+// pgx.ErrNoRows is translated into ErrNotFound.
+func scanEncryptedUser(row pgx.Row) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.UserName, &u.GithubName, &u.GithubId, &u.FirstName, &u.LastName, &u.AvatarUrl, &u.AccessToken, &u.Bio,
+		&u.Email, &u.Contact, &u.ExpiresAt, &u.Password, &u.Verified, &u.SubscriptionStatus, &u.SubscriptionID, &u.SubscriptionType, &u.SubscriptionVariantID, &u.Version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	return u, err
+}
+
+// decryptUser decrypts the encrypted columns of u in place.
+func (r *CockroachUserRepository) decryptUser(u *User) error {
+	var err error
+	if u.AccessToken, err = r.keys.Decrypt(accessTokenColumn, u.AccessToken); err != nil {
+		return err
+	}
+	if u.Email, err = r.keys.Decrypt(emailColumn, u.Email); err != nil {
+		return err
+	}
+	if u.Contact, err = r.keys.Decrypt(contactColumn, u.Contact); err != nil {
+		return err
+	}
+	return nil
+}
+
+// encryptedField is the ciphertext and blind index of an encrypted column's value.
+type encryptedField struct {
+	value string
+	index []byte
+}
+
+// encrypt encrypts value for column and computes its blind index.
+func (r *CockroachUserRepository) encrypt(column, value string) (encryptedField, error) {
+	ciphertext, err := r.keys.Encrypt(column, value)
+	if err != nil {
+		return encryptedField{}, err
+	}
+	return encryptedField{value: ciphertext, index: r.keys.BlindIndex(column, value)}, nil
+}
+
+// InsertUser inserts a new user into the database.
+// This method is useful for registering new users in the system.
+// Parameters:
+// - user: The User struct containing the user's information.
+// Returns:
+// - The generated ID of the user.
+// - An error if the query execution fails.
+func (r *CockroachUserRepository) InsertUser(ctx context.Context, user User) (int64, error) {
+	if user.Contact != "" {
+		user.Contact = "+91" + user.Contact
+	}
+	// The database can't check encrypted values, so they are checked before encrypting them.
+	if !emailPattern.MatchString(user.Email) {
+		return 0, fmt.Errorf("violates check constraint on email")
+	}
+	if !contactPattern.MatchString(user.Contact) {
+		return 0, fmt.Errorf("violates check constraint on contact")
+	}
+	email, err := r.encrypt(emailColumn, user.Email)
+	if err != nil {
+		return 0, err
+	}
+	contact, err := r.encrypt(contactColumn, user.Contact)
+	if err != nil {
+		return 0, err
+	}
+	// SQL query to insert a new user, returning the generated ID.
+	query := `INSERT INTO users (user_name, github_name, github_id, first_name, last_name, avatar_url, bio, email, email_index, contact, contact_index, expires_at, password, verified)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id`
+	// Execute the query and scan the returned ID.
+	var id int64
+	err = r.db.QueryRow(ctx, query, user.UserName, user.GithubName, user.GithubId, user.FirstName, user.LastName, user.AvatarUrl, user.Bio,
+		email.value, email.index, contact.value, contact.index, user.ExpiresAt, user.Password, user.Verified).Scan(&id)
+	if err != nil {
+		return 0, err // Return any errors encountered.
+	}
+	return id, nil // Return the new ID on success.
+}
+
+// GetUser retrieves a user by their ID from the database.
+// This method is useful for fetching user details based on their unique identifier.
+// Parameters:
+// - id: The ID of the user to retrieve.
+// Returns:
+// - The user if found.
+// - ErrNotFound if no user has the ID, or another error if the query fails.
+func (r *CockroachUserRepository) GetUser(ctx context.Context, id int64) (User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id=$1`
+	return r.scanUser(r.db.QueryRow(ctx, query, id))
+}
+
+// UpdateUser updates an existing user's information in the database.
+// This method is useful for updating user details, such as their name, email, or avatar.
+// Every update increments the user's version.
+// Parameters:
+// - id: The ID of the user to update.
+// - updatedUser: The updated User struct containing the new information. If its Version is set, the row is only updated if it still has that version.
+// Returns:
+// - ErrNotFound if no user has the ID, ErrConflict if the version does not match, or another error if the query execution fails.
+func (r *CockroachUserRepository) UpdateUser(ctx context.Context, id int64, updatedUser User) error {
+	baseQuery := "UPDATE users SET "
+	var args []interface{}
+	var updates []string
+	argCounter := 1
+
+	// For each field, check if provided and append to query and args as necessary
+	if updatedUser.UserName != "" {
+		updates = append(updates, fmt.Sprintf("user_name=$%d", argCounter))
+		args = append(args, updatedUser.UserName)
+		argCounter++
+	}
+	if updatedUser.GithubName != "" {
+		updates = append(updates, fmt.Sprintf("github_name=$%d", argCounter))
+		args = append(args, updatedUser.GithubName)
+		argCounter++
+	}
+	if updatedUser.GithubId != "" {
+		updates = append(updates, fmt.Sprintf("github_id=$%d", argCounter))
+		args = append(args, updatedUser.GithubId)
+		argCounter++
+	}
+	if updatedUser.FirstName != "" {
+		updates = append(updates, fmt.Sprintf("first_name=$%d", argCounter))
+		args = append(args, updatedUser.FirstName)
+		argCounter++
+	}
+	if updatedUser.LastName != "" {
+		updates = append(updates, fmt.Sprintf("last_name=$%d", argCounter))
+		args = append(args, updatedUser.LastName)
+		argCounter++
+	}
+	if updatedUser.AvatarUrl != "" {
+		updates = append(updates, fmt.Sprintf("avatar_url=$%d", argCounter))
+		args = append(args, updatedUser.AvatarUrl)
+		argCounter++
+	}
+	if updatedUser.Bio != "" {
+		updates = append(updates, fmt.Sprintf("bio=$%d", argCounter))
+		args = append(args, updatedUser.Bio)
+		argCounter++
+	}
+	if updatedUser.Email != "" {
+		if !emailPattern.MatchString(updatedUser.Email) {
+			return fmt.Errorf("violates check constraint on email")
+		}
+		email, err := r.encrypt(emailColumn, updatedUser.Email)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, fmt.Sprintf("email=$%d, email_index=$%d", argCounter, argCounter+1))
+		args = append(args, email.value, email.index)
+		argCounter += 2
+	}
+	if updatedUser.Contact != "" {
+		if !contactPattern.MatchString(updatedUser.Contact) {
+			return fmt.Errorf("violates check constraint on contact")
+		}
+		contact, err := r.encrypt(contactColumn, updatedUser.Contact)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, fmt.Sprintf("contact=$%d, contact_index=$%d", argCounter, argCounter+1))
+		args = append(args, contact.value, contact.index)
+		argCounter += 2
+	}
+	if !updatedUser.ExpiresAt.IsZero() {
+		updates = append(updates, fmt.Sprintf("expires_at=$%d", argCounter))
+		args = append(args, updatedUser.ExpiresAt)
+		argCounter++
+	}
+	if updatedUser.Password != "" {
+		updates = append(updates, fmt.Sprintf("password=$%d", argCounter))
+		args = append(args, updatedUser.Password)
+		argCounter++
+	}
+	if updatedUser.Verified {
+		updates = append(updates, fmt.Sprintf("verified=$%d", argCounter))
+		args = append(args, updatedUser.Verified)
+		argCounter++
+	}
+	if updatedUser.SubscriptionStatus != "" {
+		updates = append(updates, fmt.Sprintf("subscription_status=$%d", argCounter))
+		args = append(args, updatedUser.SubscriptionStatus)
+		argCounter++
+	}
+	if updatedUser.SubscriptionID != 0 {
+		updates = append(updates, fmt.Sprintf("subscription_id=$%d", argCounter))
+		args = append(args, updatedUser.SubscriptionID)
+		argCounter++
+	}
+	if updatedUser.SubscriptionType != "" {
+		updates = append(updates, fmt.Sprintf("subscription_type=$%d", argCounter))
+		args = append(args, updatedUser.SubscriptionType)
+		argCounter++
+	}
+
+	// Finalize query
+	if len(updates) == 0 {
+		return nil // No updates to make
+	}
+	updates = append(updates, "version=version+1")
+	query := baseQuery + strings.Join(updates, ", ") + fmt.Sprintf(" WHERE id=$%d", argCounter)
+	args = append(args, id)
+	if updatedUser.Version != 0 {
+		query += fmt.Sprintf(" AND version=$%d", argCounter+1)
+		args = append(args, updatedUser.Version)
+	}
+
+	// Execute the query
+	cmdTag, err := r.db.Exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	// Check if no rows were affected.
+	if cmdTag.RowsAffected() == 0 {
+		return r.notUpdated(ctx, id)
+	}
+	return nil
+}
+
+// notUpdated explains why an update of the user with the given ID matched no rows:
+// ErrNotFound if the user does not exist, otherwise ErrConflict because its version changed.
+func (r *CockroachUserRepository) notUpdated(ctx context.Context, id int64) error {
+	var version int64
+	err := r.db.QueryRow(ctx, `SELECT version FROM users WHERE id=$1`, id).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: no user found with id %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: user %d is at version %d", ErrConflict, id, version)
+}
+
+// UpdateUserSubscription updates an existing user's subscription status and name in the database.
+// Parameters:
+// - id: The ID of the user whose subscription is to be updated.
+// - subscriptionStatus: The new subscription status.
+// - subscriptionId: The provider's subscription ID.
+// - variantID: The provider's ID of the plan variant, or 0 to keep the stored one.
+// - subscriptionType: The new subscription name.
+// Returns:
+// - ErrNotFound if no user has the ID, or another error if the query execution fails.
+func (r *CockroachUserRepository) UpdateUserSubscription(ctx context.Context, id int64, subscriptionStatus string, subscriptionId float64, variantID int64, subscriptionType string) error {
+	// SQL query to update a user's subscription status and name by ID.
+	query := `UPDATE users SET subscription_status=$1, subscription_id=$2, subscription_variant_id=COALESCE(NULLIF($3, 0), subscription_variant_id), subscription_type=$4, version=version+1 WHERE id=$5`
+	// Execute the query without returning any result.
+	cmdTag, err := r.db.Exec(ctx, query, subscriptionStatus, subscriptionId, variantID, subscriptionType, id)
+	if err != nil {
+		return err // Return any errors encountered.
+	}
+	// Check if no rows were affected.
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no user found with id %d", ErrNotFound, id)
+	}
+	return nil // Return nil on success.
+}
+
+// DeleteUser removes a user from the database by their ID.
+// This method is useful for removing a user from the system.
+// Parameters:
+// - id: The ID of the user to delete.
+// Returns:
+// - ErrNotFound if no user has the ID, or another error if the query execution fails.
+func (r *CockroachUserRepository) DeleteUser(ctx context.Context, id int64) error {
+	// SQL query to delete a user by ID.
+	query := `DELETE FROM users WHERE id=$1`
+	// Execute the query.
+	cmdTag, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return err // Return any errors encountered.
+	}
+	// Check if no rows were affected.
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no user found with id %d", ErrNotFound, id)
+	}
+	return nil // Return nil on success.
+}
+
+// GetByGitId retrieves a user by their GitHub ID from the database.
+// This method is useful for integrating GitHub authentication,
+// allowing the application to fetch user details based on GitHub account information.
+//
+// Parameters:
+// - githubId: The GitHub ID of the user to retrieve.
+//
+// Returns:
+// - The user if found.
+// - ErrNotFound if no user has the GitHub ID, or another error if the query fails.
+func (r *CockroachUserRepository) GetByGitId(ctx context.Context, githubId string) (User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE github_id=$1`
+	return r.scanUser(r.db.QueryRow(ctx, query, githubId))
+}
+
+// GetByEmail retrieves a user by their email address from the database.
+// This method is useful for authenticating users based on their email address,
+// allowing the application to fetch user details based on their email.
+// Parameters:
+// - email: The email address of the user to retrieve.
+// Returns:
+// - The user if found.
+// - ErrNotFound if no user has the email, or another error if the query fails.
+func (r *CockroachUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	// Rows without a blind index haven't been encrypted yet and still hold the plaintext email.
+	query := `SELECT ` + userColumns + ` FROM users WHERE email_index=$1 OR (email_index IS NULL AND email=$2)`
+	return r.scanUser(r.db.QueryRow(ctx, query, r.keys.BlindIndex(emailColumn, email), email))
+}
+
+// GetByContact retrieves a user by their contact number from the database.
+// This method is useful for authenticating users based on their phone number,
+// allowing the application to fetch user details based on their contact.
+// Parameters:
+// - contact: The contact number of the user to retrieve, including the country code.
+// Returns:
+// - The user if found.
+// - ErrNotFound if no user has the contact, or another error if the query fails.
+func (r *CockroachUserRepository) GetByContact(ctx context.Context, contact string) (User, error) {
+	// Rows without a blind index haven't been encrypted yet and still hold the plaintext contact.
+	query := `SELECT ` + userColumns + ` FROM users WHERE contact_index=$1 OR (contact_index IS NULL AND contact=$2)`
+	return r.scanUser(r.db.QueryRow(ctx, query, r.keys.BlindIndex(contactColumn, contact), contact))
+}
+
+// ReencryptResult reports what a Reencrypt batch did.
+type ReencryptResult struct {
+	Selected  int     // Users selected, up to the batch size; fewer means no users with a higher ID need rewriting.
+	Rewritten int     // Users rewritten with the active key.
+	Failed    []int64 // IDs of users that couldn't be decrypted, such as under a key removed from the ring. They are left as they are.
+	LastID    int64   // ID of the last user selected, after which the next batch starts.
+}
+
+// Reencrypt rewrites up to batchSize users with an ID above afterID whose encrypted columns are not
+// encrypted with the active key, or that have no blind indexes yet. Call it with the LastID of the
+// previous batch until it selects fewer than batchSize users, after adding a key to the ring and
+// making it active. Users that can't be decrypted are reported in Failed rather than failing the
+// batch, so that they don't stop the users after them from being re-encrypted.
+// Re-encryption doesn't change the user, so it doesn't increment the version; a user updated
+// while it is being re-encrypted is skipped and picked up by a later pass.
+func (r *CockroachUserRepository) Reencrypt(ctx context.Context, afterID int64, batchSize int) (ReencryptResult, error) {
+	result := ReencryptResult{LastID: afterID}
+	query := `SELECT ` + userColumns + ` FROM users
+		WHERE id > $3 AND (email NOT LIKE $1 OR email_index IS NULL
+		OR (COALESCE(contact, '') != '' AND (contact NOT LIKE $1 OR contact_index IS NULL))
+		OR (COALESCE(access_token, '') != '' AND access_token NOT LIKE $1))
+		ORDER BY id
+		LIMIT $2`
+	rows, err := r.db.Query(ctx, query, r.keys.ActivePrefix()+"%", batchSize, afterID)
+	if err != nil {
+		return result, err
+	}
+	var users []User
+	for rows.Next() {
+		u, err := scanEncryptedUser(rows)
+		if err != nil {
+			rows.Close()
+			return result, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, u := range users {
+		result.Selected++
+		result.LastID = u.ID
+		if err := r.decryptUser(&u); err != nil {
+			result.Failed = append(result.Failed, u.ID)
+			continue
+		}
+		accessToken, err := r.keys.Encrypt(accessTokenColumn, u.AccessToken)
+		if err != nil {
+			return result, err
+		}
+		email, err := r.encrypt(emailColumn, u.Email)
+		if err != nil {
+			return result, err
+		}
+		contact, err := r.encrypt(contactColumn, u.Contact)
+		if err != nil {
+			return result, err
+		}
+		cmdTag, err := r.db.Exec(ctx, `UPDATE users SET access_token=$1, email=$2, email_index=$3, contact=$4, contact_index=$5 WHERE id=$6 AND version=$7`,
+			accessToken, email.value, email.index, contact.value, contact.index, u.ID, u.Version)
+		if err != nil {
+			return result, err
+		}
+		result.Rewritten += int(cmdTag.RowsAffected())
+	}
+	return result, nil
+}
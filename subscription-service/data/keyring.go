@@ -0,0 +1,228 @@
+// This file is kept identical in payment-service/data and subscription-service/data. Each service is
+// a module of its own, built from its own directory, so they can't import a shared package; change
+// both copies together. test/unit_test/keyring_test.go, also identical in both, fails if they differ.
+
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Files read by LoadKeyRing from the key directory.
+const (
+	activeKeyFile  = "active"      // Contains the ID of the key that encrypts new values.
+	blindIndexFile = "blind-index" // Contains the base64 HMAC key used for blind indexes.
+	keyFileSuffix  = ".key"        // <id>.key contains a base64 AES-256 key-encryption key.
+)
+
+// ciphertextPrefix starts every value encrypted by a KeyRing, so that values written before
+// encryption was introduced can be told apart and are returned as they are.
+const ciphertextPrefix = "enc:v1:"
+
+// keyIDPattern restricts key IDs to characters that are safe in the ciphertext format and in SQL LIKE patterns.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// ErrUnknownKey is returned when a value was encrypted with a key that is not in the key ring.
+var ErrUnknownKey = errors.New("value is encrypted with an unknown key")
+
+// KeyRing encrypts column values with envelope encryption.
+//
+// Every value is encrypted with AES-256-GCM under a fresh data key, and the data key is encrypted
+// with the ring's active key-encryption key. The stored value is
+//
+//	enc:v1:<key id>:<base64 encrypted data key>:<base64 encrypted value>
+//
+// so that it can still be decrypted after the active key changes, as long as the old key stays in
+// the ring. The column name is authenticated with the value, so ciphertexts can't be moved between columns.
+//
+// Encrypted values can't be compared, so columns that are looked up by value also store a blind
+// index: an HMAC of the value under a separate key. The blind index key can't be rotated without
+// recomputing every index, so it is not part of the rotation.
+type KeyRing struct {
+	active   string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+// NewKeyRing creates a key ring from 32-byte keys. active is the ID of the key that encrypts new values.
+// indexKey is the blind index key, or nil for a key ring that only encrypts.
+func NewKeyRing(active string, keys map[string][]byte, indexKey []byte) (*KeyRing, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the key ring", active)
+	}
+	for id, key := range keys {
+		if !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q is %d bytes, want 32", id, len(key))
+		}
+	}
+	if indexKey != nil && len(indexKey) < 32 {
+		return nil, fmt.Errorf("blind index key is %d bytes, want at least 32", len(indexKey))
+	}
+	return &KeyRing{active: active, keys: keys, indexKey: indexKey}, nil
+}
+
+// LoadKeyRing reads a key ring from dir. The directory holds one <id>.key file per
+// key-encryption key, an active file naming the key that encrypts new values and, if
+// blindIndex is set, a blind-index file with the blind index key. Keys are base64 encoded.
+func LoadKeyRing(dir string, blindIndex bool) (*KeyRing, error) {
+	active, err := os.ReadFile(filepath.Join(dir, activeKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	var indexKey []byte
+	if blindIndex {
+		indexKey, err = readKeyFile(filepath.Join(dir, blindIndexFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+keyFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string][]byte{}
+	for _, path := range paths {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys[strings.TrimSuffix(filepath.Base(path), keyFileSuffix)] = key
+	}
+	return NewKeyRing(strings.TrimSpace(string(active)), keys, indexKey)
+}
+
+// readKeyFile reads a base64 encoded key.
+func readKeyFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// ActivePrefix returns the prefix of values encrypted with the active key.
+// Values without it need to be re-encrypted.
+func (k *KeyRing) ActivePrefix() string {
+	return ciphertextPrefix + k.active + ":"
+}
+
+// Encrypt encrypts the value of the given column with the active key.
+// Empty values are stored as they are.
+func (k *KeyRing) Encrypt(column, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrappedKey, err := seal(k.keys[k.active], dataKey, []byte(k.active))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey, []byte(plaintext), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	return k.ActivePrefix() + base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value of the given column encrypted by Encrypt.
+// Values without the ciphertext prefix predate encryption and are returned as they are.
+func (k *KeyRing) Decrypt(column, value string) (string, error) {
+	if !strings.HasPrefix(value, ciphertextPrefix) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, ciphertextPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed ciphertext in %s", column)
+	}
+	kek, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%w %q in %s", ErrUnknownKey, parts[0], column)
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed ciphertext in %s: %w", column, err)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed ciphertext in %s: %w", column, err)
+	}
+	dataKey, err := open(kek, wrappedKey, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("decrypting data key for %s: %w", column, err)
+	}
+	plaintext, err := open(dataKey, sealed, []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s: %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// BlindIndex returns the blind index of the value of the given column, or nil for an empty value.
+// It panics if the key ring has no blind index key.
+func (k *KeyRing) BlindIndex(column, value string) []byte {
+	if value == "" {
+		return nil
+	}
+	if k.indexKey == nil {
+		panic("data: BlindIndex called on a key ring without a blind index key")
+	}
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(column))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// seal encrypts plaintext with AES-GCM under key and returns the nonce followed by the ciphertext.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts a value produced by seal.
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,36 @@
+package data
+
+import (
+	"context"
+	"sync"
+)
+
+// NewMemoryModels creates Models backed by in-memory repositories, for tests.
+func NewMemoryModels() Models {
+	runner := &memoryTxRunner{
+		users:  NewMemoryUserRepository(),
+		outbox: NewMemoryOutboxRepository(),
+	}
+	return Models{Users: runner.users, Outbox: runner.outbox, tx: runner}
+}
+
+// memoryTxRunner runs Models.RunInTx callbacks one at a time against the in-memory repositories.
+// If a callback fails, every repository is restored to the state it had before the callback started.
+type memoryTxRunner struct {
+	mu     sync.Mutex // mu serializes transactions.
+	users  *MemoryUserRepository
+	outbox *MemoryOutboxRepository
+}
+
+func (r *memoryTxRunner) runInTx(ctx context.Context, fn func(tx Models) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users, events := r.users.snapshot(), r.outbox.snapshot()
+	if err := fn(Models{Users: r.users, Outbox: r.outbox, tx: r, inTx: true}); err != nil {
+		r.users.restore(users)
+		r.outbox.restore(events)
+		return err
+	}
+	return nil
+}
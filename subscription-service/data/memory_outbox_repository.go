@@ -0,0 +1,156 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryOutboxEntry is an event stored by MemoryOutboxRepository along with its delivery state.
+type memoryOutboxEntry struct {
+	event       OutboxEvent
+	lockedUntil time.Time
+	published   bool
+	deadAt      time.Time // Zero unless the event is dead.
+}
+
+// MemoryOutboxRepository is an in-memory implementation of OutboxRepository.
+type MemoryOutboxRepository struct {
+	mu     sync.Mutex
+	events map[string]memoryOutboxEntry
+}
+
+// NewMemoryOutboxRepository creates an empty in-memory outbox.
+func NewMemoryOutboxRepository() *MemoryOutboxRepository {
+	return &MemoryOutboxRepository{events: map[string]memoryOutboxEntry{}}
+}
+
+// Enqueue records an event and returns its generated ID.
+func (r *MemoryOutboxRepository) Enqueue(ctx context.Context, eventType string, payload interface{}) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s payload: %w", eventType, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event := OutboxEvent{ID: uuid.NewString(), Type: eventType, Payload: body, CreatedAt: time.Now()}
+	r.events[event.ID] = memoryOutboxEntry{event: event}
+	return event.ID, nil
+}
+
+// Claim leases up to limit undelivered events that aren't dead and whose previous lease, if any, has expired.
+func (r *MemoryOutboxRepository) Claim(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var ready []memoryOutboxEntry
+	for _, entry := range r.events {
+		if !entry.published && entry.deadAt.IsZero() && !entry.lockedUntil.After(now) {
+			ready = append(ready, entry)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].event.CreatedAt.Before(ready[j].event.CreatedAt) })
+	if len(ready) > limit {
+		ready = ready[:limit]
+	}
+
+	events := make([]OutboxEvent, 0, len(ready))
+	for _, entry := range ready {
+		entry.lockedUntil = now.Add(lease)
+		entry.event.Attempts++
+		r.events[entry.event.ID] = entry
+		events = append(events, entry.event)
+	}
+	return events, nil
+}
+
+// MarkPublished records that an event was delivered so it is never claimed again.
+func (r *MemoryOutboxRepository) MarkPublished(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.events[id]
+	if !ok {
+		return fmt.Errorf("%w: no outbox event found with id %s", ErrNotFound, id)
+	}
+	entry.published, entry.lockedUntil, entry.event.LastError = true, time.Time{}, ""
+	r.events[id] = entry
+	return nil
+}
+
+// MarkFailed stores the reason a delivery failed. The event is retried once its lease expires.
+func (r *MemoryOutboxRepository) MarkFailed(ctx context.Context, id string, reason error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.events[id]
+	if !ok {
+		return fmt.Errorf("%w: no outbox event found with id %s", ErrNotFound, id)
+	}
+	entry.event.LastError = reason.Error()
+	r.events[id] = entry
+	return nil
+}
+
+// MarkDead stores the reason the last delivery of an event failed and marks it dead, so it is never claimed again.
+func (r *MemoryOutboxRepository) MarkDead(ctx context.Context, id string, reason error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.events[id]
+	if !ok {
+		return fmt.Errorf("%w: no outbox event found with id %s", ErrNotFound, id)
+	}
+	entry.deadAt, entry.lockedUntil, entry.event.LastError = time.Now(), time.Time{}, reason.Error()
+	r.events[id] = entry
+	return nil
+}
+
+// ListDead returns up to limit dead events, the ones that died last first.
+func (r *MemoryOutboxRepository) ListDead(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var dead []memoryOutboxEntry
+	for _, entry := range r.events {
+		if !entry.deadAt.IsZero() {
+			dead = append(dead, entry)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].deadAt.After(dead[j].deadAt) })
+	if len(dead) > limit {
+		dead = dead[:limit]
+	}
+	events := make([]OutboxEvent, 0, len(dead))
+	for _, entry := range dead {
+		events = append(events, entry.event)
+	}
+	return events, nil
+}
+
+// snapshot returns a copy of the stored events for rolling back a transaction.
+func (r *MemoryOutboxRepository) snapshot() map[string]memoryOutboxEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make(map[string]memoryOutboxEntry, len(r.events))
+	for id, entry := range r.events {
+		events[id] = entry
+	}
+	return events
+}
+
+// restore replaces the stored events with a snapshot.
+func (r *MemoryOutboxRepository) restore(events map[string]memoryOutboxEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = events
+}
@@ -0,0 +1,249 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Patterns mirroring the CHECK constraints on the users table. The email and contact columns are
+// encrypted, so CockroachUserRepository checks their patterns before writing them.
+var (
+	userNamePattern = regexp.MustCompile(`^[A-Za-z]+$`)
+	namePattern     = regexp.MustCompile(`^[A-Za-z ]+$`)
+	emailPattern    = regexp.MustCompile(`(?i)^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$`)
+	contactPattern  = regexp.MustCompile(`^\+91[0-9]{10}$`)
+)
+
+// MemoryUserRepository is an in-memory implementation of UserRepository.
+// It enforces the same uniqueness and check constraints as the users table so that
+// tests written against it behave the same way against CockroachDB.
+type MemoryUserRepository struct {
+	mu     sync.Mutex
+	users  map[int64]User
+	nextID int64
+}
+
+// NewMemoryUserRepository creates an empty in-memory user repository.
+// IDs start from a large time-based value, like CockroachDB's unique_rowid, so tests can't depend on small sequential IDs.
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:  map[int64]User{},
+		nextID: time.Now().UnixNano(),
+	}
+}
+
+// InsertUser stores a new user and returns the generated ID.
+// The contact number is stored with the +91 country code, as in the database implementation.
+func (r *MemoryUserRepository) InsertUser(ctx context.Context, user User) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user.Contact != "" {
+		user.Contact = "+91" + user.Contact
+	}
+	// Columns that are not written on insert start out empty.
+	user.AccessToken = ""
+	user.SubscriptionStatus, user.SubscriptionID, user.SubscriptionVariantID, user.SubscriptionType = "", 0, 0, ""
+
+	r.nextID++
+	user.ID = r.nextID
+	user.Version = 1
+	if err := r.checkConstraints(user); err != nil {
+		return 0, err
+	}
+	r.users[user.ID] = user
+	return user.ID, nil
+}
+
+// GetUser fetches a user by ID.
+func (r *MemoryUserRepository) GetUser(ctx context.Context, id int64) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+// UpdateUser overwrites the fields of the user that are set in updatedUser.
+func (r *MemoryUserRepository) UpdateUser(ctx context.Context, id int64, updatedUser User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, changed := mergeUser(r.users[id], updatedUser)
+	if !changed {
+		return nil // No updates to make
+	}
+	if _, ok := r.users[id]; !ok {
+		return fmt.Errorf("%w: no user found with id %d", ErrNotFound, id)
+	}
+	if updatedUser.Version != 0 && updatedUser.Version != user.Version {
+		return fmt.Errorf("%w: user %d is at version %d", ErrConflict, id, user.Version)
+	}
+	user.Version++
+	if err := r.checkConstraints(user); err != nil {
+		return err
+	}
+	r.users[id] = user
+	return nil
+}
+
+// UpdateUserSubscription sets the subscription status, ID, plan variant and plan name of a user.
+func (r *MemoryUserRepository) UpdateUserSubscription(ctx context.Context, id int64, subscriptionStatus string, subscriptionId float64, variantID int64, subscriptionType string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return fmt.Errorf("%w: no user found with id %d", ErrNotFound, id)
+	}
+	user.SubscriptionStatus, user.SubscriptionID, user.SubscriptionType = subscriptionStatus, subscriptionId, subscriptionType
+	if variantID != 0 {
+		// Notifications sent before variant IDs were added keep the stored one.
+		user.SubscriptionVariantID = variantID
+	}
+	user.Version++
+	if err := r.checkConstraints(user); err != nil {
+		return err
+	}
+	r.users[id] = user
+	return nil
+}
+
+// DeleteUser removes a user by ID.
+func (r *MemoryUserRepository) DeleteUser(ctx context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[id]; !ok {
+		return fmt.Errorf("%w: no user found with id %d", ErrNotFound, id)
+	}
+	delete(r.users, id)
+	return nil
+}
+
+// GetByGitId fetches a user by GitHub ID.
+func (r *MemoryUserRepository) GetByGitId(ctx context.Context, githubId string) (User, error) {
+	return r.find(func(u User) bool { return u.GithubId == githubId })
+}
+
+// GetByEmail fetches a user by email address.
+func (r *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	return r.find(func(u User) bool { return u.Email == email })
+}
+
+// GetByContact fetches a user by contact number, including the country code.
+func (r *MemoryUserRepository) GetByContact(ctx context.Context, contact string) (User, error) {
+	return r.find(func(u User) bool { return u.Contact == contact })
+}
+
+// find returns the first user matching the predicate, or ErrNotFound.
+func (r *MemoryUserRepository) find(match func(User) bool) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.users {
+		if match(user) {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+// checkConstraints validates user against the column and uniqueness constraints of the users table.
+// The caller must hold r.mu.
+func (r *MemoryUserRepository) checkConstraints(user User) error {
+	switch {
+	case !userNamePattern.MatchString(user.UserName) || utf8.RuneCountInString(user.UserName) > 255:
+		return fmt.Errorf("violates check constraint on user_name")
+	case !namePattern.MatchString(user.FirstName):
+		return fmt.Errorf("violates check constraint on first_name")
+	case !namePattern.MatchString(user.LastName):
+		return fmt.Errorf("violates check constraint on last_name")
+	case utf8.RuneCountInString(user.Bio) > 500:
+		return fmt.Errorf("value too long for bio")
+	case !emailPattern.MatchString(user.Email):
+		return fmt.Errorf("violates check constraint on email")
+	case !contactPattern.MatchString(user.Contact):
+		return fmt.Errorf("violates check constraint on contact")
+	}
+
+	for id, other := range r.users {
+		if id == user.ID {
+			continue
+		}
+		switch {
+		case other.GithubName == user.GithubName:
+			return fmt.Errorf("duplicate key value violates unique constraint on github_name")
+		case other.Email == user.Email:
+			return fmt.Errorf("duplicate key value violates unique constraint on email")
+		case other.Contact == user.Contact:
+			return fmt.Errorf("duplicate key value violates unique constraint on contact")
+		case user.SubscriptionID != 0 && other.SubscriptionID == user.SubscriptionID:
+			return fmt.Errorf("duplicate key value violates unique constraint on subscription_id")
+		}
+	}
+	return nil
+}
+
+// mergeUser applies the non-empty fields of updatedUser to user, following the same rules as
+// CockroachUserRepository.UpdateUser. It reports whether any field was set.
+func mergeUser(user, updatedUser User) (User, bool) {
+	changed := false
+	setString := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+			changed = true
+		}
+	}
+	setString(&user.UserName, updatedUser.UserName)
+	setString(&user.GithubName, updatedUser.GithubName)
+	setString(&user.GithubId, updatedUser.GithubId)
+	setString(&user.FirstName, updatedUser.FirstName)
+	setString(&user.LastName, updatedUser.LastName)
+	setString(&user.AvatarUrl, updatedUser.AvatarUrl)
+	setString(&user.Bio, updatedUser.Bio)
+	setString(&user.Email, updatedUser.Email)
+	setString(&user.Contact, updatedUser.Contact)
+	if !updatedUser.ExpiresAt.IsZero() {
+		user.ExpiresAt = updatedUser.ExpiresAt
+		changed = true
+	}
+	setString(&user.Password, updatedUser.Password)
+	if updatedUser.Verified {
+		user.Verified = true
+		changed = true
+	}
+	setString(&user.SubscriptionStatus, updatedUser.SubscriptionStatus)
+	if updatedUser.SubscriptionID != 0 {
+		user.SubscriptionID = updatedUser.SubscriptionID
+		changed = true
+	}
+	setString(&user.SubscriptionType, updatedUser.SubscriptionType)
+	return user, changed
+}
+
+// snapshot returns a copy of the stored users for rolling back a transaction.
+func (r *MemoryUserRepository) snapshot() map[int64]User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := make(map[int64]User, len(r.users))
+	for id, user := range r.users {
+		users[id] = user
+	}
+	return users
+}
+
+// restore replaces the stored users with a snapshot.
+func (r *MemoryUserRepository) restore(users map[int64]User) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users = users
+}
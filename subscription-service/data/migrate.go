@@ -0,0 +1,345 @@
+package data
+
+import (
+	"context"
+	"embed" // Used to ship the SQL migrations inside the binary.
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the ordered up/down SQL migrations for the users schema.
+// File names follow the pattern <version>_<name>.<up|down>.sql.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const (
+	lockID          = 1                // Row id used for the single migration lock.
+	lockPollPeriod  = time.Second      // How often a waiting replica retries the lock.
+	lockStaleAfter  = 5 * time.Minute  // Locks not refreshed for this long are considered abandoned.
+	lockHeartbeat   = 30 * time.Second // How often the holder refreshes the lock while migrating.
+	lockWaitTimeout = 2 * time.Minute  // Maximum time to wait for another replica to finish.
+)
+
+// ErrSchemaTooNew is returned when the database has migrations applied that this binary does not know about.
+// This usually means an older build is being started against a database migrated by a newer one.
+var ErrSchemaTooNew = errors.New("database schema is newer than this service supports")
+
+// Migration is a single versioned schema change with its up and down SQL.
+type Migration struct {
+	Version int    // Version is the ordering key taken from the file name.
+	Name    string // Name is the descriptive part of the file name.
+	Up      string // Up holds the SQL applied when migrating forward.
+	Down    string // Down holds the SQL applied when rolling back.
+}
+
+// MigrationStatus reports whether a known migration has been applied.
+type MigrationStatus struct {
+	Migration
+	Applied   bool      // Applied is true if the migration is recorded in schema_migrations.
+	AppliedAt time.Time // AppliedAt is when the migration was recorded, zero if not applied.
+}
+
+// Migrator applies the embedded migrations to a database connection.
+type Migrator struct {
+	connection DB
+	migrations []Migration
+	holder     string // holder identifies this process in the lock table.
+}
+
+// NewMigrator creates a Migrator with the embedded migrations loaded and sorted by version.
+func NewMigrator(connection DB) (*Migrator, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &Migrator{
+		connection: connection,
+		migrations: migrations,
+		holder:     fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+	}, nil
+}
+
+// LoadMigrations reads the embedded migration files and returns them ordered by version.
+// It returns an error if a version is missing its up or down file, or is defined twice.
+func LoadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(fileName, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", fileName)
+		}
+
+		content, err := fs.ReadFile(migrationFiles, "migrations/"+fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration version %d defined twice (%s, %s)", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Latest returns the highest migration version known to this binary.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration in order while holding the migration lock.
+// It returns ErrSchemaTooNew without changing anything if the database is ahead of this binary.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func() error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		if err := m.checkApplied(applied); err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := m.apply(ctx, migration, true); err != nil {
+				return err
+			}
+			log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+		}
+		return nil
+	})
+}
+
+// Down rolls back the most recently applied migration while holding the migration lock.
+// It is a no-op if no migrations have been applied.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.withLock(ctx, func() error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		if err := m.checkApplied(applied); err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := m.apply(ctx, migration, false); err != nil {
+				return err
+			}
+			log.Printf("Rolled back migration %d_%s", migration.Version, migration.Name)
+			return nil
+		}
+		return nil
+	})
+}
+
+// Status lists every known migration together with whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureMigrationTables(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, MigrationStatus{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, m.checkApplied(applied)
+}
+
+// checkApplied returns ErrSchemaTooNew if any applied version is unknown to this binary.
+func (m *Migrator) checkApplied(applied map[int]time.Time) error {
+	for version := range applied {
+		if version > m.Latest() {
+			return fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, version, m.Latest())
+		}
+	}
+	return nil
+}
+
+// apply runs a single migration in one direction and records the result in schema_migrations,
+// both inside the same transaction.
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) error {
+	tx, err := m.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	script, record := migration.Down, `DELETE FROM schema_migrations WHERE version=$1`
+	if up {
+		script, record = migration.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+	}
+	if _, err := tx.Exec(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+	args := []interface{}{migration.Version}
+	if up {
+		args = append(args, migration.Name)
+	}
+	if _, err := tx.Exec(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// applied returns the applied migration versions mapped to the time they were applied.
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := m.connection.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// ensureMigrationTables creates the bookkeeping tables used by the migrator.
+func (m *Migrator) ensureMigrationTables(ctx context.Context) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INT PRIMARY KEY,
+        name VARCHAR(255) NOT NULL,
+        applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );
+    CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+        id INT PRIMARY KEY,
+        holder VARCHAR(255) NOT NULL,
+        acquired_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );`
+	_, err := m.connection.Exec(ctx, query)
+	return err
+}
+
+// withLock runs fn while holding the migration lock so concurrent replicas don't migrate at the same time.
+// CockroachDB accepts pg_advisory_lock but does not enforce it, so the lock is a row in
+// schema_migrations_lock instead. The holder refreshes it every lockHeartbeat while fn runs, so a long
+// migration keeps it and only a lock left behind by a crashed process expires after lockStaleAfter.
+func (m *Migrator) withLock(ctx context.Context, fn func() error) error {
+	if err := m.ensureMigrationTables(ctx); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		// Clear a lock abandoned by a process that died mid-migration.
+		if _, err := m.connection.Exec(ctx, `DELETE FROM schema_migrations_lock WHERE id=$1 AND acquired_at < now() - ($2 * INTERVAL '1 second')`, lockID, int(lockStaleAfter.Seconds())); err != nil {
+			return err
+		}
+		cmdTag, err := m.connection.Exec(ctx, `INSERT INTO schema_migrations_lock (id, holder) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`, lockID, m.holder)
+		if err != nil {
+			return err
+		}
+		if cmdTag.RowsAffected() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for migration lock")
+		}
+		log.Println("Waiting for another instance to finish migrating")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollPeriod):
+		}
+	}
+
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		m.heartbeat(heartbeatCtx)
+	}()
+	defer func() {
+		stopHeartbeat()
+		<-heartbeatDone
+		if _, err := m.connection.Exec(context.Background(), `DELETE FROM schema_migrations_lock WHERE id=$1 AND holder=$2`, lockID, m.holder); err != nil {
+			log.Printf("Failed to release migration lock: %v", err)
+		}
+	}()
+	return fn()
+}
+
+// heartbeat refreshes acquired_at of the migration lock every lockHeartbeat until ctx is done.
+// It stops early if the lock is no longer held by this process.
+func (m *Migrator) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(lockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cmdTag, err := m.connection.Exec(ctx, `UPDATE schema_migrations_lock SET acquired_at = now() WHERE id=$1 AND holder=$2`, lockID, m.holder)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to refresh migration lock: %v", err)
+			}
+			continue
+		}
+		if cmdTag.RowsAffected() == 0 {
+			log.Println("Migration lock is no longer held by this instance")
+			return
+		}
+	}
+}
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    user_name VARCHAR(255) NOT NULL CHECK (user_name ~ '^[A-Za-z]+$'),
+    github_name VARCHAR(255) UNIQUE NOT NULL,
+    github_id VARCHAR(255),
+    first_name VARCHAR(255) CHECK (first_name ~ '^[A-Za-z ]+$'),
+    last_name VARCHAR(255) CHECK (last_name ~ '^[A-Za-z ]+$'),
+    avatar_url TEXT,
+    access_token TEXT,
+    bio VARCHAR(500),
+    email VARCHAR(255) NOT NULL UNIQUE CHECK (email ~* '^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$'),
+    expires_at TIMESTAMP NOT NULL,
+    password VARCHAR(255) NOT NULL,
+    contact VARCHAR(255) UNIQUE CHECK (contact ~ '^\+91[0-9]{10}$'),
+    verified BOOLEAN DEFAULT FALSE,
+    subscription_status VARCHAR(255),
+    subscription_id FLOAT UNIQUE,
+    subscription_type VARCHAR(255)
+);
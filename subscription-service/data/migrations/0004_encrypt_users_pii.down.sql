@@ -0,0 +1,12 @@
+-- The restored constraints reject ciphertext, and the database can't decrypt it, so refuse to roll back
+-- while any user still has an encrypted access_token, email or contact.
+SELECT crdb_internal.force_error('55000', 'cannot roll back 0004_encrypt_users_pii: users have encrypted columns; decrypt access_token, email and contact first')
+FROM users WHERE access_token LIKE 'enc:v1:%' OR email LIKE 'enc:v1:%' OR contact LIKE 'enc:v1:%' LIMIT 1;
+DROP INDEX IF EXISTS users@users_contact_index_key;
+DROP INDEX IF EXISTS users@users_email_index_key;
+ALTER TABLE users DROP COLUMN IF EXISTS contact_index;
+ALTER TABLE users DROP COLUMN IF EXISTS email_index;
+ALTER TABLE users ADD CONSTRAINT check_contact CHECK (contact ~ '^\+91[0-9]{10}$');
+ALTER TABLE users ADD CONSTRAINT check_email CHECK (email ~* '^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$');
+ALTER TABLE users ALTER COLUMN contact TYPE VARCHAR(255);
+ALTER TABLE users ALTER COLUMN email TYPE VARCHAR(255);
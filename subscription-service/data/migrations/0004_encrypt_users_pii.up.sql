@@ -0,0 +1,11 @@
+-- access_token, email and contact hold ciphertext, which is longer than the plaintext and can't
+-- be checked by the database. The repository checks email and contact before encrypting them.
+ALTER TABLE users ALTER COLUMN email TYPE STRING;
+ALTER TABLE users ALTER COLUMN contact TYPE STRING;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS check_email;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS check_contact;
+-- Uniqueness of email and contact is enforced on their blind indexes: the unique constraints on the
+-- columns themselves can't catch duplicates once every value is encrypted under a fresh data key.
+-- The unique indexes are created by 0007, as CockroachDB can't index a column added earlier in the same transaction.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_index BYTES;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS contact_index BYTES;
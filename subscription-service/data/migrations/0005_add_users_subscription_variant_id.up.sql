@@ -0,0 +1,2 @@
+-- The plan of a user's subscription, by Lemon Squeezy variant ID. subscription_type keeps its display name.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS subscription_variant_id INT8;
@@ -0,0 +1,3 @@
+-- When the relay gave up on delivering an event, after too many failed attempts. Dead events are never
+-- claimed again; last_error says why the last attempt failed.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS dead_at TIMESTAMPTZ;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users@users_contact_index_key;
+DROP INDEX IF EXISTS users@users_email_index_key;
@@ -0,0 +1,3 @@
+-- The indexes are created in their own migration because CockroachDB can't index a column added earlier in the same transaction.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_index_key ON users (email_index);
+CREATE UNIQUE INDEX IF NOT EXISTS users_contact_index_key ON users (contact_index);
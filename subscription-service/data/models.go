@@ -3,76 +3,143 @@ package data
 
 import (
 	"context" // Used for managing the lifetime of database requests.
-	"fmt"
+	"encoding/json"
+	"errors"
 	"log"
 	"regexp"
 	"strings"
 	"time" // Used for handling time-related data.
-
-	"github.com/jackc/pgx/v4" // PostgreSQL driver for Go.
 )
 
 // User represents a user entity in the system with various attributes.
 type User struct {
-	ID                 int64     `json:"id"`                 // Unique identifier for the user.
-	UserName           string    `json:"userName"`           // Username of the user.
-	GithubName         string    `json:"githubName"`         // GitHub username of the user.
-	GithubId           string    `json:"githubId"`           // GitHub ID of the user.
-	FirstName          string    `json:"firstName"`          // First name of the user.
-	LastName           string    `json:"lastName"`           // Last name of the user.
-	AvatarUrl          string    `json:"avatarUrl"`          // URL of the user's avatar.
-	AccessToken        string    `json:"accessToken"`        // Access token for authentication.
-	Bio                string    `json:"bio"`                // Biography of the user.
-	Email              string    `json:"email"`              // Email address of the user.
-	Contact            string    `json:"contact"`            // Contact number of the user.
-	ExpiresAt          time.Time `json:"expiresAt"`          // Expiration time of the user's session or token.
-	Password           string    `json:"password"`           // Password of the user.
-	Verified           bool      `json:"verified"`           // Verification status of the user.
-	SubscriptionStatus string    `json:"subscriptionStatus"` // Subscription status of the user.
-	SubscriptionID     float64   `json:"subscriptionId"`     // Subscription ID of the user.
-	SubscriptionType   string    `json:"subscriptionType"`   // Subscription type of the user.
+	ID                    int64     `json:"id"`                    // Unique identifier for the user.
+	UserName              string    `json:"userName"`              // Username of the user.
+	GithubName            string    `json:"githubName"`            // GitHub username of the user.
+	GithubId              string    `json:"githubId"`              // GitHub ID of the user.
+	FirstName             string    `json:"firstName"`             // First name of the user.
+	LastName              string    `json:"lastName"`              // Last name of the user.
+	AvatarUrl             string    `json:"avatarUrl"`             // URL of the user's avatar.
+	AccessToken           string    `json:"accessToken"`           // Access token for authentication.
+	Bio                   string    `json:"bio"`                   // Biography of the user.
+	Email                 string    `json:"email"`                 // Email address of the user.
+	Contact               string    `json:"contact"`               // Contact number of the user.
+	ExpiresAt             time.Time `json:"expiresAt"`             // Expiration time of the user's session or token.
+	Password              string    `json:"password"`              // Password of the user.
+	Verified              bool      `json:"verified"`              // Verification status of the user.
+	SubscriptionStatus    string    `json:"subscriptionStatus"`    // Subscription status of the user.
+	SubscriptionID        float64   `json:"subscriptionId"`        // Subscription ID of the user.
+	SubscriptionType      string    `json:"subscriptionType"`      // Display name of the user's plan.
+	SubscriptionVariantID int64     `json:"subscriptionVariantId"` // Lemon Squeezy ID of the variant of the user's plan, or 0 if it isn't known.
+	Version               int64     `json:"version"`               // Version of the row, incremented by every update.
+}
+
+// ErrNotFound is returned by repositories when the requested record does not exist.
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned by conditional updates when the record was changed since it was read.
+var ErrConflict = errors.New("record was modified concurrently")
+
+// UserRepository defines the storage operations available for users.
+// CockroachUserRepository is used in production and MemoryUserRepository in tests;
+// both must behave the same way, including the column constraints of the users table.
+type UserRepository interface {
+	// InsertUser stores a new user and returns the generated ID.
+	InsertUser(ctx context.Context, user User) (int64, error)
+	// GetUser fetches a user by ID.
+	GetUser(ctx context.Context, id int64) (User, error)
+	// UpdateUser overwrites the fields of the user that are set in updatedUser.
+	// If updatedUser.Version is set, the update only applies to that version of the user and
+	// returns ErrConflict otherwise.
+	UpdateUser(ctx context.Context, id int64, updatedUser User) error
+	// UpdateUserSubscription sets the subscription status, ID, plan variant and plan name of a user.
+	// A variantID of 0 keeps the stored variant.
+	UpdateUserSubscription(ctx context.Context, id int64, subscriptionStatus string, subscriptionId float64, variantID int64, subscriptionType string) error
+	// DeleteUser removes a user by ID.
+	DeleteUser(ctx context.Context, id int64) error
+	// GetByGitId fetches a user by GitHub ID.
+	GetByGitId(ctx context.Context, githubId string) (User, error)
+	// GetByEmail fetches a user by email address.
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// GetByContact fetches a user by contact number, including the country code.
+	GetByContact(ctx context.Context, contact string) (User, error)
+}
+
+// Outbox event types.
+const (
+	EventUserSignedUp = "user.signed_up" // A user registered; the payload holds the WelcomeWorkflow parameters.
+)
+
+// OutboxEvent is a domain event recorded in the outbox table.
+type OutboxEvent struct {
+	ID        string          `json:"id"`        // Unique identifier of the event, used by consumers to deduplicate deliveries.
+	Type      string          `json:"type"`      // Type of the event, one of the Event constants.
+	Payload   json.RawMessage `json:"payload"`   // JSON encoded event data.
+	CreatedAt time.Time       `json:"createdAt"` // Time the event was recorded.
+	Attempts  int             `json:"attempts"`  // Number of times the event has been claimed for delivery.
+	LastError string          `json:"lastError"` // Why the latest delivery failed, if it did.
+}
+
+// OutboxRepository stores domain events until they have been delivered.
+// Events are enqueued in the same transaction as the state change they describe, so an event
+// exists if and only if the change was committed. A relay then claims and delivers them.
+type OutboxRepository interface {
+	// Enqueue records an event of the given type with payload encoded as JSON and returns its ID.
+	Enqueue(ctx context.Context, eventType string, payload interface{}) (string, error)
+	// Claim leases up to limit undelivered events that aren't dead, oldest first. Claimed events are not
+	// returned again until the lease expires, so an event whose relay died is eventually redelivered.
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error)
+	// MarkPublished records that an event was delivered.
+	MarkPublished(ctx context.Context, id string) error
+	// MarkFailed records why a delivery failed. The event is retried once its lease expires.
+	MarkFailed(ctx context.Context, id string, reason error) error
+	// MarkDead records why the last delivery of an event failed and stops it from being claimed again.
+	MarkDead(ctx context.Context, id string, reason error) error
+	// ListDead returns up to limit dead events, the ones that died last first.
+	ListDead(ctx context.Context, limit int) ([]OutboxEvent, error)
 }
 
 // Models wraps all the models in the application for easy access.
 type Models struct {
-	User User // User model instance.
+	Users  UserRepository   // Users provides access to stored users.
+	Outbox OutboxRepository // Outbox holds domain events waiting to be published.
+	tx     txRunner         // tx starts transactions spanning all the repositories.
+	inTx   bool             // inTx is true for the Models passed to a RunInTx callback.
 }
 
-// NewModels initializes a new instance of Models with a database connection.
-func NewModels(conn *pgx.Conn) Models {
-	ensureTableExists(conn) // Ensure the table exists in the database.
-	return Models{
-		User: User{}, // Initialize the User model.
-	}
+// txRunner starts a transaction and calls fn with Models bound to it.
+type txRunner interface {
+	runInTx(ctx context.Context, fn func(tx Models) error) error
 }
 
-// This functions ensures that a table exists on startup
-// If the table does not exist, it creates the table
-func ensureTableExists(conn *pgx.Conn) {
-	query := `
-    DROP TABLE IF EXISTS users;
-    CREATE TABLE IF NOT EXISTS users (
-        id SERIAL PRIMARY KEY,
-        user_name VARCHAR(255) NOT NULL CHECK (user_name ~ '^[A-Za-z]+$'),
-        github_name VARCHAR(255) UNIQUE NOT NULL,
-        github_id VARCHAR(255),
-        first_name VARCHAR(255) CHECK (first_name ~ '^[A-Za-z ]+$'),
-        last_name VARCHAR(255) CHECK (last_name ~ '^[A-Za-z ]+$'),
-        avatar_url TEXT,
-        access_token TEXT,
-        bio VARCHAR(500),
-        email VARCHAR(255) NOT NULL UNIQUE CHECK (email ~* '^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$'),
-        expires_at TIMESTAMP NOT NULL,
-        password VARCHAR(255) NOT NULL,
-        contact VARCHAR(255) UNIQUE CHECK (contact ~ '^\+91[0-9]{10}$'),
-        verified BOOLEAN DEFAULT FALSE,
-        subscription_status VARCHAR(255),
-        subscription_id FLOAT UNIQUE,
-        subscription_type VARCHAR(255)
-    );`
+// NewModels initializes a new instance of Models backed by CockroachDB.
+// It applies any pending migrations first and exits if the schema is newer than this build understands.
+func NewModels(db DB, keys *KeyRing) Models {
+	ensureSchema(db) // Bring the database schema up to date.
+	return NewCockroachModels(db, keys)
+}
 
-	if _, err := conn.Exec(context.Background(), query); err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+// RunInTx runs fn with Models whose repositories all operate in one transaction.
+// The transaction is committed if fn returns nil and rolled back otherwise. fn may be retried, so it
+// must not have side effects outside the repositories; anything else belongs in the outbox.
+// Calling RunInTx on the Models passed to fn runs the nested fn in the enclosing transaction.
+func (m Models) RunInTx(ctx context.Context, fn func(tx Models) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+	return m.tx.runInTx(ctx, fn)
+}
+
+// ensureSchema runs the embedded migrations on startup.
+// Concurrent replicas serialize on the migration lock, and a database migrated by a newer
+// build causes the service to refuse to start rather than run against an unknown schema.
+func ensureSchema(db DB) {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	if err := migrator.Up(context.Background()); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
 	}
 }
 
@@ -118,252 +185,3 @@ func isValidIndianPhoneNumber(phoneNumber string) bool {
 	regex := regexp.MustCompile(`^[789]\d{9}$`)
 	return regex.MatchString(phoneNumber)
 }
-
-// InsertUser inserts a new user into the database.
-// This method is useful for registering new users in the system.
-// Parameters:
-// - user: The User struct containing the user's information.
-// Returns:
-// - An error if the query execution fails.
-func (u *User) InsertUser(connection *pgx.Conn, user User) error {
-	if user.Contact != "" {
-		user.Contact = "+91" + user.Contact
-	}
-	// SQL query to insert a new user, returning the generated ID.
-	query := `INSERT INTO users (user_name, github_name, github_id, first_name, last_name, avatar_url, bio, email,contact, expires_at,password,verified) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11,$12) RETURNING id`
-	// Execute the query and scan the returned ID into the User struct.
-	err := connection.QueryRow(context.Background(), query, user.UserName, user.GithubName, user.GithubId, user.FirstName, user.LastName, user.AvatarUrl, user.Bio, user.Email, user.Contact, user.ExpiresAt, user.Password, user.Verified).Scan(&u.ID)
-	if err != nil {
-		return err // Return any errors encountered.
-	}
-	return nil // Return nil on success.
-}
-
-// GetUser retrieves a user by their ID from the database.
-// This method is useful for fetching user details based on their unique identifier.
-// Parameters:
-// - id: The ID of the user to retrieve.
-// Returns:
-// - nil if the user is successfully found and the User struct is populated.
-// - An error if the query execution or scan fails.
-func (u *User) GetUser(connection *pgx.Conn, id int64) error {
-	// SQL query to select a user by ID.
-	query := `SELECT id, user_name, github_name, github_id, first_name, last_name, avatar_url, bio, email,contact,verified FROM users WHERE id=$1`
-	// Execute the query and scan the result into the User struct.
-	err := connection.QueryRow(context.Background(), query, id).Scan(&u.ID, &u.UserName, &u.GithubName, &u.GithubId, &u.FirstName, &u.LastName, &u.AvatarUrl, &u.Bio, &u.Email, &u.Contact, &u.Verified)
-	if err != nil {
-		return err // Return any errors encountered.
-	}
-	return nil // Return nil on success.
-}
-
-// UpdateUser updates an existing user's information in the database.
-// This method is useful for updating user details, such as their name, email, or avatar.
-// Parameters:
-// - id: The ID of the user to update.
-// - updatedUser: The updated User struct containing the new information.
-// Returns:
-// - An error if the query execution fails.
-func (u *User) UpdateUser(connection *pgx.Conn, id int64, updatedUser User) error {
-	baseQuery := "UPDATE users SET "
-	var args []interface{}
-	var updates []string
-	argCounter := 1
-
-	// For each field, check if provided and append to query and args as necessary
-	if updatedUser.UserName != "" {
-		updates = append(updates, fmt.Sprintf("user_name=$%d", argCounter))
-		args = append(args, updatedUser.UserName)
-		argCounter++
-	}
-	if updatedUser.GithubName != "" {
-		updates = append(updates, fmt.Sprintf("github_name=$%d", argCounter))
-		args = append(args, updatedUser.GithubName)
-		argCounter++
-	}
-	if updatedUser.GithubId != "" {
-		updates = append(updates, fmt.Sprintf("github_id=$%d", argCounter))
-		args = append(args, updatedUser.GithubId)
-		argCounter++
-	}
-	if updatedUser.FirstName != "" {
-		updates = append(updates, fmt.Sprintf("first_name=$%d", argCounter))
-		args = append(args, updatedUser.FirstName)
-		argCounter++
-	}
-	if updatedUser.LastName != "" {
-		updates = append(updates, fmt.Sprintf("last_name=$%d", argCounter))
-		args = append(args, updatedUser.LastName)
-		argCounter++
-	}
-	if updatedUser.AvatarUrl != "" {
-		updates = append(updates, fmt.Sprintf("avatar_url=$%d", argCounter))
-		args = append(args, updatedUser.AvatarUrl)
-		argCounter++
-	}
-	if updatedUser.Bio != "" {
-		updates = append(updates, fmt.Sprintf("bio=$%d", argCounter))
-		args = append(args, updatedUser.Bio)
-		argCounter++
-	}
-	if updatedUser.Email != "" {
-		updates = append(updates, fmt.Sprintf("email=$%d", argCounter))
-		args = append(args, updatedUser.Email)
-		argCounter++
-	}
-	if updatedUser.Contact != "" {
-		updates = append(updates, fmt.Sprintf("contact=$%d", argCounter))
-		args = append(args, updatedUser.Contact)
-		argCounter++
-	}
-	if !updatedUser.ExpiresAt.IsZero() {
-		updates = append(updates, fmt.Sprintf("expires_at=$%d", argCounter))
-		args = append(args, updatedUser.ExpiresAt)
-		argCounter++
-	}
-	if updatedUser.Password != "" {
-		updates = append(updates, fmt.Sprintf("password=$%d", argCounter))
-		args = append(args, updatedUser.Password)
-		argCounter++
-	}
-	if updatedUser.Verified {
-		updates = append(updates, fmt.Sprintf("verified=$%d", argCounter))
-		args = append(args, updatedUser.Verified)
-		argCounter++
-	}
-	if updatedUser.SubscriptionStatus != "" {
-		updates = append(updates, fmt.Sprintf("subscription_status=$%d", argCounter))
-		args = append(args, updatedUser.SubscriptionStatus)
-		argCounter++
-	}
-	if updatedUser.SubscriptionID != 0 {
-		updates = append(updates, fmt.Sprintf("subscription_id=$%d", argCounter))
-		args = append(args, updatedUser.SubscriptionID)
-		argCounter++
-	}
-	if updatedUser.SubscriptionType != "" {
-		updates = append(updates, fmt.Sprintf("subscription_type=$%d", argCounter))
-		args = append(args, updatedUser.SubscriptionType)
-		argCounter++
-	}
-
-	// Finalize query
-	if len(updates) == 0 {
-		return nil // No updates to make
-	}
-	query := baseQuery + strings.Join(updates, ", ") + fmt.Sprintf(" WHERE id=$%d", argCounter)
-	args = append(args, id)
-
-	// Execute the query
-	cmdTag, err := connection.Exec(context.Background(), query, args...)
-	if err != nil {
-		return err
-	}
-	// Check if no rows were affected.
-	if cmdTag.RowsAffected() == 0 {
-		return fmt.Errorf("no user found with id %d", id)
-	}
-	return nil
-}
-
-// UpdateUserSubscription updates an existing user's subscription status and name in the database.
-// Parameters:
-// - id: The ID of the user whose subscription is to be updated.
-// - status: The new subscription status.
-// - name: The new subscription name.
-// Returns:
-// - An error if the query execution fails.
-func (u *User) UpdateUserSubscription(connection *pgx.Conn, id int64, subscriptionStatus string, subscriptionId float64, subscriptionType string) error {
-	// SQL query to update a user's subscription status and name by ID.
-	query := `UPDATE users SET subscription_status=$1, subscription_id=$2, subscription_type=$3 WHERE id=$4`
-	// Execute the query without returning any result.
-	cmdTag, err := connection.Exec(context.Background(), query, subscriptionStatus, subscriptionId, subscriptionType, id)
-	if err != nil {
-		return err // Return any errors encountered.
-	}
-	// Check if no rows were affected.
-	if cmdTag.RowsAffected() == 0 {
-		return fmt.Errorf("no user found with id %d", id)
-	}
-	return nil // Return nil on success.
-}
-
-// DeleteUser removes a user from the database by their ID.
-// This method is useful for removing a user from the system.
-// Parameters:
-// - id: The ID of the user to delete.
-// Returns:
-// - An error if the query execution fails.s
-func (u *User) DeleteUser(connection *pgx.Conn, id int64) error {
-	// SQL query to delete a user by ID.
-	query := `DELETE FROM users WHERE id=$1`
-	// Execute the query.
-	cmdTag, err := connection.Exec(context.Background(), query, id)
-	if err != nil {
-		return err // Return any errors encountered.
-	}
-	// Check if no rows were affected.
-	if cmdTag.RowsAffected() == 0 {
-		return fmt.Errorf("no user found with id %d", id)
-	}
-	return nil // Return nil on success.
-}
-
-// GetByGitId retrieves a user by their GitHub ID from the database.
-// This method is useful for integrating GitHub authentication,
-// allowing the application to fetch user details based on GitHub account information.
-//
-// Parameters:
-// - githubId: The GitHub ID of the user to retrieve.
-//
-// Returns:
-// - nil if the user is successfully found and the User struct is populated.
-// - An error if the query execution or scan fails.
-func (u *User) GetByGitId(connection *pgx.Conn, githubId string) error {
-	// SQL query to select a user by GitHub ID.
-	query := `SELECT id, user_name, github_name, github_id, first_name, last_name, avatar_url, bio, email,contact,verified FROM users WHERE github_id=$1`
-	// Execute the query and scan the result into the User struct.
-	err := connection.QueryRow(context.Background(), query, githubId).Scan(&u.ID, &u.UserName, &u.GithubName, &u.GithubId, &u.FirstName, &u.LastName, &u.AvatarUrl, &u.Bio, &u.Email, &u.Contact, &u.Verified)
-	if err != nil {
-		return err // Return any errors encountered.
-	}
-	return nil // Return nil on success.
-}
-
-// GetByEmail retrieves a user by their email address from the database.
-// This method is useful for authenticating users based on their email address,
-// allowing the application to fetch user details based on their email.
-// Parameters:
-// - email: The email address of the user to retrieve.
-// Returns:
-// - nil if the user is successfully found and the User struct is populated.
-// - An error if the query execution or scan fails.
-func (u *User) GetByEmail(connection *pgx.Conn, email string) error {
-	// SQL query to select a user by GitHub ID.
-	query := `SELECT id, user_name,password,email,contact FROM users WHERE email=$1`
-	// Execute the query and scan the result into the User struct.
-	err := connection.QueryRow(context.Background(), query, email).Scan(&u.ID, &u.UserName, &u.Password, &u.Email, &u.Contact)
-	if err != nil {
-		return err // Return any errors encountered.
-	}
-	return nil // Return nil on success.
-}
-
-// GetByContact retrieves a user by their contact number from the database.
-// This method is useful for authenticating users based on their email address,
-// allowing the application to fetch user details based on their email.
-// Parameters:
-// - email: The email address of the user to retrieve.
-// Returns:
-// - nil if the user is successfully found and the User struct is populated.
-// - An error if the query execution or scan fails.
-func (u *User) GetByContact(connection *pgx.Conn, contact string) error {
-	// SQL query to select a user by GitHub ID.
-	query := `SELECT id, user_name,password,email,contact FROM users WHERE contact=$1`
-	// Execute the query and scan the result into the User struct.
-	err := connection.QueryRow(context.Background(), query, contact).Scan(&u.ID, &u.UserName, &u.Password, &u.Email, &u.Contact)
-	if err != nil {
-		return err // Return any errors encountered.
-	}
-	return nil // Return nil on success.
-}
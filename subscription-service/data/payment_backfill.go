@@ -0,0 +1,57 @@
+package data
+
+import (
+	"context"
+	"errors"
+)
+
+// BackfillResult reports what BackfillPaymentUserIDs did.
+type BackfillResult struct {
+	Linked    int // Payments whose user_id was set.
+	Unmatched int // Payment emails that belong to no user; their payments keep a NULL user_id.
+}
+
+// BackfillPaymentUserIDs links payments recorded before checkout passed the user ID to their users.
+//
+// Payments are owned by payment-service, which stores the user ID sent back by Lemon Squeezy in
+// payments.user_id. Older payments only have the email they were made with, so they are matched to
+// the user that currently has that email. users is used for the lookup because emails are encrypted
+// and only this service holds the key of their blind index. Payments that already have a user ID are
+// never changed, so the backfill can be run again, and concurrently with new payments.
+func BackfillPaymentUserIDs(ctx context.Context, db DB, users UserRepository) (BackfillResult, error) {
+	var result BackfillResult
+	rows, err := db.Query(ctx, `SELECT DISTINCT user_email FROM payments WHERE user_id IS NULL;`)
+	if err != nil {
+		return result, err
+	}
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			rows.Close()
+			return result, err
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, email := range emails {
+		user, err := users.GetByEmail(ctx, email)
+		if errors.Is(err, ErrNotFound) {
+			result.Unmatched++
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		tag, err := db.Exec(ctx, `UPDATE payments SET user_id = $1 WHERE user_email = $2 AND user_id IS NULL;`, user.ID, email)
+		if err != nil {
+			return result, err
+		}
+		result.Linked += int(tag.RowsAffected())
+	}
+	return result, nil
+}
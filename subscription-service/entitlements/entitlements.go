@@ -0,0 +1,221 @@
+// Package entitlements maps subscription plans to the features and limits they grant, and resolves
+// them for a user from the status and variant of their subscription.
+package entitlements
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"subscription-service/data"
+)
+
+// Unlimited is the limit of a feature that has no numeric limit.
+const Unlimited int64 = -1
+
+// Reasons a feature is denied.
+const (
+	ReasonNotSubscribed  = "not_subscribed"  // The user has no subscription in an entitled status, and a plan grants the feature.
+	ReasonNotInPlan      = "not_in_plan"     // The user's plan doesn't grant the feature, and another plan does.
+	ReasonUnknownFeature = "unknown_feature" // No plan grants the feature.
+)
+
+// defaultMapping is used when ENTITLEMENTS_FILE is not set. It only grants the free plan.
+//
+//go:embed default.json
+var defaultMapping []byte
+
+// Plan is a set of features granted together to the subscribers of any of its variants.
+type Plan struct {
+	Name     string           `json:"name"`     // Name of the plan, shown in upgrade hints.
+	Variants []int64          `json:"variants"` // Lemon Squeezy variant IDs whose subscribers get the plan.
+	Features map[string]int64 `json:"features"` // Features of the plan and their limits, or Unlimited.
+}
+
+// Mapping maps Lemon Squeezy variants to plans. Users get the plan of their subscription's variant while
+// the subscription is in one of EntitledStatuses, and the free plan otherwise.
+type Mapping struct {
+	Free             Plan     `json:"free"`              // Plan of users without an entitled subscription. Its variants are ignored.
+	Plans            []Plan   `json:"plans"`             // Paid plans.
+	EntitledStatuses []string `json:"entitled_statuses"` // Subscription statuses that grant the paid plan.
+	UpgradeURL       string   `json:"upgrade_url"`       // Page where users can pick a plan, returned in upgrade hints.
+
+	byVariant map[int64]*Plan
+	entitled  map[string]bool
+}
+
+// Load reads the mapping from the JSON file at path, or returns the default mapping if path is empty.
+func Load(path string) (*Mapping, error) {
+	if path == "" {
+		return Parse(defaultMapping)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading entitlements: %w", err)
+	}
+	return Parse(b)
+}
+
+// Parse decodes and validates a JSON mapping. A variant can only belong to one plan, and limits must be
+// zero or more, or Unlimited.
+func Parse(b []byte) (*Mapping, error) {
+	var m Mapping
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decoding entitlements: %w", err)
+	}
+	if m.Free.Name == "" {
+		m.Free.Name = "Free"
+	}
+	m.Free.Variants = nil
+	m.byVariant = map[int64]*Plan{}
+	m.entitled = map[string]bool{}
+	for _, status := range m.EntitledStatuses {
+		m.entitled[status] = true
+	}
+	if err := validateFeatures(m.Free); err != nil {
+		return nil, err
+	}
+	for i := range m.Plans {
+		plan := &m.Plans[i]
+		if plan.Name == "" {
+			return nil, fmt.Errorf("entitlements: plan %d has no name", i)
+		}
+		if err := validateFeatures(*plan); err != nil {
+			return nil, err
+		}
+		for _, variant := range plan.Variants {
+			if other, ok := m.byVariant[variant]; ok {
+				return nil, fmt.Errorf("entitlements: variant %d is in plans %q and %q", variant, other.Name, plan.Name)
+			}
+			m.byVariant[variant] = plan
+		}
+	}
+	return &m, nil
+}
+
+func validateFeatures(plan Plan) error {
+	for feature, limit := range plan.Features {
+		if limit < Unlimited {
+			return fmt.Errorf("entitlements: feature %q of plan %q has limit %d", feature, plan.Name, limit)
+		}
+	}
+	return nil
+}
+
+// Grant is what a user is entitled to.
+type Grant struct {
+	Plan       string           // Name of the user's plan.
+	Status     string           // Status of the user's subscription, or empty if they never subscribed.
+	VariantID  int64            // Variant of the user's subscription, or 0.
+	Subscribed bool             // Whether the subscription is in an entitled status.
+	Features   map[string]int64 // Features of the plan and their limits.
+}
+
+// Resolve returns the grant of a subscription with the given status and variant. Subscriptions to variants
+// that aren't in any plan get the free plan, but still count as subscribed.
+func (m *Mapping) Resolve(status string, variantID int64) Grant {
+	plan := &m.Free
+	subscribed := m.entitled[status]
+	if subscribed {
+		if p, ok := m.byVariant[variantID]; ok {
+			plan = p
+		}
+	}
+	return Grant{Plan: plan.Name, Status: status, VariantID: variantID, Subscribed: subscribed, Features: plan.Features}
+}
+
+// Decision is the answer to whether a grant includes a feature.
+type Decision struct {
+	Allowed      bool     // Whether the feature can be used.
+	Feature      string   // Name of the feature.
+	Limit        int64    // Limit of the feature, or Unlimited. Zero if it isn't allowed.
+	Plan         string   // Name of the user's plan.
+	Reason       string   // One of the Reason constants if the feature isn't allowed.
+	UpgradePlans []string // Plans that grant the feature, if it isn't allowed.
+	UpgradeURL   string   // Page where users can pick a plan, if it isn't allowed.
+}
+
+// Check decides whether g includes feature.
+func (m *Mapping) Check(g Grant, feature string) Decision {
+	d := Decision{Feature: feature, Plan: g.Plan}
+	if limit, ok := g.Features[feature]; ok {
+		d.Allowed, d.Limit = true, limit
+		return d
+	}
+	d.UpgradePlans, d.UpgradeURL = m.plansWith(feature), m.UpgradeURL
+	switch {
+	case len(d.UpgradePlans) == 0:
+		d.Reason = ReasonUnknownFeature
+	case !g.Subscribed:
+		d.Reason = ReasonNotSubscribed
+	default:
+		d.Reason = ReasonNotInPlan
+	}
+	return d
+}
+
+// plansWith returns the names of the paid plans that grant feature, in the order of the mapping.
+func (m *Mapping) plansWith(feature string) []string {
+	var names []string
+	for _, plan := range m.Plans {
+		if _, ok := plan.Features[feature]; ok {
+			names = append(names, plan.Name)
+		}
+	}
+	return names
+}
+
+// Entitlement is a feature a user can use, and its limit.
+type Entitlement struct {
+	Feature string `json:"feature"`
+	Limit   int64  `json:"limit"` // Unlimited (-1) if the feature has no limit.
+}
+
+// List returns the features of g, sorted by name.
+func (g Grant) List() []Entitlement {
+	list := make([]Entitlement, 0, len(g.Features))
+	for feature, limit := range g.Features {
+		list = append(list, Entitlement{Feature: feature, Limit: limit})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Feature < list[j].Feature })
+	return list
+}
+
+// ErrUnknownUser is returned for users that don't exist.
+var ErrUnknownUser = errors.New("user does not exist")
+
+// Service resolves the grants of users from their stored subscription.
+type Service struct {
+	Mapping *Mapping
+	users   data.UserRepository
+}
+
+// NewService creates a Service that reads subscriptions from users.
+func NewService(mapping *Mapping, users data.UserRepository) *Service {
+	return &Service{Mapping: mapping, users: users}
+}
+
+// ForUser returns the grant of the user with the given ID, or ErrUnknownUser.
+func (s *Service) ForUser(ctx context.Context, userID int64) (Grant, error) {
+	user, err := s.users.GetUser(ctx, userID)
+	if errors.Is(err, data.ErrNotFound) {
+		return Grant{}, ErrUnknownUser
+	}
+	if err != nil {
+		return Grant{}, err
+	}
+	return s.Mapping.Resolve(user.SubscriptionStatus, user.SubscriptionVariantID), nil
+}
+
+// Check decides whether the user with the given ID can use feature.
+func (s *Service) Check(ctx context.Context, userID int64, feature string) (Decision, error) {
+	grant, err := s.ForUser(ctx, userID)
+	if err != nil {
+		return Decision{}, err
+	}
+	return s.Mapping.Check(grant, feature), nil
+}
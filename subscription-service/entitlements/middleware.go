@@ -0,0 +1,68 @@
+package entitlements
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ContextKey is the Echo context key RequireEntitlement stores the caller's Entitlement under, so handlers
+// can enforce its limit.
+const ContextKey = "entitlement"
+
+// Denial is the response body of a request denied by RequireEntitlement.
+type Denial struct {
+	Message string   `json:"message"`
+	Feature string   `json:"feature"`
+	Plan    string   `json:"plan"`   // The caller's plan.
+	Reason  string   `json:"reason"` // One of the Reason constants.
+	Upgrade *Upgrade `json:"upgrade,omitempty"`
+}
+
+// Upgrade tells the caller which plans grant a feature they were denied.
+type Upgrade struct {
+	Plans []string `json:"plans"`
+	URL   string   `json:"url,omitempty"`
+}
+
+// RequireEntitlement returns a middleware that lets requests through only if the caller's plan grants
+// feature. It must run after a middleware that sets the caller's ID as "userID". Callers without an
+// entitled subscription are answered with 402 Payment Required, and callers whose plan lacks the feature
+// with 403 Forbidden, both with the plans that grant it.
+func (s *Service) RequireEntitlement(feature string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, ok := c.Get("userID").(int64)
+			if !ok {
+				return echo.NewHTTPError(http.StatusUnauthorized, "missing user")
+			}
+			decision, err := s.Check(c.Request().Context(), userID, feature)
+			if errors.Is(err, ErrUnknownUser) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "user does not exist")
+			}
+			if err != nil {
+				return err
+			}
+			if decision.Allowed {
+				c.Set(ContextKey, Entitlement{Feature: feature, Limit: decision.Limit})
+				return next(c)
+			}
+
+			denial := Denial{Feature: feature, Plan: decision.Plan, Reason: decision.Reason}
+			if len(decision.UpgradePlans) > 0 {
+				denial.Upgrade = &Upgrade{Plans: decision.UpgradePlans, URL: decision.UpgradeURL}
+			}
+			switch decision.Reason {
+			case ReasonNotSubscribed:
+				denial.Message = "a subscription is required to use " + feature
+				return c.JSON(http.StatusPaymentRequired, denial)
+			case ReasonNotInPlan:
+				denial.Message = "your plan does not include " + feature
+			default:
+				denial.Message = feature + " is not available on any plan"
+			}
+			return c.JSON(http.StatusForbidden, denial)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strconv"
 	"subscription-service/data"
@@ -16,7 +15,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/go-redis/redis/v8"
-	"github.com/jackc/pgx/v4"
 	"github.com/joho/godotenv"
 	"github.com/twilio/twilio-go"
 )
@@ -24,52 +22,41 @@ import (
 type ActivitySuite struct {
 	activites   activity.Activites
 	redisClient *redis.Client
-	connection  *pgx.Conn
+	users       data.UserRepository
 	userID      []int64
 }
 
-func (suite *ActivitySuite) SetupSuite() {
-	// db connection
-	url := "postgres://root@localhost:26257/defaultdb?sslmode=disable" // Database connection URL.
-	conn, err := pgx.Connect(context.Background(), url)                // Attempt to connect to the database.
-	if err != nil {
-		log.Fatalf("Failed to connect to the database: %v", err)
-	}
-	fmt.Println("Connected to the database")
-	ensureTableExists(conn) // Ensure the table exists in the database.
-	suite.connection = conn
-
-	// initializing new redis client
-	redis, err := data.NewRedisClient("localhost:6379", "")
-	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
-
-	}
+// SetupSuite creates the activities with an in-memory user repository and the real SES, Twilio and Redis clients.
+// It returns an error instead of failing so the suite can be skipped when those services are not configured.
+func (suite *ActivitySuite) SetupSuite() error {
+	suite.users = data.NewMemoryUserRepository()
 
 	// sns client
 	ses, err := NewSESClient()
 	if err != nil {
-		log.Fatalf("Failed to create SNS client: %v", err)
-
+		return fmt.Errorf("failed to create SNS client: %w", err)
 	}
 	// twilio client
 	twilio, err := TwilioClient()
 	if err != nil {
-		log.Fatalf("Failed to create Twilio client: %v", err)
-
+		return fmt.Errorf("failed to create Twilio client: %w", err)
 	}
-	suite.redisClient = redis
-	suite.activites = activity.NewActivities(ses, twilio, redis, conn)
 
+	// initializing new redis client
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		redisClient.Close()
+		return fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	suite.redisClient = redisClient
+	suite.activites = activity.NewActivities(ses, twilio, redisClient, suite.users, nil, "")
+	return nil
 }
 
 func (suite *ActivitySuite) TeardownSuite() {
 	if suite.redisClient != nil {
 		suite.redisClient.Close()
 	}
-	if suite.connection != nil {
-		suite.connection.Close(context.Background())
-	}
 }
 
 // get user activity test
@@ -178,8 +165,7 @@ func (suite *ActivitySuite) TestUpdateSubscriptionActitvity(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		u := data.User{}
-		err := u.UpdateUserSubscription(suite.connection, tc.id, tc.subscriptionStatus, tc.subscriptionId, tc.subscriptionType)
+		err := suite.users.UpdateUserSubscription(context.Background(), tc.id, tc.subscriptionStatus, tc.subscriptionId, 0, tc.subscriptionType)
 
 		if err != nil && !tc.expectedError {
 			t.Errorf("UpdateSubscription() error = %v, wantErr %v", err, tc.expectedError)
@@ -362,7 +348,7 @@ func (suite *ActivitySuite) TestInsertUser(t *testing.T) {
 				Verified:    tc.user.Verified,
 			}
 
-			err := u.InsertUser(suite.connection, u)
+			id, err := suite.users.InsertUser(context.Background(), u)
 			if err != nil && !tc.wantErr {
 				t.Errorf("InsertUser() error = %v, wantErr %v", err, tc.wantErr)
 				return
@@ -371,14 +357,16 @@ func (suite *ActivitySuite) TestInsertUser(t *testing.T) {
 				t.Errorf("InsertUser() error = %v, wantErr %v", err, tc.wantErr)
 				return
 			}
-			suite.userID = append(suite.userID, u.ID)
+			suite.userID = append(suite.userID, id)
 		})
 	}
 
 }
 func TestActivitySuite(t *testing.T) {
 	activity_suite := ActivitySuite{}
-	activity_suite.SetupSuite()
+	if err := activity_suite.SetupSuite(); err != nil {
+		t.Skipf("External services are not available: %v", err)
+	}
 	defer activity_suite.TeardownSuite()
 
 	t.Run("CreateUser", activity_suite.TestInsertUser)
@@ -0,0 +1,66 @@
+package test
+
+import (
+	"context"
+	"subscription-service/data"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ensurePaymentsTableExists creates the columns of payment-service's payments table that the backfill uses.
+func ensurePaymentsTableExists(t *testing.T, conn *pgx.Conn) {
+	query := `
+    DROP TABLE IF EXISTS payments;
+    CREATE TABLE payments (
+        id SERIAL PRIMARY KEY,
+        user_id INT8,
+        user_email VARCHAR(255) NOT NULL
+    );`
+	if _, err := conn.Exec(context.Background(), query); err != nil {
+		t.Fatalf("Failed to create payments table: %v", err)
+	}
+}
+
+func TestBackfillPaymentUserIDs(t *testing.T) {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, "postgres://root@localhost:26257/defaultdb?sslmode=disable")
+	if err != nil {
+		t.Skipf("CockroachDB is not available: %v", err)
+	}
+	defer conn.Close(ctx)
+	ensureTableExists(conn)
+	ensurePaymentsTableExists(t, conn)
+
+	models := data.NewCockroachModels(conn, newTestKeyRing("k1"))
+	id, err := models.Users.InsertUser(ctx, data.User{UserName: "backfill", GithubName: "backfillGithub", FirstName: "Back", LastName: "Fill", Email: "backfill@example.com", Contact: "5556667778"})
+	if err != nil {
+		t.Fatalf("InsertUser() error = %v", err)
+	}
+	_, err = conn.Exec(ctx, `INSERT INTO payments (user_id, user_email) VALUES
+        (NULL, 'backfill@example.com'), (NULL, 'backfill@example.com'), (NULL, 'nobody@example.com'), (12345, 'backfill@example.com');`)
+	if err != nil {
+		t.Fatalf("Failed to insert payments: %v", err)
+	}
+
+	result, err := data.BackfillPaymentUserIDs(ctx, conn, models.Users)
+	if err != nil {
+		t.Fatalf("BackfillPaymentUserIDs() error = %v", err)
+	}
+	if result.Linked != 2 || result.Unmatched != 1 {
+		t.Errorf("BackfillPaymentUserIDs() = %+v, want 2 linked and 1 unmatched", result)
+	}
+	// Payments that already have a user ID are left alone.
+	var linked, kept int
+	if err := conn.QueryRow(ctx, `SELECT count(*) FILTER (WHERE user_id = $1), count(*) FILTER (WHERE user_id = 12345) FROM payments;`, id).Scan(&linked, &kept); err != nil {
+		t.Fatalf("Failed to count payments: %v", err)
+	}
+	if linked != 2 || kept != 1 {
+		t.Errorf("payments linked to the user = %d, kept = %d, want 2 and 1", linked, kept)
+	}
+
+	// Running the backfill again changes nothing.
+	if result, err := data.BackfillPaymentUserIDs(ctx, conn, models.Users); err != nil || result.Linked != 0 {
+		t.Errorf("second BackfillPaymentUserIDs() = %+v, error %v, want nothing linked", result, err)
+	}
+}
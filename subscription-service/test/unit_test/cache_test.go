@@ -0,0 +1,136 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+// newCachedModels returns in-memory models whose users are served through a cache.
+func newCachedModels() (data.Models, *data.CachedUserRepository) {
+	return newCachedModelsWith(data.NewMemoryCache())
+}
+
+// newCachedModelsWith returns in-memory models whose users are served through cache.
+func newCachedModelsWith(cache data.Cache) (data.Models, *data.CachedUserRepository) {
+	models := data.NewMemoryModels()
+	users := data.NewCachedUserRepository(models.Users, cache, newTestKeyRing("k1"), time.Minute)
+	return models.WithUserCache(users), users
+}
+
+// recordingCache is a memory cache that records every key and value set in it.
+type recordingCache struct {
+	*data.MemoryCache
+	set map[string][]byte
+}
+
+func (c *recordingCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.set[key] = value
+	return c.MemoryCache.Set(ctx, key, value, ttl)
+}
+
+// TestCachedUserSuite checks that the cache doesn't change what the repository returns.
+func TestCachedUserSuite(t *testing.T) {
+	models, _ := newCachedModels()
+	user_suite := UserTestSuite{models: models}
+	user_suite.run(t)
+}
+
+func TestUserCache(t *testing.T) {
+	ctx := context.Background()
+	models, users := newCachedModels()
+
+	id, err := models.Users.InsertUser(ctx, data.User{UserName: "cached", GithubName: "cachedGithub", FirstName: "Cache", LastName: "User", Email: "cached@example.com", Contact: "1112223334"})
+	if err != nil {
+		t.Fatalf("InsertUser() error = %v", err)
+	}
+
+	// The first lookup misses and fills the cache for lookups by ID and by email.
+	if _, err := models.Users.GetUser(ctx, id); err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if _, err := models.Users.GetUser(ctx, id); err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if u, err := models.Users.GetByEmail(ctx, "cached@example.com"); err != nil || u.ID != id {
+		t.Fatalf("GetByEmail() = %+v, error %v", u, err)
+	}
+	if got, want := users.Stats(), (data.CacheStats{Hits: 2, Misses: 1}); got != want {
+		t.Errorf("Stats() after reads = %+v, want %+v", got, want)
+	}
+
+	// An update removes the user from the cache, so the next read sees it.
+	if err := models.Users.UpdateUser(ctx, id, data.User{Bio: "Updated"}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if u, err := models.Users.GetUser(ctx, id); err != nil || u.Bio != "Updated" {
+		t.Errorf("GetUser() after UpdateUser got bio %q, error %v", u.Bio, err)
+	}
+
+	// So does an update made in a committed transaction.
+	err = models.RunInTx(ctx, func(tx data.Models) error {
+		return tx.Users.UpdateUserSubscription(ctx, id, "active", 42, 7, "monthly")
+	})
+	if err != nil {
+		t.Fatalf("RunInTx() error = %v", err)
+	}
+	if u, err := models.Users.GetByEmail(ctx, "cached@example.com"); err != nil || u.SubscriptionStatus != "active" {
+		t.Errorf("GetByEmail() after RunInTx got status %q, error %v", u.SubscriptionStatus, err)
+	}
+
+	// A changed email must not be served from the old email's entry.
+	if err := models.Users.UpdateUser(ctx, id, data.User{Email: "renamed@example.com"}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if _, err := models.Users.GetByEmail(ctx, "cached@example.com"); err == nil {
+		t.Errorf("GetByEmail() with old email found the user after it changed")
+	}
+
+	// A deleted user is no longer served from the cache.
+	if err := models.Users.DeleteUser(ctx, id); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if _, err := models.Users.GetUser(ctx, id); err == nil {
+		t.Errorf("GetUser() found the user after DeleteUser")
+	}
+}
+
+func TestUserCacheHoldsNoSecrets(t *testing.T) {
+	ctx := context.Background()
+	cache := &recordingCache{MemoryCache: data.NewMemoryCache(), set: map[string][]byte{}}
+	models, users := newCachedModelsWith(cache)
+
+	id, err := models.Users.InsertUser(ctx, data.User{UserName: "secret", GithubName: "secretGithub", FirstName: "Secret", LastName: "User", Email: "secret@example.com", Contact: "9876543210", Password: "$2a$10$secrethash"})
+	if err != nil {
+		t.Fatalf("InsertUser() error = %v", err)
+	}
+	stored, err := models.Users.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if len(cache.set) == 0 {
+		t.Fatalf("GetUser() cached nothing")
+	}
+	for key, value := range cache.set {
+		for _, secret := range []string{stored.Email, stored.Contact, stored.Password, "secret@"} {
+			if strings.Contains(key, secret) || strings.Contains(string(value), secret) {
+				t.Errorf("cache entry %q = %q holds %q", key, value, secret)
+			}
+		}
+	}
+
+	// Lookups by email and contact are still answered from the cache, with the secrets decrypted.
+	for name, lookup := range map[string]func() (data.User, error){
+		"GetByEmail":   func() (data.User, error) { return models.Users.GetByEmail(ctx, stored.Email) },
+		"GetByContact": func() (data.User, error) { return models.Users.GetByContact(ctx, stored.Contact) },
+	} {
+		if u, err := lookup(); err != nil || u != stored {
+			t.Errorf("%s() = %+v, error %v, want %+v", name, u, err, stored)
+		}
+	}
+	if got, want := users.Stats(), (data.CacheStats{Hits: 2, Misses: 1}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
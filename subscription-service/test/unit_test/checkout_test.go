@@ -0,0 +1,119 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"subscription-service/clients"
+	"testing"
+)
+
+func TestCreateCheckout(t *testing.T) {
+	var got struct {
+		Data struct {
+			Type       string `json:"type"`
+			Attributes struct {
+				CheckoutData struct {
+					Email  string            `json:"email"`
+					Name   string            `json:"name"`
+					Custom map[string]string `json:"custom"`
+				} `json:"checkout_data"`
+				ProductOptions struct {
+					RedirectURL string `json:"redirect_url"`
+				} `json:"product_options"`
+			} `json:"attributes"`
+			Relationships map[string]struct {
+				Data struct {
+					Type string `json:"type"`
+					ID   string `json:"id"`
+				} `json:"data"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/checkouts" || r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding checkout request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		if got.Data.Relationships["variant"].Data.ID != "42" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"status":"404","detail":"Variant not found."}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"data":{"type":"checkouts","id":"1","attributes":{"url":"https://example.lemonsqueezy.com/checkout/custom/abc"}}}`))
+	}))
+	defer server.Close()
+
+	client := &clients.CheckoutClient{APIKey: "key", StoreID: "7", BaseURL: server.URL, SuccessURL: "https://example.com/billing/success"}
+	link, err := client.CreateCheckout(context.Background(), clients.Checkout{VariantID: "42", UserID: 9007199254740993, Email: "jane@example.com", Name: "Jane Doe"})
+	if err != nil {
+		t.Fatalf("CreateCheckout() error = %v", err)
+	}
+	if link != "https://example.lemonsqueezy.com/checkout/custom/abc" {
+		t.Errorf("CreateCheckout() = %q, want the URL of the created checkout", link)
+	}
+	attributes := got.Data.Attributes
+	if got.Data.Type != "checkouts" || got.Data.Relationships["store"].Data.ID != "7" {
+		t.Errorf("CreateCheckout() sent %+v, want a checkout for store 7", got.Data)
+	}
+	if attributes.CheckoutData.Custom["user_id"] != "9007199254740993" {
+		t.Errorf("CreateCheckout() custom data = %v, want user_id 9007199254740993", attributes.CheckoutData.Custom)
+	}
+	if attributes.CheckoutData.Email != "jane@example.com" || attributes.CheckoutData.Name != "Jane Doe" {
+		t.Errorf("CreateCheckout() prefilled %q <%s>, want Jane Doe <jane@example.com>", attributes.CheckoutData.Name, attributes.CheckoutData.Email)
+	}
+	if attributes.ProductOptions.RedirectURL != "https://example.com/billing/success" {
+		t.Errorf("CreateCheckout() redirect_url = %q, want the success URL", attributes.ProductOptions.RedirectURL)
+	}
+
+	if _, err := client.CreateCheckout(context.Background(), clients.Checkout{VariantID: "43", UserID: 1}); !errors.Is(err, clients.ErrInvalidCheckout) {
+		t.Errorf("CreateCheckout() of an unknown variant error = %v, want ErrInvalidCheckout", err)
+	}
+	if _, err := client.CreateCheckout(context.Background(), clients.Checkout{VariantID: "../stores", UserID: 1}); !errors.Is(err, clients.ErrInvalidCheckout) {
+		t.Errorf("CreateCheckout() with an invalid variant error = %v, want ErrInvalidCheckout", err)
+	}
+	unauthorized := *client
+	unauthorized.APIKey = "wrong"
+	if _, err := unauthorized.CreateCheckout(context.Background(), clients.Checkout{VariantID: "42", UserID: 1}); err == nil || errors.Is(err, clients.ErrInvalidCheckout) {
+		t.Errorf("CreateCheckout() with a wrong API key error = %v, want a failure", err)
+	}
+}
+
+func TestUpdatePaymentMethodURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		if r.URL.Path != "/v1/subscriptions/5" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"status":"404","detail":"Subscription not found."}]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"type":"subscriptions","id":"5","attributes":{"urls":{"update_payment_method":"https://example.lemonsqueezy.com/subscription/5/payment-details?signature=abc"}}}}`))
+	}))
+	defer server.Close()
+
+	client := &clients.CheckoutClient{APIKey: "key", BaseURL: server.URL}
+	link, err := client.UpdatePaymentMethodURL(context.Background(), "5")
+	if err != nil {
+		t.Fatalf("UpdatePaymentMethodURL() error = %v", err)
+	}
+	if link != "https://example.lemonsqueezy.com/subscription/5/payment-details?signature=abc" {
+		t.Errorf("UpdatePaymentMethodURL() = %q, want the subscription's signed link", link)
+	}
+	if _, err := client.UpdatePaymentMethodURL(context.Background(), "6"); err == nil {
+		t.Errorf("UpdatePaymentMethodURL() of an unknown subscription succeeded")
+	}
+	if _, err := client.UpdatePaymentMethodURL(context.Background(), "../stores"); err == nil {
+		t.Errorf("UpdatePaymentMethodURL() with an invalid subscription succeeded")
+	}
+}
@@ -0,0 +1,164 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"subscription-service/data"
+	"subscription-service/entitlements"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func loadExampleEntitlements(t *testing.T) *entitlements.Mapping {
+	t.Helper()
+	mapping, err := entitlements.Load("../../entitlements/example.json")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	return mapping
+}
+
+func TestEntitlementsResolve(t *testing.T) {
+	mapping := loadExampleEntitlements(t)
+	tests := []struct {
+		name       string
+		status     string
+		variantID  int64
+		plan       string
+		subscribed bool
+	}{
+		{"never subscribed", "", 0, "Free", false},
+		{"active", "active", 100003, "Pro", true},
+		{"cancelled until the end of the period", "cancelled", 100001, "Starter", true},
+		{"expired", "expired", 100003, "Free", false},
+		{"unpaid", "unpaid", 100003, "Free", false},
+		{"variant in no plan", "active", 999, "Free", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			grant := mapping.Resolve(tc.status, tc.variantID)
+			if grant.Plan != tc.plan || grant.Subscribed != tc.subscribed {
+				t.Errorf("Resolve(%q, %d) = plan %q, subscribed %v, want %q, %v", tc.status, tc.variantID, grant.Plan, grant.Subscribed, tc.plan, tc.subscribed)
+			}
+		})
+	}
+
+	want := []entitlements.Entitlement{{Feature: "api_requests", Limit: 10000}, {Feature: "projects", Limit: 5}}
+	if got := mapping.Resolve("active", 100002).List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %+v, want %+v", got, want)
+	}
+}
+
+func TestEntitlementsCheck(t *testing.T) {
+	mapping := loadExampleEntitlements(t)
+	pro, starter, free := mapping.Resolve("active", 100004), mapping.Resolve("active", 100001), mapping.Resolve("expired", 100001)
+
+	if d := mapping.Check(pro, "export"); !d.Allowed || d.Limit != entitlements.Unlimited {
+		t.Errorf("Check(Pro, export) = %+v, want allowed without limit", d)
+	}
+	if d := mapping.Check(free, "projects"); !d.Allowed || d.Limit != 1 {
+		t.Errorf("Check(Free, projects) = %+v, want allowed with limit 1", d)
+	}
+	if d := mapping.Check(starter, "export"); d.Allowed || d.Reason != entitlements.ReasonNotInPlan || !reflect.DeepEqual(d.UpgradePlans, []string{"Pro"}) {
+		t.Errorf("Check(Starter, export) = %+v, want not_in_plan with Pro as upgrade", d)
+	}
+	if d := mapping.Check(free, "api_requests"); d.Allowed || d.Reason != entitlements.ReasonNotSubscribed || len(d.UpgradePlans) != 2 || d.UpgradeURL == "" {
+		t.Errorf("Check(Free, api_requests) = %+v, want not_subscribed with both plans as upgrade", d)
+	}
+	if d := mapping.Check(pro, "teleport"); d.Allowed || d.Reason != entitlements.ReasonUnknownFeature || len(d.UpgradePlans) != 0 {
+		t.Errorf("Check(Pro, teleport) = %+v, want unknown_feature", d)
+	}
+}
+
+func TestEntitlementsParse(t *testing.T) {
+	invalid := map[string]string{
+		"variant in two plans": `{"plans": [{"name": "A", "variants": [1]}, {"name": "B", "variants": [1]}]}`,
+		"plan without a name":  `{"plans": [{"variants": [1]}]}`,
+		"negative limit":       `{"plans": [{"name": "A", "features": {"seats": -2}}]}`,
+		"not JSON":             `plans`,
+	}
+	for name, mapping := range invalid {
+		if _, err := entitlements.Parse([]byte(mapping)); err == nil {
+			t.Errorf("Parse() with %s succeeded", name)
+		}
+	}
+
+	// Without ENTITLEMENTS_FILE, everyone gets the free plan.
+	mapping, err := entitlements.Load("")
+	if err != nil {
+		t.Fatalf("Load() of the default mapping error = %v", err)
+	}
+	if grant := mapping.Resolve("active", 100003); grant.Plan != "Free" || !grant.Subscribed {
+		t.Errorf("Resolve() with the default mapping = %+v, want Free", grant)
+	}
+}
+
+func TestRequireEntitlement(t *testing.T) {
+	ctx := context.Background()
+	users := data.NewMemoryUserRepository()
+	service := entitlements.NewService(loadExampleEntitlements(t), users)
+
+	newUser := func(n int, status string, variantID int64) int64 {
+		id, err := users.InsertUser(ctx, data.User{
+			UserName:   "jane",
+			GithubName: fmt.Sprint("jane", n),
+			FirstName:  "Jane",
+			LastName:   "Doe",
+			Email:      fmt.Sprintf("jane%d@example.com", n),
+			Contact:    fmt.Sprintf("987654321%d", n),
+			Password:   "secret",
+			ExpiresAt:  time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("InsertUser() error = %v", err)
+		}
+		if status != "" {
+			if err := users.UpdateUserSubscription(ctx, id, status, float64(n), variantID, "Plan"); err != nil {
+				t.Fatalf("UpdateUserSubscription() error = %v", err)
+			}
+		}
+		return id
+	}
+	pro, starter, lapsed := newUser(1, "active", 100003), newUser(2, "on_trial", 100001), newUser(3, "expired", 100003)
+
+	var limit int64
+	handler := service.RequireEntitlement("export")(func(c echo.Context) error {
+		limit = c.Get(entitlements.ContextKey).(entitlements.Entitlement).Limit
+		return c.NoContent(http.StatusNoContent)
+	})
+	call := func(userID int64) (int, entitlements.Denial) {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/export", nil), rec)
+		c.Set("userID", userID)
+		if err := handler(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		var denial entitlements.Denial
+		if rec.Code != http.StatusNoContent {
+			json.Unmarshal(rec.Body.Bytes(), &denial)
+		}
+		return rec.Code, denial
+	}
+
+	if code, _ := call(pro); code != http.StatusNoContent || limit != entitlements.Unlimited {
+		t.Errorf("Pro user: status %d, limit %d, want 204 without limit", code, limit)
+	}
+	code, denial := call(starter)
+	if code != http.StatusForbidden || denial.Reason != entitlements.ReasonNotInPlan || denial.Upgrade == nil || !reflect.DeepEqual(denial.Upgrade.Plans, []string{"Pro"}) {
+		t.Errorf("Starter user: status %d, %+v, want 403 with an upgrade to Pro", code, denial)
+	}
+	code, denial = call(lapsed)
+	if code != http.StatusPaymentRequired || denial.Reason != entitlements.ReasonNotSubscribed || denial.Plan != "Free" || denial.Upgrade == nil {
+		t.Errorf("Lapsed user: status %d, %+v, want 402 with an upgrade hint", code, denial)
+	}
+	if code, _ := call(42); code != http.StatusUnauthorized {
+		t.Errorf("Unknown user: status %d, want 401", code)
+	}
+}
@@ -2,34 +2,44 @@ package test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"subscription-service/data"
 	"testing"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 )
 
+// UserTestSuite is the conformance suite every data.UserRepository implementation must pass.
+// The repositories are reached through data.Models so that transactions can be tested too.
 type UserTestSuite struct {
-	connection *pgx.Conn
+	models     data.Models
+	connection *pgx.Conn // connection is only set when running against CockroachDB.
 	userID     []int64
 }
 
-func (suite *UserTestSuite) SetupSuite() {
+// SetupSuite connects to the local CockroachDB and resets the users table.
+// It returns an error instead of failing so the suite can be skipped when no database is running.
+func (suite *UserTestSuite) SetupSuite() error {
 	url := "postgres://root@localhost:26257/defaultdb?sslmode=disable" // Database connection URL.
 	conn, err := pgx.Connect(context.Background(), url)                // Attempt to connect to the database.
 	if err != nil {
-		log.Panic(err) // Panic if the connection fails.
+		return err
 	}
 	fmt.Println("Connected to the database")
 	ensureTableExists(conn) // Ensure the table exists in the database.
 	suite.connection = conn // Assign the connection to the global variable.
+	suite.models = data.NewCockroachModels(conn, newTestKeyRing("k1"))
+	return nil
 }
 
 func (suite *UserTestSuite) TeardownSuite() {
-	suite.connection.Close(context.Background())
-
+	if suite.connection != nil {
+		suite.connection.Close(context.Background())
+	}
 }
 
 func ensureTableExists(conn *pgx.Conn) {
@@ -45,14 +55,18 @@ func ensureTableExists(conn *pgx.Conn) {
         avatar_url TEXT,
         access_token TEXT,
         bio VARCHAR(500),
-        email VARCHAR(255) NOT NULL UNIQUE CHECK (email ~* '^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$'),
+        email STRING NOT NULL UNIQUE,
+        email_index BYTES UNIQUE,
         expires_at TIMESTAMP NOT NULL,
         password VARCHAR(255) NOT NULL,
-        contact VARCHAR(255) UNIQUE CHECK (contact ~ '^\+91[0-9]{10}$'),
+        contact STRING UNIQUE,
+        contact_index BYTES UNIQUE,
         verified BOOLEAN DEFAULT FALSE,
         subscription_status VARCHAR(255),
         subscription_id FLOAT UNIQUE,
-        subscription_type VARCHAR(255)
+        subscription_type VARCHAR(255),
+        subscription_variant_id INT8,
+        version INT8 NOT NULL DEFAULT 1
     );`
 
 	if _, err := conn.Exec(context.Background(), query); err != nil {
@@ -282,7 +296,7 @@ func (suite *UserTestSuite) TestInsertUser(t *testing.T) {
 				Verified:    tc.user.Verified,
 			}
 
-			err := u.InsertUser(suite.connection, u)
+			id, err := suite.models.Users.InsertUser(context.Background(), u)
 			if err != nil && !tc.wantErr {
 				t.Errorf("InsertUser() error = %v, wantErr %v", err, tc.wantErr)
 				return
@@ -291,7 +305,7 @@ func (suite *UserTestSuite) TestInsertUser(t *testing.T) {
 				t.Errorf("InsertUser() error = %v, wantErr %v", err, tc.wantErr)
 				return
 			}
-			suite.userID = append(suite.userID, u.ID)
+			suite.userID = append(suite.userID, id)
 		})
 	}
 
@@ -332,9 +346,7 @@ func (suite *UserTestSuite) TestGetUser(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			u := data.User{}
-
-			err := u.GetUser(suite.connection, tc.userID)
+			u, err := suite.models.Users.GetUser(context.Background(), tc.userID)
 			if err != nil && !tc.wantErr {
 				t.Errorf("GetUser() error = %v, wantErr %v", err, tc.wantErr)
 				return
@@ -443,8 +455,7 @@ func (suite *UserTestSuite) TestUpdateUser(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			u := data.User{}
-			err := u.UpdateUser(suite.connection, tc.userID, tc.update)
+			err := suite.models.Users.UpdateUser(context.Background(), tc.userID, tc.update)
 			if err != nil && !tc.wantErr {
 				t.Errorf("UpdateUser() error = %v, wantErr %v", err, tc.wantErr)
 				return
@@ -499,8 +510,7 @@ func (suite *UserTestSuite) TestDeleteUser(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			u := data.User{}
-			err := u.DeleteUser(suite.connection, tc.userID)
+			err := suite.models.Users.DeleteUser(context.Background(), tc.userID)
 			t.Log(err)
 			if err != nil && !tc.wantErr {
 				t.Errorf("DeleteUser() error = %v, wantErr %v", err, tc.wantErr)
@@ -513,7 +523,7 @@ func (suite *UserTestSuite) TestDeleteUser(t *testing.T) {
 			}
 
 			if err == nil {
-				err = u.GetUser(suite.connection, tc.userID)
+				_, err = suite.models.Users.GetUser(context.Background(), tc.userID)
 				if err == nil {
 					t.Errorf("DeleteUser() user with ID %v still exists", tc.userID)
 				}
@@ -575,8 +585,7 @@ func (suite *UserTestSuite) UpdateSubscription(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		u := data.User{}
-		err := u.UpdateUserSubscription(suite.connection, tc.id, tc.subscriptionStatus, tc.subscriptionId, tc.subscriptionType)
+		err := suite.models.Users.UpdateUserSubscription(context.Background(), tc.id, tc.subscriptionStatus, tc.subscriptionId, 0, tc.subscriptionType)
 
 		if err != nil && !tc.expectedError {
 			t.Errorf("UpdateSubscription() error = %v, wantErr %v", err, tc.expectedError)
@@ -619,8 +628,7 @@ func (suite *UserTestSuite) TestGetUserByEmail(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			u := data.User{}
-			err := u.GetByEmail(suite.connection, tc.email)
+			u, err := suite.models.Users.GetByEmail(context.Background(), tc.email)
 			if (err != nil) != tc.wantErr {
 				t.Errorf("GetUserByEmail() for email %v, error = %v, wantErr %v", tc.email, err, tc.wantErr)
 			}
@@ -662,8 +670,7 @@ func (suite *UserTestSuite) TestGetUserByContact(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			u := data.User{}
-			err := u.GetByContact(suite.connection, tc.contact)
+			u, err := suite.models.Users.GetByContact(context.Background(), tc.contact)
 			if (err != nil) != tc.wantErr {
 				t.Errorf("GetUserByContact() for contact %v, error = %v, wantErr %v", tc.contact, err, tc.wantErr)
 			}
@@ -675,16 +682,119 @@ func (suite *UserTestSuite) TestGetUserByContact(t *testing.T) {
 	}
 }
 
+func (suite *UserTestSuite) TestUpdateUserVersion(t *testing.T) {
+	ctx := context.Background()
+	id := suite.userID[1]
+
+	before, err := suite.models.Users.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+
+	// An update at the current version applies and increments the version.
+	if err := suite.models.Users.UpdateUser(ctx, id, data.User{Bio: "First writer", Version: before.Version}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	after, err := suite.models.Users.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if after.Version != before.Version+1 || after.Bio != "First writer" {
+		t.Errorf("UpdateUser() got version %d and bio %q, want version %d and bio %q", after.Version, after.Bio, before.Version+1, "First writer")
+	}
+
+	// A second writer that read the same version must not overwrite the first one.
+	err = suite.models.Users.UpdateUser(ctx, id, data.User{Bio: "Second writer", Version: before.Version})
+	if !errors.Is(err, data.ErrConflict) {
+		t.Errorf("UpdateUser() with stale version error = %v, want %v", err, data.ErrConflict)
+	}
+	if u, err := suite.models.Users.GetUser(ctx, id); err != nil || u.Bio != "First writer" {
+		t.Errorf("UpdateUser() with stale version got bio %q, error %v", u.Bio, err)
+	}
+
+	// A missing user is reported as not found, not as a conflict.
+	err = suite.models.Users.UpdateUser(ctx, 999, data.User{Bio: "Nobody", Version: 1})
+	if !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("UpdateUser() on missing user error = %v, want %v", err, data.ErrNotFound)
+	}
+}
+
+func (suite *UserTestSuite) TestRunInTx(t *testing.T) {
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	// A failing transaction must leave no trace.
+	err := suite.models.RunInTx(ctx, func(tx data.Models) error {
+		if err := tx.Users.UpdateUser(ctx, suite.userID[1], data.User{Bio: "Rolled back"}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, errAbort)
+	}
+	if u, err := suite.models.Users.GetUser(ctx, suite.userID[1]); err != nil || u.Bio == "Rolled back" {
+		t.Errorf("RunInTx() rollback got bio %q, error %v", u.Bio, err)
+	}
+
+	// A successful transaction, including a nested one, must be committed.
+	err = suite.models.RunInTx(ctx, func(tx data.Models) error {
+		return tx.RunInTx(ctx, func(tx data.Models) error {
+			return tx.Users.UpdateUser(ctx, suite.userID[1], data.User{Bio: "Committed"})
+		})
+	})
+	if err != nil {
+		t.Fatalf("RunInTx() error = %v", err)
+	}
+	if u, err := suite.models.Users.GetUser(ctx, suite.userID[1]); err != nil || u.Bio != "Committed" {
+		t.Errorf("RunInTx() commit got bio %q, error %v", u.Bio, err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"SerializationFailure", &pgconn.PgError{Code: "40001"}, true},
+		{"WrappedSerializationFailure", fmt.Errorf("update failed: %w", &pgconn.PgError{Code: "40001"}), true},
+		{"UniqueViolation", &pgconn.PgError{Code: "23505"}, false},
+		{"NotFound", data.ErrNotFound, false},
+		{"Nil", nil, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := data.IsRetryable(tc.err); got != tc.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+// run executes the suite's tests in the order they depend on each other.
+func (suite *UserTestSuite) run(t *testing.T) {
+	t.Run("TestInsertUser", suite.TestInsertUser)
+	t.Run("TestGetUser", suite.TestGetUser)
+	t.Run("UpdateSubscription", suite.UpdateSubscription)
+	t.Run("TestGetUserByEmail", suite.TestGetUserByEmail)
+	t.Run("TestGetUserByContact", suite.TestGetUserByContact)
+	t.Run("TestUpdateUser", suite.TestUpdateUser)
+	t.Run("TestUpdateUserVersion", suite.TestUpdateUserVersion)
+	t.Run("TestRunInTx", suite.TestRunInTx)
+	t.Run("TestDeleteUser", suite.TestDeleteUser)
+}
+
 func TestUserSuite(t *testing.T) {
+	user_suite := UserTestSuite{models: data.NewMemoryModels()}
+	user_suite.run(t)
+}
+
+func TestCockroachUserSuite(t *testing.T) {
 	user_suite := UserTestSuite{}
-	user_suite.SetupSuite()
+	if err := user_suite.SetupSuite(); err != nil {
+		t.Skipf("CockroachDB is not available: %v", err)
+	}
 	defer user_suite.TeardownSuite()
-	t.Run("TestInsertUser", user_suite.TestInsertUser)
-	t.Run("TestGetUser", user_suite.TestGetUser)
-	t.Run("UpdateSubscription", user_suite.UpdateSubscription)
-	t.Run("TestGetUserByEmail", user_suite.TestGetUserByEmail)
-	t.Run("TestGetUserByContact", user_suite.TestGetUserByContact)
-	t.Run("TestUpdateUser", user_suite.TestUpdateUser)
-	t.Run("TestDeleteUser", user_suite.TestDeleteUser)
-
+	user_suite.run(t)
 }
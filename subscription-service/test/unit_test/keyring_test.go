@@ -0,0 +1,197 @@
+package test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"subscription-service/data"
+)
+
+// This file is kept identical in the unit tests of payment-service and subscription-service, like
+// data/keyring.go, apart from the module imported above. TestKeyRingCopiesMatch checks both.
+
+// testKeys are fixed keys for tests; every key ring built from them shares the blind index key.
+var testKeys = map[string][]byte{
+	"k1": bytes.Repeat([]byte{1}, 32),
+	"k2": bytes.Repeat([]byte{2}, 32),
+}
+
+// testIndexKey is the blind index key of the key rings built by newTestKeyRing.
+var testIndexKey = bytes.Repeat([]byte{9}, 32)
+
+// newTestKeyRing returns a key ring holding testKeys with the given key active.
+func newTestKeyRing(active string) *data.KeyRing {
+	keys, err := data.NewKeyRing(active, testKeys, testIndexKey)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+func TestKeyRingEncrypt(t *testing.T) {
+	keys := newTestKeyRing("k1")
+
+	ciphertext, err := keys.Encrypt("users.email", "john.doe@example.com")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	if !strings.HasPrefix(ciphertext, keys.ActivePrefix()) || strings.Contains(ciphertext, "john.doe") {
+		t.Errorf("Encrypt() = %q, want ciphertext with prefix %q", ciphertext, keys.ActivePrefix())
+	}
+	if again, _ := keys.Encrypt("users.email", "john.doe@example.com"); again == ciphertext {
+		t.Errorf("Encrypt() returned the same ciphertext twice")
+	}
+	if got, err := keys.Decrypt("users.email", ciphertext); err != nil || got != "john.doe@example.com" {
+		t.Errorf("Decrypt() = %q, error %v", got, err)
+	}
+
+	// A ciphertext can't be decrypted as the value of another column.
+	if _, err := keys.Decrypt("payments.card_last_four", ciphertext); err == nil {
+		t.Errorf("Decrypt() of another column's ciphertext succeeded")
+	}
+	// Values written before encryption are returned as they are.
+	if got, err := keys.Decrypt("payments.card_last_four", "1234"); err != nil || got != "1234" {
+		t.Errorf("Decrypt() of plaintext = %q, error %v", got, err)
+	}
+	if got, err := keys.Encrypt("users.contact", ""); err != nil || got != "" {
+		t.Errorf("Encrypt() of empty value = %q, error %v", got, err)
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	old := newTestKeyRing("k1")
+	ciphertext, err := old.Encrypt("payments.card_last_four", "4242")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	rotated := newTestKeyRing("k2")
+	if strings.HasPrefix(ciphertext, rotated.ActivePrefix()) {
+		t.Errorf("ciphertext %q already has the prefix of the new active key", ciphertext)
+	}
+	if got, err := rotated.Decrypt("payments.card_last_four", ciphertext); err != nil || got != "4242" {
+		t.Errorf("Decrypt() after rotation = %q, error %v", got, err)
+	}
+
+	// Once k1 is removed from the ring, its values can't be decrypted.
+	withoutOld, err := data.NewKeyRing("k2", map[string][]byte{"k2": testKeys["k2"]}, testIndexKey)
+	if err != nil {
+		t.Fatalf("NewKeyRing() error = %v", err)
+	}
+	if _, err := withoutOld.Decrypt("payments.card_last_four", ciphertext); !errors.Is(err, data.ErrUnknownKey) {
+		t.Errorf("Decrypt() without the old key error = %v, want ErrUnknownKey", err)
+	}
+
+	// Blind indexes don't depend on the active key, so lookups keep working across rotations.
+	if !bytes.Equal(old.BlindIndex("users.email", "a@b.com"), rotated.BlindIndex("users.email", "a@b.com")) {
+		t.Errorf("BlindIndex() changed with the active key")
+	}
+	if bytes.Equal(old.BlindIndex("users.email", "a@b.com"), old.BlindIndex("users.contact", "a@b.com")) {
+		t.Errorf("BlindIndex() is the same for different columns")
+	}
+}
+
+func TestNewKeyRingWithoutBlindIndex(t *testing.T) {
+	keys, err := data.NewKeyRing("k1", testKeys, nil)
+	if err != nil {
+		t.Fatalf("NewKeyRing() without a blind index key error = %v", err)
+	}
+	ciphertext, _ := keys.Encrypt("payments.card_last_four", "4242")
+	if got, err := keys.Decrypt("payments.card_last_four", ciphertext); err != nil || got != "4242" {
+		t.Errorf("Decrypt() = %q, error %v", got, err)
+	}
+	if _, err := data.NewKeyRing("k1", testKeys, []byte("short")); err == nil {
+		t.Errorf("NewKeyRing() with a short blind index key succeeded")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("BlindIndex() without a blind index key didn't panic")
+		}
+	}()
+	keys.BlindIndex("users.email", "a@b.com")
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"active": "k2\n",
+		"k1.key": base64.StdEncoding.EncodeToString(testKeys["k1"]),
+		"k2.key": base64.StdEncoding.EncodeToString(testKeys["k2"]) + "\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := data.LoadKeyRing(dir, false)
+	if err != nil {
+		t.Fatalf("LoadKeyRing() error = %v", err)
+	}
+	if keys.ActivePrefix() != newTestKeyRing("k2").ActivePrefix() {
+		t.Errorf("LoadKeyRing() active prefix = %q", keys.ActivePrefix())
+	}
+	ciphertext, _ := newTestKeyRing("k1").Encrypt("users.email", "john.doe@example.com")
+	if got, err := keys.Decrypt("users.email", ciphertext); err != nil || got != "john.doe@example.com" {
+		t.Errorf("Decrypt() with loaded keys = %q, error %v", got, err)
+	}
+
+	// The blind index key is only required when asked for.
+	if _, err := data.LoadKeyRing(dir, true); err == nil {
+		t.Errorf("LoadKeyRing() without a blind-index file succeeded")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blind-index"), []byte(base64.StdEncoding.EncodeToString(testIndexKey)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = data.LoadKeyRing(dir, true)
+	if err != nil {
+		t.Fatalf("LoadKeyRing() with a blind index error = %v", err)
+	}
+	if !bytes.Equal(keys.BlindIndex("users.email", "a@b.com"), newTestKeyRing("k1").BlindIndex("users.email", "a@b.com")) {
+		t.Errorf("BlindIndex() with the loaded key differs")
+	}
+
+	// An active key that isn't in the directory is rejected.
+	if err := os.WriteFile(filepath.Join(dir, "active"), []byte("k3"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.LoadKeyRing(dir, false); err == nil {
+		t.Errorf("LoadKeyRing() with unknown active key succeeded")
+	}
+}
+
+// TestKeyRingCopiesMatch fails when data/keyring.go or this file differs from its copy in the other service.
+func TestKeyRingCopiesMatch(t *testing.T) {
+	service, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := map[string]string{"payment-service": "subscription-service", "subscription-service": "payment-service"}
+	module, other := filepath.Base(service), modules[filepath.Base(service)]
+	if other == "" {
+		t.Skipf("%s is not one of the services sharing the key ring", module)
+	}
+	for _, file := range []string{filepath.Join("data", "keyring.go"), filepath.Join("test", "unit_test", "keyring_test.go")} {
+		mine, err := os.ReadFile(filepath.Join(service, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirs, err := os.ReadFile(filepath.Join(service, "..", other, file))
+		if errors.Is(err, fs.ErrNotExist) {
+			t.Skipf("%s is not checked out next to %s", other, module)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirs = bytes.ReplaceAll(theirs, []byte(`"`+other+`/data"`), []byte(`"`+module+`/data"`))
+		if !bytes.Equal(mine, theirs) {
+			t.Errorf("%s differs from its copy in %s; change both together", file, other)
+		}
+	}
+}
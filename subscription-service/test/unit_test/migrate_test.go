@@ -0,0 +1,82 @@
+package test
+
+import (
+	"regexp"
+	"strings"
+	"subscription-service/data"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := data.LoadMigrations()
+	if err != nil {
+		t.Fatalf("LoadMigrations() error = %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatalf("LoadMigrations() returned no migrations")
+	}
+
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			t.Errorf("LoadMigrations() version %d is not after %d", m.Version, migrations[i-1].Version)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Errorf("LoadMigrations() migration %d_%s is missing up or down SQL", m.Version, m.Name)
+		}
+		if strings.Contains(strings.ToUpper(m.Up), "DROP TABLE IF EXISTS USERS") {
+			t.Errorf("LoadMigrations() migration %d_%s drops the users table on the way up", m.Version, m.Name)
+		}
+	}
+}
+
+func TestEncryptionDownRefusesWithCiphertext(t *testing.T) {
+	migrations, err := data.LoadMigrations()
+	if err != nil {
+		t.Fatalf("LoadMigrations() error = %v", err)
+	}
+	for _, m := range migrations {
+		if m.Version != 4 {
+			continue
+		}
+		// Ciphertext can't be decrypted by the database, so the check must come before anything is dropped or altered.
+		down := strings.ToUpper(m.Down)
+		refusal := strings.Index(down, "CRDB_INTERNAL.FORCE_ERROR")
+		if refusal < 0 {
+			t.Fatalf("migration %d_%s down doesn't refuse to run while values are encrypted", m.Version, m.Name)
+		}
+		for _, statement := range []string{"ALTER TABLE", "DROP "} {
+			if i := strings.Index(down, statement); i >= 0 && i < refusal {
+				t.Errorf("migration %d_%s down runs %s before refusing", m.Version, m.Name, statement)
+			}
+		}
+		return
+	}
+	t.Fatalf("LoadMigrations() has no migration 4")
+}
+
+// addedColumn and indexedColumns match the columns a migration adds and those it indexes.
+var (
+	addedColumn    = regexp.MustCompile(`(?i)ADD COLUMN (?:IF NOT EXISTS )?(\w+)`)
+	indexedColumns = regexp.MustCompile(`(?i)CREATE (?:UNIQUE )?INDEX [^;]* ON \w+ \(([^)]*)\)`)
+)
+
+func TestMigrationsDontIndexColumnsTheyAdd(t *testing.T) {
+	migrations, err := data.LoadMigrations()
+	if err != nil {
+		t.Fatalf("LoadMigrations() error = %v", err)
+	}
+	// Each migration runs in one transaction, and CockroachDB can't index a column added earlier in it.
+	for _, m := range migrations {
+		added := map[string]bool{}
+		for _, match := range addedColumn.FindAllStringSubmatch(m.Up, -1) {
+			added[strings.ToLower(match[1])] = true
+		}
+		for _, match := range indexedColumns.FindAllStringSubmatch(m.Up, -1) {
+			for _, column := range strings.Split(match[1], ",") {
+				if column = strings.ToLower(strings.Fields(column)[0]); added[column] {
+					t.Errorf("migration %d_%s indexes %s, which it adds", m.Version, m.Name, column)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	models := data.NewMemoryModels()
+	errAbort := errors.New("abort")
+
+	// Events enqueued in a rolled back transaction must never be delivered.
+	err := models.RunInTx(ctx, func(tx data.Models) error {
+		if _, err := tx.Outbox.Enqueue(ctx, data.EventUserSignedUp, map[string]string{"To": "rolled@back.com"}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTx() error = %v, want %v", err, errAbort)
+	}
+
+	var id string
+	err = models.RunInTx(ctx, func(tx data.Models) error {
+		id, err = tx.Outbox.Enqueue(ctx, data.EventUserSignedUp, map[string]string{"To": "committed@example.com"})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RunInTx() error = %v", err)
+	}
+
+	events, err := models.Outbox.Claim(ctx, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("Claim() error = %v", err)
+	}
+	if len(events) != 1 || events[0].ID != id || events[0].Type != data.EventUserSignedUp || events[0].Attempts != 1 {
+		t.Fatalf("Claim() = %+v, want only event %s", events, id)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(events[0].Payload, &payload); err != nil || payload["To"] != "committed@example.com" {
+		t.Errorf("Claim() payload = %s, error %v", events[0].Payload, err)
+	}
+
+	// A leased event is not handed to another relay.
+	if events, err := models.Outbox.Claim(ctx, 10, time.Hour); err != nil || len(events) != 0 {
+		t.Errorf("Claim() during lease = %+v, error %v, want none", events, err)
+	}
+}
+
+func TestOutboxRedelivery(t *testing.T) {
+	ctx := context.Background()
+	outbox := data.NewMemoryOutboxRepository()
+
+	failed, _ := outbox.Enqueue(ctx, data.EventUserSignedUp, nil)
+	published, _ := outbox.Enqueue(ctx, data.EventUserSignedUp, nil)
+	if _, err := outbox.Claim(ctx, 10, 0); err != nil {
+		t.Fatalf("Claim() error = %v", err)
+	}
+	if err := outbox.MarkFailed(ctx, failed, errors.New("temporal unavailable")); err != nil {
+		t.Fatalf("MarkFailed() error = %v", err)
+	}
+	if err := outbox.MarkPublished(ctx, published); err != nil {
+		t.Fatalf("MarkPublished() error = %v", err)
+	}
+
+	// Once the lease has expired, only the failed event is claimed again.
+	events, err := outbox.Claim(ctx, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("Claim() error = %v", err)
+	}
+	if len(events) != 1 || events[0].ID != failed || events[0].Attempts != 2 {
+		t.Errorf("Claim() = %+v, want event %s on its second attempt", events, failed)
+	}
+
+	if err := outbox.MarkPublished(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("MarkPublished() error = %v, want %v", err, data.ErrNotFound)
+	}
+}
+
+func TestOutboxDeadEvents(t *testing.T) {
+	ctx := context.Background()
+	outbox := data.NewMemoryOutboxRepository()
+
+	poison, _ := outbox.Enqueue(ctx, data.EventUserSignedUp, nil)
+	healthy, _ := outbox.Enqueue(ctx, data.EventUserSignedUp, nil)
+	if _, err := outbox.Claim(ctx, 10, 0); err != nil {
+		t.Fatalf("Claim() error = %v", err)
+	}
+	if err := outbox.MarkDead(ctx, poison, errors.New("invalid payload")); err != nil {
+		t.Fatalf("MarkDead() error = %v", err)
+	}
+
+	// A dead event is never claimed again, but is kept with its last error.
+	events, err := outbox.Claim(ctx, 10, 0)
+	if err != nil || len(events) != 1 || events[0].ID != healthy {
+		t.Errorf("Claim() after MarkDead() = %+v, error %v, want only event %s", events, err, healthy)
+	}
+	dead, err := outbox.ListDead(ctx, 10)
+	if err != nil || len(dead) != 1 || dead[0].ID != poison || dead[0].LastError != "invalid payload" {
+		t.Errorf("ListDead() = %+v, error %v, want event %s with its error", dead, err, poison)
+	}
+
+	if err := outbox.MarkDead(ctx, "missing", errors.New("invalid payload")); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("MarkDead() error = %v, want %v", err, data.ErrNotFound)
+	}
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	"context"
+	"reflect"
+	"subscription-service/data"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+func TestReencryptSkipsUndecryptableUsers(t *testing.T) {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, "postgres://root@localhost:26257/defaultdb?sslmode=disable")
+	if err != nil {
+		t.Skipf("CockroachDB is not available: %v", err)
+	}
+	defer conn.Close(ctx)
+	ensureTableExists(conn)
+
+	models := data.NewCockroachModels(conn, newTestKeyRing("k1"))
+	var ids []int64
+	for _, user := range []struct{ name, contact string }{{"alpha", "5556667701"}, {"bravo", "5556667702"}, {"charlie", "5556667703"}} {
+		id, err := models.Users.InsertUser(ctx, data.User{UserName: user.name, GithubName: user.name + "Github", FirstName: "Re", LastName: "Encrypt", Email: user.name + "@example.com", Contact: user.contact})
+		if err != nil {
+			t.Fatalf("InsertUser(%s) error = %v", user.name, err)
+		}
+		ids = append(ids, id)
+	}
+	// The first user's email is under a key that is no longer in the ring.
+	if _, err := conn.Exec(ctx, `UPDATE users SET email = 'enc:v1:gone:AAAA:AAAA' WHERE id = $1`, ids[0]); err != nil {
+		t.Fatalf("Failed to corrupt the user: %v", err)
+	}
+
+	// With batches of one, the undecryptable user comes first and must not stop the others from being reached.
+	repository := data.NewCockroachUserRepository(conn, newTestKeyRing("k2"))
+	var afterID int64
+	var rewritten int
+	var failed []int64
+	for batches := 0; ; batches++ {
+		if batches > len(ids) {
+			t.Fatalf("Reencrypt() didn't finish after %d batches", batches)
+		}
+		result, err := repository.Reencrypt(ctx, afterID, 1)
+		if err != nil {
+			t.Fatalf("Reencrypt() error = %v", err)
+		}
+		rewritten += result.Rewritten
+		failed = append(failed, result.Failed...)
+		if result.Selected < 1 {
+			break
+		}
+		afterID = result.LastID
+	}
+	if rewritten != 2 || !reflect.DeepEqual(failed, []int64{ids[0]}) {
+		t.Errorf("Reencrypt() rewrote %d and failed %v, want 2 rewritten and %v failed", rewritten, failed, ids[:1])
+	}
+
+	// The other users were moved to k2, so they can be read without k1.
+	withoutOld, err := data.NewKeyRing("k2", map[string][]byte{"k2": testKeys["k2"]}, testIndexKey)
+	if err != nil {
+		t.Fatalf("NewKeyRing() error = %v", err)
+	}
+	for _, id := range ids[1:] {
+		if _, err := data.NewCockroachUserRepository(conn, withoutOld).GetUser(ctx, id); err != nil {
+			t.Errorf("GetUser(%d) without k1 error = %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package test
+
+import (
+	"context"
+	"reflect"
+	activity "subscription-service/worker/activities"
+	"subscription-service/worker/workflow"
+	"testing"
+	"time"
+
+	"go.temporal.io/sdk/testsuite"
+)
+
+// fakeSubscriptionActivities stands in for the activities of SubscriptionWorkflow and records how they were called.
+type fakeSubscriptionActivities struct {
+	user      activity.UserResponse
+	lookups   []string
+	emailedTo string
+	status    string // Status the user was last updated to.
+	variantID int64  // Variant the user was last updated to.
+}
+
+func (f *fakeSubscriptionActivities) GetUser(email string) (activity.UserResponse, error) {
+	f.lookups = append(f.lookups, "email:"+email)
+	return f.user, nil
+}
+
+func (f *fakeSubscriptionActivities) GetUserByID(id int64) (activity.UserResponse, error) {
+	f.lookups = append(f.lookups, "id")
+	return f.user, nil
+}
+
+func (f *fakeSubscriptionActivities) UpdateSubscription(id int64, subscriptionStatus string, subscriptionId float64, subscriptionType string, variantID int64) error {
+	f.status, f.variantID = subscriptionStatus, variantID
+	return nil
+}
+
+func (f *fakeSubscriptionActivities) SendSubscriptionStatusEmail(ctx context.Context, to string, subscriptionID float64, subscriptionName, status string) error {
+	f.emailedTo = to
+	return nil
+}
+
+func (f *fakeSubscriptionActivities) SendSubscriptionUpdateSMS(to, subscriptionName, status string) error {
+	return nil
+}
+
+func TestSubscriptionWorkflowUserLookup(t *testing.T) {
+	testCases := []struct {
+		name        string
+		params      workflow.SubscriptionParams
+		wantLookups []string
+	}{
+		{
+			name:        "ByID",
+			params:      workflow.SubscriptionParams{UserID: 7, Email: "old@example.com", Status: "active", Type: "success update"},
+			wantLookups: []string{"id"},
+		},
+		{
+			name:        "ByEmailWithoutID",
+			params:      workflow.SubscriptionParams{Email: "old@example.com", Status: "active", Type: "success update"},
+			wantLookups: []string{"email:old@example.com"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var suite testsuite.WorkflowTestSuite
+			env := suite.NewTestWorkflowEnvironment()
+			activities := &fakeSubscriptionActivities{user: activity.UserResponse{ID: 7, Email: "new@example.com"}}
+			env.RegisterActivity(activities)
+
+			env.ExecuteWorkflow(workflow.SubscriptionWorkflow, tc.params)
+			if err := env.GetWorkflowError(); err != nil {
+				t.Fatalf("SubscriptionWorkflow() error = %v", err)
+			}
+			if len(activities.lookups) != len(tc.wantLookups) || activities.lookups[0] != tc.wantLookups[0] {
+				t.Errorf("user lookups = %v, want %v", activities.lookups, tc.wantLookups)
+			}
+			// The status email goes to the user's current address, not the one the payment was made with.
+			if activities.emailedTo != "new@example.com" {
+				t.Errorf("status email sent to %q, want new@example.com", activities.emailedTo)
+			}
+		})
+	}
+}
+
+// TestSubscriptionUpdateKeepsEntitlements checks that a subscription_updated notification about an active
+// subscription, such as a change of card, leaves the user on their plan.
+func TestSubscriptionUpdateKeepsEntitlements(t *testing.T) {
+	mapping := loadExampleEntitlements(t)
+	var suite testsuite.WorkflowTestSuite
+	env := suite.NewTestWorkflowEnvironment()
+	activities := &fakeSubscriptionActivities{user: activity.UserResponse{ID: 7, Email: "jane@example.com"}}
+	env.RegisterActivity(activities)
+
+	params := workflow.SubscriptionParams{UserID: 7, Email: "jane@example.com", Status: "active", Type: "success update", PlanName: "Pro", VariantID: 100003}
+	env.ExecuteWorkflow(workflow.SubscriptionWorkflow, params)
+	if err := env.GetWorkflowError(); err != nil {
+		t.Fatalf("SubscriptionWorkflow() error = %v", err)
+	}
+	grant := mapping.Resolve(activities.status, activities.variantID)
+	if grant.Plan != "Pro" || !grant.Subscribed {
+		t.Errorf("after the update the user has status %q and plan %q, subscribed %v, want active on Pro", activities.status, grant.Plan, grant.Subscribed)
+	}
+}
+
+// fakeDunningActivities stands in for the activities of DunningWorkflow and records the reminders and downgrades.
+type fakeDunningActivities struct {
+	fakeSubscriptionActivities
+	reminders  []int
+	links      []string
+	downgrades []string
+}
+
+func (f *fakeDunningActivities) UpdateSubscription(id int64, subscriptionStatus string, subscriptionId float64, subscriptionType string, variantID int64) error {
+	f.downgrades = append(f.downgrades, subscriptionStatus)
+	return nil
+}
+
+func (f *fakeDunningActivities) GetUpdatePaymentMethodURL(ctx context.Context, subscriptionID string) (string, error) {
+	return "https://example.lemonsqueezy.com/subscription/" + subscriptionID + "/payment-details", nil
+}
+
+func (f *fakeDunningActivities) SendDunningEmail(ctx context.Context, to, subscriptionName, link string, reminder, reminders int) error {
+	f.reminders = append(f.reminders, reminder)
+	f.links = append(f.links, link)
+	return nil
+}
+
+func (f *fakeDunningActivities) SendDunningSMS(to, subscriptionName, link string, reminder, reminders int) error {
+	return nil
+}
+
+func TestDunningWorkflow(t *testing.T) {
+	params := workflow.DunningParams{
+		SubscriptionID: "5",
+		UserID:         7,
+		PlanName:       "Pro",
+		Schedule:       []time.Duration{0, 72 * time.Hour, 168 * time.Hour},
+		GracePeriod:    336 * time.Hour,
+	}
+	testCases := []struct {
+		name           string
+		recoverAfter   time.Duration // Zero if payment never recovers.
+		wantReminders  []int
+		wantDowngrades []string
+	}{
+		{name: "Unpaid", wantReminders: []int{1, 2, 3}, wantDowngrades: []string{workflow.DunningDowngradeStatus}},
+		{name: "RecoveredAfterFirstReminder", recoverAfter: 24 * time.Hour, wantReminders: []int{1}},
+		{name: "RecoveredDuringGracePeriod", recoverAfter: 200 * time.Hour, wantReminders: []int{1, 2, 3}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var suite testsuite.WorkflowTestSuite
+			env := suite.NewTestWorkflowEnvironment()
+			activities := &fakeDunningActivities{fakeSubscriptionActivities: fakeSubscriptionActivities{user: activity.UserResponse{ID: 7, Email: "jane@example.com"}}}
+			env.RegisterActivity(activities)
+			if tc.recoverAfter != 0 {
+				env.RegisterDelayedCallback(func() {
+					env.SignalWorkflow(workflow.PaymentRecoveredSignal, nil)
+				}, tc.recoverAfter)
+			}
+
+			env.ExecuteWorkflow(workflow.DunningWorkflow, params)
+			if err := env.GetWorkflowError(); err != nil {
+				t.Fatalf("DunningWorkflow() error = %v", err)
+			}
+			if !reflect.DeepEqual(activities.reminders, tc.wantReminders) {
+				t.Errorf("reminders = %v, want %v", activities.reminders, tc.wantReminders)
+			}
+			if !reflect.DeepEqual(activities.downgrades, tc.wantDowngrades) {
+				t.Errorf("downgrades = %v, want %v", activities.downgrades, tc.wantDowngrades)
+			}
+			for _, link := range activities.links {
+				if link != "https://example.lemonsqueezy.com/subscription/5/payment-details" {
+					t.Errorf("reminder linked to %q, want the subscription's update payment method page", link)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDunningSchedule(t *testing.T) {
+	schedule, grace, err := workflow.ParseDunningSchedule("0h, 72h,168h", "336h")
+	if err != nil {
+		t.Fatalf("ParseDunningSchedule() error = %v", err)
+	}
+	if !reflect.DeepEqual(schedule, []time.Duration{0, 72 * time.Hour, 168 * time.Hour}) || grace != 336*time.Hour {
+		t.Errorf("ParseDunningSchedule() = %v, %v, want [0 72h 168h], 336h", schedule, grace)
+	}
+
+	for _, tc := range []struct{ schedule, grace string }{
+		{"0h,3d", "336h"},       // Days aren't a Go duration unit.
+		{"72h,24h", "336h"},     // Reminders out of order.
+		{"0h,400h", "336h"},     // Reminder after the downgrade.
+		{"-1h", "336h"},         // Reminder before the failure.
+		{"0h,72h", "0h"},        // No grace period.
+		{"0h,72h", "two weeks"}, // Not a duration.
+	} {
+		if _, _, err := workflow.ParseDunningSchedule(tc.schedule, tc.grace); err == nil {
+			t.Errorf("ParseDunningSchedule(%q, %q) succeeded, want an error", tc.schedule, tc.grace)
+		}
+	}
+}
+
+// fakeTrialActivities stands in for the activities of TrialWorkflow and records the reminders.
+type fakeTrialActivities struct {
+	fakeSubscriptionActivities
+	reminders []int
+	endsAt    []time.Time
+}
+
+func (f *fakeTrialActivities) SendTrialEndingEmail(ctx context.Context, to, subscriptionName string, endsAt time.Time, daysLeft int) error {
+	f.reminders = append(f.reminders, daysLeft)
+	f.endsAt = append(f.endsAt, endsAt)
+	return nil
+}
+
+func (f *fakeTrialActivities) SendTrialEndingSMS(to, subscriptionName string, endsAt time.Time, daysLeft int) error {
+	return nil
+}
+
+func TestTrialWorkflow(t *testing.T) {
+	const day = 24 * time.Hour
+	type signal struct {
+		after  time.Duration
+		update workflow.TrialUpdate
+	}
+	testCases := []struct {
+		name          string
+		trialLength   time.Duration
+		signals       []signal
+		wantReminders []int
+		wantEndsAt    time.Duration // End of the trial sent with the reminders.
+		wantOutcome   string
+	}{
+		{
+			name:          "Converted",
+			trialLength:   14 * day,
+			signals:       []signal{{14*day + time.Hour, workflow.TrialUpdate{Status: "active"}}},
+			wantReminders: []int{3, 1},
+			wantEndsAt:    14 * day,
+			wantOutcome:   workflow.TrialConverted,
+		},
+		{
+			name:        "CancelledThenExpired",
+			trialLength: 14 * day,
+			signals: []signal{
+				{12 * day, workflow.TrialUpdate{Status: "cancelled"}},
+				{14*day + time.Hour, workflow.TrialUpdate{Status: "expired"}},
+			},
+			wantReminders: []int{3},
+			wantEndsAt:    14 * day,
+			wantOutcome:   workflow.TrialExpired,
+		},
+		{
+			name:        "Extended",
+			trialLength: 14 * day,
+			signals: []signal{
+				{5 * day, workflow.TrialUpdate{Status: "on_trial"}}, // Extended to 21 days, set below.
+				{21*day + time.Hour, workflow.TrialUpdate{Status: "active"}},
+			},
+			wantReminders: []int{3, 1},
+			wantEndsAt:    21 * day,
+			wantOutcome:   workflow.TrialConverted,
+		},
+		{
+			name:          "StartedLateWithoutOutcome",
+			trialLength:   2 * day,
+			wantReminders: []int{1},
+			wantEndsAt:    2 * day,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var suite testsuite.WorkflowTestSuite
+			env := suite.NewTestWorkflowEnvironment()
+			activities := &fakeTrialActivities{fakeSubscriptionActivities: fakeSubscriptionActivities{user: activity.UserResponse{ID: 7, Email: "jane@example.com"}}}
+			env.RegisterActivity(activities)
+			start := env.Now()
+			for _, s := range tc.signals {
+				update := s.update
+				if update.Status == "on_trial" {
+					update.EndsAt = start.Add(tc.wantEndsAt)
+				}
+				env.RegisterDelayedCallback(func() {
+					env.SignalWorkflow(workflow.TrialUpdateSignal, update)
+				}, s.after)
+			}
+
+			params := workflow.TrialParams{SubscriptionID: "5", UserID: 7, PlanName: "Pro", EndsAt: start.Add(tc.trialLength), ReminderDays: []int{3, 1}}
+			env.ExecuteWorkflow(workflow.TrialWorkflow, params)
+			if err := env.GetWorkflowError(); err != nil {
+				t.Fatalf("TrialWorkflow() error = %v", err)
+			}
+			var outcome string
+			if err := env.GetWorkflowResult(&outcome); err != nil || outcome != tc.wantOutcome {
+				t.Errorf("TrialWorkflow() = %q, error %v, want %q", outcome, err, tc.wantOutcome)
+			}
+			if !reflect.DeepEqual(activities.reminders, tc.wantReminders) {
+				t.Errorf("reminders = %v, want %v", activities.reminders, tc.wantReminders)
+			}
+			for _, endsAt := range activities.endsAt {
+				if !endsAt.Equal(start.Add(tc.wantEndsAt)) {
+					t.Errorf("reminder said the trial ends at %s, want %s", endsAt, start.Add(tc.wantEndsAt))
+				}
+			}
+		})
+	}
+}
+
+func TestParseTrialReminderDays(t *testing.T) {
+	days, err := workflow.ParseTrialReminderDays("1, 7,3")
+	if err != nil || !reflect.DeepEqual(days, []int{7, 3, 1}) {
+		t.Errorf("ParseTrialReminderDays() = %v, error %v, want [7 3 1]", days, err)
+	}
+	for _, days := range []string{"", "0", "3,3", "3d"} {
+		if _, err := workflow.ParseTrialReminderDays(days); err == nil {
+			t.Errorf("ParseTrialReminderDays(%q) succeeded, want an error", days)
+		}
+	}
+}
+
+// fakeRenewalActivities stands in for the activities of RenewalNoticeWorkflow and records the notices.
+type fakeRenewalActivities struct {
+	fakeSubscriptionActivities
+	notices []string
+	texts   int
+}
+
+func (f *fakeRenewalActivities) SendRenewalNoticeEmail(ctx context.Context, to, subscriptionName, amount string, renewsAt time.Time) error {
+	f.notices = append(f.notices, to+" "+subscriptionName+" "+amount+" "+renewsAt.Format(time.RFC3339))
+	return nil
+}
+
+func (f *fakeRenewalActivities) SendRenewalNoticeSMS(to, subscriptionName, amount string, renewsAt time.Time) error {
+	f.texts++
+	return nil
+}
+
+func TestRenewalNoticeWorkflow(t *testing.T) {
+	testCases := []struct {
+		name        string
+		renewsIn    time.Duration
+		wantNotices int
+	}{
+		{name: "Upcoming", renewsIn: 7 * 24 * time.Hour, wantNotices: 1},
+		{name: "AlreadyRenewed", renewsIn: -time.Hour},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var suite testsuite.WorkflowTestSuite
+			env := suite.NewTestWorkflowEnvironment()
+			activities := &fakeRenewalActivities{fakeSubscriptionActivities: fakeSubscriptionActivities{user: activity.UserResponse{ID: 7, Email: "jane@example.com"}}}
+			env.RegisterActivity(activities)
+			renewsAt := env.Now().Add(tc.renewsIn).UTC().Truncate(time.Second)
+
+			params := workflow.RenewalNoticeParams{SubscriptionID: "5", UserID: 7, PlanName: "Pro", VariantName: "Yearly", RenewsAt: renewsAt, Amount: "99.00 USD"}
+			env.ExecuteWorkflow(workflow.RenewalNoticeWorkflow, params)
+			if err := env.GetWorkflowError(); err != nil {
+				t.Fatalf("RenewalNoticeWorkflow() error = %v", err)
+			}
+			if len(activities.notices) != tc.wantNotices || activities.texts != tc.wantNotices {
+				t.Fatalf("sent %d emails and %d SMS, want %d of each", len(activities.notices), activities.texts, tc.wantNotices)
+			}
+			want := "jane@example.com Pro - Yearly 99.00 USD " + renewsAt.Format(time.RFC3339)
+			if tc.wantNotices > 0 && activities.notices[0] != want {
+				t.Errorf("notice = %q, want %q", activities.notices[0], want)
+			}
+			if tc.wantNotices == 0 && len(activities.lookups) != 0 {
+				t.Errorf("looked up the user %v for a past renewal", activities.lookups)
+			}
+		})
+	}
+}
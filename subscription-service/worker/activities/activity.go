@@ -2,10 +2,12 @@ package activity
 
 import (
 	"context"
+	"subscription-service/clients"
+	"subscription-service/data"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/go-redis/redis/v8"
-	"github.com/jackc/pgx/v4"
 	twilio "github.com/twilio/twilio-go"
 )
 
@@ -18,9 +20,17 @@ type Activites interface {
 	SendOTPEmail(ctx context.Context, to, otpCode string) error
 	GenerateOTP(ctx context.Context, userID string) (string, error)
 	GetUser(email string) (UserResponse, error)
-	UpdateSubscription(id int64, subscriptionStatus string, subscriptionId float64, subscriptionType string) error
+	GetUserByID(id int64) (UserResponse, error)
+	UpdateSubscription(id int64, subscriptionStatus string, subscriptionId float64, subscriptionType string, variantID int64) error
 	SendSubscriptionUpdateSMS(to, subscriptionName, status string) error
 	SendSubscriptionStatusEmail(ctx context.Context, to string, subscriptionID float64, subscriptionName, status string) error
+	GetUpdatePaymentMethodURL(ctx context.Context, subscriptionID string) (string, error)
+	SendDunningEmail(ctx context.Context, to, subscriptionName, link string, reminder, reminders int) error
+	SendDunningSMS(to, subscriptionName, link string, reminder, reminders int) error
+	SendTrialEndingEmail(ctx context.Context, to, subscriptionName string, endsAt time.Time, daysLeft int) error
+	SendTrialEndingSMS(to, subscriptionName string, endsAt time.Time, daysLeft int) error
+	SendRenewalNoticeEmail(ctx context.Context, to, subscriptionName, amount string, renewsAt time.Time) error
+	SendRenewalNoticeSMS(to, subscriptionName, amount string, renewsAt time.Time) error
 }
 
 // ActivitiesImpl is an implementation of the Activites interface.
@@ -29,16 +39,21 @@ type ActivitiesImpl struct {
 	sesClient    *ses.SES
 	twilioClient *twilio.RestClient
 	redis        *redis.Client
-	connection   *pgx.Conn
+	users        data.UserRepository
+
+	billing    *clients.CheckoutClient // Retrieves update payment method links, or nil if Lemon Squeezy isn't configured.
+	billingURL string                  // Page sent instead when no link can be retrieved, such as the store's customer portal.
 }
 
 // NewActivities creates a new ActivitiesImpl instance with the given clients and services.
 // It returns an Activites interface.
-func NewActivities(sesClient *ses.SES, twilioClient *twilio.RestClient, redis *redis.Client, connection *pgx.Conn) Activites {
+func NewActivities(sesClient *ses.SES, twilioClient *twilio.RestClient, redis *redis.Client, users data.UserRepository, billing *clients.CheckoutClient, billingURL string) Activites {
 	return &ActivitiesImpl{
 		sesClient:    sesClient,
 		twilioClient: twilioClient,
 		redis:        redis,
-		connection:   connection,
+		users:        users,
+		billing:      billing,
+		billingURL:   billingURL,
 	}
 }
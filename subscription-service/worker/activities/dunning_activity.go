@@ -0,0 +1,74 @@
+package activity
+
+import (
+	"context"
+	"fmt"
+	"html"
+)
+
+// GetUpdatePaymentMethodURL returns a fresh link to the page where the customer of a Lemon Squeezy
+// subscription changes their card. If Lemon Squeezy isn't configured or the link can't be retrieved,
+// the billing page is returned instead, so a reminder is never held back by a missing link.
+func (ac *ActivitiesImpl) GetUpdatePaymentMethodURL(ctx context.Context, subscriptionID string) (string, error) {
+	if ac.billing == nil || ac.billing.APIKey == "" {
+		if ac.billingURL == "" {
+			return "", fmt.Errorf("no link to update the payment method of subscription %s: Lemon Squeezy and the billing page are not configured", subscriptionID)
+		}
+		return ac.billingURL, nil
+	}
+	link, err := ac.billing.UpdatePaymentMethodURL(ctx, subscriptionID)
+	if err != nil && ac.billingURL != "" {
+		fmt.Println("Sending the billing page instead of the update payment method link:", err)
+		return ac.billingURL, nil
+	}
+	return link, err
+}
+
+// dunningSubject returns the subject of the given reminder, starting at 1, out of reminders.
+// The wording escalates so the last one reads as the final notice before access is lost.
+func dunningSubject(subscriptionName string, reminder, reminders int) string {
+	switch {
+	case reminder >= reminders:
+		return fmt.Sprintf("Final notice: update your payment method to keep %s", subscriptionName)
+	case reminder == 1:
+		return fmt.Sprintf("We couldn't process your payment for %s", subscriptionName)
+	default:
+		return fmt.Sprintf("Reminder: your payment for %s is still outstanding", subscriptionName)
+	}
+}
+
+// SendDunningEmail sends the given reminder, starting at 1, out of reminders that the renewal of a
+// subscription failed, with the link where the customer updates their payment method.
+func (ac *ActivitiesImpl) SendDunningEmail(ctx context.Context, to, subscriptionName, link string, reminder, reminders int) error {
+	subject := dunningSubject(subscriptionName, reminder, reminders)
+	warning := "We'll retry the payment automatically, so you only need to make sure your card is up to date."
+	if reminder >= reminders {
+		warning = "If the payment still fails, your subscription will be downgraded to the free plan."
+	}
+	htmlBody := fmt.Sprintf(`<html>
+<head>
+<style>
+body {font-family: 'Arial', sans-serif; background-color: #f0f0f0; margin: 0; padding: 20px;}
+.container {background-color: #ffffff; padding: 20px; max-width: 600px; margin: auto; border-radius: 8px; box-shadow: 0 0 10px rgba(0,0,0,0.1);}
+h1 {color: #333366;}
+p {color: #666666;}
+.button {background-color: #4CAF50; color: white; padding: 14px 20px; text-align: center; display: inline-block; font-size: 16px; margin: 4px 2px; cursor: pointer; border-radius: 5px; text-decoration: none;}
+</style>
+</head>
+<body>
+<div class="container">
+<h1>%s</h1>
+<p>The renewal payment for your subscription <b>%s</b> didn't go through. %s</p>
+<a href="%s" class="button">Update Payment Method</a>
+</div>
+</body>
+</html>`, html.EscapeString(subject), html.EscapeString(subscriptionName), warning, html.EscapeString(link))
+	return sendEmail(ctx, ac.sesClient, to, subject, htmlBody)
+}
+
+// SendDunningSMS sends the given reminder, starting at 1, out of reminders that the renewal of a
+// subscription failed, with the link where the customer updates their payment method.
+func (ac *ActivitiesImpl) SendDunningSMS(to, subscriptionName, link string, reminder, reminders int) error {
+	message := fmt.Sprintf("⚠️ %s.\nUpdate your payment method: %s", dunningSubject(subscriptionName, reminder, reminders), link)
+	return sendSMS(ac.twilioClient, to, message)
+}
@@ -0,0 +1,53 @@
+package activity
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"time"
+)
+
+// renewalCharge describes what a renewal charges, such as "9.99 USD on February 1, 2024".
+// The amount is left out if it isn't known.
+func renewalCharge(amount string, renewsAt time.Time) string {
+	date := renewsAt.UTC().Format("January 2, 2006")
+	if amount == "" {
+		return "on " + date
+	}
+	return fmt.Sprintf("%s on %s", amount, date)
+}
+
+// SendRenewalNoticeEmail tells a user that their subscription renews at renewsAt and charges amount,
+// with a link to the billing page where they can change or cancel it first.
+func (ac *ActivitiesImpl) SendRenewalNoticeEmail(ctx context.Context, to, subscriptionName, amount string, renewsAt time.Time) error {
+	subject := fmt.Sprintf("Your %s subscription renews on %s", subscriptionName, renewsAt.UTC().Format("January 2, 2006"))
+	manage := ""
+	if ac.billingURL != "" {
+		manage = fmt.Sprintf(`<a href="%s" class="button">Manage Subscription</a>`, html.EscapeString(ac.billingURL))
+	}
+	htmlBody := fmt.Sprintf(`<html>
+<head>
+<style>
+body {font-family: 'Arial', sans-serif; background-color: #f0f0f0; margin: 0; padding: 20px;}
+.container {background-color: #ffffff; padding: 20px; max-width: 600px; margin: auto; border-radius: 8px; box-shadow: 0 0 10px rgba(0,0,0,0.1);}
+h1 {color: #333366;}
+p {color: #666666;}
+.button {background-color: #4CAF50; color: white; padding: 14px 20px; text-align: center; display: inline-block; font-size: 16px; margin: 4px 2px; cursor: pointer; border-radius: 5px; text-decoration: none;}
+</style>
+</head>
+<body>
+<div class="container">
+<h1>%s</h1>
+<p>Your subscription <b>%s</b> renews automatically and your payment method will be charged %s. You don't need to do anything to keep it. To change or cancel your plan, do so before then.</p>
+%s
+</div>
+</body>
+</html>`, html.EscapeString(subject), html.EscapeString(subscriptionName), html.EscapeString(renewalCharge(amount, renewsAt)), manage)
+	return sendEmail(ctx, ac.sesClient, to, subject, htmlBody)
+}
+
+// SendRenewalNoticeSMS tells a user that their subscription renews at renewsAt and charges amount.
+func (ac *ActivitiesImpl) SendRenewalNoticeSMS(to, subscriptionName, amount string, renewsAt time.Time) error {
+	message := fmt.Sprintf("🔁 Your subscription '%s' renews automatically: %s.", subscriptionName, renewalCharge(amount, renewsAt))
+	return sendSMS(ac.twilioClient, to, message)
+}
@@ -0,0 +1,52 @@
+package activity
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"time"
+)
+
+// trialEnding describes when a trial ends, such as "in 3 days (on January 15, 2024)".
+func trialEnding(endsAt time.Time, daysLeft int) string {
+	when := "tomorrow"
+	if daysLeft > 1 {
+		when = fmt.Sprintf("in %d days", daysLeft)
+	}
+	return fmt.Sprintf("%s (on %s)", when, endsAt.UTC().Format("January 2, 2006"))
+}
+
+// SendTrialEndingEmail tells a user that the free trial of their subscription ends in daysLeft days,
+// after which it is billed.
+func (ac *ActivitiesImpl) SendTrialEndingEmail(ctx context.Context, to, subscriptionName string, endsAt time.Time, daysLeft int) error {
+	subject := fmt.Sprintf("Your %s trial ends %s", subscriptionName, trialEnding(endsAt, daysLeft))
+	manage := ""
+	if ac.billingURL != "" {
+		manage = fmt.Sprintf(`<a href="%s" class="button">Manage Subscription</a>`, html.EscapeString(ac.billingURL))
+	}
+	htmlBody := fmt.Sprintf(`<html>
+<head>
+<style>
+body {font-family: 'Arial', sans-serif; background-color: #f0f0f0; margin: 0; padding: 20px;}
+.container {background-color: #ffffff; padding: 20px; max-width: 600px; margin: auto; border-radius: 8px; box-shadow: 0 0 10px rgba(0,0,0,0.1);}
+h1 {color: #333366;}
+p {color: #666666;}
+.button {background-color: #4CAF50; color: white; padding: 14px 20px; text-align: center; display: inline-block; font-size: 16px; margin: 4px 2px; cursor: pointer; border-radius: 5px; text-decoration: none;}
+</style>
+</head>
+<body>
+<div class="container">
+<h1>%s</h1>
+<p>Your free trial of <b>%s</b> ends %s. After that your subscription continues and your payment method is charged. You don't need to do anything to keep it.</p>
+%s
+</div>
+</body>
+</html>`, html.EscapeString(subject), html.EscapeString(subscriptionName), trialEnding(endsAt, daysLeft), manage)
+	return sendEmail(ctx, ac.sesClient, to, subject, htmlBody)
+}
+
+// SendTrialEndingSMS tells a user that the free trial of their subscription ends in daysLeft days.
+func (ac *ActivitiesImpl) SendTrialEndingSMS(to, subscriptionName string, endsAt time.Time, daysLeft int) error {
+	message := fmt.Sprintf("⏳ Your free trial of '%s' ends %s. Your subscription continues after that.", subscriptionName, trialEnding(endsAt, daysLeft))
+	return sendSMS(ac.twilioClient, to, message)
+}
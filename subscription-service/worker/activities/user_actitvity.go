@@ -1,14 +1,14 @@
 // Package activity contains the business logic for user activities.
 package activity
 
-// Import the data package from the subscription-service project.
-// This package likely contains definitions for interacting with the database.
-import "subscription-service/data"
+// Import context to pass a request context to the user repository.
+import "context"
 
 // UserResponse is a struct used to represent the response structure for user-related queries.
 // It holds information about the user's ID, contact details, and subscription status.
 type UserResponse struct {
 	ID                 int64   // ID is the unique identifier for the user.
+	Email              string  // Email is the user's current email address.
 	Contact            string  // Contact represents the user's contact information, such as an email address.
 	SubscriptionStatus float64 // SubscriptionStatus holds the subscription status as a float64. This might represent a subscription ID or status code.
 }
@@ -16,13 +16,9 @@ type UserResponse struct {
 // GetUser is a method on ActivitiesImpl (not shown here but presumably a struct related to user activities)
 // that retrieves a user's information based on their email address.
 func (ac *ActivitiesImpl) GetUser(email string) (UserResponse, error) {
-	// Initialize an empty User struct from the data package.
-	// This struct likely contains methods for database operations related to a User.
-	user := data.User{}
-
-	// Call the GetByEmail method on the user object, passing in the email address.
-	// This method is expected to populate the user object with data from the database.
-	err := user.GetByEmail(ac.connection, email)
+	// Call the GetByEmail method on the user repository, passing in the email address.
+	// This method is expected to return the user stored with that email.
+	user, err := ac.users.GetByEmail(context.Background(), email)
 
 	// If there was an error retrieving the user, return an empty UserResponse and the error.
 	if err != nil {
@@ -33,20 +29,34 @@ func (ac *ActivitiesImpl) GetUser(email string) (UserResponse, error) {
 	// and return it along with a nil error.
 	return UserResponse{
 		ID:                 user.ID,             // User's unique identifier.
+		Email:              user.Email,          // User's current email address.
 		Contact:            user.Contact,        // User's contact information.
 		SubscriptionStatus: user.SubscriptionID, // User's subscription status or ID.
 	}, nil
 }
 
-// UpdateSubscription is a method on ActivitiesImpl that updates a user's subscription information.
-func (ac *ActivitiesImpl) UpdateSubscription(id int64, subscriptionStatus string, subscriptionId float64, subscriptionType string) error {
-	// Initialize an empty User struct from the data package.
-	user := data.User{}
+// GetUserByID retrieves a user's information based on their ID. Unlike GetUser, it keeps finding
+// the user after they change their email address.
+func (ac *ActivitiesImpl) GetUserByID(id int64) (UserResponse, error) {
+	user, err := ac.users.GetUser(context.Background(), id)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	return UserResponse{
+		ID:                 user.ID,
+		Email:              user.Email,
+		Contact:            user.Contact,
+		SubscriptionStatus: user.SubscriptionID,
+	}, nil
+}
 
-	// Call the UpdateUserSubscription method on the user object, passing in the user's ID,
-	// new subscription status, subscription ID, and subscription type.
+// UpdateSubscription is a method on ActivitiesImpl that updates a user's subscription information.
+// variantID is the last argument so that workflows scheduled before it existed still run, with zero.
+func (ac *ActivitiesImpl) UpdateSubscription(id int64, subscriptionStatus string, subscriptionId float64, subscriptionType string, variantID int64) error {
+	// Call the UpdateUserSubscription method on the user repository, passing in the user's ID,
+	// new subscription status, subscription ID, plan variant ID, and subscription type.
 	// This method is expected to update the user's subscription information in the database.
-	err := user.UpdateUserSubscription(ac.connection, id, subscriptionStatus, subscriptionId, subscriptionType)
+	err := ac.users.UpdateUserSubscription(context.Background(), id, subscriptionStatus, subscriptionId, variantID, subscriptionType)
 
 	// If there was an error updating the user's subscription, return the error.
 	if err != nil {
@@ -0,0 +1,162 @@
+package workflow
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// PaymentRecoveredSignal is the signal sent to a DunningWorkflow when the subscription's payment succeeds.
+const PaymentRecoveredSignal = "payment_recovered"
+
+// DunningDowngradeStatus is the status a subscription is given when its grace period ends unpaid.
+// It matches Lemon Squeezy's status for subscriptions whose retries failed, and grants no plan.
+const DunningDowngradeStatus = "unpaid"
+
+// DunningWorkflowID returns the ID of the DunningWorkflow of a Lemon Squeezy subscription. There is at most
+// one running per subscription, so further failures join it and recoveries know which workflow to signal.
+func DunningWorkflowID(subscriptionID string) string {
+	return "DunningWorkflow_" + subscriptionID
+}
+
+// DunningParams holds the parameters of the DunningWorkflow of a failed renewal.
+type DunningParams struct {
+	SubscriptionID string          // Lemon Squeezy ID of the subscription whose renewal failed.
+	UserID         int64           // ID of the user who started the checkout, or zero if it wasn't recorded.
+	Email          string          // Email the payment was made with. Used to find the user when UserID is zero.
+	PlanName       string          // Name of the subscription plan.
+	VariantName    string          // Name of the subscription variant.
+	VariantID      int64           // Lemon Squeezy ID of the subscription variant, or zero if it wasn't sent.
+	Schedule       []time.Duration // Time after the failure each reminder is sent at, in increasing order.
+	GracePeriod    time.Duration   // Time after the failure the plan is downgraded at, unless payment recovered.
+}
+
+// ParseDunningSchedule parses a comma-separated list of reminder times, such as "0h,72h,168h", and a
+// grace period, such as "336h", both measured from the failed payment. The reminders must be in
+// increasing order and no later than the grace period.
+func ParseDunningSchedule(schedule, gracePeriod string) ([]time.Duration, time.Duration, error) {
+	grace, err := time.ParseDuration(gracePeriod)
+	if err != nil || grace <= 0 {
+		return nil, 0, fmt.Errorf("invalid dunning grace period %q", gracePeriod)
+	}
+	var reminders []time.Duration
+	for _, field := range strings.Split(schedule, ",") {
+		at, err := time.ParseDuration(strings.TrimSpace(field))
+		if err != nil || at < 0 {
+			return nil, 0, fmt.Errorf("invalid dunning reminder %q", field)
+		}
+		if len(reminders) > 0 && at <= reminders[len(reminders)-1] {
+			return nil, 0, fmt.Errorf("dunning reminder %q is not after the one before it", field)
+		}
+		if at > grace {
+			return nil, 0, fmt.Errorf("dunning reminder %q is after the grace period of %s", field, grace)
+		}
+		reminders = append(reminders, at)
+	}
+	return reminders, grace, nil
+}
+
+// DunningWorkflow reminds the user of a subscription whose renewal failed to update their payment
+// method, with reminders escalating on params.Schedule, until a PaymentRecoveredSignal arrives.
+// If none has arrived when the grace period ends, the subscription is downgraded so its plan is no
+// longer granted, and the user is told so.
+func DunningWorkflow(ctx workflow.Context, params DunningParams) error {
+	ao := workflow.ActivityOptions{
+		ScheduleToStartTimeout: 10 * time.Second,
+		StartToCloseTimeout:    10 * time.Second,
+		HeartbeatTimeout:       10 * time.Second,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2.0,
+			MaximumInterval:    time.Minute,
+			MaximumAttempts:    5,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, ao)
+	logger := workflow.GetLogger(ctx)
+
+	// The field names match activity.UserResponse, whose SubscriptionStatus holds the subscription ID.
+	var user struct {
+		ID                 int64
+		Email              string
+		Contact            string
+		SubscriptionStatus float64
+	}
+	var err error
+	if params.UserID != 0 {
+		err = workflow.ExecuteActivity(ctx, "GetUserByID", params.UserID).Get(ctx, &user)
+	} else {
+		err = workflow.ExecuteActivity(ctx, "GetUser", params.Email).Get(ctx, &user)
+	}
+	if err != nil {
+		return err
+	}
+
+	recovered := workflow.GetSignalChannel(ctx, PaymentRecoveredSignal)
+	failedAt := workflow.Now(ctx)
+	// waitUntil blocks until offset after the failure, and reports whether payment recovered first.
+	waitUntil := func(offset time.Duration) bool {
+		if recovered.ReceiveAsync(nil) {
+			return true
+		}
+		remaining := offset - workflow.Now(ctx).Sub(failedAt)
+		if remaining <= 0 {
+			return false
+		}
+		timerCtx, cancel := workflow.WithCancel(ctx)
+		defer cancel()
+		paid := false
+		selector := workflow.NewSelector(ctx)
+		selector.AddFuture(workflow.NewTimer(timerCtx, remaining), func(workflow.Future) {})
+		selector.AddReceive(recovered, func(c workflow.ReceiveChannel, more bool) {
+			c.Receive(ctx, nil)
+			paid = true
+		})
+		selector.Select(ctx)
+		return paid
+	}
+
+	for i, at := range params.Schedule {
+		if waitUntil(at) {
+			logger.Info("Payment recovered, ending dunning", "subscription", params.SubscriptionID, "reminders", i)
+			return nil
+		}
+		// A link is retrieved for every reminder, since Lemon Squeezy's links expire after a day.
+		var link string
+		if err := workflow.ExecuteActivity(ctx, "GetUpdatePaymentMethodURL", params.SubscriptionID).Get(ctx, &link); err != nil {
+			logger.Error("Skipping dunning reminder without a link", "subscription", params.SubscriptionID, "error", err)
+			continue
+		}
+		// Reminders are best effort; a failed one doesn't delay the next or the downgrade.
+		if err := workflow.ExecuteActivity(ctx, "SendDunningEmail", user.Email, params.planName(), link, i+1, len(params.Schedule)).Get(ctx, nil); err != nil {
+			logger.Error("Failed to send dunning email", "subscription", params.SubscriptionID, "error", err)
+		}
+		if err := workflow.ExecuteActivity(ctx, "SendDunningSMS", user.Contact, params.planName(), link, i+1, len(params.Schedule)).Get(ctx, nil); err != nil {
+			logger.Error("Failed to send dunning SMS", "subscription", params.SubscriptionID, "error", err)
+		}
+	}
+
+	if waitUntil(params.GracePeriod) {
+		logger.Info("Payment recovered, ending dunning", "subscription", params.SubscriptionID, "reminders", len(params.Schedule))
+		return nil
+	}
+	err = workflow.ExecuteActivity(ctx, "UpdateSubscription", user.ID, DunningDowngradeStatus, user.SubscriptionStatus, params.planName(), params.VariantID).Get(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := workflow.ExecuteActivity(ctx, "SendSubscriptionStatusEmail", user.Email, user.SubscriptionStatus, params.planName(), DunningDowngradeStatus).Get(ctx, nil); err != nil {
+		return nil // The downgrade stands even if the user couldn't be told.
+	}
+	if err := workflow.ExecuteActivity(ctx, "SendSubscriptionUpdateSMS", user.Contact, params.planName(), DunningDowngradeStatus).Get(ctx, nil); err != nil {
+		return nil
+	}
+	return nil
+}
+
+// planName returns the display name of the plan, such as "Pro - Yearly".
+func (params DunningParams) planName() string {
+	return SubscriptionParams{PlanName: params.PlanName, VariantName: params.VariantName}.planName()
+}
@@ -0,0 +1,69 @@
+package workflow
+
+import (
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// RenewalNoticeParams holds the parameters of the RenewalNoticeWorkflow of an upcoming renewal.
+type RenewalNoticeParams struct {
+	SubscriptionID string    // Lemon Squeezy ID of the subscription that renews.
+	UserID         int64     // ID of the user who started the checkout, or zero if it wasn't recorded.
+	Email          string    // Email the subscription was made with. Used to find the user when UserID is zero.
+	PlanName       string    // Name of the subscription plan.
+	VariantName    string    // Name of the subscription variant.
+	RenewsAt       time.Time // Time the subscription renews.
+	Amount         string    // Amount the renewal is expected to charge, such as "9.99 USD", or "" if it isn't known.
+}
+
+// RenewalNoticeWorkflow tells the user of a subscription by email and SMS that it renews soon, and for how much.
+// It doesn't change the subscription. Notices that arrive after the renewal, such as ones held up while the
+// service was down, are dropped rather than announcing a renewal that already happened.
+func RenewalNoticeWorkflow(ctx workflow.Context, params RenewalNoticeParams) error {
+	ao := workflow.ActivityOptions{
+		ScheduleToStartTimeout: 10 * time.Second,
+		StartToCloseTimeout:    10 * time.Second,
+		HeartbeatTimeout:       10 * time.Second,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2.0,
+			MaximumInterval:    time.Minute,
+			MaximumAttempts:    5,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, ao)
+	logger := workflow.GetLogger(ctx)
+
+	if !params.RenewsAt.After(workflow.Now(ctx)) {
+		logger.Info("Dropping notice of a past renewal", "subscription", params.SubscriptionID, "renewsAt", params.RenewsAt)
+		return nil
+	}
+
+	var user struct {
+		ID      int64
+		Email   string
+		Contact string
+	}
+	var err error
+	if params.UserID != 0 {
+		err = workflow.ExecuteActivity(ctx, "GetUserByID", params.UserID).Get(ctx, &user)
+	} else {
+		err = workflow.ExecuteActivity(ctx, "GetUser", params.Email).Get(ctx, &user)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = workflow.ExecuteActivity(ctx, "SendRenewalNoticeEmail", user.Email, params.planName(), params.Amount, params.RenewsAt).Get(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return workflow.ExecuteActivity(ctx, "SendRenewalNoticeSMS", user.Contact, params.planName(), params.Amount, params.RenewsAt).Get(ctx, nil)
+}
+
+// planName returns the display name of the plan, such as "Pro - Yearly".
+func (params RenewalNoticeParams) planName() string {
+	return SubscriptionParams{PlanName: params.PlanName, VariantName: params.VariantName}.planName()
+}
@@ -11,9 +11,11 @@ import (
 
 // SubscriptionParams struct holds the parameters required for the subscription workflow.
 type SubscriptionParams struct {
-	Email       string // Email of the recipient.
+	UserID      int64  // ID of the user who started the checkout, or zero if it wasn't recorded.
+	Email       string // Email the payment was made with. Used to find the user when UserID is zero.
 	PlanName    string // Name of the subscription plan.
 	VariantName string // Name of the subscription variant.
+	VariantID   int64  // Lemon Squeezy ID of the subscription variant, or zero if it wasn't sent.
 	Status      string // Current status of the subscription.
 	Type        string // Type of mail to be sent, used here to demonstrate a custom logic.
 }
@@ -39,15 +41,22 @@ func SubscriptionWorkflow(ctx workflow.Context, params SubscriptionParams) error
 	// Resp struct is used to capture the response from the GetUser activity.
 	type Resp struct {
 		ID             int64   // User's ID.
+		Email          string  // User's current email address.
 		Contact        string  // User's contact information.
 		SubscriptionID float64 // ID of the user's subscription.
 	}
 
 	var userResponse Resp // Variable to store the response from GetUser activity.
 
-	// Execute the GetUser activity with the provided email.
+	// Look the user up by ID, which survives email changes. Payments made before the ID was
+	// recorded only carry the email they were made with, so fall back to it for those.
 	// The result is stored in userResponse.
-	err := workflow.ExecuteActivity(ctx, "GetUser", params.Email).Get(ctx, &userResponse)
+	var err error
+	if params.UserID != 0 {
+		err = workflow.ExecuteActivity(ctx, "GetUserByID", params.UserID).Get(ctx, &userResponse)
+	} else {
+		err = workflow.ExecuteActivity(ctx, "GetUser", params.Email).Get(ctx, &userResponse)
+	}
 	if err != nil {
 		return err // Return the error if the activity fails.
 	}
@@ -60,22 +69,32 @@ func SubscriptionWorkflow(ctx workflow.Context, params SubscriptionParams) error
 	}
 
 	// Execute the UpdateSubscription activity with the updated subscription details.
-	err = workflow.ExecuteActivity(ctx, "UpdateSubscription", userResponse.ID, params.Status, userResponse.SubscriptionID, params.PlanName+params.VariantName).Get(ctx, nil)
+	// The plan is referenced by its variant ID; the name is only kept for display.
+	err = workflow.ExecuteActivity(ctx, "UpdateSubscription", userResponse.ID, params.Status, userResponse.SubscriptionID, params.planName(), params.VariantID).Get(ctx, nil)
 	if err != nil {
 		return err // Return the error if the activity fails.
 	}
 
 	// Execute the SendSubscriptionStatusEmail activity to send an email to the user.
-	err = workflow.ExecuteActivity(ctx, "SendSubscriptionStatusEmail", params.Email, userResponse.SubscriptionID, params.PlanName+params.VariantName, params.Status).Get(ctx, nil)
+	// The user's current email is used, which may differ from the one the payment was made with.
+	err = workflow.ExecuteActivity(ctx, "SendSubscriptionStatusEmail", userResponse.Email, userResponse.SubscriptionID, params.planName(), params.Status).Get(ctx, nil)
 	if err != nil {
 		return nil // Proceed even if sending the email fails.
 	}
 
 	// Execute the SendSubscriptionUpdateSMS activity to send an SMS to the user.
-	err = workflow.ExecuteActivity(ctx, "SendSubscriptionUpdateSMS", userResponse.Contact, params.PlanName+params.VariantName, params.Status).Get(ctx, nil)
+	err = workflow.ExecuteActivity(ctx, "SendSubscriptionUpdateSMS", userResponse.Contact, params.planName(), params.Status).Get(ctx, nil)
 	if err != nil {
 		return nil // Proceed even if sending the SMS fails.
 	}
 
 	return nil // Return nil to indicate successful completion of the workflow.
 }
+
+// planName returns the display name of the plan, such as "Pro - Yearly".
+func (params SubscriptionParams) planName() string {
+	if params.PlanName == "" || params.VariantName == "" {
+		return params.PlanName + params.VariantName
+	}
+	return params.PlanName + " - " + params.VariantName
+}
@@ -0,0 +1,178 @@
+package workflow
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// TrialUpdateSignal is the signal sent to a TrialWorkflow when the status of its subscription changes.
+const TrialUpdateSignal = "trial_update"
+
+// Outcomes of trials, returned by TrialWorkflow.
+const (
+	TrialConverted = "converted" // The subscription became active after the trial.
+	TrialExpired   = "expired"   // The subscription expired or went unpaid after the trial.
+)
+
+// trialOutcomeTimeout is how long after its end a TrialWorkflow waits for the outcome of the trial.
+const trialOutcomeTimeout = 30 * 24 * time.Hour
+
+// TrialWorkflowID returns the ID of the TrialWorkflow of a Lemon Squeezy subscription.
+func TrialWorkflowID(subscriptionID string) string {
+	return "TrialWorkflow_" + subscriptionID
+}
+
+// TrialUpdate is the payload of a TrialUpdateSignal.
+type TrialUpdate struct {
+	Status string    // New status of the subscription.
+	EndsAt time.Time // End of the trial, moved if it was extended, or zero if it isn't known.
+}
+
+// TrialParams holds the parameters of the TrialWorkflow of a subscription on trial.
+type TrialParams struct {
+	SubscriptionID string    // Lemon Squeezy ID of the subscription on trial.
+	UserID         int64     // ID of the user who started the checkout, or zero if it wasn't recorded.
+	Email          string    // Email the subscription was made with. Used to find the user when UserID is zero.
+	PlanName       string    // Name of the subscription plan.
+	VariantName    string    // Name of the subscription variant.
+	VariantID      int64     // Lemon Squeezy ID of the subscription variant, or zero if it wasn't sent.
+	EndsAt         time.Time // End of the trial.
+	ReminderDays   []int     // Days before the end of the trial reminders are sent, in decreasing order.
+}
+
+// ParseTrialReminderDays parses a comma-separated list of days before the end of a trial to send
+// reminders, such as "3,1", and returns them in decreasing order.
+func ParseTrialReminderDays(days string) ([]int, error) {
+	var reminders []int
+	seen := map[int]bool{}
+	for _, field := range strings.Split(days, ",") {
+		day, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || day < 1 {
+			return nil, fmt.Errorf("invalid trial reminder day %q", field)
+		}
+		if seen[day] {
+			return nil, fmt.Errorf("trial reminder day %d is listed twice", day)
+		}
+		seen[day] = true
+		reminders = append(reminders, day)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(reminders)))
+	return reminders, nil
+}
+
+// TrialWorkflow reminds the user of a subscription on trial that it is about to end, params.ReminderDays
+// before it does, and returns the outcome of the trial once a TrialUpdateSignal reports it: TrialConverted
+// when the subscription becomes active, TrialExpired when it expires or goes unpaid. An extension of the
+// trial moves the reminders still to come, and none are sent while the subscription is cancelled or
+// paused. If no outcome is reported within trialOutcomeTimeout after the end, it returns "".
+func TrialWorkflow(ctx workflow.Context, params TrialParams) (string, error) {
+	ao := workflow.ActivityOptions{
+		ScheduleToStartTimeout: 10 * time.Second,
+		StartToCloseTimeout:    10 * time.Second,
+		HeartbeatTimeout:       10 * time.Second,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2.0,
+			MaximumInterval:    time.Minute,
+			MaximumAttempts:    5,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, ao)
+	logger := workflow.GetLogger(ctx)
+
+	var user struct {
+		ID      int64
+		Email   string
+		Contact string
+	}
+	var err error
+	if params.UserID != 0 {
+		err = workflow.ExecuteActivity(ctx, "GetUserByID", params.UserID).Get(ctx, &user)
+	} else {
+		err = workflow.ExecuteActivity(ctx, "GetUser", params.Email).Get(ctx, &user)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	updates := workflow.GetSignalChannel(ctx, TrialUpdateSignal)
+	endsAt, status := params.EndsAt, "on_trial"
+	// done holds the reminders sent or skipped. Ones due before the workflow started are skipped rather than sent late.
+	done := map[int]bool{}
+	for _, day := range params.ReminderDays {
+		if !endsAt.AddDate(0, 0, -day).After(workflow.Now(ctx)) {
+			done[day] = true
+		}
+	}
+
+	for {
+		// Wait for the next reminder that is due, or for the outcome once none is left.
+		next, at := 0, endsAt.Add(trialOutcomeTimeout)
+		for _, day := range params.ReminderDays {
+			if !done[day] {
+				next, at = day, endsAt.AddDate(0, 0, -day)
+				break
+			}
+		}
+		var update *TrialUpdate
+		timerCtx, cancel := workflow.WithCancel(ctx)
+		selector := workflow.NewSelector(ctx)
+		wait := at.Sub(workflow.Now(ctx))
+		if wait < 0 {
+			wait = 0
+		}
+		selector.AddFuture(workflow.NewTimer(timerCtx, wait), func(workflow.Future) {})
+		selector.AddReceive(updates, func(c workflow.ReceiveChannel, more bool) {
+			update = &TrialUpdate{}
+			c.Receive(ctx, update)
+		})
+		selector.Select(ctx)
+		cancel()
+
+		if update == nil && next == 0 {
+			logger.Warn("No outcome reported for trial", "subscription", params.SubscriptionID)
+			return "", nil
+		}
+		if update == nil {
+			done[next] = true
+			if status != "on_trial" {
+				continue
+			}
+			// Reminders are best effort; a failed one doesn't hold back the next.
+			if err := workflow.ExecuteActivity(ctx, "SendTrialEndingEmail", user.Email, params.planName(), endsAt, next).Get(ctx, nil); err != nil {
+				logger.Error("Failed to send trial reminder email", "subscription", params.SubscriptionID, "error", err)
+			}
+			if err := workflow.ExecuteActivity(ctx, "SendTrialEndingSMS", user.Contact, params.planName(), endsAt, next).Get(ctx, nil); err != nil {
+				logger.Error("Failed to send trial reminder SMS", "subscription", params.SubscriptionID, "error", err)
+			}
+			continue
+		}
+
+		switch update.Status {
+		case "active":
+			logger.Info("Trial converted", "subscription", params.SubscriptionID)
+			return TrialConverted, nil
+		case "expired", "unpaid":
+			logger.Info("Trial expired", "subscription", params.SubscriptionID)
+			return TrialExpired, nil
+		case "on_trial":
+			if !update.EndsAt.IsZero() {
+				endsAt = update.EndsAt
+			}
+			status = update.Status
+		case "cancelled", "paused":
+			status = update.Status
+		}
+	}
+}
+
+// planName returns the display name of the plan, such as "Pro - Yearly".
+func (params TrialParams) planName() string {
+	return SubscriptionParams{PlanName: params.PlanName, VariantName: params.VariantName}.planName()
+}